@@ -0,0 +1,251 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/client"
+	"github.com/rogosprojects/kbak/pkg/diff"
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"github.com/rogosprojects/kbak/pkg/resources"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+
+	"k8s.io/client-go/util/homedir"
+)
+
+// compareExcludedKinds are left out of kbak compare unless selected with
+// --kind, as their objects have generated names
+var compareExcludedKinds = map[string]bool{"pod": true, "job": true}
+
+// compareSide is one of the namespaces compared by kbak compare
+type compareSide struct {
+	kubeContext string
+	namespace   string
+	backup      string
+}
+
+// addCompareSideFlags registers the flags of the left or right side
+func addCompareSideFlags(flags *flag.FlagSet, name string, side *compareSide) {
+	flags.StringVar(&side.kubeContext, name+"-context", "", "Kubeconfig context of the "+name+" namespace (default: the current context)")
+	flags.StringVar(&side.namespace, name+"-namespace", "", "The "+name+" namespace")
+	flags.StringVar(&side.backup, name+"-backup", "", "Read the "+name+" namespace from this backup relative to --output instead of the cluster")
+}
+
+// runCompare compares the objects of two namespaces, live or from backups,
+// by kind and name. Like diff(1) it exits with 0 when they match, 1 when
+// they differ and 2 on errors.
+func runCompare(args []string) int {
+	var left, right compareSide
+	var kubeconfig string
+	var outputDir string
+	var kinds stringList
+	var rulesFile string
+	var replace stringList
+	var reportOpts reportFlags
+	var identities identityFlags
+	var storageOpts storage.Options
+
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	addCompareSideFlags(flags, "left", &left)
+	addCompareSideFlags(flags, "right", &right)
+	if home := homedir.HomeDir(); home != "" {
+		flags.StringVar(&kubeconfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "Path to kubeconfig file")
+	} else {
+		flags.StringVar(&kubeconfig, "kubeconfig", "", "Path to kubeconfig file")
+	}
+	flags.StringVar(&outputDir, "output", "backups", "Output directory containing the backups, or s3://, azblob:// or gs://bucket/prefix")
+	flags.Var(&kinds, "kind", "Kind to compare, e.g. deployment (repeatable; default: all kinds except pods and jobs)")
+	flags.StringVar(&rulesFile, "rules", "", "YAML file of normalization rules: fields to ignore and values to replace")
+	flags.Var(&replace, "replace", "Replace FROM with TO in the values and names of the left objects, as FROM=TO (repeatable)")
+	addReportFlags(flags, &reportOpts)
+	addIdentityFlags(flags, &identities)
+	addStorageFlags(flags, &storageOpts)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak compare [flags] --left-namespace NAMESPACE [--right-namespace NAMESPACE]\n\n"+
+			"Compares the objects of two namespaces by kind and name, e.g. staging and\n"+
+			"production on different contexts. Each side is read from the cluster, or\n"+
+			"from a backup with --left-backup or --right-backup. The right namespace\n"+
+			"defaults to the left one. Exits with 0 if the namespaces match after\n"+
+			"normalization, 1 if they differ and 2 on errors.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 || left.namespace == "" && left.backup == "" {
+		flags.Usage()
+		return 2
+	}
+
+	opts, err := reportOpts.parseOptions()
+	var selectedTypes map[string]bool
+	if err == nil {
+		selectedTypes, err = compareKinds(kinds)
+	}
+	if err == nil && rulesFile != "" {
+		var data []byte
+		if data, err = os.ReadFile(rulesFile); err == nil {
+			var rules []diff.Rule
+			var replacements []diff.Replacement
+			if rules, replacements, err = diff.ParseNormalization(data); err != nil {
+				err = fmt.Errorf("%s: %v", rulesFile, err)
+			}
+			opts.Ignore = append(opts.Ignore, rules...)
+			opts.Replace = append(opts.Replace, replacements...)
+		}
+	}
+	for _, text := range replace {
+		if err != nil {
+			break
+		}
+		var replacement diff.Replacement
+		if replacement, err = diff.ParseReplacement(text); err == nil {
+			opts.Replace = append(opts.Replace, replacement)
+		}
+	}
+	var decryptor *encrypt.Decryptor
+	if err == nil {
+		decryptor, err = identities.decryptor()
+	}
+	var store storage.Storage
+	var repository *backup.Repository
+	if err == nil && (left.backup != "" || right.backup != "") {
+		store, repository, err = openBackupStorage(outputDir, storageOpts)
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 2
+	}
+
+	// Objects are matched across namespaces
+	namespaceRule, _ := diff.ParseRule("metadata.namespace")
+	opts.Ignore = append(opts.Ignore, namespaceRule)
+
+	var labels [2]string
+	var objects [2]map[backup.ObjectKey][]byte
+	for i, side := range []*compareSide{&left, &right} {
+		if side == &right && right.namespace == "" {
+			right.namespace = left.namespace
+		}
+		labels[i], objects[i], err = side.read(kubeconfig, store, repository, decryptor, selectedTypes)
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError reading the %s namespace: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, []string{"left", "right"}[i], err, utils.Reset)
+			return 2
+		}
+	}
+
+	// Names of the left objects get the replacements that apply to every field
+	renamed := make(map[backup.ObjectKey][]byte, len(objects[0]))
+	for key, data := range objects[0] {
+		for _, replacement := range opts.Replace {
+			if replacement.Rule == nil {
+				key.Name = replacement.Apply(key.Name)
+			}
+		}
+		renamed[key] = data
+	}
+
+	report, err := diff.Compare(renamed, objects[1], opts)
+	if err == nil {
+		reportOpts.noNamespaces = true
+		report.Old, report.New = labels[0], labels[1]
+		err = reportOpts.write(report, fmt.Sprintf("%d differ, %d only left, %d only right",
+			report.Modified, report.Removed, report.Added))
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 2
+	}
+
+	if report.Changed() {
+		return 1
+	}
+	return 0
+}
+
+// compareKinds returns the resource types to compare for the --kind values
+func compareKinds(kinds []string) (map[string]bool, error) {
+	selectedTypes := make(map[string]bool)
+	for _, kind := range kinds {
+		selectedTypes[strings.ToLower(kind)] = true
+	}
+	if len(selectedTypes) > 0 {
+		if known := resources.GetResourceTypes(selectedTypes); len(known) != len(selectedTypes) {
+			return nil, fmt.Errorf("unknown kind in %s", strings.Join(kinds, ", "))
+		}
+		return selectedTypes, nil
+	}
+
+	for _, resourceType := range resources.GetAllResourceTypes() {
+		kind := strings.ToLower(resourceType.Kind)
+		if !compareExcludedKinds[kind] {
+			selectedTypes[kind] = true
+		}
+	}
+	return selectedTypes, nil
+}
+
+// read returns a label and the objects of the namespace, keyed by kind and
+// name only. A backup holding one namespace sets a missing namespace.
+func (s *compareSide) read(kubeconfig string, store storage.Storage, repository *backup.Repository,
+	decryptor *encrypt.Decryptor, selectedTypes map[string]bool) (string, map[backup.ObjectKey][]byte, error) {
+	var label string
+	var objects map[backup.ObjectKey][]byte
+	var err error
+
+	if s.backup != "" {
+		label, _, objects, err = readBackupObjects(store, repository, s.backup, decryptor)
+		if err != nil {
+			return "", nil, err
+		}
+		if s.namespace == "" {
+			if s.namespace, err = onlyNamespace(objects); err != nil {
+				return "", nil, err
+			}
+		}
+	} else {
+		var k8sClient *client.K8sClient
+		if k8sClient, err = client.NewClientForContext(kubeconfig, s.kubeContext, false); err != nil {
+			return "", nil, err
+		}
+		if objects, err = backup.LiveObjects(k8sClient, s.namespace, selectedTypes, false); err != nil {
+			return "", nil, err
+		}
+		label = "context " + k8sClient.Context
+	}
+
+	matched := make(map[backup.ObjectKey][]byte)
+	for key, data := range objects {
+		if key.Namespace == s.namespace && selectedTypes[strings.ToLower(key.Kind)] {
+			matched[backup.ObjectKey{Kind: key.Kind, Name: key.Name}] = data
+		}
+	}
+	return fmt.Sprintf("%s namespace %s", label, s.namespace), matched, nil
+}
+
+// onlyNamespace returns the namespace of the objects of a backup holding one namespace
+func onlyNamespace(objects map[backup.ObjectKey][]byte) (string, error) {
+	seen := make(map[string]bool)
+	for key := range objects {
+		seen[key.Namespace] = true
+	}
+	if len(seen) == 1 {
+		for namespace := range seen {
+			return namespace, nil
+		}
+	}
+	var namespaces []string
+	for namespace := range seen {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return "", fmt.Errorf("the backup holds the namespaces %s, choose one", strings.Join(namespaces, ", "))
+}
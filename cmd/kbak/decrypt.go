@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+)
+
+// identityFlags holds the keys used to read encrypted backups
+type identityFlags struct {
+	age stringList
+	pgp stringList
+}
+
+// addIdentityFlags registers the flags for the keys of encrypted backups
+func addIdentityFlags(flags *flag.FlagSet, identities *identityFlags) {
+	flags.Var(&identities.age, "age-identity", "age identity file to decrypt with (repeatable)")
+	flags.Var(&identities.pgp, "pgp-identity", "OpenPGP private key file to decrypt with (repeatable); protected keys read the passphrase from $"+encrypt.PassphraseEnv)
+}
+
+// decryptor returns the decryptor for the given identities, or nil when none were given
+func (i *identityFlags) decryptor() (*encrypt.Decryptor, error) {
+	if len(i.age) == 0 && len(i.pgp) == 0 {
+		return nil, nil
+	}
+	return encrypt.NewDecryptor(i.age, i.pgp, []byte(os.Getenv(encrypt.PassphraseEnv)))
+}
+
+// insideLocation checks if the storage location target is location or below
+// it, comparing absolute paths of local directories
+func insideLocation(target, location string) bool {
+	if strings.Contains(target, "://") != strings.Contains(location, "://") {
+		return false
+	}
+	if !strings.Contains(target, "://") {
+		absTarget, err := filepath.Abs(target)
+		if err != nil {
+			return false
+		}
+		absLocation, err := filepath.Abs(location)
+		if err != nil {
+			return false
+		}
+		rel, err := filepath.Rel(absLocation, absTarget)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	target = strings.TrimSuffix(target, "/")
+	location = strings.TrimSuffix(location, "/")
+	return target == location || strings.HasPrefix(target, location+"/")
+}
+
+// runDecrypt writes a decrypted copy of an encrypted backup
+func runDecrypt(args []string) int {
+	var outputDir string
+	var targetDir string
+	var inPlace bool
+	var identities identityFlags
+	var storageOpts storage.Options
+
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	flags.StringVar(&outputDir, "output", "backups", "Output directory containing the backup, or s3://, azblob:// or gs://bucket/prefix")
+	flags.StringVar(&targetDir, "to", "", "Local directory or s3://, azblob:// or gs://bucket/prefix outside of --output to write the decrypted copy to, below a directory named after the backup")
+	flags.BoolVar(&inPlace, "in-place", false, "Write the decrypted copy into --output as BACKUP-decrypted, next to the encrypted backup")
+	addIdentityFlags(flags, &identities)
+	addStorageFlags(flags, &storageOpts)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak decrypt [flags] --to TARGET BACKUP\n       kbak decrypt [flags] --in-place BACKUP\n\n"+
+			"BACKUP is the backup directory relative to --output, e.g. 2025-01-02T03-04-05Z\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || (targetDir == "") == !inPlace {
+		flags.Usage()
+		return 2
+	}
+	dir := path.Clean(flags.Arg(0))
+	if !inPlace && insideLocation(targetDir, outputDir) {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: --to %s is inside --output %s, where the decrypted copy would be kept with the encrypted backups; use --in-place for that%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, targetDir, outputDir, utils.Reset)
+		return 1
+	}
+
+	decryptor, err := identities.decryptor()
+	if err == nil && decryptor == nil {
+		err = fmt.Errorf("--age-identity or --pgp-identity is required")
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	store, err := storage.Open(outputDir, storageOpts)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError opening output location: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+	target := store
+	destDir := dir + "-decrypted"
+	if !inPlace {
+		if target, err = storage.Open(targetDir, storageOpts); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError opening target location: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			return 1
+		}
+		destDir = path.Base(dir)
+	}
+	if exists, err := target.Exists(destDir); err != nil || exists {
+		if err == nil {
+			err = fmt.Errorf("%s already exists", target.Location(destDir))
+		}
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	manifest, err := backup.DecryptBackup(store, dir, target, destDir, decryptor)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError decrypting %s: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, store.Location(dir), err, utils.Reset)
+		return 1
+	}
+
+	fmt.Fprintf(utils.StatusOutput, "%s %s%sDecrypted %d files to %s%s\n",
+		utils.SuccessEmoji, utils.Green, utils.Bold, len(manifest.Files), target.Location(destDir), utils.Reset)
+
+	return 0
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestInsideLocation(t *testing.T) {
+	tests := []struct {
+		target, location string
+		want             bool
+	}{
+		{"backups", "backups", true},
+		{"backups/plain", "./backups", true},
+		{"backups-plain", "backups", false},
+		{"../plain", "backups", false},
+		{"s3://bucket/prod/plain", "s3://bucket/prod/", true},
+		{"s3://bucket/production", "s3://bucket/prod", false},
+		{"s3://bucket", "backups", false},
+	}
+	for _, tt := range tests {
+		if got := insideLocation(tt.target, tt.location); got != tt.want {
+			t.Errorf("insideLocation(%q, %q) = %v, expected %v", tt.target, tt.location, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/diff"
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+)
+
+// changeMarkers are the markers and colors of the change types in the text report
+var changeMarkers = map[string][2]string{
+	diff.TypeAdded:    {"+", utils.Green},
+	diff.TypeRemoved:  {"-", utils.Red},
+	diff.TypeModified: {"~", utils.Yellow},
+}
+
+// ignoreFlags are the flags of the fields left out of a comparison
+type ignoreFlags struct {
+	ignore     stringList
+	ignoreFile string
+}
+
+// addIgnoreFlags registers the flags of the fields left out of a comparison
+func addIgnoreFlags(flags *flag.FlagSet, f *ignoreFlags) {
+	flags.Var(&f.ignore, "ignore", "Field to leave out of the comparison, as [KIND:]PATH, e.g. Deployment:spec.replicas (repeatable)")
+	flags.StringVar(&f.ignoreFile, "ignore-file", "", "File with fields to leave out of the comparison, one [KIND:]PATH per line")
+}
+
+// rules parses the rules of --ignore-file and --ignore
+func (f *ignoreFlags) rules() ([]diff.Rule, error) {
+	var rules []diff.Rule
+	if f.ignoreFile != "" {
+		data, err := os.ReadFile(f.ignoreFile)
+		if err != nil {
+			return nil, err
+		}
+		if rules, err = diff.ParseRules(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.ignoreFile, err)
+		}
+	}
+	for _, text := range f.ignore {
+		rule, err := diff.ParseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// reportFlags are the flags of the commands that print a diff.Report
+type reportFlags struct {
+	ignoreFlags
+	json    bool
+	summary bool
+	noColor bool
+	options diff.Options
+	// noNamespaces leaves out the namespace headings of the text report, for
+	// objects matched across namespaces
+	noNamespaces bool
+}
+
+// addReportFlags registers the flags that control the comparison and its report
+func addReportFlags(flags *flag.FlagSet, f *reportFlags) {
+	flags.BoolVar(&f.json, "json", false, "Print the changes as JSON, e.g. for CI")
+	flags.BoolVar(&f.summary, "summary", false, "List changed objects without their field changes and diffs")
+	flags.BoolVar(&f.noColor, "no-color", false, "Print the text report without colors")
+	flags.IntVar(&f.options.Context, "context", 3, "Number of unchanged lines shown around each change of a diff")
+	flags.BoolVar(&f.options.ShowSecrets, "show-secrets", false, "Show the values of Secret data instead of placeholders")
+	addIgnoreFlags(flags, &f.ignoreFlags)
+}
+
+// parseOptions returns the comparison options with the ignore rules
+func (f *reportFlags) parseOptions() (diff.Options, error) {
+	opts := f.options
+	if opts.Context < 0 {
+		return opts, fmt.Errorf("--context must not be negative")
+	}
+	rules, err := f.rules()
+	opts.Ignore = rules
+	return opts, err
+}
+
+// write prints the report to stdout as JSON or as text ending with the summary line
+func (f *reportFlags) write(report *diff.Report, summary string) error {
+	if f.summary {
+		for i := range report.Changes {
+			report.Changes[i].Fields, report.Changes[i].Diff = nil, ""
+		}
+	}
+
+	if f.json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	printDiffReport(os.Stdout, report, !f.noNamespaces, !f.noColor)
+	_, err := fmt.Printf("\n%s\n", summary)
+	return err
+}
+
+// runDiff compares two backups. Like diff(1) it exits with 0 when they hold
+// the same objects, 1 when they differ and 2 on errors.
+func runDiff(args []string) int {
+	var outputDir string
+	var reportOpts reportFlags
+	var identities identityFlags
+	var storageOpts storage.Options
+
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.StringVar(&outputDir, "output", "backups", "Output directory containing the backups, or s3://, azblob:// or gs://bucket/prefix")
+	addReportFlags(flags, &reportOpts)
+	addIdentityFlags(flags, &identities)
+	addStorageFlags(flags, &storageOpts)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak diff [flags] OLD NEW\n\n"+
+			"OLD and NEW are backup directories or archives relative to --output, e.g.\n"+
+			"2025-01-02T03-04-05Z or prod-2025-01-03T03-04-05Z.tar.gz, or snapshot IDs\n"+
+			"when --output is a repository. Exits with 0 if the backups hold the same\n"+
+			"objects, 1 if they differ and 2 on errors.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	opts, err := reportOpts.parseOptions()
+	var store storage.Storage
+	var repository *backup.Repository
+	if err == nil {
+		store, repository, err = openBackupStorage(outputDir, storageOpts)
+	}
+	var decryptor *encrypt.Decryptor
+	if err == nil {
+		decryptor, err = identities.decryptor()
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 2
+	}
+
+	var locations [2]string
+	var objects [2]map[backup.ObjectKey][]byte
+	for i, name := range flags.Args() {
+		locations[i], _, objects[i], err = readBackupObjects(store, repository, name, decryptor)
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError reading %s: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, name, err, utils.Reset)
+			return 2
+		}
+	}
+
+	report, err := diff.Compare(objects[0], objects[1], opts)
+	if err == nil {
+		report.Old, report.New = locations[0], locations[1]
+		err = reportOpts.write(report, fmt.Sprintf("%d added, %d removed, %d modified", report.Added, report.Removed, report.Modified))
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 2
+	}
+
+	if report.Changed() {
+		return 1
+	}
+	return 0
+}
+
+// readBackupObjects reads the manifest and the objects of a backup directory,
+// an archive or, when the storage is a repository, a snapshot
+func readBackupObjects(store storage.Storage, repository *backup.Repository, name string, decryptor *encrypt.Decryptor) (string, *backup.Manifest, map[backup.ObjectKey][]byte, error) {
+	if repository != nil {
+		id, _, err := repository.ReadSnapshot(name)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		snapshot := storage.NewMemory(store.Location(backup.SnapshotPath(id)))
+		if _, err := repository.Export(id, snapshot, ""); err != nil {
+			return "", nil, nil, err
+		}
+		manifest, objects, err := backup.ReadObjects(snapshot, "", decryptor)
+		return id, manifest, objects, err
+	}
+
+	backupStore, dir, err := backup.OpenBackup(store, name)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	manifest, objects, err := backup.ReadObjects(backupStore, dir, decryptor)
+	return store.Location(name), manifest, objects, err
+}
+
+// openBackupStorage opens the storage of the backups and, if it is a
+// repository, the repository
+func openBackupStorage(outputDir string, storageOpts storage.Options) (storage.Storage, *backup.Repository, error) {
+	store, err := storage.Open(outputDir, storageOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	repository, err := backup.OpenRepository(store)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, repository, nil
+}
+
+// printDiffReport prints the changes grouped by namespace and kind, with the
+// unified diffs of modified objects
+func printDiffReport(out io.Writer, report *diff.Report, namespaces, colors bool) {
+	color := func(code string) string {
+		if !colors {
+			return ""
+		}
+		return code
+	}
+	bold, reset := color(utils.Bold), color(utils.Reset)
+
+	fmt.Fprintf(out, "%s--- %s%s\n%s+++ %s%s\n", bold, report.Old, reset, bold, report.New, reset)
+
+	namespace, kind := "", ""
+	if !namespaces {
+		fmt.Fprintln(out)
+	}
+	for i, change := range report.Changes {
+		if namespaces && (i == 0 || change.Namespace != namespace) {
+			namespace, kind = change.Namespace, ""
+			title := "Namespace " + namespace
+			if namespace == "" {
+				title = "Cluster-scoped"
+			}
+			fmt.Fprintf(out, "\n%s%s%s%s\n", color(utils.Cyan), bold, title, reset)
+		}
+		if change.Kind != kind {
+			kind = change.Kind
+			fmt.Fprintf(out, "  %s%s%s\n", bold, kind, reset)
+		}
+		marker := changeMarkers[change.Type]
+		fmt.Fprintf(out, "    %s%s %s%s\n", color(marker[1]), marker[0], change.Name, reset)
+
+		if change.Diff == "" {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(change.Diff, "\n"), "\n") {
+			fmt.Fprintf(out, "        %s%s%s\n", color(diffLineColor(line)), line, reset)
+		}
+	}
+}
+
+// diffLineColor returns the color of a line of a unified diff
+func diffLineColor(line string) string {
+	switch {
+	case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+		return utils.Bold
+	case strings.HasPrefix(line, "+"):
+		return utils.Green
+	case strings.HasPrefix(line, "-"):
+		return utils.Red
+	case strings.HasPrefix(line, "@@"):
+		return utils.Cyan
+	}
+	return ""
+}
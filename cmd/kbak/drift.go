@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/client"
+	"github.com/rogosprojects/kbak/pkg/diff"
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/homedir"
+)
+
+// redactedFields are ignored when a backup was redacted, as the live values
+// cannot match their replacements
+var redactedFields = []string{"Secret:data", "Secret:stringData"}
+
+// runDrift compares a backup with the live objects of the cluster. It exits
+// with 0 when they match, 1 on drift and 2 on errors.
+func runDrift(args []string) int {
+	var outputDir string
+	var kubeconfig string
+	var canonical bool
+	var reportOpts reportFlags
+	var identities identityFlags
+	var storageOpts storage.Options
+
+	flags := flag.NewFlagSet("drift", flag.ExitOnError)
+	flags.StringVar(&outputDir, "output", "backups", "Output directory containing the backups, or s3://, azblob:// or gs://bucket/prefix")
+	if home := homedir.HomeDir(); home != "" {
+		flags.StringVar(&kubeconfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "Path to kubeconfig file")
+	} else {
+		flags.StringVar(&kubeconfig, "kubeconfig", "", "Path to kubeconfig file")
+	}
+	flags.BoolVar(&canonical, "canonical", false, "Canonicalize the live objects, for backups written with --canonical or --git")
+	addReportFlags(flags, &reportOpts)
+	addIdentityFlags(flags, &identities)
+	addStorageFlags(flags, &storageOpts)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak drift [flags] BACKUP\n\n"+
+			"BACKUP is a backup directory or archive relative to --output, or a snapshot ID\n"+
+			"or latest when --output is a repository. The namespaces and resource types of\n"+
+			"the backup are compared with the cluster. Exits with 0 if they match, 1 on\n"+
+			"drift and 2 on errors.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	opts, err := reportOpts.parseOptions()
+	var store storage.Storage
+	var repository *backup.Repository
+	if err == nil {
+		store, repository, err = openBackupStorage(outputDir, storageOpts)
+	}
+	var decryptor *encrypt.Decryptor
+	if err == nil {
+		decryptor, err = identities.decryptor()
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 2
+	}
+
+	location, manifest, backupObjects, err := readBackupObjects(store, repository, flags.Arg(0), decryptor)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError reading %s: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, flags.Arg(0), err, utils.Reset)
+		return 2
+	}
+	if manifest.Redaction != "" {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: the backup is redacted, Secret data is not compared%s\n",
+			utils.WarningEmoji, utils.Yellow, utils.Bold, utils.Reset)
+		for _, text := range redactedFields {
+			rule, _ := diff.ParseRule(text)
+			opts.Ignore = append(opts.Ignore, rule)
+		}
+	}
+
+	k8sClient, err := client.NewClient(kubeconfig, false)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError initializing Kubernetes client: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 2
+	}
+
+	namespaces, err := driftNamespaces(k8sClient, manifest, backupObjects)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError listing namespaces: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 2
+	}
+	selectedTypes := make(map[string]bool, len(manifest.Filters.ResourceTypes))
+	for _, resourceType := range manifest.Filters.ResourceTypes {
+		selectedTypes[resourceType] = true
+	}
+
+	liveObjects := make(map[backup.ObjectKey][]byte)
+	for _, namespace := range namespaces {
+		objects, err := backup.LiveObjects(k8sClient, namespace, selectedTypes, canonical)
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			return 2
+		}
+		for key, data := range objects {
+			liveObjects[key] = data
+		}
+	}
+
+	report, err := diff.Compare(backupObjects, liveObjects, opts)
+	if err == nil {
+		report.Old, report.New = location, "cluster "+k8sClient.Context
+		err = reportOpts.write(report, fmt.Sprintf("%d modified, %d missing in the cluster, %d not in the backup",
+			report.Modified, report.Removed, report.Added))
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 2
+	}
+
+	if report.Changed() {
+		return 1
+	}
+	return 0
+}
+
+// driftNamespaces returns the namespaces to compare: those selected for the
+// backup or, for a backup of all namespaces, every live namespace, and every
+// namespace holding objects of the backup
+func driftNamespaces(k8sClient *client.K8sClient, manifest *backup.Manifest, objects map[backup.ObjectKey][]byte) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, namespace := range manifest.Filters.Namespaces {
+		seen[namespace] = true
+	}
+	for key := range objects {
+		seen[key.Namespace] = true
+	}
+	if manifest.Filters.AllNamespaces {
+		namespaceList, err := k8sClient.Clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range namespaceList.Items {
+			seen[ns.Name] = true
+		}
+	}
+
+	namespaces := make([]string, 0, len(seen))
+	for namespace := range seen {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/diff"
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+)
+
+// historyBackup is a backup scanned for the history of an object
+type historyBackup struct {
+	backup.StoredBackup
+	// Name is the backup path relative to --output, or the snapshot ID
+	Name  string
+	store storage.Storage
+	state *backup.State
+}
+
+// historyReport is the JSON output of kbak history
+type historyReport struct {
+	Namespace string          `json:"namespace"`
+	Kind      string          `json:"kind"`
+	Name      string          `json:"name"`
+	Backups   int             `json:"backups"`
+	Revisions []diff.Revision `json:"revisions"`
+}
+
+// runHistory prints the distinct revisions of one object across the backups
+// of a series, or writes the manifest of one revision to stdout
+func runHistory(args []string) int {
+	var outputDir string
+	var series string
+	var extract int
+	var jsonOutput bool
+	var showDiff bool
+	var noColor bool
+	var opts diff.Options
+	var ignore ignoreFlags
+	var identities identityFlags
+	var storageOpts storage.Options
+
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.StringVar(&outputDir, "output", "backups", "Output directory containing the backups, or s3://, azblob:// or gs://bucket/prefix")
+	flags.StringVar(&series, "series", "", "Directory of the backups relative to --output, or cluster of a repository, when there are several")
+	flags.IntVar(&extract, "extract", 0, "Write the manifest of this revision to stdout instead of the timeline")
+	flags.BoolVar(&jsonOutput, "json", false, "Print the revisions as JSON")
+	flags.BoolVar(&showDiff, "diff", false, "Show the unified diff of every revision")
+	flags.BoolVar(&noColor, "no-color", false, "Print the timeline without colors")
+	flags.IntVar(&opts.Context, "context", 3, "Number of unchanged lines shown around each change of a diff")
+	flags.BoolVar(&opts.ShowSecrets, "show-secrets", false, "Show the values of Secret data instead of placeholders")
+	addIgnoreFlags(flags, &ignore)
+	addIdentityFlags(flags, &identities)
+	addStorageFlags(flags, &storageOpts)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak history [flags] [NAMESPACE/]KIND/NAME\n\n"+
+			"Prints when the object changed across the backups in --output, e.g.\n"+
+			"kbak history default/Deployment/checkout. The namespace may be left out\n"+
+			"when only one namespace holds the object.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	key, ok := parseObjectKey(flags.Arg(0))
+	if flags.NArg() != 1 || !ok || extract < 0 || opts.Context < 0 {
+		flags.Usage()
+		return 2
+	}
+
+	rules, err := ignore.rules()
+	opts.Ignore = rules
+	var store storage.Storage
+	var repository *backup.Repository
+	if err == nil {
+		store, repository, err = openBackupStorage(outputDir, storageOpts)
+	}
+	var decryptor *encrypt.Decryptor
+	if err == nil {
+		decryptor, err = identities.decryptor()
+	}
+	var backups []historyBackup
+	if err == nil {
+		backups, err = historyBackups(store, repository, series)
+	}
+	if err == nil {
+		key, err = resolveObjectKey(key, backups)
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	versions := make([]diff.Version, 0, len(backups))
+	for _, b := range backups {
+		version := diff.Version{Backup: b.Name, Time: b.Time}
+		if file, ok := b.state.Find(key); ok {
+			if version.Data, err = backup.ReadFile(b.store, file.Dir, file.ManifestFile, decryptor); err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError reading %s from %s: %v%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, key, b.Name, err, utils.Reset)
+				return 1
+			}
+		}
+		versions = append(versions, version)
+	}
+
+	revisions, err := diff.History(key, versions, opts)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	if extract > 0 {
+		if extract > len(revisions) || revisions[extract-1].Data == nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %s has no revision %d with a manifest%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, key, extract, utils.Reset)
+			return 1
+		}
+		os.Stdout.Write(revisions[extract-1].Data)
+		return 0
+	}
+
+	if jsonOutput {
+		if !showDiff {
+			for i := range revisions {
+				revisions[i].Diff = ""
+			}
+		}
+		report := historyReport{Namespace: key.Namespace, Kind: key.Kind, Name: key.Name, Backups: len(backups), Revisions: revisions}
+		if report.Revisions == nil {
+			report.Revisions = []diff.Revision{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			return 1
+		}
+		return 0
+	}
+
+	printHistory(os.Stdout, key, len(backups), revisions, showDiff, !noColor)
+	return 0
+}
+
+// parseObjectKey parses [NAMESPACE/]KIND/NAME
+func parseObjectKey(text string) (backup.ObjectKey, bool) {
+	parts := strings.Split(text, "/")
+	for _, part := range parts {
+		if part == "" {
+			return backup.ObjectKey{}, false
+		}
+	}
+	switch len(parts) {
+	case 2:
+		return backup.ObjectKey{Kind: parts[0], Name: parts[1]}, true
+	case 3:
+		return backup.ObjectKey{Namespace: parts[0], Kind: parts[1], Name: parts[2]}, true
+	}
+	return backup.ObjectKey{}, false
+}
+
+// historyBackups returns the complete backups or the snapshots of one
+// series, oldest first, with their resolved states
+func historyBackups(store storage.Storage, repository *backup.Repository, series string) ([]historyBackup, error) {
+	var stored []backup.StoredBackup
+	var err error
+	if repository != nil {
+		stored, err = repository.Snapshots()
+	} else {
+		stored, err = backup.FindBackups(store)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Backups are scanned oldest first
+	sort.SliceStable(stored, func(i, j int) bool {
+		return stored[i].Time.Before(stored[j].Time) ||
+			stored[i].Time.Equal(stored[j].Time) && stored[i].Sequence < stored[j].Sequence
+	})
+
+	var backups []historyBackup
+	seriesNames := make(map[string]bool)
+	for _, b := range stored {
+		name, backupSeries := b.Path, b.Series()
+		if repository != nil {
+			name = backup.SnapshotID(b.Path)
+			backupSeries = path.Dir(name)
+		}
+		if !b.Complete || series != "" && path.Clean(series) != backupSeries {
+			continue
+		}
+		seriesNames[backupSeries] = true
+		backups = append(backups, historyBackup{StoredBackup: b, Name: name})
+	}
+
+	if len(seriesNames) > 1 {
+		var names []string
+		for name := range seriesNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("found backups of several series, choose one of %s with --series", strings.Join(names, ", "))
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no complete backups found in %s", store.Location(series))
+	}
+
+	for i := range backups {
+		b := &backups[i]
+		if repository != nil {
+			b.store = repository.Storage
+			b.state, err = repository.SnapshotState(b.Name)
+		} else {
+			// The manifest of a directory may be below it, e.g. in all-namespaces
+			name, dir := b.Path, b.Dir
+			if dir != "" {
+				name = dir
+			}
+			if b.store, dir, err = backup.OpenBackup(store, name); err == nil {
+				b.state, err = backup.ResolveState(b.store, dir)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", b.Name, err)
+		}
+	}
+	return backups, nil
+}
+
+// resolveObjectKey completes the key of the object: the kind is matched
+// case-insensitively and a missing namespace is the one namespace holding
+// the object
+func resolveObjectKey(key backup.ObjectKey, backups []historyBackup) (backup.ObjectKey, error) {
+	matches := make(map[backup.ObjectKey]bool)
+	for _, b := range backups {
+		for _, file := range b.state.Files {
+			if file.Name == key.Name && strings.EqualFold(file.Kind, key.Kind) &&
+				(key.Namespace == "" || file.Namespace == key.Namespace) {
+				matches[backup.ObjectKey{Namespace: file.Namespace, Kind: file.Kind, Name: file.Name}] = true
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		return key, fmt.Errorf("no backup holds %s/%s", key.Kind, key.Name)
+	}
+	if len(matches) > 1 {
+		var namespaces []string
+		for match := range matches {
+			namespaces = append(namespaces, match.Namespace)
+		}
+		sort.Strings(namespaces)
+		return key, fmt.Errorf("%s/%s exists in several namespaces, choose one of %s", key.Kind, key.Name, strings.Join(namespaces, ", "))
+	}
+	for match := range matches {
+		key = match
+	}
+	return key, nil
+}
+
+// printHistory prints the revisions as a timeline with the changed fields
+func printHistory(out io.Writer, key backup.ObjectKey, backups int, revisions []diff.Revision, showDiff, colors bool) {
+	color := func(code string) string {
+		if !colors {
+			return ""
+		}
+		return code
+	}
+	bold, reset := color(utils.Bold), color(utils.Reset)
+
+	fmt.Fprintf(out, "%s%s %s/%s%s: %d revisions in %d backups\n", bold, key.Kind, key.Namespace, key.Name, reset, len(revisions), backups)
+	for _, revision := range revisions {
+		marker := changeMarkers[revision.Type]
+		seen := "1 backup"
+		if revision.Backups > 1 {
+			seen = fmt.Sprintf("%d backups, until %s", revision.Backups, revision.LastBackup)
+		}
+		fmt.Fprintf(out, "\n%s%3d  %s%s  %s%s%s  (%s)\n", bold, revision.Number, revision.Backup, reset,
+			color(marker[1]), revision.Type, reset, seen)
+
+		for _, field := range revision.Fields {
+			fmt.Fprintf(out, "       %s: %s -> %s\n", field.Path, formatValue(field.Old), formatValue(field.New))
+		}
+		if showDiff && revision.Diff != "" {
+			for _, line := range strings.Split(strings.TrimSuffix(revision.Diff, "\n"), "\n") {
+				fmt.Fprintf(out, "       %s%s%s\n", color(diffLineColor(line)), line, reset)
+			}
+		}
+	}
+}
+
+// formatValue formats a field value on one line, with (none) for unset fields
+func formatValue(value interface{}) string {
+	if value == nil {
+		return "(none)"
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
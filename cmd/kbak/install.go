@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/install"
+	"github.com/rogosprojects/kbak/pkg/resources"
+	"github.com/rogosprojects/kbak/pkg/utils"
+)
+
+// runInstall writes the manifests for running kbak in a cluster to stdout
+func runInstall(args []string) int {
+	var opts install.Options
+	var namespaces stringList
+	var kinds stringList
+
+	flags := flag.NewFlagSet("install", flag.ExitOnError)
+	flags.StringVar(&opts.Name, "name", "kbak", "Name of the ServiceAccount, ClusterRole, bindings and CronJob")
+	flags.StringVar(&opts.Namespace, "namespace", "kbak", "Namespace kbak runs in")
+	flags.StringVar(&opts.Image, "image", "kbak:latest", "Container image of kbak")
+	flags.StringVar(&opts.Schedule, "schedule", "0 2 * * *", "Cron schedule of the CronJob")
+	flags.Var(&namespaces, "backup-namespace", "Namespace to back up, with access to this namespace only (repeatable; default: all namespaces)")
+	flags.Var(&kinds, "kind", "Kind to back up, e.g. deployment (repeatable; default: all kinds)")
+	flags.BoolVar(&opts.ExcludeSecrets, "exclude-secrets", false, "Leave Secrets out of the backup and grant no access to them")
+	flags.StringVar(&opts.Output, "output", install.BackupVolumePath, "Output of the backups; a local output is on the --claim volume")
+	flags.StringVar(&opts.PVC, "claim", "", "PersistentVolumeClaim mounted at "+install.BackupVolumePath+" for the backups")
+	flags.BoolVar(&opts.Operator, "operator", false, "Install the BackupSchedule CRD and a Deployment of kbak operator instead of a CronJob")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak install [flags] [-- BACKUP FLAGS]\n\n"+
+			"Writes the manifests for running kbak in a cluster to stdout: a ServiceAccount,\n"+
+			"a ClusterRole that only lists the backed-up resource types, its bindings and\n"+
+			"a CronJob, e.g. kbak install --claim kbak-backups | kubectl apply -f -\n"+
+			"With --operator the CronJob is replaced by the BackupSchedule CRD and a\n"+
+			"Deployment of kbak operator, which backs up what BackupSchedules declare.\n"+
+			"Flags after -- are added to the backup, e.g. -- --keep-daily 7, or to the operator.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	opts.Namespaces = namespaces
+	opts.Args = flags.Args()
+
+	var data []byte
+	var err error
+	if len(kinds) > 0 {
+		opts.SelectedTypes = make(map[string]bool)
+		for _, kind := range kinds {
+			opts.SelectedTypes[strings.ToLower(kind)] = true
+		}
+		if len(resources.GetResourceTypes(opts.SelectedTypes)) != len(opts.SelectedTypes) {
+			err = fmt.Errorf("unknown kind in %s", strings.Join(kinds, ", "))
+		}
+	}
+	if err == nil {
+		data, err = install.Manifests(opts)
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	os.Stdout.Write(data)
+	return 0
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/client"
+	"github.com/rogosprojects/kbak/pkg/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderElection holds the settings of Lease-based leader election between
+// replicas running scheduled backups
+type leaderElection struct {
+	enabled       bool
+	leaseName     string
+	namespace     string
+	identity      string
+	leaseDuration time.Duration
+}
+
+// addLeaderElectionFlags registers the leader election flags
+func addLeaderElectionFlags(flags *flag.FlagSet, e *leaderElection) {
+	flags.BoolVar(&e.enabled, "leader-elect", false, "With --schedule, only run backups while holding a Lease, so one of several replicas backs up and another takes over when it fails")
+	flags.StringVar(&e.leaseName, "leader-elect-lease-name", "kbak", "Name of the Lease used for leader election")
+	flags.StringVar(&e.namespace, "leader-elect-namespace", "", "Namespace of the Lease (default: the namespace of the pod, or of the kubeconfig context)")
+	flags.StringVar(&e.identity, "leader-elect-identity", "", "Identity of this replica in the Lease (default: the host name, i.e. the pod name)")
+	flags.DurationVar(&e.leaseDuration, "leader-elect-lease-duration", 15*time.Second, "How long the Lease is valid without renewal, i.e. how long a failed leader blocks the others")
+}
+
+// config returns the leader election settings for the client, without callbacks.
+// The leader renews the Lease after two thirds of its duration, and the
+// other replicas try to acquire it every fifth of its duration.
+func (e *leaderElection) config(k8sClient *client.K8sClient, kubeconfig string) (leaderelection.LeaderElectionConfig, error) {
+	if e.leaseDuration < time.Second {
+		return leaderelection.LeaderElectionConfig{}, fmt.Errorf("--leader-elect-lease-duration must be at least 1s")
+	}
+
+	identity := e.identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return leaderelection.LeaderElectionConfig{}, fmt.Errorf("error getting the host name for --leader-elect-identity: %v", err)
+		}
+		identity = hostname
+	}
+	namespace := e.namespace
+	if namespace == "" {
+		var err error
+		if namespace, err = kubeconfigNamespace(kubeconfig); err != nil {
+			return leaderelection.LeaderElectionConfig{}, fmt.Errorf("error getting the namespace for --leader-elect-namespace: %v", err)
+		}
+	}
+
+	return leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: e.leaseName, Namespace: namespace},
+			Client:     k8sClient.Clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   e.leaseDuration,
+		RenewDeadline:   e.leaseDuration * 2 / 3,
+		RetryPeriod:     e.leaseDuration / 5,
+		ReleaseOnCancel: true,
+		Name:            e.leaseName,
+	}, nil
+}
+
+// lead calls run while this replica holds the Lease, and campaigns again when
+// it loses it, until ctx is done. The first context of run is done when the
+// Lease is lost or ctx is done, the second one only when the Lease is lost.
+// Backups are made with the second one: when ctx is done the Lease is only
+// released once run returned, so a running backup is finished before another
+// replica takes over, while a backup running when the Lease is lost is
+// interrupted, as the next leader may already be making its own.
+func lead(ctx context.Context, config leaderelection.LeaderElectionConfig, run func(ctx, lease context.Context)) error {
+	identity := config.Lock.Identity()
+	for ctx.Err() == nil {
+		electionCtx, cancel := context.WithCancel(context.Background())
+		var mu sync.Mutex
+		leading := false
+		finished := make(chan struct{})
+
+		config.Callbacks = leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				defer close(finished)
+				defer cancel()
+				mu.Lock()
+				leading = ctx.Err() == nil && leaderCtx.Err() == nil
+				mu.Unlock()
+				if !leading {
+					return
+				}
+
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sAcquired Lease %s as %s%s\n",
+					utils.InfoEmoji, utils.Cyan, utils.Bold, config.Lock.Describe(), identity, utils.Reset)
+				runCtx, stop := context.WithCancel(leaderCtx)
+				defer stop()
+				go func() {
+					select {
+					case <-ctx.Done():
+						stop()
+					case <-runCtx.Done():
+					}
+				}()
+				run(runCtx, leaderCtx)
+			},
+			OnStoppedLeading: func() {},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					fmt.Fprintf(utils.StatusOutput, "%s %sWaiting for the Lease %s held by %s%s\n",
+						utils.InfoEmoji, utils.Cyan, config.Lock.Describe(), leader, utils.Reset)
+				}
+			},
+		}
+		elector, err := leaderelection.NewLeaderElector(config)
+		if err != nil {
+			cancel()
+			return err
+		}
+
+		// Stopping while waiting for the Lease ends the election right away
+		go func() {
+			select {
+			case <-ctx.Done():
+				mu.Lock()
+				if !leading {
+					cancel()
+				}
+				mu.Unlock()
+			case <-electionCtx.Done():
+			}
+		}()
+
+		elector.Run(electionCtx)
+		mu.Lock()
+		wasLeading := leading
+		mu.Unlock()
+		if wasLeading {
+			<-finished
+		}
+		cancel()
+
+		if wasLeading && ctx.Err() == nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: lost the Lease %s, campaigning again%s\n",
+				utils.WarningEmoji, utils.Yellow, utils.Bold, config.Lock.Describe(), utils.Reset)
+		}
+	}
+	return nil
+}
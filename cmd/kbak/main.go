@@ -2,17 +2,34 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/robfig/cron/v3"
 	"github.com/rogosprojects/kbak/pkg/backup"
 	"github.com/rogosprojects/kbak/pkg/client"
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"github.com/rogosprojects/kbak/pkg/gitrepo"
+	"github.com/rogosprojects/kbak/pkg/metrics"
+	"github.com/rogosprojects/kbak/pkg/oci"
+	"github.com/rogosprojects/kbak/pkg/redact"
+	"github.com/rogosprojects/kbak/pkg/resources"
+	"github.com/rogosprojects/kbak/pkg/sign"
+	"github.com/rogosprojects/kbak/pkg/sops"
+	"github.com/rogosprojects/kbak/pkg/storage"
 	"github.com/rogosprojects/kbak/pkg/utils"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/util/homedir"
 )
 
@@ -39,23 +56,106 @@ type resourceFlags struct {
 	job            bool
 }
 
+// commands are the subcommands of kbak; without one kbak runs a backup
+var commands = map[string]func(args []string) int{
+	"compare":     runCompare,
+	"decrypt":     runDecrypt,
+	"diff":        runDiff,
+	"drift":       runDrift,
+	"history":     runHistory,
+	"install":     runInstall,
+	"materialize": runMaterialize,
+	"operator":    runOperator,
+	"prune":       runPrune,
+	"pull":        runPull,
+	"repo":        runRepo,
+	"verify":      runVerify,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	var namespace string
 	var kubeconfig string
 	var outputDir string
 	var verbose bool
 	var showVersion bool
 	var allNamespaces bool
+	var pathTemplate string
+	var canonical bool
+	var gitMode bool
+	var toStdout bool
+	var storageOpts storage.Options
+	var gitAuthorName string
+	var gitAuthorEmail string
+	var ociPush string
+	var ociPlainHTTP bool
+	var retention backup.RetentionPolicy
+	var encryptSecrets bool
+	var encryptAll bool
+	var ageRecipients stringList
+	var pgpRecipients stringList
+	var sopsSecrets bool
+	var pgpFingerprints stringList
+	var redactMode string
+	var redactSaltFile string
+	var redactEnv bool
+	var redactReport string
+	var signKey string
+	var incremental bool
+	var fullEvery int
+	var repositoryMode bool
+	var scheduleSpec string
+	var scheduleJitter time.Duration
+	var leaderElect leaderElection
+	var metricsAddress string
+	var pushgateway string
+	var pushgatewayJob string
 
 	// Define resource type flags
 	var resFlags resourceFlags
 
 	// Basic flags
 	flag.StringVar(&namespace, "namespace", "", "Namespace to backup (uses current namespace from kubeconfig if not specified)")
-	flag.StringVar(&outputDir, "output", "backups", "Output directory for backup files")
+	flag.StringVar(&outputDir, "output", "backups", "Output directory for backup files, or s3://, azblob:// or gs://bucket/prefix")
 	flag.BoolVar(&verbose, "verbose", false, "Show verbose output")
 	flag.BoolVar(&showVersion, "version", false, "Show version information and exit")
 	flag.BoolVar(&allNamespaces, "all-namespaces", false, "Backup resources from all namespaces")
+	flag.BoolVar(&canonical, "canonical", false, "Write deterministic, diff-friendly output into a fixed tree: sort well-known lists, skip unchanged files and remove files of deleted objects")
+	flag.BoolVar(&toStdout, "stdout", false, "Write the cleaned manifests to stdout as multi-document YAML instead of files; status output goes to stderr")
+	flag.BoolVar(&gitMode, "git", false, "Write into a git repository at --output (initialized if needed) and commit the changes of each run; implies --canonical")
+	flag.StringVar(&gitAuthorName, "git-author-name", "", "Author name for git commits (default from git config, or \"kbak\")")
+	flag.StringVar(&gitAuthorEmail, "git-author-email", "", "Author email for git commits (default from git config, or \"kbak@localhost\")")
+	flag.StringVar(&pathTemplate, "path-template", "", "Go template for backup file paths relative to --output, with fields .Timestamp, .Cluster, .Namespace, .Kind and .Name (default \""+backup.DefaultPathTemplate+"\")")
+
+	flag.StringVar(&ociPush, "oci-push", "", "Push the backup as an OCI artifact to a registry repository, e.g. registry.example.com/backups/prod[:tag] (default tag: the backup timestamp)")
+	flag.BoolVar(&ociPlainHTTP, "oci-plain-http", false, "Use plain HTTP for the OCI registry")
+	flag.BoolVar(&encryptSecrets, "encrypt-secrets", false, "Encrypt Secret manifests to the --age-recipient or --pgp-recipient-file recipients")
+	flag.BoolVar(&encryptAll, "encrypt-all", false, "Encrypt every manifest of the backup, not only Secrets")
+	flag.Var(&ageRecipients, "age-recipient", "age public key (age1...) or recipients file to encrypt to (repeatable)")
+	flag.Var(&pgpRecipients, "pgp-recipient-file", "OpenPGP public key file to encrypt to (repeatable)")
+	flag.BoolVar(&sopsSecrets, "sops-secrets", false, "Write Secrets in sops format: data and stringData values encrypted to the --age-recipient, --pgp-recipient-file and --pgp-fingerprint recipients, metadata readable")
+	flag.Var(&pgpFingerprints, "pgp-fingerprint", "Fingerprint of an OpenPGP key to encrypt sops Secrets to, looked up in --pgp-recipient-file or the gpg keyring (repeatable)")
+	flag.StringVar(&redactMode, "redact", "", "Redact Secret values for sharing the backup: \"placeholder\" replaces them with "+redact.Placeholder+", \"hash\" with a salted SHA-256 hash")
+	flag.StringVar(&redactSaltFile, "redact-salt-file", "", "File with the salt for --redact=hash, so hashes are comparable across backups (default: a random salt per run)")
+	flag.BoolVar(&redactEnv, "redact-env", false, "With --redact, also redact credential-like environment variable values of pods and pod templates")
+	flag.StringVar(&redactReport, "redact-report", "", "Write the redaction report to this local file (default: "+redact.ReportFileName+" in the backup directory)")
+	flag.StringVar(&signKey, "sign-key", "", "PEM ed25519 or ECDSA private key to sign the backup manifest with, verified by kbak verify")
+	flag.BoolVar(&incremental, "incremental", false, "Only write objects that changed since the latest complete backup, and tombstones for deleted objects; restore with kbak materialize")
+	flag.IntVar(&fullEvery, "full-every", 0, "With --incremental, make a full backup once the latest one is the Nth of its chain (0: only when there is no complete backup)")
+	flag.BoolVar(&repositoryMode, "repository", false, "Store the backup as a snapshot in a content-addressable repository at --output (created if empty), where identical files are stored once; see kbak repo")
+	flag.StringVar(&scheduleSpec, "schedule", "", "Keep running and back up on this cron schedule, e.g. \"0 * * * *\" or @hourly, instead of once; a run is skipped while the previous one is still going")
+	flag.DurationVar(&scheduleJitter, "schedule-jitter", 0, "With --schedule, delay every run by a random duration up to this, e.g. 5m to spread the load of many clusters")
+	addLeaderElectionFlags(flag.CommandLine, &leaderElect)
+	flag.StringVar(&metricsAddress, "metrics-address", "", "With --schedule, serve Prometheus metrics of the backups on /metrics at this address, e.g. :9090")
+	flag.StringVar(&pushgateway, "pushgateway", "", "Push Prometheus metrics of every backup to this Pushgateway, e.g. http://pushgateway:9091")
+	flag.StringVar(&pushgatewayJob, "pushgateway-job", "kbak", "Job of the metrics pushed to --pushgateway")
+	addStorageFlags(flag.CommandLine, &storageOpts)
+	addRetentionFlags(flag.CommandLine, &retention)
 
 	// Resource type flags
 	flag.BoolVar(&resFlags.all, "all-resources", true, "Backup all resource types (default)")
@@ -88,146 +188,778 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Keep stdout free for the manifests
+	if toStdout {
+		utils.StatusOutput = os.Stderr
+		if gitMode || ociPush != "" {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: --stdout cannot be combined with --git or --oci-push%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, utils.Reset)
+			os.Exit(1)
+		}
+	}
+
 	if allNamespaces && namespace != "" {
-		fmt.Printf("%s %s%sWarning: --namespace flag is ignored when --all-namespaces is used%s\n",
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: --namespace flag is ignored when --all-namespaces is used%s\n",
 			utils.WarningEmoji, utils.Yellow, utils.Bold, utils.Reset)
 		namespace = ""
 	}
 
+	// Encryption needs recipients, and recipients are only used for encryption
+	var encryptor *encrypt.Encryptor
+	var sopsEncryptor *sops.Encryptor
+	if encryptSecrets || encryptAll || sopsSecrets || len(ageRecipients) > 0 || len(pgpRecipients) > 0 || len(pgpFingerprints) > 0 {
+		var err error
+		switch {
+		case !encryptSecrets && !encryptAll && !sopsSecrets:
+			err = fmt.Errorf("--age-recipient, --pgp-recipient-file and --pgp-fingerprint require --encrypt-secrets, --encrypt-all or --sops-secrets")
+		case toStdout:
+			err = fmt.Errorf("encryption cannot be combined with --stdout")
+		case sopsSecrets && (encryptSecrets || encryptAll):
+			err = fmt.Errorf("--sops-secrets cannot be combined with --encrypt-secrets or --encrypt-all")
+		case sopsSecrets:
+			sopsEncryptor, err = sops.NewEncryptor(ageRecipients, pgpFingerprints, pgpRecipients)
+		case len(pgpFingerprints) > 0:
+			err = fmt.Errorf("--pgp-fingerprint requires --sops-secrets")
+		default:
+			encryptor, err = encrypt.NewEncryptor(ageRecipients, pgpRecipients)
+		}
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			os.Exit(1)
+		}
+	}
+
+	// Redaction records every replaced value in a report, so every run gets
+	// its own redactor
+	var redactSalt []byte
+	if redactMode != "" || redactSaltFile != "" || redactEnv || redactReport != "" {
+		var err error
+		if redactMode == "" {
+			err = fmt.Errorf("--redact-salt-file, --redact-env and --redact-report require --redact")
+		} else if toStdout && redactReport == "" {
+			err = fmt.Errorf("--redact with --stdout requires --redact-report")
+		} else if redactSaltFile != "" {
+			if redactMode != redact.ModeHash {
+				err = fmt.Errorf("--redact-salt-file requires --redact=hash")
+			} else if redactSalt, err = os.ReadFile(redactSaltFile); err == nil && len(redactSalt) == 0 {
+				err = fmt.Errorf("salt file %s is empty", redactSaltFile)
+			}
+		}
+		if err == nil {
+			_, err = redact.NewRedactor(redactMode, redactSalt, redactEnv)
+		}
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			os.Exit(1)
+		}
+	}
+
+	var signer *sign.Signer
+	if signKey != "" {
+		var err error
+		if toStdout {
+			err = fmt.Errorf("--sign-key cannot be combined with --stdout")
+		} else {
+			signer, err = sign.LoadSigner(signKey)
+		}
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			os.Exit(1)
+		}
+	}
+
+	// Git mode keeps a single tree that is committed after every run
+	if gitMode {
+		canonical = true
+	}
+
+	// Incremental backups build on the timestamped directories of earlier runs,
+	// which an artifact pushed on its own would lack
+	if incremental && (canonical || toStdout || ociPush != "") {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: --incremental cannot be combined with --canonical, --git, --stdout or --oci-push%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, utils.Reset)
+		os.Exit(1)
+	}
+
+	// Repositories replace the backup directory with a snapshot index
+	if repositoryMode && (canonical || toStdout || incremental || ociPush != "") {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: --repository cannot be combined with --canonical, --git, --stdout, --incremental or --oci-push%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, utils.Reset)
+		os.Exit(1)
+	}
+
+	// Scheduled runs keep the process alive between backups
+	var schedule cron.Schedule
+	if scheduleSpec != "" || scheduleJitter != 0 || leaderElect.enabled || metricsAddress != "" {
+		var err error
+		switch {
+		case scheduleSpec == "" && leaderElect.enabled:
+			err = fmt.Errorf("--leader-elect requires --schedule")
+		case scheduleSpec == "" && metricsAddress != "":
+			err = fmt.Errorf("--metrics-address requires --schedule; use --pushgateway for one-off backups")
+		case scheduleSpec == "":
+			err = fmt.Errorf("--schedule-jitter requires --schedule")
+		case toStdout:
+			err = fmt.Errorf("--schedule cannot be combined with --stdout")
+		case scheduleJitter < 0:
+			err = fmt.Errorf("--schedule-jitter must not be negative")
+		default:
+			if schedule, err = cron.ParseStandard(scheduleSpec); err != nil {
+				err = fmt.Errorf("invalid --schedule %q: %v", scheduleSpec, err)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			os.Exit(1)
+		}
+	}
+
+	// Open the output storage
+	store, err := storage.Open(outputDir, storageOpts)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError opening output location: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		os.Exit(1)
+	}
+	if _, isLocal := store.(*storage.Local); gitMode && !isLocal {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: --git requires a local output directory%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, utils.Reset)
+		os.Exit(1)
+	}
+	var repository *backup.Repository
+	if repositoryMode {
+		if repository, err = backup.InitRepository(store); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError opening repository: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			os.Exit(1)
+		}
+	}
+
 	// Initialize Kubernetes client first to validate connectivity
 	k8sClient, err := client.NewClient(kubeconfig, verbose)
 	if err != nil {
-		fmt.Printf("%s %s%sError initializing Kubernetes client: %v%s\n",
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError initializing Kubernetes client: %v%s\n",
 			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
 		os.Exit(1)
 	}
 
 	// If namespace is not specified and not using all-namespaces, get the current namespace from kubeconfig
 	if namespace == "" && !allNamespaces {
-		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
-		loadingRules.ExplicitPath = kubeconfig
-		configOverrides := &clientcmd.ConfigOverrides{}
-		kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
-		currentNamespace, _, err := kubeConfig.Namespace()
-		if err != nil {
-			fmt.Printf("%s %s%sError getting current namespace: %v%s\n",
+		if namespace, err = kubeconfigNamespace(kubeconfig); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError getting current namespace: %v%s\n",
 				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
 			os.Exit(1)
 		}
-		namespace = currentNamespace
 		if verbose {
-			fmt.Printf(" %sUsing current namespace: %s%s\n",
+			fmt.Fprintf(utils.StatusOutput, " %sUsing current namespace: %s%s\n",
 				utils.Cyan, namespace, utils.Reset)
 		}
 	}
 
-	// Handle all-namespaces case
-	if allNamespaces {
-		// Get all namespaces
-		namespaces, err := k8sClient.Clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+	// Only the leader of several replicas runs scheduled backups
+	var election *leaderelection.LeaderElectionConfig
+	if leaderElect.enabled {
+		config, err := leaderElect.config(k8sClient, kubeconfig)
 		if err != nil {
-			fmt.Printf("%s %s%sError listing namespaces: %v%s\n",
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
 				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
 			os.Exit(1)
 		}
+		election = &config
+	}
 
-		// Create parent backup directory
-		timestamp := time.Now().Format("02Jan2006-15:04")
-		parentBackupDir := filepath.Join(outputDir, timestamp, "all-namespaces")
-
-		if err := os.MkdirAll(parentBackupDir, 0755); err != nil {
-			fmt.Printf("%s %s%sError creating output directory: %v%s\n",
+	// Resolve the output layout
+	if pathTemplate == "" {
+		pathTemplate = backup.DefaultPathTemplate
+		if canonical || repositoryMode {
+			pathTemplate = backup.CanonicalPathTemplate
+		} else if allNamespaces {
+			pathTemplate = backup.DefaultAllNamespacesPathTemplate
+		}
+	}
+	tmpl, err := backup.ParsePathTemplate(pathTemplate)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError parsing path template: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		os.Exit(1)
+	}
+	// makeBackup makes one backup, adds the stats of every namespace to
+	// namespaceStats and returns the number of errors. Scheduled runs share
+	// the client, the storage and the settings. Once ctx is done the backup
+	// stops and is left incomplete.
+	makeBackup := func(ctx context.Context, namespaceStats map[string]*backup.BackupStats) int {
+		startedAt := time.Now()
+		layout, err := backup.NewLayout(store, tmpl, k8sClient.Cluster, startedAt)
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError preparing output directory: %v%s\n",
 				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
-			os.Exit(1)
+			return 1
+		}
+		backupDir := layout.RunDir()
+		target := store.Location(backupDir)
+		if toStdout {
+			target = "stdout"
 		}
 
-		fmt.Printf("%s %s%sStarting backup of all namespaces to '%s'%s\n\n",
-			utils.StartEmoji, utils.Blue, utils.Bold, parentBackupDir, utils.Reset)
+		var redactor *redact.Redactor
+		if redactMode != "" {
+			if redactor, err = redact.NewRedactor(redactMode, redactSalt, redactEnv); err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+				return 1
+			}
+		}
+
+		// The lock of the snapshot protects its objects from garbage collection until the index is written
+		var snapshotID string
+		if repository != nil {
+			if snapshotID, err = repository.BeginSnapshot(layout.Cluster, layout.Timestamp); err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError starting snapshot: %v%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+				return 1
+			}
+			target = fmt.Sprintf("snapshot %s of repository %s", snapshotID, store.Location(""))
+		}
+
+		// Resolve the namespaces to back up
+		namespaces := []string{namespace}
+		if allNamespaces {
+			namespaceList, err := k8sClient.Clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError listing namespaces: %v%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+				return 1
+			}
+			namespaces = namespaces[:0]
+			for _, ns := range namespaceList.Items {
+				namespaces = append(namespaces, ns.Name)
+			}
+		}
 
-		totalResourceCount := 0
-		totalErrorCount := 0
+		// Prepare resource type filter
+		selectedTypes := buildResourceTypeMap(resFlags)
+		opts := backup.Options{
+			SelectedTypes: selectedTypes,
+			Canonical:     canonical,
+			Encryptor:     encryptor,
+			EncryptAll:    encryptAll,
+			SOPS:          sopsEncryptor,
+			Redactor:      redactor,
+			Repository:    repository,
+			Verbose:       verbose,
+		}
+		if toStdout {
+			opts.Stdout = os.Stdout
+		}
+		manifest := newManifest(k8sClient, layout, selectedTypes, startedAt, verbose)
+		manifest.Filters.AllNamespaces = allNamespaces
+		if incremental {
+			if backupDir == "" {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError: --incremental requires a path template starting with {{.Timestamp}}%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, utils.Reset)
+				return 1
+			}
+			// The parent is a backup of the same namespaces and resource types
+			filters := manifest.Filters
+			filters.Namespaces = namespaces
+			opts.Previous = previousState(store, layout, filters, fullEvery)
+		}
+
+		// In canonical mode the previous manifest lists the files of objects that may have been deleted
+		var previous *backup.Manifest
+		if canonical && !toStdout {
+			previous, err = backup.ReadManifest(store, backupDir)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: ignoring unreadable previous manifest: %v%s\n",
+					utils.WarningEmoji, utils.Yellow, utils.Bold, err, utils.Reset)
+			}
+		}
+
+		if allNamespaces {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sStarting backup of all namespaces to '%s'%s\n\n",
+				utils.StartEmoji, utils.Blue, utils.Bold, target, utils.Reset)
+		} else if len(selectedTypes) > 0 {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sStarting backup of selected resource types from namespace '%s' to '%s'%s\n\n",
+				utils.StartEmoji, utils.Blue, utils.Bold, namespace, target, utils.Reset)
+		} else {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sStarting backup of all resource types from namespace '%s' to '%s'%s\n\n",
+				utils.StartEmoji, utils.Blue, utils.Bold, namespace, target, utils.Reset)
+		}
+
+		if redactor != nil {
+			manifest.Redaction = redactor.Mode()
+		}
+		if opts.Previous != nil {
+			manifest.Parent = backup.BackupName(opts.Previous.Chain[len(opts.Previous.Chain)-1])
+		}
+		resourceCount := 0
+		errorCount := 0
+		newObjects := 0
+		var unchanged []string
 
 		// Process each namespace
-		for _, ns := range namespaces.Items {
-			nsName := ns.Name
-			nsBackupDir := filepath.Join(parentBackupDir, nsName)
+		for _, nsName := range namespaces {
+			if ctx.Err() != nil {
+				break
+			}
+			if allNamespaces {
+				fmt.Fprintf(utils.StatusOutput, "%sProcessing namespace: %s%s\n",
+					utils.Blue, nsName, utils.Reset)
+			}
 
-			if err := os.MkdirAll(nsBackupDir, 0755); err != nil {
-				fmt.Printf("%s %s%sError creating directory for namespace %s: %v%s\n",
+			// Perform backup for this namespace
+			stats := backup.PerformBackup(ctx, k8sClient, nsName, layout, opts)
+			namespaceStats[nsName] = stats
+
+			resourceCount += stats.ResourceCount
+			errorCount += stats.ErrorCount
+			unchanged = append(unchanged, stats.Unchanged...)
+			newObjects += stats.NewObjects
+			manifest.Filters.Namespaces = append(manifest.Filters.Namespaces, nsName)
+			if err := manifest.AddNamespace(nsName, backupDir, stats); err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError recording namespace %s in manifest: %v%s\n",
 					utils.ErrorEmoji, utils.Red, utils.Bold, nsName, err, utils.Reset)
-				totalErrorCount++
-				continue
+				errorCount++
+			}
+		}
+
+		// Without a manifest the interrupted backup is incomplete, and pruned like a failed one
+		if ctx.Err() != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: the backup to %s was interrupted and is left incomplete%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, target, utils.Reset)
+			if repository != nil {
+				if err := repository.AbortSnapshot(snapshotID); err != nil {
+					fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+						utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+					errorCount++
+				}
 			}
+			return errorCount + 1
+		}
 
-			// Prepare resource type filter
-			selectedTypes := buildResourceTypeMap(resFlags)
+		if redactor != nil {
+			errorCount += writeRedactionReport(redactor, manifest, store, repository, backupDir, redactReport)
+		}
 
-			fmt.Printf("%sProcessing namespace: %s%s\n",
-				utils.Blue, nsName, utils.Reset)
+		// Streamed backups have no files, manifest or commit
+		if !toStdout {
+			if canonical {
+				errorCount += removeStaleFiles(store, backupDir, previous, manifest, selectedTypes, verbose)
+			}
+			if opts.Previous != nil {
+				manifest.Tombstones = backup.Tombstones(opts.Previous, manifest, unchanged, selectedKinds(selectedTypes))
+				fmt.Fprintf(utils.StatusOutput, "%s%sIncremental backup on top of %s: %d new or changed, %d unchanged, %d deleted resources%s\n",
+					utils.Green, utils.Bold, manifest.Parent, len(manifest.Files), len(unchanged), len(manifest.Tombstones), utils.Reset)
+			}
 
-			// Perform backup for this namespace
-			resourceCount, errorCount := backup.PerformBackup(k8sClient, nsName, nsBackupDir, selectedTypes, verbose)
+			// The manifest is written last and marks the backup as complete.
+			// In canonical mode an unchanged manifest is left untouched as well.
+			manifestPath := path.Join(backupDir, backup.ManifestFileName)
+			if repository != nil {
+				manifestPath = backup.SnapshotPath(snapshotID)
+				if err := repository.CommitSnapshot(snapshotID, manifest); err != nil {
+					fmt.Fprintf(utils.StatusOutput, "%s %s%sError writing snapshot: %v%s\n",
+						utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+					errorCount++
+				} else {
+					fmt.Fprintf(utils.StatusOutput, "%s%sStored snapshot %s: %d files, %d new objects%s\n",
+						utils.Green, utils.Bold, snapshotID, len(manifest.Files)+len(manifest.Attachments), newObjects, utils.Reset)
+				}
+			} else if !canonical || !manifest.SameContent(previous) {
+				if err := manifest.Write(store, backupDir); err != nil {
+					fmt.Fprintf(utils.StatusOutput, "%s %s%sError writing backup manifest: %v%s\n",
+						utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+					errorCount++
+				}
+			}
 
-			totalResourceCount += resourceCount
-			totalErrorCount += errorCount
+			if signer != nil {
+				errorCount += signManifest(store, manifestPath, signer)
+			}
+
+			if gitMode {
+				errorCount += commitBackup(store.Location(backupDir), k8sClient.Cluster, previous, manifest, gitAuthorName, gitAuthorEmail)
+			}
+
+			if ociPush != "" {
+				errorCount += pushArtifact(store, backupDir, ociPush, layout.Timestamp, ociPlainHTTP)
+			}
+
+			// Prune older backups once this one is complete
+			if repository != nil && !retention.Empty() {
+				errorCount += collectGarbage(repository, retention, defaultLockTimeout, false, verbose)
+			} else if !retention.Empty() {
+				errorCount += pruneBackups(store, retention, false, false, verbose)
+			}
 		}
 
-		if totalResourceCount > 0 {
-			fmt.Printf("\n%s %s%sBackup completed successfully to %s (%d resources total across all namespaces)%s\n",
-				utils.SuccessEmoji, utils.Green, utils.Bold, parentBackupDir, totalResourceCount, utils.Reset)
-		} else {
-			fmt.Printf("\n%s %s%sNo resources found to backup in any namespace%s\n",
+		if resourceCount > 0 {
+			if allNamespaces {
+				fmt.Fprintf(utils.StatusOutput, "\n%s %s%sBackup completed successfully to %s (%d resources total across all namespaces)%s\n",
+					utils.SuccessEmoji, utils.Green, utils.Bold, target, resourceCount, utils.Reset)
+			} else {
+				fmt.Fprintf(utils.StatusOutput, "\n%s %s%sBackup completed successfully to %s (%d resources total)%s\n",
+					utils.SuccessEmoji, utils.Green, utils.Bold, target, resourceCount, utils.Reset)
+			}
+		} else if allNamespaces {
+			fmt.Fprintf(utils.StatusOutput, "\n%s %s%sNo resources found to backup in any namespace%s\n",
 				utils.WarningEmoji, utils.Yellow, utils.Bold, utils.Reset)
+		} else {
+			fmt.Fprintf(utils.StatusOutput, "\n%s %s%sNo resources found to backup in namespace '%s'%s\n",
+				utils.WarningEmoji, utils.Yellow, utils.Bold, namespace, utils.Reset)
+		}
+
+		if errorCount > 0 {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sCompleted with %d errors%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, errorCount, utils.Reset)
 		}
+		return errorCount
+	}
 
-		// Exit with error code if there were errors
-		if totalErrorCount > 0 {
-			fmt.Printf("%s %s%sCompleted with %d errors%s\n",
-				utils.ErrorEmoji, utils.Red, utils.Bold, totalErrorCount, utils.Reset)
+	// runBackup makes one backup and records its metrics
+	var backupMetrics *metrics.Metrics
+	if metricsAddress != "" || pushgateway != "" {
+		backupMetrics = metrics.New()
+	}
+	runBackup := func(ctx context.Context) int {
+		startedAt := time.Now()
+		namespaceStats := make(map[string]*backup.BackupStats)
+		errorCount := makeBackup(ctx, namespaceStats)
+		if backupMetrics == nil {
+			return errorCount
+		}
+
+		backupMetrics.Observe("", startedAt, time.Now(), namespaceStats, errorCount)
+		if pushgateway != "" {
+			if err := backupMetrics.Push(pushgateway, pushgatewayJob); err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+				errorCount++
+			}
+		}
+		return errorCount
+	}
+
+	if metricsAddress != "" {
+		if err := serveMetrics(metricsAddress, backupMetrics); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
 			os.Exit(1)
 		}
+	}
+	if schedule != nil {
+		os.Exit(runSchedule(schedule, scheduleJitter, election, runBackup))
+	}
+	if runBackup(context.Background()) > 0 {
+		os.Exit(1)
+	}
+}
 
-		os.Exit(0)
+// signManifest writes the signature of the manifest or snapshot index at
+// manifestPath next to it and returns the number of errors. A valid signature
+// of an unchanged manifest is kept.
+func signManifest(store storage.Storage, manifestPath string, signer *sign.Signer) int {
+	signaturePath := manifestPath + backup.SignatureExtension
+
+	data, err := store.Read(manifestPath)
+	if err == nil {
+		existing, readErr := store.Read(signaturePath)
+		if readErr == nil && signer.Verifier().Verify(data, existing) == nil {
+			return 0
+		}
+		var signature []byte
+		if signature, err = signer.Sign(data); err == nil {
+			err = store.Write(signaturePath, signature)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError signing backup manifest: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
 	}
 
-	// Create output directory with timestamp
-	timestamp := time.Now().Format("02Jan2006-15:04")
-	backupDir := filepath.Join(outputDir, timestamp, namespace)
+	fmt.Fprintf(utils.StatusOutput, "%s%sSigned backup manifest%s\n",
+		utils.Green, utils.Bold, utils.Reset)
+	return 0
+}
+
+// writeRedactionReport writes the redaction report to reportFile, or into the
+// backup directory or repository as an attachment of the manifest, and returns
+// the number of errors
+func writeRedactionReport(redactor *redact.Redactor, manifest *backup.Manifest, store storage.Storage, repository *backup.Repository, backupDir, reportFile string) int {
+	report := redactor.Report()
 
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
-		fmt.Printf("%s %s%sError creating output directory: %v%s\n",
+	data, err := report.Marshal()
+	if err == nil {
+		if reportFile != "" {
+			err = os.WriteFile(reportFile, data, 0600)
+		} else if repository != nil {
+			err = repository.AddAttachment(manifest, redact.ReportFileName, data)
+		} else {
+			err = manifest.AddAttachment(store, backupDir, redact.ReportFileName, data)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError writing redaction report: %v%s\n",
 			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
-		os.Exit(1)
+		return 1
 	}
 
-	// Prepare resource type filter
-	selectedTypes := buildResourceTypeMap(resFlags)
+	fmt.Fprintf(utils.StatusOutput, "%s%sRedacted %d values%s\n",
+		utils.Green, utils.Bold, len(report.Redactions), utils.Reset)
+	return 0
+}
 
-	if len(selectedTypes) > 0 {
-		fmt.Printf("%s %s%sStarting backup of selected resource types from namespace '%s' to '%s'%s\n\n",
-			utils.StartEmoji, utils.Blue, utils.Bold, namespace, backupDir, utils.Reset)
-	} else {
-		fmt.Printf("%s %s%sStarting backup of all resource types from namespace '%s' to '%s'%s\n\n",
-			utils.StartEmoji, utils.Blue, utils.Bold, namespace, backupDir, utils.Reset)
+// removeStaleFiles deletes the files of objects that no longer exist and
+// returns the number of errors
+func removeStaleFiles(store storage.Storage, backupDir string, previous, manifest *backup.Manifest, selectedTypes map[string]bool, verbose bool) int {
+	removed, err := backup.RemoveStaleFiles(store, backupDir, previous, manifest, selectedKinds(selectedTypes))
+	if verbose || err != nil {
+		for _, file := range removed {
+			fmt.Fprintf(utils.StatusOutput, "%sRemoved %s '%s' which no longer exists in namespace %s%s\n",
+				utils.BrightBlue, file.Kind, file.Name, file.Namespace, utils.Reset)
+		}
+	}
+	if len(removed) > 0 {
+		fmt.Fprintf(utils.StatusOutput, "%s%sRemoved %d deleted resources%s\n",
+			utils.Green, utils.Bold, len(removed), utils.Reset)
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError removing deleted resources: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	return 0
+}
+
+// kubeconfigNamespace returns the namespace of the current kubeconfig
+// context, or of the pod when running in a cluster
+func kubeconfigNamespace(kubeconfig string) (string, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	configOverrides := &clientcmd.ConfigOverrides{}
+	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
+	namespace, _, err := kubeConfig.Namespace()
+	return namespace, err
+}
+
+// selectedKinds returns the kinds of the selected resource types
+func selectedKinds(selectedTypes map[string]bool) []string {
+	var kinds []string
+	for _, resourceType := range resources.GetResourceTypes(selectedTypes) {
+		kinds = append(kinds, resourceType.Kind)
+	}
+	return kinds
+}
+
+// previousState returns the state of the latest complete backup in the series
+// of the layout made with the same filters for an incremental backup, or nil
+// when a full backup is due
+func previousState(store storage.Storage, layout *backup.Layout, filters backup.ManifestFilters, fullEvery int) *backup.State {
+	latest, err := backup.LatestCompleteBackup(store, layout.Series(), filters)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: making a full backup, cannot find the latest backup: %v%s\n",
+			utils.WarningEmoji, utils.Yellow, utils.Bold, err, utils.Reset)
+		return nil
+	}
+	if latest == nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %sNo complete backup found, making a full backup%s\n",
+			utils.InfoEmoji, utils.Cyan, utils.Reset)
+		return nil
+	}
+
+	state, err := backup.ResolveState(store, latest.Dir)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: making a full backup, cannot resolve the latest backup: %v%s\n",
+			utils.WarningEmoji, utils.Yellow, utils.Bold, err, utils.Reset)
+		return nil
+	}
+	if fullEvery > 0 && len(state.Chain) >= fullEvery {
+		fmt.Fprintf(utils.StatusOutput, "%s %sMaking a full backup after a chain of %d backups%s\n",
+			utils.InfoEmoji, utils.Cyan, len(state.Chain), utils.Reset)
+		return nil
+	}
+
+	return state
+}
+
+// commitBackup stages the backup directory in its git repository and commits
+// the changes, returning the number of errors
+func commitBackup(backupDir, cluster string, previous, manifest *backup.Manifest, authorName, authorEmail string) int {
+	repo, initialized, err := gitrepo.Open(backupDir)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError opening git repository: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+	if initialized {
+		fmt.Fprintf(utils.StatusOutput, "%s %sInitialized git repository in %s%s\n",
+			utils.InfoEmoji, utils.Cyan, repo.Root(), utils.Reset)
 	}
 
-	// Perform backup
-	resourceCount, errorCount := backup.PerformBackup(k8sClient, namespace, backupDir, selectedTypes, verbose)
+	changes, err := repo.Stage(backupDir)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError staging backup: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+	if len(changes) == 0 {
+		fmt.Fprintf(utils.StatusOutput, "%s %sNo changes to commit%s\n",
+			utils.InfoEmoji, utils.Cyan, utils.Reset)
+		return 0
+	}
+
+	// Group changes by the namespace and kind recorded in the manifests
+	files := make(map[string]backup.ManifestFile)
+	for _, m := range []*backup.Manifest{previous, manifest} {
+		if m == nil {
+			continue
+		}
+		for _, file := range m.Files {
+			files[file.Path] = file
+		}
+	}
+	for i := range changes {
+		if file, ok := files[changes[i].Path]; ok {
+			changes[i].Namespace = file.Namespace
+			changes[i].Kind = file.Kind
+		}
+	}
 
-	if resourceCount > 0 {
-		fmt.Printf("\n%s %s%sBackup completed successfully to %s (%d resources total)%s\n",
-			utils.SuccessEmoji, utils.Green, utils.Bold, backupDir, resourceCount, utils.Reset)
+	message := gitrepo.CommitMessage(fmt.Sprintf("kbak backup of %s", cluster), changes)
+	hash, err := repo.Commit(message, authorName, authorEmail)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError committing backup: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	fmt.Fprintf(utils.StatusOutput, "%s%sCommitted %d changed files as %s%s\n",
+		utils.Green, utils.Bold, len(changes), hash[:12], utils.Reset)
+
+	return 0
+}
+
+// pushArtifact pushes the backup as an OCI artifact and returns the number of errors
+func pushArtifact(store storage.Storage, backupDir, reference, defaultTag string, plainHTTP bool) int {
+	repo, err := oci.NewRepository(reference, plainHTTP)
+	if err == nil && repo.Reference.Reference == "" {
+		repo.Reference.Reference = defaultTag
+	}
+	if err == nil {
+		err = repo.Reference.ValidateReferenceAsTag()
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: invalid --oci-push reference: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	desc, err := oci.Push(context.TODO(), repo, repo.Reference.Reference, store, backupDir)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError pushing backup to %s: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, repo.Reference, err, utils.Reset)
+		return 1
+	}
+
+	fmt.Fprintf(utils.StatusOutput, "%s%sPushed backup to %s (%s)%s\n",
+		utils.Green, utils.Bold, repo.Reference, desc.Digest, utils.Reset)
+
+	return 0
+}
+
+// newManifest creates the manifest for a backup run, filled with cluster metadata
+func newManifest(k8sClient *client.K8sClient, layout *backup.Layout, selectedTypes map[string]bool,
+	startedAt time.Time, verbose bool) *backup.Manifest {
+	manifest := backup.NewManifest(layout, Version, startedAt)
+	manifest.Context = k8sClient.Context
+	manifest.Server = k8sClient.Config.Host
+
+	serverVersion, err := k8sClient.Clientset.Discovery().ServerVersion()
+	if err != nil {
+		if verbose {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: could not determine Kubernetes version: %v%s\n",
+				utils.WarningEmoji, utils.Yellow, utils.Bold, err, utils.Reset)
+		}
 	} else {
-		fmt.Printf("\n%s %s%sNo resources found to backup in namespace '%s'%s\n",
-			utils.WarningEmoji, utils.Yellow, utils.Bold, namespace, utils.Reset)
+		manifest.KubernetesVersion = serverVersion.GitVersion
 	}
 
-	// Exit with error code if there were errors
-	if errorCount > 0 {
-		fmt.Printf("%s %s%sCompleted with %d errors%s\n",
-			utils.ErrorEmoji, utils.Red, utils.Bold, errorCount, utils.Reset)
-		os.Exit(1)
+	for resourceType := range selectedTypes {
+		manifest.Filters.ResourceTypes = append(manifest.Filters.ResourceTypes, resourceType)
+	}
+	sort.Strings(manifest.Filters.ResourceTypes)
+
+	return manifest
+}
+
+// fileMode is a flag holding an octal file mode
+type fileMode fs.FileMode
+
+func (m *fileMode) String() string {
+	if m == nil || *m == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%04o", uint32(*m))
+}
+
+func (m *fileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return fmt.Errorf("invalid mode %q, expected an octal mode like 0700", value)
 	}
+	*m = fileMode(mode)
+	return nil
+}
+
+// stringList is a flag that can be given multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// addStorageFlags registers the settings of the remote storage backends
+func addStorageFlags(flags *flag.FlagSet, opts *storage.Options) {
+	flags.BoolFunc("restrict-permissions", "Create local directories with mode 0700 and files with mode 0600 unless other modes are given", func(value string) error {
+		restrict, err := strconv.ParseBool(value)
+		if err != nil || !restrict {
+			return err
+		}
+		if opts.Local.Permissions.DirMode == 0 {
+			opts.Local.Permissions.DirMode = storage.RestrictedPermissions.DirMode
+		}
+		if opts.Local.Permissions.FileMode == 0 {
+			opts.Local.Permissions.FileMode = storage.RestrictedPermissions.FileMode
+		}
+		return nil
+	})
+	flags.Var((*fileMode)(&opts.Local.Permissions.DirMode), "dir-mode", "Octal mode of created local directories (default 0755, subject to the umask)")
+	flags.Var((*fileMode)(&opts.Local.Permissions.FileMode), "file-mode", "Octal mode of created local files (default 0644, subject to the umask)")
+	flags.Var((*fileMode)(&opts.Local.SecretPermissions.DirMode), "secret-dir-mode", "Octal mode of local directories created for Secret and ServiceAccount files (default: --dir-mode)")
+	flags.Var((*fileMode)(&opts.Local.SecretPermissions.FileMode), "secret-file-mode", "Octal mode of local Secret and ServiceAccount files (default: --file-mode)")
+	flags.StringVar(&opts.Local.Group, "output-group", "", "Group name or ID given to created local files and directories, for shared access")
+	flags.BoolVar(&opts.Local.AllowWorldWritable, "allow-world-writable-output", false, "Write into a world-writable local output directory")
+	flags.StringVar(&opts.S3.Endpoint, "s3-endpoint", storage.DefaultS3Endpoint, "S3 API endpoint (host[:port]) for s3:// outputs")
+	flags.StringVar(&opts.S3.Region, "s3-region", "", "S3 region for s3:// outputs")
+	flags.BoolVar(&opts.S3.Insecure, "s3-insecure", false, "Use plain HTTP for the S3 endpoint")
+	flags.StringVar(&opts.S3.SSE, "s3-sse", "", "S3 server-side encryption: \"s3\" (SSE-S3) or \"kms\" (SSE-KMS)")
+	flags.StringVar(&opts.S3.KMSKeyID, "s3-sse-kms-key-id", "", "KMS key ID for --s3-sse=kms")
+	flags.StringVar(&opts.Azure.Account, "azure-account", "", "Azure storage account for azblob:// outputs (default $AZURE_STORAGE_ACCOUNT)")
+	flags.StringVar(&opts.Azure.Endpoint, "azure-endpoint", "", "Azure blob service URL, e.g. for Azurite")
+	flags.StringVar(&opts.Azure.AccountKeyFile, "azure-account-key-file", "", "File containing the Azure storage account key")
+	flags.StringVar(&opts.GCS.Endpoint, "gcs-endpoint", "", "GCS JSON API endpoint for gs:// outputs, e.g. for fake-gcs-server")
+	flags.StringVar(&opts.GCS.CredentialsFile, "gcs-credentials-file", "", "GCS service account key file (default: Application Default Credentials)")
 }
 
 // buildResourceTypeMap creates a map of resource types to include in the backup
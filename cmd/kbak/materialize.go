@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+)
+
+// runMaterialize reconstructs the full point-in-time tree of an incremental
+// backup from the backups it builds on
+func runMaterialize(args []string) int {
+	var outputDir string
+	var targetDir string
+	var storageOpts storage.Options
+
+	flags := flag.NewFlagSet("materialize", flag.ExitOnError)
+	flags.StringVar(&outputDir, "output", "backups", "Output directory containing the backups, or s3://, azblob:// or gs://bucket/prefix")
+	flags.StringVar(&targetDir, "to", "", "Directory or s3://, azblob:// or gs://bucket/prefix to write the full backup to, below a directory named after the backup (required)")
+	addStorageFlags(flags, &storageOpts)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak materialize [flags] --to TARGET BACKUP\n\nBACKUP is the backup directory relative to --output, e.g. 2025-01-02T03-04-05Z\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || targetDir == "" {
+		flags.Usage()
+		return 2
+	}
+	dir := path.Clean(flags.Arg(0))
+
+	store, err := storage.Open(outputDir, storageOpts)
+	var target storage.Storage
+	if err == nil {
+		target, err = storage.Open(targetDir, storageOpts)
+	}
+	name := path.Base(dir)
+	if err == nil {
+		var exists bool
+		if exists, err = target.Exists(name); err == nil && exists {
+			err = fmt.Errorf("%s already exists", target.Location(name))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	state, err := backup.Materialize(store, dir, target, name)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError materializing %s: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, store.Location(dir), err, utils.Reset)
+		return 1
+	}
+
+	fmt.Fprintf(utils.StatusOutput, "%s %s%sMaterialized %d files from a chain of %d backups to %s%s\n",
+		utils.SuccessEmoji, utils.Green, utils.Bold, len(state.Files), len(state.Chain), target.Location(name), utils.Reset)
+	return 0
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/metrics"
+	"github.com/rogosprojects/kbak/pkg/utils"
+)
+
+// serveMetrics serves the metrics on /metrics at address in the background,
+// for as long as kbak runs
+func serveMetrics(address string, backupMetrics *metrics.Metrics) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error listening on --metrics-address %s: %v", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", backupMetrics.Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError serving metrics: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		}
+	}()
+
+	fmt.Fprintf(utils.StatusOutput, "%s %sServing metrics on http://%s/metrics%s\n",
+		utils.InfoEmoji, utils.Cyan, listener.Addr(), utils.Reset)
+	return nil
+}
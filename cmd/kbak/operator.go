@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/client"
+	"github.com/rogosprojects/kbak/pkg/install"
+	"github.com/rogosprojects/kbak/pkg/metrics"
+	"github.com/rogosprojects/kbak/pkg/operator"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/util/homedir"
+)
+
+// runOperator runs kbak as a controller of BackupSchedule custom resources
+// until it receives SIGINT or SIGTERM
+func runOperator(args []string) int {
+	var kubeconfig string
+	var destinationRoot string
+	var metricsAddress string
+	var verbose bool
+	var storageOpts storage.Options
+	var leaderElect leaderElection
+
+	flags := flag.NewFlagSet("operator", flag.ExitOnError)
+	if home := homedir.HomeDir(); home != "" {
+		flags.StringVar(&kubeconfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "Path to kubeconfig file")
+	} else {
+		flags.StringVar(&kubeconfig, "kubeconfig", "", "Path to kubeconfig file")
+	}
+	flags.StringVar(&destinationRoot, "destination-root", install.BackupVolumePath, "Directory holding the local destinations of the BackupSchedules")
+	flags.StringVar(&metricsAddress, "metrics-address", "", "Serve Prometheus metrics of the backups on /metrics at this address, e.g. :9090")
+	flags.BoolVar(&verbose, "verbose", false, "Show verbose output")
+	addStorageFlags(flags, &storageOpts)
+	addLeaderElectionFlags(flags, &leaderElect)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak operator [flags]\n\n"+
+			"Runs the backups declared by BackupSchedule resources on their schedules and\n"+
+			"reports the results in their status. The BackupSchedule CRD is written by\n"+
+			"kbak install --operator.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	k8sClient, err := client.NewClient(kubeconfig, verbose)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError initializing Kubernetes client: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+	dynamicClient, err := dynamic.NewForConfig(k8sClient.Config)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError initializing Kubernetes client: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	// The metrics of a BackupSchedule are labeled with its name
+	var backupMetrics *metrics.Metrics
+	if metricsAddress != "" {
+		backupMetrics = metrics.New()
+		if err := serveMetrics(metricsAddress, backupMetrics); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			return 1
+		}
+	}
+	// The backups of a controller are interrupted once lease is done
+	newController := func(lease context.Context) *operator.Controller {
+		runner := func(schedule *operator.BackupSchedule) operator.RunStatus {
+			namespaceStats := make(map[string]*backup.BackupStats)
+			status := runScheduledBackup(lease, k8sClient, schedule, namespaceStats, storageOpts, verbose)
+			if backupMetrics != nil {
+				backupMetrics.Observe(schedule.Name, status.StartTime.Time, status.CompletionTime.Time, namespaceStats, status.ErrorCount)
+			}
+			return status
+		}
+		controller := operator.NewController(dynamicClient, destinationRoot, runner)
+		if backupMetrics != nil {
+			controller.OnRemove = backupMetrics.Forget
+		}
+		return controller
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Fprintf(utils.StatusOutput, "%s %s%sWatching BackupSchedules%s\n",
+		utils.StartEmoji, utils.Blue, utils.Bold, utils.Reset)
+	if !leaderElect.enabled {
+		err = newController(context.Background()).Run(ctx)
+	} else {
+		var config leaderelection.LeaderElectionConfig
+		if config, err = leaderElect.config(k8sClient, kubeconfig); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			return 1
+		}
+		// Every term of the leader starts a new controller from a fresh watch
+		err = lead(ctx, config, func(ctx, lease context.Context) {
+			if err := newController(lease).Run(ctx); err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			}
+		})
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+	return 0
+}
+
+// runScheduledBackup makes the backup of a BackupSchedule: every selected
+// namespace into one run of its destination, followed by its retention policy.
+// The stats of every namespace are added to namespaceStats. Once ctx is done
+// the backup stops and is left incomplete.
+func runScheduledBackup(ctx context.Context, k8sClient *client.K8sClient, schedule *operator.BackupSchedule, namespaceStats map[string]*backup.BackupStats,
+	storageOpts storage.Options, verbose bool) operator.RunStatus {
+	spec := schedule.Spec
+	status := operator.RunStatus{StartTime: metav1.Now()}
+	finish := func() operator.RunStatus {
+		status.CompletionTime = metav1.Now()
+		for _, message := range status.Errors {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %s%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, message, utils.Reset)
+		}
+		if status.ErrorCount > 0 {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sCompleted with %d errors%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, status.ErrorCount, utils.Reset)
+		}
+		return status
+	}
+
+	store, err := storage.Open(spec.Destination, storageOpts)
+	if err != nil {
+		status.AddError(fmt.Errorf("error opening output location: %v", err))
+		return finish()
+	}
+
+	// Without namespaces every namespace is backed up
+	allNamespaces := len(spec.Namespaces) == 0
+	namespaces := spec.Namespaces
+	pathTemplate := backup.DefaultPathTemplate
+	if allNamespaces {
+		pathTemplate = backup.DefaultAllNamespacesPathTemplate
+		namespaceList, err := k8sClient.Clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			status.AddError(fmt.Errorf("error listing namespaces: %v", err))
+			return finish()
+		}
+		for _, ns := range namespaceList.Items {
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+	tmpl, err := backup.ParsePathTemplate(pathTemplate)
+	if err != nil {
+		status.AddError(fmt.Errorf("error parsing path template: %v", err))
+		return finish()
+	}
+	startedAt := time.Now()
+	layout, err := backup.NewLayout(store, tmpl, k8sClient.Cluster, startedAt)
+	if err != nil {
+		status.AddError(fmt.Errorf("error preparing output directory: %v", err))
+		return finish()
+	}
+	backupDir := layout.RunDir()
+	status.Location = store.Location(backupDir)
+
+	fmt.Fprintf(utils.StatusOutput, "%s %s%sStarting backup of %s to '%s'%s\n\n",
+		utils.StartEmoji, utils.Blue, utils.Bold, schedule.Name, status.Location, utils.Reset)
+
+	selectedTypes := spec.SelectedTypes()
+	manifest := newManifest(k8sClient, layout, selectedTypes, startedAt, verbose)
+	manifest.Filters.AllNamespaces = allNamespaces
+	opts := backup.Options{SelectedTypes: selectedTypes, Verbose: verbose}
+	for _, nsName := range namespaces {
+		if ctx.Err() != nil {
+			break
+		}
+		fmt.Fprintf(utils.StatusOutput, "%sProcessing namespace: %s%s\n",
+			utils.Blue, nsName, utils.Reset)
+		stats := backup.PerformBackup(ctx, k8sClient, nsName, layout, opts)
+		status.AddStats(stats)
+		namespaceStats[nsName] = stats
+		manifest.Filters.Namespaces = append(manifest.Filters.Namespaces, nsName)
+		if err := manifest.AddNamespace(nsName, backupDir, stats); err != nil {
+			status.AddError(fmt.Errorf("error recording namespace %s in manifest: %v", nsName, err))
+		}
+	}
+
+	// Without a manifest the interrupted backup is incomplete, and pruned like a failed one
+	if ctx.Err() != nil {
+		status.AddError(fmt.Errorf("the backup to %s was interrupted and is left incomplete", status.Location))
+		return finish()
+	}
+
+	// The manifest is written last and marks the backup as complete
+	if err := manifest.Write(store, backupDir); err != nil {
+		status.AddError(fmt.Errorf("error writing backup manifest: %v", err))
+		return finish()
+	}
+	if policy := spec.Retention.Policy(); !policy.Empty() {
+		if pruneBackups(store, policy, false, false, verbose) > 0 {
+			status.AddError(fmt.Errorf("error pruning backups in %s", store.Location("")))
+		}
+	}
+
+	fmt.Fprintf(utils.StatusOutput, "\n%s %s%sBackup completed to %s (%d resources total)%s\n",
+		utils.SuccessEmoji, utils.Green, utils.Bold, status.Location, status.ResourceCount, utils.Reset)
+	return finish()
+}
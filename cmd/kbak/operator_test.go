@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/client"
+	"github.com/rogosprojects/kbak/pkg/operator"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// newTestClient returns a client of an API server with the namespaces shop
+// and web and none of the backed-up kinds
+func newTestClient(t *testing.T) *client.K8sClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"kind":"NamespaceList","apiVersion":"v1","items":[{"metadata":{"name":"shop"}},{"metadata":{"name":"web"}}]}`)
+	}))
+	t.Cleanup(server.Close)
+	config := &rest.Config{Host: server.URL}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("NewForConfig returned error: %v", err)
+	}
+	return &client.K8sClient{Clientset: clientset, Config: config, Context: "test", Cluster: "test"}
+}
+
+func TestRunScheduledBackupAllNamespacesRetention(t *testing.T) {
+	k8sClient := newTestClient(t)
+	statusOutput := utils.StatusOutput
+	utils.StatusOutput = io.Discard
+	defer func() { utils.StatusOutput = statusOutput }()
+
+	// Two earlier complete backups of every namespace
+	dir := t.TempDir()
+	for _, name := range []string{"2024-01-01T00-00-00Z", "2024-01-02T00-00-00Z"} {
+		runDir := filepath.Join(dir, name, "all-namespaces")
+		if err := os.MkdirAll(runDir, 0755); err != nil {
+			t.Fatalf("MkdirAll returned error: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(runDir, backup.ManifestFileName), []byte("{}"), 0644); err != nil {
+			t.Fatalf("WriteFile returned error: %v", err)
+		}
+	}
+
+	schedule := &operator.BackupSchedule{Spec: operator.BackupScheduleSpec{
+		Schedule:    "@daily",
+		Destination: dir,
+		Retention:   &operator.Retention{KeepLast: 2},
+	}}
+	schedule.Name = "nightly"
+	status := runScheduledBackup(context.Background(), k8sClient, schedule, make(map[string]*backup.BackupStats), storage.Options{}, false)
+	if status.ErrorCount != 0 {
+		t.Fatalf("Expected no errors, got %v", status.Errors)
+	}
+
+	store, err := storage.Open(dir, storage.Options{})
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	backups, err := backup.FindBackups(store)
+	if err != nil {
+		t.Fatalf("FindBackups returned error: %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Expected the 2 newest backups to be kept, got %+v", backups)
+	}
+	if !backups[0].Complete || backups[0].Dir != backups[0].Path+"/all-namespaces" {
+		t.Errorf("Expected the complete new backup in all-namespaces, got %+v", backups[0])
+	}
+	if backups[1].Path != "2024-01-02T00-00-00Z" || !backups[1].Complete {
+		t.Errorf("Expected the complete backup of 2024-01-02 to be kept, got %+v", backups[1])
+	}
+}
+
+func TestRunScheduledBackupInterrupted(t *testing.T) {
+	k8sClient := newTestClient(t)
+	statusOutput := utils.StatusOutput
+	utils.StatusOutput = io.Discard
+	defer func() { utils.StatusOutput = statusOutput }()
+
+	// The Lease was lost before the backup started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dir := t.TempDir()
+	schedule := &operator.BackupSchedule{Spec: operator.BackupScheduleSpec{Schedule: "@daily", Destination: dir}}
+	schedule.Name = "nightly"
+	status := runScheduledBackup(ctx, k8sClient, schedule, make(map[string]*backup.BackupStats), storage.Options{}, false)
+	if status.ErrorCount != 1 {
+		t.Errorf("Expected the interruption as error, got %v", status.Errors)
+	}
+
+	store, err := storage.Open(dir, storage.Options{})
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	backups, err := backup.FindBackups(store)
+	if err != nil {
+		t.Fatalf("FindBackups returned error: %v", err)
+	}
+	for _, b := range backups {
+		if b.Complete {
+			t.Errorf("Expected no complete backup, got %+v", b)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+)
+
+// addRetentionFlags registers the flags of a retention policy
+func addRetentionFlags(flags *flag.FlagSet, policy *backup.RetentionPolicy) {
+	flags.IntVar(&policy.KeepLast, "keep-last", 0, "Keep the newest N backups")
+	flags.IntVar(&policy.KeepDaily, "keep-daily", 0, "Keep the newest backup of each of the last N days")
+	flags.IntVar(&policy.KeepWeekly, "keep-weekly", 0, "Keep the newest backup of each of the last N weeks")
+	flags.IntVar(&policy.KeepMonthly, "keep-monthly", 0, "Keep the newest backup of each of the last N months")
+}
+
+// runPrune deletes the backups in the output location that are not kept by
+// the retention policy
+func runPrune(args []string) int {
+	var outputDir string
+	var dryRun bool
+	var deleteIncompleteNewest bool
+	var verbose bool
+	var policy backup.RetentionPolicy
+	var storageOpts storage.Options
+
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	flags.StringVar(&outputDir, "output", "backups", "Output directory containing the backups, or s3://, azblob:// or gs://bucket/prefix")
+	flags.BoolVar(&dryRun, "dry-run", false, "List the backups that would be removed without removing them")
+	flags.BoolVar(&deleteIncompleteNewest, "delete-incomplete-newest", false, "Also remove the newest backup when it is incomplete (it may still be running)")
+	flags.BoolVar(&verbose, "verbose", false, "Also list the backups that are kept")
+	addRetentionFlags(flags, &policy)
+	addStorageFlags(flags, &storageOpts)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak prune [flags]\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+	if policy.Empty() {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: at least one of --keep-last, --keep-daily, --keep-weekly or --keep-monthly is required%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, utils.Reset)
+		return 1
+	}
+
+	store, err := storage.Open(outputDir, storageOpts)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError opening output location: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	if pruneBackups(store, policy, dryRun, deleteIncompleteNewest, verbose) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// pruneBackups applies the retention policy to the backups in store and
+// returns the number of errors
+func pruneBackups(store storage.Storage, policy backup.RetentionPolicy, dryRun, deleteIncompleteNewest, verbose bool) int {
+	backups, err := backup.FindBackups(store)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	// Incremental backups need every backup of their chain
+	decisions := policy.Apply(backups, deleteIncompleteNewest)
+	if err := backup.KeepBases(store, decisions); err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	removed := 0
+	errorCount := 0
+	for _, decision := range decisions {
+		location := store.Location(decision.Backup.Path)
+		if decision.Keep {
+			if verbose {
+				fmt.Fprintf(utils.StatusOutput, "%sKeeping %s (%s)%s\n",
+					utils.Cyan, location, strings.Join(decision.Reasons, ", "), utils.Reset)
+			}
+			continue
+		}
+
+		note := ""
+		if !decision.Backup.Complete {
+			note = " (incomplete)"
+		}
+		if dryRun {
+			fmt.Fprintf(utils.StatusOutput, "%sWould remove %s%s%s\n",
+				utils.Yellow, location, note, utils.Reset)
+			removed++
+			continue
+		}
+		if err := backup.DeleteBackup(store, decision.Backup); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError removing %s: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, location, err, utils.Reset)
+			errorCount++
+			continue
+		}
+		if verbose {
+			fmt.Fprintf(utils.StatusOutput, "%sRemoved %s%s%s\n",
+				utils.BrightBlue, location, note, utils.Reset)
+		}
+		removed++
+	}
+
+	if dryRun {
+		fmt.Fprintf(utils.StatusOutput, "%s %sDry run: %d of %d backups would be removed%s\n",
+			utils.InfoEmoji, utils.Cyan, removed, len(backups), utils.Reset)
+	} else {
+		fmt.Fprintf(utils.StatusOutput, "%s%sPruned %d of %d backups%s\n",
+			utils.Green, utils.Bold, removed, len(backups), utils.Reset)
+	}
+
+	return errorCount
+}
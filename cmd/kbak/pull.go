@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/rogosprojects/kbak/pkg/oci"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+)
+
+// runPull downloads a backup pushed with --oci-push by tag or digest and
+// writes it to the output location
+func runPull(args []string) int {
+	var outputDir string
+	var dir string
+	var plainHTTP bool
+	var storageOpts storage.Options
+
+	flags := flag.NewFlagSet("pull", flag.ExitOnError)
+	flags.StringVar(&outputDir, "output", "backups", "Output directory for the pulled backup, or s3://, azblob:// or gs://bucket/prefix")
+	flags.StringVar(&dir, "dir", "", "Directory below --output to write the backup to (default: the backup timestamp)")
+	flags.BoolVar(&plainHTTP, "oci-plain-http", false, "Use plain HTTP for the OCI registry")
+	addStorageFlags(flags, &storageOpts)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak pull [flags] REGISTRY/REPOSITORY:TAG|REGISTRY/REPOSITORY@DIGEST\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	repo, err := oci.NewRepository(flags.Arg(0), plainHTTP)
+	if err == nil && repo.Reference.Reference == "" {
+		err = fmt.Errorf("a tag or digest is required")
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	store, err := storage.Open(outputDir, storageOpts)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError opening output location: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	fmt.Fprintf(utils.StatusOutput, "%s %s%sPulling backup %s%s\n",
+		utils.StartEmoji, utils.Blue, utils.Bold, repo.Reference, utils.Reset)
+
+	ctx := context.TODO()
+	artifact, err := oci.Fetch(ctx, repo, repo.Reference.Reference)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	if dir == "" {
+		dir = artifact.Timestamp()
+	}
+	if exists, err := store.Exists(dir); err != nil || exists {
+		if err == nil {
+			err = fmt.Errorf("%s already exists", store.Location(dir))
+		}
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	manifest, err := artifact.Extract(ctx, store, dir)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError writing backup: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	fmt.Fprintf(utils.StatusOutput, "%s %s%sPulled backup of %s (%d resources, %s) to %s%s\n",
+		utils.SuccessEmoji, utils.Green, utils.Bold, manifest.Cluster, manifest.ResourceCount,
+		artifact.Descriptor.Digest, store.Location(dir), utils.Reset)
+
+	return 0
+}
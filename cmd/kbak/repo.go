@@ -0,0 +1,310 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/sign"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+)
+
+// defaultLockTimeout is the age after which the lock of a backup run that
+// never completed no longer blocks garbage collection
+const defaultLockTimeout = 24 * time.Hour
+
+// repoCommands are the subcommands of kbak repo
+var repoCommands = map[string]func(args []string) int{
+	"check":     runRepoCheck,
+	"export":    runRepoExport,
+	"gc":        runRepoGC,
+	"snapshots": runRepoSnapshots,
+}
+
+// runRepo runs a subcommand on a repository written with --repository
+func runRepo(args []string) int {
+	if len(args) > 0 {
+		if command, ok := repoCommands[args[0]]; ok {
+			return command(args[1:])
+		}
+	}
+
+	var names []string
+	for name := range repoCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: kbak repo %s [flags]\n", strings.Join(names, "|"))
+	return 2
+}
+
+// repoFlags creates the flag set of a repo subcommand with the repository location and storage flags
+func repoFlags(name, usage string, outputDir *string, storageOpts *storage.Options) *flag.FlagSet {
+	flags := flag.NewFlagSet("repo "+name, flag.ExitOnError)
+	flags.StringVar(outputDir, "output", "backups", "Repository location, a directory or s3://, azblob:// or gs://bucket/prefix")
+	addStorageFlags(flags, storageOpts)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak repo %s\n\n", usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// openRepository opens an existing repository, printing errors
+func openRepository(outputDir string, storageOpts storage.Options) *backup.Repository {
+	store, err := storage.Open(outputDir, storageOpts)
+	var repository *backup.Repository
+	if err == nil {
+		repository, err = backup.OpenRepository(store)
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError opening repository: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return nil
+	}
+	return repository
+}
+
+// runRepoSnapshots lists the snapshots of a repository, newest first
+func runRepoSnapshots(args []string) int {
+	var outputDir string
+	var storageOpts storage.Options
+	flags := repoFlags("snapshots", "snapshots [flags]", &outputDir, &storageOpts)
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	repository := openRepository(outputDir, storageOpts)
+	if repository == nil {
+		return 1
+	}
+	snapshots, err := repository.Snapshots()
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	errorCount := 0
+	for _, snapshot := range snapshots {
+		id, manifest, err := repository.ReadSnapshot(backup.SnapshotID(snapshot.Path))
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			errorCount++
+			continue
+		}
+		fmt.Printf("%s\t%d resources\t%d errors\t%d namespaces\t%s\n",
+			id, manifest.ResourceCount, manifest.ErrorCount, len(manifest.Namespaces), manifest.Context)
+	}
+
+	if errorCount > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runRepoCheck checks that every snapshot is readable and every object it
+// references is intact, and optionally the snapshot signatures
+func runRepoCheck(args []string) int {
+	var outputDir string
+	var keyFile string
+	var storageOpts storage.Options
+	flags := repoFlags("check", "check [flags]", &outputDir, &storageOpts)
+	flags.StringVar(&keyFile, "key", "", "PEM public key to check the snapshot signatures with; every snapshot must be signed when set")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	var verifier *sign.Verifier
+	if keyFile != "" {
+		var err error
+		if verifier, err = sign.LoadVerifier(keyFile); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			return 1
+		}
+	}
+	repository := openRepository(outputDir, storageOpts)
+	if repository == nil {
+		return 1
+	}
+
+	check, err := repository.Check()
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError checking repository: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	problems := 0
+	if verifier != nil {
+		snapshots, err := repository.Snapshots()
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			return 1
+		}
+		for _, snapshot := range snapshots {
+			if err := verifySignature(repository.Storage, snapshot.Path, verifier); err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%sSignature of %s: %v%s\n",
+					utils.Red, backup.SnapshotID(snapshot.Path), err, utils.Reset)
+				problems++
+			}
+		}
+	}
+	for _, id := range check.Unreadable {
+		fmt.Fprintf(utils.StatusOutput, "%sUnreadable: snapshot %s%s\n", utils.Red, id, utils.Reset)
+	}
+	for _, problem := range check.Missing {
+		fmt.Fprintf(utils.StatusOutput, "%sMissing:    %s %s (%s)%s\n",
+			utils.Red, problem.Snapshot, problem.File.Path, problem.File.SHA256, utils.Reset)
+	}
+	for _, problem := range check.Corrupt {
+		fmt.Fprintf(utils.StatusOutput, "%sCorrupt:    %s %s (%s)%s\n",
+			utils.Red, problem.Snapshot, problem.File.Path, problem.File.SHA256, utils.Reset)
+	}
+	problems += len(check.Unreadable) + len(check.Missing) + len(check.Corrupt)
+
+	if check.Unreferenced > 0 {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%d unreferenced objects can be removed with kbak repo gc%s\n",
+			utils.InfoEmoji, utils.Cyan, check.Unreferenced, utils.Reset)
+	}
+	if problems > 0 {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sCheck of %s failed: %d problems%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, repository.Storage.Location(""), problems, utils.Reset)
+		return 1
+	}
+
+	fmt.Fprintf(utils.StatusOutput, "%s %s%sChecked %d snapshots and %d objects of %s%s\n",
+		utils.SuccessEmoji, utils.Green, utils.Bold, check.Snapshots, check.Objects, repository.Storage.Location(""), utils.Reset)
+	return 0
+}
+
+// runRepoGC removes the snapshots not kept by a retention policy and the
+// objects no snapshot references
+func runRepoGC(args []string) int {
+	var outputDir string
+	var storageOpts storage.Options
+	var policy backup.RetentionPolicy
+	var lockTimeout time.Duration
+	var dryRun bool
+	var verbose bool
+	flags := repoFlags("gc", "gc [flags]", &outputDir, &storageOpts)
+	addRetentionFlags(flags, &policy)
+	flags.DurationVar(&lockTimeout, "lock-timeout", defaultLockTimeout, "Ignore the locks of backup runs started longer ago, which never completed")
+	flags.BoolVar(&dryRun, "dry-run", false, "List what would be removed without removing it")
+	flags.BoolVar(&verbose, "verbose", false, "List the kept and removed snapshots")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	repository := openRepository(outputDir, storageOpts)
+	if repository == nil {
+		return 1
+	}
+	if collectGarbage(repository, policy, lockTimeout, dryRun, verbose) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// collectGarbage applies the retention policy to the snapshots of the
+// repository, when set, removes unreferenced objects and returns the number of errors
+func collectGarbage(repository *backup.Repository, policy backup.RetentionPolicy, lockTimeout time.Duration, dryRun, verbose bool) int {
+	result, err := repository.GarbageCollect(policy, lockTimeout, time.Now(), dryRun)
+	if result != nil {
+		for _, id := range result.StaleLocks {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: ignoring the lock of backup run %s, which never completed%s\n",
+				utils.WarningEmoji, utils.Yellow, utils.Bold, id, utils.Reset)
+		}
+
+		forgotten := 0
+		for _, decision := range result.Decisions {
+			id := backup.SnapshotID(decision.Backup.Path)
+			switch {
+			case decision.Keep && verbose:
+				fmt.Fprintf(utils.StatusOutput, "%sKeeping snapshot %s (%s)%s\n",
+					utils.Cyan, id, strings.Join(decision.Reasons, ", "), utils.Reset)
+			case !decision.Keep && dryRun:
+				fmt.Fprintf(utils.StatusOutput, "%sWould remove snapshot %s%s\n", utils.Yellow, id, utils.Reset)
+			case !decision.Keep && verbose:
+				fmt.Fprintf(utils.StatusOutput, "%sRemoved snapshot %s%s\n", utils.BrightBlue, id, utils.Reset)
+			}
+			if !decision.Keep {
+				forgotten++
+			}
+		}
+
+		if dryRun {
+			fmt.Fprintf(utils.StatusOutput, "%s %sDry run: %d snapshots and %d of %d objects would be removed%s\n",
+				utils.InfoEmoji, utils.Cyan, forgotten, len(result.Removed), len(result.Removed)+result.Kept, utils.Reset)
+		} else if err == nil {
+			fmt.Fprintf(utils.StatusOutput, "%s%sRemoved %d snapshots and %d of %d objects%s\n",
+				utils.Green, utils.Bold, forgotten, len(result.Removed), len(result.Removed)+result.Kept, utils.Reset)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError collecting garbage: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+	return 0
+}
+
+// runRepoExport writes a snapshot as a regular backup directory
+func runRepoExport(args []string) int {
+	var outputDir string
+	var targetDir string
+	var storageOpts storage.Options
+	flags := repoFlags("export", "export [flags] --to TARGET SNAPSHOT\n\nSNAPSHOT is a snapshot ID as listed by kbak repo snapshots, e.g. prod/2025-01-02T03-04-05Z, or latest", &outputDir, &storageOpts)
+	flags.StringVar(&targetDir, "to", "", "Directory or s3://, azblob:// or gs://bucket/prefix to write the backup to, below a directory named after the snapshot ID (required)")
+	flags.Parse(args)
+	if flags.NArg() != 1 || targetDir == "" {
+		flags.Usage()
+		return 2
+	}
+
+	repository := openRepository(outputDir, storageOpts)
+	if repository == nil {
+		return 1
+	}
+	id, _, err := repository.ReadSnapshot(flags.Arg(0))
+	var target storage.Storage
+	if err == nil {
+		target, err = storage.Open(targetDir, storageOpts)
+	}
+	if err == nil {
+		var exists bool
+		if exists, err = target.Exists(id); err == nil && exists {
+			err = fmt.Errorf("%s already exists", target.Location(id))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	manifest, err := repository.Export(id, target, id)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError exporting snapshot %s: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, id, err, utils.Reset)
+		return 1
+	}
+
+	fmt.Fprintf(utils.StatusOutput, "%s %s%sExported snapshot %s (%d files) to %s%s\n",
+		utils.SuccessEmoji, utils.Green, utils.Bold, id, len(manifest.Files)+len(manifest.Attachments), target.Location(id), utils.Reset)
+	return 0
+}
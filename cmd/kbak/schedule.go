@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/rogosprojects/kbak/pkg/utils"
+
+	"k8s.io/client-go/tools/leaderelection"
+)
+
+// runSchedule runs scheduled backups until kbak receives SIGINT or SIGTERM.
+// With an election config, backups only run while this replica is the leader,
+// and a backup is interrupted when it loses the Lease.
+func runSchedule(schedule cron.Schedule, jitter time.Duration, election *leaderelection.LeaderElectionConfig, runBackup func(context.Context) int) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	backups := func(ctx, lease context.Context) {
+		scheduleBackups(ctx, lease, schedule, jitter, runBackup)
+	}
+	if election == nil {
+		backups(ctx, context.Background())
+		return 0
+	}
+	if err := lead(ctx, *election, backups); err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError in leader election: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+	return 0
+}
+
+// scheduleBackups calls runBackup on every activation of the schedule, delayed
+// by a random duration up to jitter, until ctx is done. An activation is
+// skipped while the previous run is still going. A running backup is finished
+// before scheduleBackups returns, unless lease is done, which interrupts it.
+// Failed runs are retried at the next activation.
+func scheduleBackups(ctx, lease context.Context, schedule cron.Schedule, jitter time.Duration, runBackup func(context.Context) int) {
+	var running atomic.Bool
+	scheduler := cron.New()
+	scheduler.Schedule(schedule, cron.FuncJob(func() {
+		if !running.CompareAndSwap(false, true) {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: skipping the scheduled backup, the previous one is still running%s\n",
+				utils.WarningEmoji, utils.Yellow, utils.Bold, utils.Reset)
+			return
+		}
+		defer running.Store(false)
+
+		if jitter > 0 {
+			delay := time.Duration(rand.Int63n(int64(jitter)))
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		fmt.Fprintf(utils.StatusOutput, "\n%s %s%sScheduled backup at %s%s\n",
+			utils.InfoEmoji, utils.Cyan, utils.Bold, time.Now().Format(time.RFC3339), utils.Reset)
+		runBackup(lease)
+		fmt.Fprintf(utils.StatusOutput, "%s %sNext backup at %s%s\n",
+			utils.InfoEmoji, utils.Cyan, schedule.Next(time.Now()).Format(time.RFC3339), utils.Reset)
+	}))
+
+	fmt.Fprintf(utils.StatusOutput, "%s %s%sRunning scheduled backups, next at %s%s\n",
+		utils.StartEmoji, utils.Blue, utils.Bold, schedule.Next(time.Now()).Format(time.RFC3339), utils.Reset)
+	scheduler.Start()
+
+	<-ctx.Done()
+	if running.Load() {
+		fmt.Fprintf(utils.StatusOutput, "%s %sStopping after the running backup%s\n",
+			utils.InfoEmoji, utils.Cyan, utils.Reset)
+	}
+	<-scheduler.Stop().Done()
+}
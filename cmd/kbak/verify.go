@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/sign"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"github.com/rogosprojects/kbak/pkg/utils"
+)
+
+// runVerify checks the files of a backup against its manifest and the
+// signature of the manifest. It returns 1 when anything does not match.
+func runVerify(args []string) int {
+	var outputDir string
+	var keyFile string
+	var storageOpts storage.Options
+
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.StringVar(&outputDir, "output", "backups", "Output directory containing the backup, or s3://, azblob:// or gs://bucket/prefix")
+	flags.StringVar(&keyFile, "key", "", "PEM public key to check the manifest signature with; the signature is required when set")
+	addStorageFlags(flags, &storageOpts)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kbak verify [flags] BACKUP\n\nBACKUP is the backup directory relative to --output, e.g. 2025-01-02T03-04-05Z, or . for a canonical or git backup at the root\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	dir := path.Clean(flags.Arg(0))
+	if dir == "." {
+		dir = ""
+	}
+
+	var verifier *sign.Verifier
+	store, err := storage.Open(outputDir, storageOpts)
+	if err == nil && keyFile != "" {
+		verifier, err = sign.LoadVerifier(keyFile)
+	}
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+		return 1
+	}
+
+	verification, err := backup.VerifyBackup(store, dir)
+	if err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError verifying %s: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, store.Location(dir), err, utils.Reset)
+		return 1
+	}
+
+	problems := 0
+	if verifier != nil {
+		if err := verifySignature(store, path.Join(dir, backup.ManifestFileName), verifier); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sSignature: %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
+			problems++
+		} else {
+			fmt.Fprintf(utils.StatusOutput, "%s%sSignature: valid%s\n",
+				utils.Green, utils.Bold, utils.Reset)
+		}
+	} else if exists, _ := store.Exists(path.Join(dir, backup.SignatureFileName)); exists {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sSignature present but not checked, use --key%s\n",
+			utils.WarningEmoji, utils.Yellow, utils.Bold, utils.Reset)
+	}
+
+	for _, file := range verification.Modified {
+		fmt.Fprintf(utils.StatusOutput, "%sModified: %s%s\n", utils.Red, file.Path, utils.Reset)
+	}
+	for _, file := range verification.Missing {
+		fmt.Fprintf(utils.StatusOutput, "%sMissing:  %s%s\n", utils.Red, file.Path, utils.Reset)
+	}
+	for _, file := range verification.Extra {
+		fmt.Fprintf(utils.StatusOutput, "%sExtra:    %s%s\n", utils.Red, file, utils.Reset)
+	}
+	problems += len(verification.Modified) + len(verification.Missing) + len(verification.Extra)
+
+	if problems > 0 {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sVerification of %s failed: %d modified, %d missing, %d extra files%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, store.Location(dir),
+			len(verification.Modified), len(verification.Missing), len(verification.Extra), utils.Reset)
+		return 1
+	}
+
+	fmt.Fprintf(utils.StatusOutput, "%s %s%sVerified %d files of %s%s\n",
+		utils.SuccessEmoji, utils.Green, utils.Bold, verification.Verified, store.Location(dir), utils.Reset)
+	return 0
+}
+
+// verifySignature checks the signature of the manifest or snapshot index at manifestPath
+func verifySignature(store storage.Storage, manifestPath string, verifier *sign.Verifier) error {
+	signature, err := store.Read(manifestPath + backup.SignatureExtension)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("missing %s", path.Base(manifestPath)+backup.SignatureExtension)
+	}
+	if err != nil {
+		return err
+	}
+	data, err := store.Read(manifestPath)
+	if err != nil {
+		return err
+	}
+	return verifier.Verify(data, signature)
+}
@@ -0,0 +1,202 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"github.com/rogosprojects/kbak/pkg/storage"
+
+	"sigs.k8s.io/yaml"
+)
+
+// ObjectKey identifies a backed-up object
+type ObjectKey struct {
+	Namespace string
+	Kind      string
+	Name      string
+}
+
+// String returns the key as namespace/Kind/name, or Kind/name when the
+// object is cluster-scoped
+func (k ObjectKey) String() string {
+	if k.Namespace == "" {
+		return k.Kind + "/" + k.Name
+	}
+	return k.Namespace + "/" + k.Kind + "/" + k.Name
+}
+
+// IsArchive checks if a storage path names a backup archive by its extension
+func IsArchive(name string) bool {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenBackup returns the storage and directory of the backup at the storage
+// path name: the directory itself, or the content of an archive read into
+// memory. Archives may hold the backup at their root or in one directory.
+func OpenBackup(store storage.Storage, name string) (storage.Storage, string, error) {
+	name = path.Clean(name)
+	if name == "." {
+		name = ""
+	}
+	if !IsArchive(name) {
+		return store, name, nil
+	}
+
+	data, err := store.Read(name)
+	if err != nil {
+		return nil, "", err
+	}
+	archive := storage.NewMemory(store.Location(name))
+	if strings.HasSuffix(name, ".zip") {
+		err = readZip(data, archive)
+	} else {
+		err = readTar(data, strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz"), archive)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading archive %s: %v", store.Location(name), err)
+	}
+
+	// The shallowest manifest marks the backup directory
+	files, err := archive.List("")
+	if err != nil {
+		return nil, "", err
+	}
+	dir := ""
+	found := false
+	for _, file := range files {
+		if path.Base(file) != ManifestFileName {
+			continue
+		}
+		candidate := path.Dir(file)
+		if candidate == "." {
+			candidate = ""
+		}
+		if !found || strings.Count(candidate, "/") < strings.Count(dir, "/") || candidate == "" {
+			dir, found = candidate, true
+		}
+	}
+	if !found {
+		return nil, "", fmt.Errorf("archive %s contains no %s", store.Location(name), ManifestFileName)
+	}
+	return archive, dir, nil
+}
+
+// archivePath validates the name of a file in an archive
+func archivePath(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(name, "./"))
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid path %q in archive", name)
+	}
+	return cleaned, nil
+}
+
+// readTar writes the regular files of a tar archive to the storage
+func readTar(data []byte, compressed bool, store storage.Storage) error {
+	var r io.Reader = bytes.NewReader(data)
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = gz
+	}
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name, err := archivePath(header.Name)
+		if err != nil {
+			return err
+		}
+		fileData, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := store.Write(name, fileData); err != nil {
+			return err
+		}
+	}
+}
+
+// readZip writes the regular files of a zip archive to the storage
+func readZip(data []byte, store storage.Storage) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range zr.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		name, err := archivePath(file.Name)
+		if err != nil {
+			return err
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+		fileData, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := store.Write(name, fileData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadObjects returns the plain manifests of every object of the backup in
+// the storage directory dir, resolving incremental backups and decrypting
+// encrypted files. The manifest is the one of the backup itself.
+func ReadObjects(store storage.Storage, dir string, decryptor *encrypt.Decryptor) (*Manifest, map[ObjectKey][]byte, error) {
+	state, err := ResolveState(store, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	objects := make(map[ObjectKey][]byte, len(state.Files))
+	for _, file := range state.sortedFiles() {
+		data, err := ReadFile(store, file.Dir, file.ManifestFile, decryptor)
+		if err != nil {
+			return nil, nil, err
+		}
+		objects[ObjectKey{Namespace: file.Namespace, Kind: file.Kind, Name: file.Name}] = data
+	}
+
+	return state.Manifest, objects, nil
+}
+
+// ParseObject parses the YAML manifest of an object
+func ParseObject(data []byte) (map[string]interface{}, error) {
+	var obj map[string]interface{}
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
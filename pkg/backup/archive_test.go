@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// archiveFiles returns the files of a backup with a ConfigMap and a Secret
+func archiveFiles(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	objects := []struct {
+		kind, name, content string
+	}{
+		{"ConfigMap", "a", "data:\n  a: \"1\"\n"},
+		{"Secret", "b", "data:\n  b: MQ==\n"},
+	}
+	files := map[string][]byte{}
+	manifest := &Manifest{Namespaces: map[string]NamespaceSummary{}}
+	for _, obj := range objects {
+		filePath := "default/" + obj.kind + "/" + obj.name + ".yaml"
+		files[dir+filePath] = []byte(obj.content)
+		file := manifestFile(filePath, obj.kind, []byte(obj.content))
+		file.Namespace, file.Name = "default", obj.name
+		manifest.Files = append(manifest.Files, file)
+	}
+	data, err := manifest.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+	files[dir+ManifestFileName] = data
+	return files
+}
+
+func TestOpenBackupArchives(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+
+	var tarData bytes.Buffer
+	gz := gzip.NewWriter(&tarData)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "prod-2025-01-01T00-00-00Z/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, data := range archiveFiles(t, "prod-2025-01-01T00-00-00Z/") {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	tw.Close()
+	gz.Close()
+	store.Write("prod-2025-01-01T00-00-00Z.tar.gz", tarData.Bytes())
+
+	var zipData bytes.Buffer
+	zw := zip.NewWriter(&zipData)
+	for name, data := range archiveFiles(t, "") {
+		w, _ := zw.Create(name)
+		w.Write(data)
+	}
+	zw.Close()
+	store.Write("prod.zip", zipData.Bytes())
+
+	for _, name := range []string{"prod-2025-01-01T00-00-00Z.tar.gz", "prod.zip"} {
+		archive, dir, err := OpenBackup(store, name)
+		if err != nil {
+			t.Fatalf("OpenBackup(%s) returned error: %v", name, err)
+		}
+		_, objects, err := ReadObjects(archive, dir, nil)
+		if err != nil {
+			t.Fatalf("ReadObjects(%s) returned error: %v", name, err)
+		}
+		secret := objects[ObjectKey{Namespace: "default", Kind: "Secret", Name: "b"}]
+		if len(objects) != 2 || string(secret) != "data:\n  b: MQ==\n" {
+			t.Errorf("Expected 2 objects in %s, got %v", name, objects)
+		}
+	}
+}
+
+func TestOpenBackupInvalidArchives(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+
+	var tarData bytes.Buffer
+	tw := tar.NewWriter(&tarData)
+	tw.WriteHeader(&tar.Header{Name: "../escape.yaml", Typeflag: tar.TypeReg, Mode: 0644, Size: 2})
+	tw.Write([]byte("x\n"))
+	tw.Close()
+	store.Write("escape.tar", tarData.Bytes())
+
+	var zipData bytes.Buffer
+	zw := zip.NewWriter(&zipData)
+	w, _ := zw.Create("default/ConfigMap/a.yaml")
+	w.Write([]byte("a: 1\n"))
+	zw.Close()
+	store.Write("no-manifest.zip", zipData.Bytes())
+
+	for _, name := range []string{"escape.tar", "no-manifest.zip", "missing.tgz"} {
+		if _, _, err := OpenBackup(store, name); err == nil {
+			t.Errorf("Expected error opening %s", name)
+		}
+	}
+}
@@ -1,13 +1,21 @@
 package backup
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"os"
+	"io"
 	"path/filepath"
 	"strings"
 
 	"github.com/rogosprojects/kbak/pkg/client"
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"github.com/rogosprojects/kbak/pkg/redact"
 	"github.com/rogosprojects/kbak/pkg/resources"
+	"github.com/rogosprojects/kbak/pkg/sops"
+	"github.com/rogosprojects/kbak/pkg/storage"
 	"github.com/rogosprojects/kbak/pkg/utils"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -20,6 +28,49 @@ type BackupStats struct {
 	ErrorCount        int
 	ResourcesBackedUp map[string]int
 	ResourceErrors    map[string]int
+	Files             []FileRecord
+	// Unchanged holds the paths, relative to the backup directory, of the
+	// files an incremental backup left out because the previous state holds them
+	Unchanged []string
+	// WrittenBytes is the size of the files written to the storage, without
+	// files left untouched in canonical mode and objects the repository held
+	WrittenBytes int64
+	// NewObjects counts the objects stored in the repository that it did not
+	// hold yet
+	NewObjects int
+}
+
+// FileRecord describes a file written during a backup operation
+type FileRecord struct {
+	// Path is the storage path of the file
+	Path      string
+	Namespace string
+	Kind      string
+	Name      string
+	Size      int64
+	SHA256    string
+	// Encryption is the format the file is encrypted with, empty when plain
+	Encryption string
+}
+
+// secretKinds are the kinds whose files may contain credentials
+var secretKinds = map[string]bool{
+	"Secret":         true,
+	"ServiceAccount": true,
+}
+
+// IsSecretKind checks if files of a kind may contain credentials. They are
+// written with the secret permissions of the storage.
+func IsSecretKind(kind string) bool {
+	return secretKinds[kind]
+}
+
+// writeFile stores a file of an object of the given kind
+func writeFile(store storage.Storage, filename, kind string, data []byte) error {
+	if IsSecretKind(kind) {
+		return storage.WriteSecret(store, filename, data)
+	}
+	return store.Write(filename, data)
 }
 
 // NewBackupStats creates and initializes a new BackupStats object
@@ -32,24 +83,60 @@ func NewBackupStats() *BackupStats {
 	}
 }
 
+// Options controls how a backup is performed
+type Options struct {
+	// SelectedTypes limits the backup to these lowercase kinds; empty means all
+	SelectedTypes map[string]bool
+	// Canonical sorts well-known lists, names unnamed objects by content and
+	// leaves files untouched when their content did not change
+	Canonical bool
+	// Stdout, when set, receives every object as a YAML document instead of
+	// writing files
+	Stdout io.Writer
+	// Encryptor, when set, encrypts Secret manifests, or every manifest with
+	// EncryptAll. Encrypted files get the extension of the encryption format.
+	Encryptor  *encrypt.Encryptor
+	EncryptAll bool
+	// SOPS, when set, writes Secret manifests in the sops format instead:
+	// values of data and stringData are encrypted, everything else stays
+	// readable and the file keeps its .yaml extension
+	SOPS *sops.Encryptor
+	// Redactor, when set, replaces Secret values and credential-like
+	// environment variables before anything is written
+	Redactor *redact.Redactor
+	// Previous, when set, makes the backup incremental: files identical to
+	// those of the previous backup state are left out. Encrypted files are
+	// always written, as their content differs on every run.
+	Previous *State
+	// Repository, when set, stores files as objects of the repository by
+	// their checksum instead of at their path; the path is only recorded
+	Repository *Repository
+	Verbose    bool
+}
+
 // PerformBackup performs the backup of resources in the specified namespace
+// Files are written to the storage and paths given by the layout
 // Returns statistics about the backup operation including counts of resources backed up and errors
-func PerformBackup(k8sClient *client.K8sClient, namespace, backupDir string, selectedTypes map[string]bool, verbose bool) (int, int) {
+// Once ctx is done no further resource types are backed up
+func PerformBackup(ctx context.Context, k8sClient *client.K8sClient, namespace string, layout *Layout, opts Options) *BackupStats {
 	stats := NewBackupStats()
-	resourceTypes := resources.GetResourceTypes(selectedTypes)
+	resourceTypes := resources.GetResourceTypes(opts.SelectedTypes)
 
-	if len(resourceTypes) == 0 && verbose {
-		fmt.Printf("%s %s%sWarning: No resource types selected for backup%s\n",
+	if len(resourceTypes) == 0 && opts.Verbose {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: No resource types selected for backup%s\n",
 			utils.WarningEmoji, utils.Yellow, utils.Bold, utils.Reset)
-		return 0, 0
+		return stats
 	}
 
 	// Backup each resource type
 	for _, resource := range resourceTypes {
-		backupResourceType(k8sClient, namespace, backupDir, resource, stats, verbose)
+		if ctx.Err() != nil {
+			break
+		}
+		backupResourceType(k8sClient, namespace, layout, resource, stats, opts)
 	}
 
-	return stats.ResourceCount, stats.ErrorCount
+	return stats
 }
 
 // ensureValidFilename sanitizes a resource name to ensure it's a valid filename
@@ -101,8 +188,9 @@ func ensureValidFilename(name string) string {
 }
 
 // backupResourceType handles the backup of a single resource type
-func backupResourceType(k8sClient *client.K8sClient, namespace, backupDir string,
-	resource resources.ResourceType, stats *BackupStats, verbose bool) {
+func backupResourceType(k8sClient *client.K8sClient, namespace string, layout *Layout,
+	resource resources.ResourceType, stats *BackupStats, opts Options) {
+	verbose := opts.Verbose
 
 	var objects interface{}
 	var err error
@@ -114,16 +202,16 @@ func backupResourceType(k8sClient *client.K8sClient, namespace, backupDir string
 		// Check if this is a "resource not found" type of error
 		if resources.IsNotFoundError(err) {
 			if verbose {
-				fmt.Printf("%s %sResource type %s not available in the cluster, skipping%s\n",
+				fmt.Fprintf(utils.StatusOutput, "%s %sResource type %s not available in the cluster, skipping%s\n",
 					utils.SkippedEmoji, utils.Cyan, resource.Kind, utils.Reset)
 			}
 		} else {
-			fmt.Printf("%s %s%sError listing %s: %v%s\n",
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError listing %s: %v%s\n",
 				utils.ErrorEmoji, utils.Red, utils.Bold, resource.Kind, err, utils.Reset)
 			if verbose {
-				fmt.Printf("%sDebug info - API endpoint: %s%s\n",
+				fmt.Fprintf(utils.StatusOutput, "%sDebug info - API endpoint: %s%s\n",
 					utils.BrightBlue, k8sClient.Config.Host, utils.Reset)
-				fmt.Printf("%sDebug info - Resource: %s in namespace %s%s\n",
+				fmt.Fprintf(utils.StatusOutput, "%sDebug info - Resource: %s in namespace %s%s\n",
 					utils.BrightBlue, resource.Kind, namespace, utils.Reset)
 			}
 			stats.ErrorCount++
@@ -134,14 +222,14 @@ func backupResourceType(k8sClient *client.K8sClient, namespace, backupDir string
 
 	// Debug the response from the API
 	if verbose {
-		fmt.Printf("%sResponse type for %s: %T%s\n",
+		fmt.Fprintf(utils.StatusOutput, "%sResponse type for %s: %T%s\n",
 			utils.BrightBlue, resource.Kind, objects, utils.Reset)
 	}
 
 	// Extract items from the list
 	items, itemCount := utils.ExtractItems(objects)
 	if verbose {
-		fmt.Printf("%s%sFound %d %s resources in namespace %s%s\n",
+		fmt.Fprintf(utils.StatusOutput, "%s%sFound %d %s resources in namespace %s%s\n",
 			utils.InfoEmoji, utils.Cyan, itemCount, resource.Kind, namespace, utils.Reset)
 	}
 	if itemCount == 0 {
@@ -155,16 +243,6 @@ func backupResourceType(k8sClient *client.K8sClient, namespace, backupDir string
 		objects = nil
 	}()
 
-	// Create directory for this resource kind
-	kindDir := filepath.Join(backupDir, resource.Kind)
-	if err := os.MkdirAll(kindDir, 0755); err != nil {
-		fmt.Printf("%s %s%sError creating directory for %s: %v%s\n",
-			utils.ErrorEmoji, utils.Red, utils.Bold, resource.Kind, err, utils.Reset)
-		stats.ErrorCount++
-		stats.ResourceErrors[resource.Kind]++
-		return
-	}
-
 	itemsBackedUp := 0
 	for i, item := range items {
 		if item == nil {
@@ -172,40 +250,148 @@ func backupResourceType(k8sClient *client.K8sClient, namespace, backupDir string
 		}
 
 		name := utils.ExtractName(item)
+
+		// Remove cluster-specific and runtime fields
+		utils.CleanObject(item)
+		if opts.Redactor != nil {
+			opts.Redactor.Redact(item)
+		}
+		if opts.Canonical {
+			utils.CanonicalizeObject(item)
+		}
+
+		// Convert to YAML
+		yamlData, err := yaml.Marshal(item)
+		if err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError marshaling %s '%s': %v%s\n",
+				utils.ErrorEmoji, utils.Red, utils.Bold, resource.Kind, name, err, utils.Reset)
+			stats.ErrorCount++
+			stats.ResourceErrors[resource.Kind]++
+			continue
+		}
+		checksum := sha256.Sum256(yamlData)
+
 		if name == "" {
-			name = fmt.Sprintf("unknown-%d", i)
+			if opts.Canonical {
+				// List positions change between runs, content does not
+				name = "unknown-" + hex.EncodeToString(checksum[:6])
+			} else {
+				name = fmt.Sprintf("unknown-%d", i)
+			}
 		}
 
 		// Ensure the filename is valid for the filesystem
 		safeName := ensureValidFilename(name)
 		if safeName != name && verbose {
-			fmt.Printf("%sResource name %q sanitized to %q for filesystem compatibility%s\n",
+			fmt.Fprintf(utils.StatusOutput, "%sResource name %q sanitized to %q for filesystem compatibility%s\n",
 				utils.BrightBlue, name, safeName, utils.Reset)
 		}
 
-		// Remove cluster-specific and runtime fields
-		utils.CleanObject(item)
+		// Stream to stdout as a multi-document YAML instead of writing files
+		if opts.Stdout != nil {
+			if _, err := fmt.Fprintf(opts.Stdout, "---\n%s", yamlData); err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError writing %s '%s' to stdout: %v%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, resource.Kind, name, err, utils.Reset)
+				stats.ErrorCount++
+				stats.ResourceErrors[resource.Kind]++
+				continue
+			}
+			itemsBackedUp++
+			continue
+		}
 
-		// Convert to YAML
-		yamlData, err := yaml.Marshal(item)
+		// Resolve the target path from the layout
+		filename, err := layout.ObjectPath(namespace, resource.Kind, safeName)
 		if err != nil {
-			fmt.Printf("%s %s%sError marshaling %s '%s': %v%s\n",
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError resolving path for %s '%s': %v%s\n",
 				utils.ErrorEmoji, utils.Red, utils.Bold, resource.Kind, name, err, utils.Reset)
 			stats.ErrorCount++
 			stats.ResourceErrors[resource.Kind]++
 			continue
 		}
 
-		// Save to file
-		filename := filepath.Join(kindDir, safeName+".yaml")
-		if err := os.WriteFile(filename, yamlData, 0644); err != nil {
-			fmt.Printf("%s %s%sError writing %s '%s': %v%s\n",
+		// Encrypt before anything touches the storage
+		data := yamlData
+		encryption := ""
+		if opts.SOPS != nil && resource.Kind == "Secret" {
+			data, err = opts.SOPS.EncryptYAML(yamlData)
+			if err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError encrypting %s '%s' with sops: %v%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, resource.Kind, name, err, utils.Reset)
+				stats.ErrorCount++
+				stats.ResourceErrors[resource.Kind]++
+				continue
+			}
+			encryption = sops.Format
+		} else if opts.Encryptor != nil && (opts.EncryptAll || resource.Kind == "Secret") {
+			data, err = opts.Encryptor.Encrypt(yamlData)
+			if err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError encrypting %s '%s': %v%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, resource.Kind, name, err, utils.Reset)
+				stats.ErrorCount++
+				stats.ResourceErrors[resource.Kind]++
+				continue
+			}
+			filename += opts.Encryptor.Extension()
+			encryption = opts.Encryptor.Format()
+		}
+		fileChecksum := sha256.Sum256(data)
+
+		// Leave out files the previous backup state already holds
+		if opts.Previous != nil && encryption == "" {
+			relPath := strings.TrimPrefix(filename, layout.RunDir()+"/")
+			if opts.Previous.Holds(relPath, hex.EncodeToString(fileChecksum[:])) {
+				if verbose {
+					fmt.Fprintf(utils.StatusOutput, "%s%s '%s' is unchanged%s\n",
+						utils.BrightBlue, resource.Kind, name, utils.Reset)
+				}
+				stats.Unchanged = append(stats.Unchanged, relPath)
+				itemsBackedUp++
+				continue
+			}
+		}
+
+		// Save to storage, leaving identical files untouched in canonical mode
+		written := true
+		if opts.Repository != nil {
+			added, err := opts.Repository.Put(resource.Kind, data)
+			if err != nil {
+				fmt.Fprintf(utils.StatusOutput, "%s %s%sError storing %s '%s' in the repository: %v%s\n",
+					utils.ErrorEmoji, utils.Red, utils.Bold, resource.Kind, name, err, utils.Reset)
+				stats.ErrorCount++
+				stats.ResourceErrors[resource.Kind]++
+				continue
+			}
+			if added {
+				stats.NewObjects++
+			}
+			written = added
+		} else if opts.Canonical && hasContent(layout.Storage, filename, data) {
+			if verbose {
+				fmt.Fprintf(utils.StatusOutput, "%s%s '%s' is unchanged%s\n",
+					utils.BrightBlue, resource.Kind, name, utils.Reset)
+			}
+			written = false
+		} else if err := writeFile(layout.Storage, filename, resource.Kind, data); err != nil {
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError writing %s '%s': %v%s\n",
 				utils.ErrorEmoji, utils.Red, utils.Bold, resource.Kind, name, err, utils.Reset)
 			stats.ErrorCount++
 			stats.ResourceErrors[resource.Kind]++
 			continue
 		}
 
+		stats.Files = append(stats.Files, FileRecord{
+			Path:       filename,
+			Namespace:  namespace,
+			Kind:       resource.Kind,
+			Name:       name,
+			Size:       int64(len(data)),
+			SHA256:     hex.EncodeToString(fileChecksum[:]),
+			Encryption: encryption,
+		})
+		if written {
+			stats.WrittenBytes += int64(len(data))
+		}
 		itemsBackedUp++
 	}
 
@@ -216,9 +402,18 @@ func backupResourceType(k8sClient *client.K8sClient, namespace, backupDir string
 	items = nil
 
 	if itemsBackedUp > 0 {
-		fmt.Printf("%s%sBacked up %d %s resources%s\n",
+		fmt.Fprintf(utils.StatusOutput, "%s%sBacked up %d %s resources%s\n",
 			utils.Green, utils.Bold, itemsBackedUp, resource.Kind, utils.Reset)
 		stats.ResourceCount += itemsBackedUp
 		stats.ResourcesBackedUp[resource.Kind] = itemsBackedUp
 	}
 }
+
+// hasContent checks if the file exists in the storage and contains exactly data
+func hasContent(store storage.Storage, filename string, data []byte) bool {
+	existing, err := store.Read(filename)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(existing, data)
+}
@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"github.com/rogosprojects/kbak/pkg/sops"
+	"github.com/rogosprojects/kbak/pkg/storage"
+
+	"sigs.k8s.io/yaml"
+)
+
+// ReadFile returns the plain content of a file of the backup in the storage
+// directory dir, decrypting it when it is encrypted
+func ReadFile(store storage.Storage, dir string, file ManifestFile, decryptor *encrypt.Decryptor) ([]byte, error) {
+	filename, err := resolveManifestPath(dir, file.Path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := store.Read(filename)
+	if err != nil {
+		return nil, err
+	}
+	if file.Encryption == "" {
+		return data, nil
+	}
+
+	if decryptor == nil {
+		return nil, fmt.Errorf("%s is encrypted with %s, an identity is required", file.Path, file.Encryption)
+	}
+	if file.Encryption == sops.Format {
+		return readSOPSFile(file.Path, data, decryptor)
+	}
+	plaintext, err := decryptor.Decrypt(file.Encryption, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file.Path, err)
+	}
+	return plaintext, nil
+}
+
+// readSOPSFile decrypts a sops file and formats it like the manifests kbak
+// writes, so it matches the manifest as it was before encryption
+func readSOPSFile(filename string, data []byte, decryptor *encrypt.Decryptor) ([]byte, error) {
+	plaintext, err := sops.DecryptYAML(data, decryptor)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	jsonData, err := yaml.YAMLToJSON(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return yaml.JSONToYAML(jsonData)
+}
+
+// DecryptBackup writes a decrypted copy of the backup in the storage
+// directory dir to destDir of dest. Encrypted files lose their encryption
+// extension and the manifest of the copy describes the plain files.
+// Attachments are copied as they are.
+func DecryptBackup(store storage.Storage, dir string, dest storage.Storage, destDir string, decryptor *encrypt.Decryptor) (*Manifest, error) {
+	manifest, err := ReadManifest(store, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading backup manifest: %v", err)
+	}
+
+	for i, file := range manifest.Files {
+		data, err := ReadFile(store, dir, file, decryptor)
+		if err != nil {
+			return nil, err
+		}
+
+		if file.Encryption != "" {
+			file.Path = strings.TrimSuffix(strings.TrimSuffix(file.Path, encrypt.AgeExtension), encrypt.PGPExtension)
+			checksum := sha256.Sum256(data)
+			file.Size = int64(len(data))
+			file.SHA256 = hex.EncodeToString(checksum[:])
+			file.Encryption = ""
+		}
+		if err := writeFile(dest, path.Join(destDir, file.Path), file.Kind, data); err != nil {
+			return nil, err
+		}
+		manifest.Files[i] = file
+	}
+	for _, file := range manifest.Attachments {
+		filename, err := resolveManifestPath(dir, file.Path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := store.Read(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := dest.Write(path.Join(destDir, file.Path), data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := manifest.Write(dest, destDir); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"github.com/rogosprojects/kbak/pkg/sops"
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+func TestDecryptBackup(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity returned error: %v", err)
+	}
+	identityFile := filepath.Join(t.TempDir(), "key.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	encryptor, err := encrypt.NewEncryptor([]string{identity.Recipient().String()}, nil)
+	if err != nil {
+		t.Fatalf("NewEncryptor returned error: %v", err)
+	}
+	decryptor, err := encrypt.NewDecryptor([]string{identityFile}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewDecryptor returned error: %v", err)
+	}
+
+	store := storage.NewLocal(t.TempDir())
+	ciphertext, err := encryptor.Encrypt([]byte("kind: Secret\n"))
+	if err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+	store.Write("run/default/Secret/s.yaml.age", ciphertext)
+	store.Write("run/default/ConfigMap/c.yaml", []byte("kind: ConfigMap\n"))
+
+	manifest := &Manifest{
+		Namespaces: map[string]NamespaceSummary{},
+		Files: []ManifestFile{
+			{Path: "default/ConfigMap/c.yaml", Namespace: "default", Kind: "ConfigMap", Name: "c"},
+			{Path: "default/Secret/s.yaml.age", Namespace: "default", Kind: "Secret", Name: "s", Encryption: encrypt.FormatAge},
+		},
+	}
+	if err := manifest.AddAttachment(store, "run", "kbak-redactions.json", []byte("[]\n")); err != nil {
+		t.Fatalf("AddAttachment returned error: %v", err)
+	}
+	if err := manifest.Write(store, "run"); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	if _, err := ReadFile(store, "run", manifest.Files[1], nil); err == nil {
+		t.Errorf("Expected error reading an encrypted file without identity")
+	}
+
+	decrypted, err := DecryptBackup(store, "run", store, "plain", decryptor)
+	if err != nil {
+		t.Fatalf("DecryptBackup returned error: %v", err)
+	}
+	secret := decrypted.Files[1]
+	if secret.Path != "default/Secret/s.yaml" || secret.Encryption != "" || secret.Size != int64(len("kind: Secret\n")) {
+		t.Errorf("Unexpected decrypted manifest entry %+v", secret)
+	}
+	data, err := store.Read("plain/default/Secret/s.yaml")
+	if err != nil || string(data) != "kind: Secret\n" {
+		t.Errorf("Unexpected decrypted content %q, %v", data, err)
+	}
+	if _, err := ReadManifest(store, "plain"); err != nil {
+		t.Errorf("Expected manifest in decrypted copy: %v", err)
+	}
+	verification, err := VerifyBackup(store, "plain")
+	if err != nil {
+		t.Fatalf("VerifyBackup returned error: %v", err)
+	}
+	if len(verification.Missing) != 0 {
+		t.Errorf("Expected the attachments in the decrypted copy, got %v missing", verification.Missing)
+	}
+}
+
+func TestReadFileSOPS(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity returned error: %v", err)
+	}
+	identityFile := filepath.Join(t.TempDir(), "key.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	encryptor, err := sops.NewEncryptor([]string{identity.Recipient().String()}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewEncryptor returned error: %v", err)
+	}
+	decryptor, err := encrypt.NewDecryptor([]string{identityFile}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewDecryptor returned error: %v", err)
+	}
+
+	// Manifests are written by sigs.k8s.io/yaml, decrypted files must match them
+	plain := "apiVersion: v1\ndata:\n  password: c2VjcmV0\nkind: Secret\nmetadata:\n  annotations:\n    enabled: \"true\"\n  name: s\ntype: Opaque\n"
+	encrypted, err := encryptor.EncryptYAML([]byte(plain))
+	if err != nil {
+		t.Fatalf("EncryptYAML returned error: %v", err)
+	}
+	store := storage.NewLocal(t.TempDir())
+	store.Write("run/default/Secret/s.yaml", encrypted)
+
+	file := ManifestFile{Path: "default/Secret/s.yaml", Kind: "Secret", Name: "s", Encryption: sops.Format}
+	data, err := ReadFile(store, "run", file, decryptor)
+	if err != nil {
+		t.Fatalf("ReadFile returned error: %v", err)
+	}
+	if string(data) != plain {
+		t.Errorf("ReadFile =\n%s\nwant\n%s", data, plain)
+	}
+}
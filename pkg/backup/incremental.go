@@ -0,0 +1,279 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// State is the full content of a backup: for an incremental backup, the
+// full backup it builds on with every increment of the chain applied
+type State struct {
+	// Manifest is the manifest of the resolved backup
+	Manifest *Manifest
+	// Chain holds the storage directories of the backups, from the full
+	// backup to the resolved one
+	Chain []string
+	// Files maps the path of every object file, relative to the backup
+	// directory, to its entry
+	Files map[string]StateFile
+}
+
+// StateFile is an object file of a State
+type StateFile struct {
+	ManifestFile
+	// Dir is the storage directory of the backup holding the file
+	Dir string
+}
+
+// ResolveState reads the manifest of the backup in the storage directory
+// dir and those of the backups it builds on, and applies their files and
+// tombstones in order
+func ResolveState(store storage.Storage, dir string) (*State, error) {
+	var manifests []*Manifest
+	var dirs []string
+	visited := make(map[string]bool)
+	for d := dir; ; {
+		if visited[d] {
+			return nil, fmt.Errorf("the parent backups of %s form a loop", store.Location(dir))
+		}
+		visited[d] = true
+
+		m, err := ReadManifest(store, d)
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest of %s: %v", store.Location(d), err)
+		}
+		manifests = append(manifests, m)
+		dirs = append(dirs, d)
+		if m.Parent == "" {
+			break
+		}
+		if d, err = parentDir(d, m.Parent); err != nil {
+			return nil, err
+		}
+	}
+
+	state := &State{Manifest: manifests[0], Files: make(map[string]StateFile)}
+	for i := len(manifests) - 1; i >= 0; i-- {
+		state.Chain = append(state.Chain, dirs[i])
+		for _, file := range manifests[i].Tombstones {
+			delete(state.Files, path.Clean(file.Path))
+		}
+		for _, file := range manifests[i].Files {
+			state.Files[path.Clean(file.Path)] = StateFile{ManifestFile: file, Dir: dirs[i]}
+		}
+	}
+
+	return state, nil
+}
+
+// parentDir returns the storage directory of the parent of the backup in dir.
+// Parents are sibling directories, so the chain survives moving the series.
+// The directories below the timestamped one, e.g. all-namespaces, are the
+// same in the parent.
+func parentDir(dir, parent string) (string, error) {
+	if dir == "" || parent == "." || parent == ".." || strings.ContainsAny(parent, "/\\") {
+		return "", fmt.Errorf("invalid parent backup %q of %s", parent, dir)
+	}
+	series, _, below := splitBackupDir(dir)
+	return path.Join(series, parent, below), nil
+}
+
+// BackupName returns the name of the timestamped directory of the backup in
+// dir, the Parent of the incremental backups building on it
+func BackupName(dir string) string {
+	_, name, _ := splitBackupDir(dir)
+	return name
+}
+
+// splitBackupDir splits the storage directory of a backup at its timestamped
+// directory, as found by FindBackups. Without one the last directory is taken.
+func splitBackupDir(dir string) (series, name, below string) {
+	segments := strings.Split(dir, "/")
+	for i, segment := range segments {
+		if _, _, archive, ok := parseBackupName(segment); ok && !archive {
+			return strings.Join(segments[:i], "/"), segment, strings.Join(segments[i+1:], "/")
+		}
+	}
+	return path.Dir(dir), path.Base(dir), ""
+}
+
+// Holds checks if the state has a file at the relative path with the given checksum
+func (s *State) Holds(filePath, sha256 string) bool {
+	file, ok := s.Files[filePath]
+	return ok && file.SHA256 == sha256
+}
+
+// Find returns the file of the object with the given key
+func (s *State) Find(key ObjectKey) (StateFile, bool) {
+	for _, file := range s.Files {
+		if file.Namespace == key.Namespace && file.Kind == key.Kind && file.Name == key.Name {
+			return file, true
+		}
+	}
+	return StateFile{}, false
+}
+
+// sortedFiles returns the files of the state ordered by path
+func (s *State) sortedFiles() []StateFile {
+	files := make([]StateFile, 0, len(s.Files))
+	for _, file := range s.Files {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
+// Tombstones returns the files of the previous state that the current
+// incremental run neither wrote nor found unchanged, i.e. files of deleted
+// objects. unchanged holds the paths, relative to the backup directory, of
+// the files the run left out. The namespaces and kinds considered are those
+// of RemoveStaleFiles.
+func Tombstones(previous *State, current *Manifest, unchanged []string, kinds []string) []ManifestFile {
+	seen := make(map[string]bool, len(current.Files)+len(unchanged))
+	for _, file := range current.Files {
+		seen[file.Path] = true
+	}
+	for _, file := range unchanged {
+		seen[file] = true
+	}
+
+	var files []ManifestFile
+	for _, file := range previous.sortedFiles() {
+		files = append(files, file.ManifestFile)
+	}
+	return staleFiles(files, current, seen, kinds)
+}
+
+// LatestCompleteBackup returns the newest complete backup directory of the
+// series, the directory containing the backups, made with the same selection
+// as filters, or nil when there is none. Backups of other namespaces or
+// resource types in the same series are skipped, as the objects they lack
+// would be recorded as deleted.
+func LatestCompleteBackup(store storage.Storage, series string, filters ManifestFilters) (*StoredBackup, error) {
+	backups, err := FindBackups(store)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range backups {
+		if !b.Complete || b.Archive || b.Series() != series {
+			continue
+		}
+		manifest, err := ReadManifest(store, b.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.Filters.SameSelection(filters) {
+			return &b, nil
+		}
+	}
+	return nil, nil
+}
+
+// Materialize writes the full content of the backup in the storage directory
+// dir to targetDir of the target storage: the object files of its state and
+// its attachments, checked against their checksums, and a manifest without
+// parent. The manifest is written last, so the copy is complete only when
+// every file was copied.
+func Materialize(store storage.Storage, dir string, target storage.Storage, targetDir string) (*State, error) {
+	state, err := ResolveState(store, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments []StateFile
+	for _, file := range state.Manifest.Attachments {
+		attachments = append(attachments, StateFile{ManifestFile: file, Dir: dir})
+	}
+	files := state.sortedFiles()
+	for _, file := range append(files, attachments...) {
+		filename, err := resolveManifestPath(file.Dir, file.Path)
+		if err != nil {
+			return nil, err
+		}
+		if err := copyFile(store, filename, target, targetDir, file.ManifestFile); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest := *state.Manifest
+	manifest.Parent = ""
+	manifest.Tombstones = nil
+	manifest.Files = make([]ManifestFile, 0, len(files))
+	for _, file := range files {
+		manifest.Files = append(manifest.Files, file.ManifestFile)
+	}
+	if err := manifest.Write(target, targetDir); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// copyFile copies the file at the storage path source to the path of the
+// manifest entry in targetDir of the target storage, checking its checksum
+func copyFile(store storage.Storage, source string, target storage.Storage, targetDir string, file ManifestFile) error {
+	data, err := store.Read(source)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", store.Location(source), err)
+	}
+	checksum := sha256.Sum256(data)
+	if hex.EncodeToString(checksum[:]) != file.SHA256 {
+		return fmt.Errorf("%s does not match its checksum in the manifest", store.Location(source))
+	}
+
+	targetFile, err := resolveManifestPath(targetDir, file.Path)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(target, targetFile, file.Kind, data); err != nil {
+		return fmt.Errorf("error writing %s: %v", target.Location(targetFile), err)
+	}
+	return nil
+}
+
+// KeepBases keeps the backups that kept incremental backups build on, so
+// pruning never breaks a chain. decisions must be ordered newest first, as
+// returned by RetentionPolicy.Apply.
+func KeepBases(store storage.Storage, decisions []PruneDecision) error {
+	// Parents are found by the directory of their manifest
+	index := make(map[string]int, len(decisions))
+	for i, decision := range decisions {
+		index[decision.Backup.Path] = i
+		if decision.Backup.Dir != "" {
+			index[decision.Backup.Dir] = i
+		}
+	}
+
+	// Parents are older, so they are visited after the backups building on them
+	for _, decision := range decisions {
+		b := decision.Backup
+		if !decision.Keep || !b.Complete || b.Archive {
+			continue
+		}
+		m, err := ReadManifest(store, b.Dir)
+		if err != nil {
+			return fmt.Errorf("error reading manifest of %s: %v", store.Location(b.Dir), err)
+		}
+		if m.Parent == "" {
+			continue
+		}
+		parent, err := parentDir(b.Dir, m.Parent)
+		if err != nil {
+			return err
+		}
+		if j, ok := index[parent]; ok && !decisions[j].Keep {
+			decisions[j].Keep = true
+			decisions[j].Reasons = append(decisions[j].Reasons, "base of "+path.Base(b.Path))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,305 @@
+package backup
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// writeChain writes a full backup and two incremental backups on top of it:
+// the first changes a.yaml and adds c.yaml, the second deletes b.yaml
+func writeChain(t *testing.T, store storage.Storage) {
+	t.Helper()
+	backups := []struct {
+		dir        string
+		parent     string
+		files      map[string]string
+		tombstones []string
+	}{
+		{"prod/2025-01-01T00-00-00Z", "", map[string]string{"a.yaml": "a: 1\n", "b.yaml": "b: 1\n"}, nil},
+		{"prod/2025-01-01T01-00-00Z", "2025-01-01T00-00-00Z", map[string]string{"a.yaml": "a: 2\n", "c.yaml": "c: 1\n"}, nil},
+		{"prod/2025-01-01T02-00-00Z", "2025-01-01T01-00-00Z", nil, []string{"b.yaml"}},
+	}
+
+	for _, b := range backups {
+		manifest := &Manifest{Parent: b.parent, Namespaces: map[string]NamespaceSummary{}, Files: []ManifestFile{}}
+		for name, content := range b.files {
+			if err := store.Write(b.dir+"/"+name, []byte(content)); err != nil {
+				t.Fatalf("Write returned error: %v", err)
+			}
+			manifest.Files = append(manifest.Files, manifestFile(name, "ConfigMap", []byte(content)))
+		}
+		for _, name := range b.tombstones {
+			manifest.Tombstones = append(manifest.Tombstones, ManifestFile{Path: name, Kind: "ConfigMap"})
+		}
+		if err := manifest.Write(store, b.dir); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+	}
+}
+
+func TestResolveState(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	writeChain(t, store)
+
+	state, err := ResolveState(store, "prod/2025-01-01T02-00-00Z")
+	if err != nil {
+		t.Fatalf("ResolveState returned error: %v", err)
+	}
+
+	expectedChain := []string{"prod/2025-01-01T00-00-00Z", "prod/2025-01-01T01-00-00Z", "prod/2025-01-01T02-00-00Z"}
+	if !reflect.DeepEqual(state.Chain, expectedChain) {
+		t.Errorf("Expected chain %v, got %v", expectedChain, state.Chain)
+	}
+	expectedFiles := map[string]string{
+		"a.yaml": "prod/2025-01-01T01-00-00Z",
+		"c.yaml": "prod/2025-01-01T01-00-00Z",
+	}
+	files := make(map[string]string)
+	for name, file := range state.Files {
+		files[name] = file.Dir
+	}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("Expected files %v, got %v", expectedFiles, files)
+	}
+	if !state.Holds("a.yaml", manifestFile("a.yaml", "", []byte("a: 2\n")).SHA256) {
+		t.Errorf("Expected the state to hold the changed a.yaml")
+	}
+	if state.Holds("a.yaml", manifestFile("a.yaml", "", []byte("a: 1\n")).SHA256) {
+		t.Errorf("Expected the state not to hold the original a.yaml")
+	}
+
+	// A missing parent breaks the chain
+	if err := DeleteBackup(store, StoredBackup{Path: "prod/2025-01-01T00-00-00Z"}); err != nil {
+		t.Fatalf("DeleteBackup returned error: %v", err)
+	}
+	if _, err := ResolveState(store, "prod/2025-01-01T02-00-00Z"); err == nil {
+		t.Errorf("Expected error for a missing parent backup")
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	previous := &State{Files: map[string]StateFile{
+		"default/ConfigMap/unchanged.yaml": {ManifestFile: ManifestFile{Path: "default/ConfigMap/unchanged.yaml", Namespace: "default", Kind: "ConfigMap"}},
+		"default/ConfigMap/changed.yaml":   {ManifestFile: ManifestFile{Path: "default/ConfigMap/changed.yaml", Namespace: "default", Kind: "ConfigMap"}},
+		"default/ConfigMap/deleted.yaml":   {ManifestFile: ManifestFile{Path: "default/ConfigMap/deleted.yaml", Namespace: "default", Kind: "ConfigMap"}},
+		"default/Secret/failed.yaml":       {ManifestFile: ManifestFile{Path: "default/Secret/failed.yaml", Namespace: "default", Kind: "Secret"}},
+		"other/ConfigMap/other.yaml":       {ManifestFile: ManifestFile{Path: "other/ConfigMap/other.yaml", Namespace: "other", Kind: "ConfigMap"}},
+	}}
+	current := &Manifest{
+		Namespaces: map[string]NamespaceSummary{
+			"default": {ResourceErrors: map[string]int{"Secret": 1}},
+		},
+		Files: []ManifestFile{
+			{Path: "default/ConfigMap/changed.yaml", Namespace: "default", Kind: "ConfigMap"},
+		},
+	}
+
+	tombstones := Tombstones(previous, current, []string{"default/ConfigMap/unchanged.yaml"}, []string{"ConfigMap", "Secret"})
+	if len(tombstones) != 1 || tombstones[0].Path != "default/ConfigMap/deleted.yaml" {
+		t.Errorf("Expected only deleted.yaml as tombstone, got %v", tombstones)
+	}
+
+	// Namespaces that no longer exist are deleted in all-namespaces runs
+	current.Filters.AllNamespaces = true
+	tombstones = Tombstones(previous, current, []string{"default/ConfigMap/unchanged.yaml"}, []string{"ConfigMap", "Secret"})
+	if len(tombstones) != 2 || tombstones[1].Path != "other/ConfigMap/other.yaml" {
+		t.Errorf("Expected deleted.yaml and other.yaml as tombstones, got %v", tombstones)
+	}
+}
+
+func TestMaterialize(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	writeChain(t, store)
+	target := storage.NewLocal(t.TempDir())
+
+	state, err := Materialize(store, "prod/2025-01-01T02-00-00Z", target, "2025-01-01T02-00-00Z")
+	if err != nil {
+		t.Fatalf("Materialize returned error: %v", err)
+	}
+	if len(state.Chain) != 3 {
+		t.Errorf("Expected a chain of 3 backups, got %v", state.Chain)
+	}
+
+	v, err := VerifyBackup(target, "2025-01-01T02-00-00Z")
+	if err != nil {
+		t.Fatalf("VerifyBackup returned error: %v", err)
+	}
+	if !v.OK() || v.Verified != 2 {
+		t.Errorf("Expected 2 verified files, got %+v", v)
+	}
+	if v.Manifest.Parent != "" || len(v.Manifest.Tombstones) != 0 {
+		t.Errorf("Expected a full manifest, got parent %q and tombstones %v", v.Manifest.Parent, v.Manifest.Tombstones)
+	}
+	data, err := target.Read("2025-01-01T02-00-00Z/a.yaml")
+	if err != nil || string(data) != "a: 2\n" {
+		t.Errorf("Expected the changed a.yaml, got %q (%v)", data, err)
+	}
+
+	// Modified files are not copied
+	store.Write("prod/2025-01-01T01-00-00Z/c.yaml", []byte("c: 2\n"))
+	if _, err := Materialize(store, "prod/2025-01-01T02-00-00Z", target, "copy"); err == nil {
+		t.Errorf("Expected error for a file that does not match its checksum")
+	}
+	if exists, _ := target.Exists("copy/" + ManifestFileName); exists {
+		t.Errorf("Expected no manifest for a failed materialization")
+	}
+}
+
+func TestKeepBases(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	writeChain(t, store)
+	store.Write("prod/2024-12-31T00-00-00Z/"+ManifestFileName, []byte("{}\n"))
+
+	backups, err := FindBackups(store)
+	if err != nil {
+		t.Fatalf("FindBackups returned error: %v", err)
+	}
+	decisions := RetentionPolicy{KeepLast: 1}.Apply(backups, false)
+	if err := KeepBases(store, decisions); err != nil {
+		t.Fatalf("KeepBases returned error: %v", err)
+	}
+
+	var kept []string
+	for _, decision := range decisions {
+		if decision.Keep {
+			kept = append(kept, decision.Backup.Path)
+		}
+	}
+	sort.Strings(kept)
+	expected := []string{"prod/2025-01-01T00-00-00Z", "prod/2025-01-01T01-00-00Z", "prod/2025-01-01T02-00-00Z"}
+	if !reflect.DeepEqual(kept, expected) {
+		t.Errorf("Expected %v to be kept, got %v", expected, kept)
+	}
+}
+
+func TestLatestCompleteBackup(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	writeChain(t, store)
+	store.Write("prod/2025-01-01T03-00-00Z/a.yaml", []byte("incomplete"))
+	store.Write("staging/2025-01-02T00-00-00Z/"+ManifestFileName, []byte("{}\n"))
+
+	latest, err := LatestCompleteBackup(store, "prod", ManifestFilters{})
+	if err != nil {
+		t.Fatalf("LatestCompleteBackup returned error: %v", err)
+	}
+	if latest == nil || latest.Path != "prod/2025-01-01T02-00-00Z" {
+		t.Errorf("Expected prod/2025-01-01T02-00-00Z, got %v", latest)
+	}
+	if latest, _ := LatestCompleteBackup(store, "dev", ManifestFilters{}); latest != nil {
+		t.Errorf("Expected no backup in an empty series, got %v", latest)
+	}
+}
+
+func TestLatestCompleteBackupFilters(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	tmpl, err := ParsePathTemplate(DefaultPathTemplate)
+	if err != nil {
+		t.Fatalf("ParsePathTemplate returned error: %v", err)
+	}
+	layout, _ := NewLayout(store, tmpl, "prod", time.Date(2025, 1, 1, 4, 0, 0, 0, time.UTC))
+
+	// Runs of the namespaces web and shop alternate in the same series
+	runs := []struct {
+		dir     string
+		filters ManifestFilters
+	}{
+		{"2025-01-01T00-00-00Z", ManifestFilters{Namespaces: []string{"web"}}},
+		{"2025-01-01T01-00-00Z", ManifestFilters{Namespaces: []string{"shop"}}},
+		{"2025-01-01T02-00-00Z", ManifestFilters{Namespaces: []string{"web"}, ResourceTypes: []string{"configmaps"}}},
+		{"2025-01-01T03-00-00Z", ManifestFilters{AllNamespaces: true, Namespaces: []string{"shop", "web"}}},
+	}
+	for _, run := range runs {
+		manifest := &Manifest{Filters: run.filters, Namespaces: map[string]NamespaceSummary{}, Files: []ManifestFile{}}
+		if err := manifest.Write(store, run.dir); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		filters  ManifestFilters
+		expected string
+	}{
+		{ManifestFilters{Namespaces: []string{"web"}}, "2025-01-01T00-00-00Z"},
+		{ManifestFilters{Namespaces: []string{"shop"}}, "2025-01-01T01-00-00Z"},
+		{ManifestFilters{Namespaces: []string{"web"}, ResourceTypes: []string{"configmaps"}}, "2025-01-01T02-00-00Z"},
+		{ManifestFilters{AllNamespaces: true, Namespaces: []string{"db", "shop", "web"}}, "2025-01-01T03-00-00Z"},
+		{ManifestFilters{Namespaces: []string{"db"}}, ""},
+	}
+	for _, tt := range tests {
+		latest, err := LatestCompleteBackup(store, layout.Series(), tt.filters)
+		if err != nil {
+			t.Fatalf("LatestCompleteBackup returned error: %v", err)
+		}
+		path := ""
+		if latest != nil {
+			path = latest.Path
+		}
+		if path != tt.expected {
+			t.Errorf("Expected %q as latest backup of %+v, got %q", tt.expected, tt.filters, path)
+		}
+	}
+}
+
+func TestIncrementalAllNamespaces(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	tmpl, err := ParsePathTemplate("{{.Cluster}}/" + DefaultAllNamespacesPathTemplate)
+	if err != nil {
+		t.Fatalf("ParsePathTemplate returned error: %v", err)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A full backup, then an incremental one found through the series of its layout
+	full, _ := NewLayout(store, tmpl, "prod", start)
+	data := []byte("a: 1\n")
+	store.Write(full.RunDir()+"/default/ConfigMap/a.yaml", data)
+	manifest := &Manifest{Namespaces: map[string]NamespaceSummary{}, Files: []ManifestFile{manifestFile("default/ConfigMap/a.yaml", "ConfigMap", data)}}
+	if err := manifest.Write(store, full.RunDir()); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	incremental, _ := NewLayout(store, tmpl, "prod", start.Add(time.Hour))
+	if series := incremental.Series(); series != "prod" {
+		t.Errorf("Expected series prod, got %q", series)
+	}
+	latest, err := LatestCompleteBackup(store, incremental.Series(), ManifestFilters{})
+	if err != nil || latest == nil || latest.Dir != full.RunDir() {
+		t.Fatalf("Expected the full backup in %s as base, got %+v (%v)", full.RunDir(), latest, err)
+	}
+	previous, err := ResolveState(store, latest.Dir)
+	if err != nil {
+		t.Fatalf("ResolveState returned error: %v", err)
+	}
+
+	manifest = &Manifest{Parent: BackupName(previous.Chain[0]), Namespaces: map[string]NamespaceSummary{}, Files: []ManifestFile{}}
+	if manifest.Parent != full.Timestamp {
+		t.Errorf("Expected parent %s, got %s", full.Timestamp, manifest.Parent)
+	}
+	if err := manifest.Write(store, incremental.RunDir()); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	state, err := ResolveState(store, incremental.RunDir())
+	if err != nil {
+		t.Fatalf("ResolveState returned error: %v", err)
+	}
+	if !reflect.DeepEqual(state.Chain, []string{full.RunDir(), incremental.RunDir()}) {
+		t.Errorf("Expected the chain of both backups, got %v", state.Chain)
+	}
+	if file := state.Files["default/ConfigMap/a.yaml"]; file.Dir != full.RunDir() {
+		t.Errorf("Expected a.yaml from the full backup, got %+v", file)
+	}
+
+	// Pruning keeps the base of the kept incremental backup
+	backups, _ := FindBackups(store)
+	decisions := RetentionPolicy{KeepLast: 1}.Apply(backups, false)
+	if err := KeepBases(store, decisions); err != nil {
+		t.Fatalf("KeepBases returned error: %v", err)
+	}
+	if kept := keptPaths(decisions); len(kept) != 2 {
+		t.Errorf("Expected the full backup to be kept as base, got %v", kept)
+	}
+}
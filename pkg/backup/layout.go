@@ -0,0 +1,193 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// TimestampFormat is the layout used for backup timestamps.
+// It is UTC, sorts lexically and contains no characters that are invalid on
+// Windows filesystems or awkward in object store keys.
+const TimestampFormat = "2006-01-02T15-04-05Z"
+
+// DefaultPathTemplate is the path template used for single namespace backups
+const DefaultPathTemplate = "{{.Timestamp}}/{{.Namespace}}/{{.Kind}}/{{.Name}}.yaml"
+
+// DefaultAllNamespacesPathTemplate is the path template used with --all-namespaces
+const DefaultAllNamespacesPathTemplate = "{{.Timestamp}}/all-namespaces/{{.Namespace}}/{{.Kind}}/{{.Name}}.yaml"
+
+// CanonicalPathTemplate is the path template used with --canonical.
+// It has no timestamp, so every run updates the same tree.
+const CanonicalPathTemplate = "{{.Namespace}}/{{.Kind}}/{{.Name}}.yaml"
+
+// rootMarker stands in for per-object fields when rendering the run root
+const rootMarker = "\x00"
+
+// PathParams holds the values available to a path template
+type PathParams struct {
+	Timestamp string
+	Cluster   string
+	Namespace string
+	Kind      string
+	Name      string
+}
+
+// PathTemplate renders the relative file path of a backed-up object
+type PathTemplate struct {
+	raw  string
+	tmpl *template.Template
+}
+
+// ParsePathTemplate parses and validates a path template.
+// The template must reference {{.Name}} so that objects never overwrite each other.
+func ParsePathTemplate(text string) (*PathTemplate, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("path template is empty")
+	}
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path template: %v", err)
+	}
+	pt := &PathTemplate{raw: text, tmpl: tmpl}
+
+	// Render with distinct values to check that every object gets its own path
+	a, err := pt.Render(PathParams{Timestamp: "t", Cluster: "c", Namespace: "ns", Kind: "Kind", Name: "a"})
+	if err != nil {
+		return nil, err
+	}
+	b, err := pt.Render(PathParams{Timestamp: "t", Cluster: "c", Namespace: "ns", Kind: "Kind", Name: "b"})
+	if err != nil {
+		return nil, err
+	}
+	if a == b {
+		return nil, fmt.Errorf("path template %q must include {{.Name}}", text)
+	}
+
+	return pt, nil
+}
+
+// String returns the original template text
+func (p *PathTemplate) String() string {
+	return p.raw
+}
+
+// Render executes the template and returns a clean, slash-separated relative path
+func (p *PathTemplate) Render(params PathParams) (string, error) {
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, params); err != nil {
+		return "", fmt.Errorf("error rendering path template: %v", err)
+	}
+
+	rendered := path.Clean(filepath.ToSlash(buf.String()))
+	if rendered == "." || path.IsAbs(rendered) || rendered == ".." || strings.HasPrefix(rendered, "../") {
+		return "", fmt.Errorf("path template %q rendered invalid path %q", p.raw, buf.String())
+	}
+
+	return rendered, nil
+}
+
+// RunRoot returns the leading directories of the rendered path that only depend
+// on run-level fields (Timestamp and Cluster). It is empty when the template
+// starts with a per-object field.
+func (p *PathTemplate) RunRoot(timestamp, cluster string) string {
+	rendered, err := p.Render(PathParams{
+		Timestamp: timestamp,
+		Cluster:   cluster,
+		Namespace: rootMarker,
+		Kind:      rootMarker,
+		Name:      rootMarker,
+	})
+	if err != nil {
+		return ""
+	}
+
+	segments := strings.Split(rendered, "/")
+	var root []string
+	// The last segment is always the file name, never part of the root
+	for _, segment := range segments[:len(segments)-1] {
+		if strings.Contains(segment, rootMarker) {
+			break
+		}
+		root = append(root, segment)
+	}
+
+	return strings.Join(root, "/")
+}
+
+// Layout describes where the objects of one backup run are written
+type Layout struct {
+	Storage   storage.Storage
+	Template  *PathTemplate
+	Timestamp string
+	Cluster   string
+}
+
+// NewLayout creates a layout for a backup run starting at the given time.
+// If the run directory already exists (for example two runs within the same
+// second), a numeric suffix is appended to the timestamp so that existing
+// backups are never overwritten.
+func NewLayout(store storage.Storage, tmpl *PathTemplate, cluster string, now time.Time) (*Layout, error) {
+	base := now.UTC().Format(TimestampFormat)
+	layout := &Layout{
+		Storage:   store,
+		Template:  tmpl,
+		Timestamp: base,
+		Cluster:   ensureValidFilename(cluster),
+	}
+
+	// Without a run-level root there is no directory to collide with
+	if tmpl.RunRoot(base, layout.Cluster) == "" {
+		return layout, nil
+	}
+
+	for i := 1; ; i++ {
+		exists, err := store.Exists(layout.RunDir())
+		if err != nil {
+			return nil, fmt.Errorf("error checking backup directory %s: %v", store.Location(layout.RunDir()), err)
+		}
+		if !exists {
+			return layout, nil
+		}
+		layout.Timestamp = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// RunDir returns the storage path of the root directory of this backup run.
+// It is empty when the run root is the root of the storage.
+func (l *Layout) RunDir() string {
+	return l.Template.RunRoot(l.Timestamp, l.Cluster)
+}
+
+// Series returns the storage directory holding the timestamped directories
+// of the runs of this layout, e.g. the cluster directory with a
+// {{.Cluster}}/{{.Timestamp}} template. Below the timestamp, the run directory
+// may have more run-level directories, such as all-namespaces. Like
+// StoredBackup.Series, it is "." for timestamped directories at the root.
+func (l *Layout) Series() string {
+	segments := strings.Split(l.RunDir(), "/")
+	for i, segment := range segments {
+		if segment == l.Timestamp {
+			return path.Dir(strings.Join(segments[:i+1], "/"))
+		}
+	}
+	return path.Dir(l.RunDir())
+}
+
+// ObjectPath returns the storage path for an object. Namespace, kind and name
+// are sanitized so they cannot introduce extra path segments.
+func (l *Layout) ObjectPath(namespace, kind, name string) (string, error) {
+	return l.Template.Render(PathParams{
+		Timestamp: l.Timestamp,
+		Cluster:   l.Cluster,
+		Namespace: ensureValidFilename(namespace),
+		Kind:      ensureValidFilename(kind),
+		Name:      ensureValidFilename(name),
+	})
+}
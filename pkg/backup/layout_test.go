@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+	}{
+		{"default", DefaultPathTemplate, false},
+		{"all namespaces", DefaultAllNamespacesPathTemplate, false},
+		{"with cluster", "{{.Timestamp}}/{{.Cluster}}/{{.Namespace}}/{{.Kind}}/{{.Name}}.yaml", false},
+		{"empty", "", true},
+		{"syntax error", "{{.Timestamp", true},
+		{"unknown field", "{{.Foo}}/{{.Name}}.yaml", true},
+		{"missing name", "{{.Timestamp}}/{{.Kind}}.yaml", true},
+		{"escapes output", "../{{.Name}}.yaml", true},
+		{"absolute", "/{{.Name}}.yaml", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePathTemplate(tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParsePathTemplate(%q) error = %v, wantErr %v", tt.template, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPathTemplateRunRoot(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{DefaultPathTemplate, "2025-01-02T03-04-05Z"},
+		{DefaultAllNamespacesPathTemplate, "2025-01-02T03-04-05Z/all-namespaces"},
+		{"{{.Timestamp}}/{{.Cluster}}/{{.Namespace}}/{{.Kind}}/{{.Name}}.yaml", "2025-01-02T03-04-05Z/prod"},
+		{"{{.Namespace}}/{{.Timestamp}}/{{.Name}}.yaml", ""},
+		{"{{.Timestamp}}-{{.Name}}.yaml", ""},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := ParsePathTemplate(tt.template)
+		if err != nil {
+			t.Fatalf("ParsePathTemplate(%q) returned error: %v", tt.template, err)
+		}
+		if got := tmpl.RunRoot("2025-01-02T03-04-05Z", "prod"); got != tt.want {
+			t.Errorf("RunRoot for %q = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestLayoutObjectPath(t *testing.T) {
+	tmpl, err := ParsePathTemplate("{{.Timestamp}}/{{.Cluster}}/{{.Namespace}}/{{.Kind}}/{{.Name}}.yaml")
+	if err != nil {
+		t.Fatalf("ParsePathTemplate returned error: %v", err)
+	}
+	layout := &Layout{Storage: storage.NewLocal("out"), Template: tmpl, Timestamp: "ts", Cluster: "prod"}
+
+	got, err := layout.ObjectPath("default", "ConfigMap", "../etc/passwd")
+	if err != nil {
+		t.Fatalf("ObjectPath returned error: %v", err)
+	}
+	want := "ts/prod/default/ConfigMap/etc_passwd.yaml"
+	if got != want {
+		t.Errorf("ObjectPath = %q, want %q", got, want)
+	}
+}
+
+func TestNewLayoutAvoidsExistingDirectory(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	tmpl, err := ParsePathTemplate(DefaultPathTemplate)
+	if err != nil {
+		t.Fatalf("ParsePathTemplate returned error: %v", err)
+	}
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	first, err := NewLayout(store, tmpl, "prod", now)
+	if err != nil {
+		t.Fatalf("NewLayout returned error: %v", err)
+	}
+	if first.Timestamp != "2025-01-02T03-04-05Z" {
+		t.Errorf("Expected timestamp 2025-01-02T03-04-05Z, got %s", first.Timestamp)
+	}
+	if err := store.Write(first.RunDir()+"/default/ConfigMap/a.yaml", []byte("a")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	second, err := NewLayout(store, tmpl, "prod", now)
+	if err != nil {
+		t.Fatalf("NewLayout returned error: %v", err)
+	}
+	if second.Timestamp != "2025-01-02T03-04-05Z-1" {
+		t.Errorf("Expected timestamp 2025-01-02T03-04-05Z-1, got %s", second.Timestamp)
+	}
+}
@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"fmt"
+
+	"github.com/rogosprojects/kbak/pkg/client"
+	"github.com/rogosprojects/kbak/pkg/resources"
+	"github.com/rogosprojects/kbak/pkg/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// LiveObjects returns the manifests of the objects of the selected resource
+// types in a namespace of the cluster, cleaned like a backup writes them, and
+// canonicalized with canonical. Resource types the cluster does not serve
+// and objects without a name are skipped.
+func LiveObjects(k8sClient *client.K8sClient, namespace string, selectedTypes map[string]bool, canonical bool) (map[ObjectKey][]byte, error) {
+	objects := make(map[ObjectKey][]byte)
+
+	for _, resource := range resources.GetResourceTypes(selectedTypes) {
+		list, err := resource.APIFunc(k8sClient, namespace, metav1.ListOptions{})
+		if err != nil {
+			if resources.IsNotFoundError(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error listing %s in namespace %s: %v", resource.Kind, namespace, err)
+		}
+
+		items, _ := utils.ExtractItems(list)
+		for _, item := range items {
+			if item == nil {
+				continue
+			}
+			name := utils.ExtractName(item)
+			if name == "" {
+				continue
+			}
+
+			utils.CleanObject(item)
+			if canonical {
+				utils.CanonicalizeObject(item)
+			}
+			data, err := yaml.Marshal(item)
+			if err != nil {
+				return nil, fmt.Errorf("error marshaling %s '%s': %v", resource.Kind, name, err)
+			}
+			objects[ObjectKey{Namespace: namespace, Kind: resource.Kind, Name: name}] = data
+		}
+	}
+
+	return objects, nil
+}
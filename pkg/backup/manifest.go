@@ -0,0 +1,231 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// ManifestFileName is the name of the manifest written at the root of every backup.
+// It is written last, so its presence marks a completed backup.
+const ManifestFileName = "kbak-manifest.json"
+
+// ManifestFormatVersion is the version of the manifest format
+const ManifestFormatVersion = 1
+
+// Manifest describes a completed backup run. Redaction is the redaction
+// mode of the backup, empty when values are kept.
+//
+// Parent is set for incremental backups: the name of the timestamped
+// directory of the backup it builds on, a sibling of its own timestamped
+// directory. Files then only lists new and
+// changed objects and Tombstones the files of the parent state whose objects
+// were deleted.
+type Manifest struct {
+	FormatVersion     int                         `json:"formatVersion"`
+	KbakVersion       string                      `json:"kbakVersion"`
+	KubernetesVersion string                      `json:"kubernetesVersion,omitempty"`
+	Context           string                      `json:"context,omitempty"`
+	Cluster           string                      `json:"cluster,omitempty"`
+	Server            string                      `json:"server,omitempty"`
+	Timestamp         string                      `json:"timestamp"`
+	Parent            string                      `json:"parent,omitempty"`
+	StartedAt         time.Time                   `json:"startedAt"`
+	CompletedAt       time.Time                   `json:"completedAt"`
+	Filters           ManifestFilters             `json:"filters"`
+	Redaction         string                      `json:"redaction,omitempty"`
+	ResourceCount     int                         `json:"resourceCount"`
+	ErrorCount        int                         `json:"errorCount"`
+	Namespaces        map[string]NamespaceSummary `json:"namespaces"`
+	Files             []ManifestFile              `json:"files"`
+	Tombstones        []ManifestFile              `json:"tombstones,omitempty"`
+	// Attachments are files of the backup that hold no object, such as the
+	// redaction report, so the checksums cover them as well
+	Attachments []ManifestFile `json:"attachments,omitempty"`
+}
+
+// ManifestFilters records the selection used for a backup run
+type ManifestFilters struct {
+	AllNamespaces bool     `json:"allNamespaces"`
+	Namespaces    []string `json:"namespaces,omitempty"`
+	ResourceTypes []string `json:"resourceTypes,omitempty"`
+	PathTemplate  string   `json:"pathTemplate"`
+}
+
+// SameSelection reports whether backups with the filters f and other select
+// the same objects: the same resource types, and all namespaces in both or
+// the same namespaces
+func (f ManifestFilters) SameSelection(other ManifestFilters) bool {
+	if f.AllNamespaces != other.AllNamespaces || !sameStrings(f.ResourceTypes, other.ResourceTypes) {
+		return false
+	}
+	return f.AllNamespaces || sameStrings(f.Namespaces, other.Namespaces)
+}
+
+// sameStrings reports whether a and b hold the same strings in any order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NamespaceSummary holds the per-kind results of one namespace
+type NamespaceSummary struct {
+	ResourceCount     int            `json:"resourceCount"`
+	ErrorCount        int            `json:"errorCount"`
+	ResourcesBackedUp map[string]int `json:"resourcesBackedUp"`
+	ResourceErrors    map[string]int `json:"resourceErrors"`
+}
+
+// ManifestFile describes one file of the backup
+type ManifestFile struct {
+	// Path is slash-separated and relative to the directory of the manifest
+	Path      string `json:"path"`
+	Namespace string `json:"namespace,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	// Encryption is the format the file is encrypted with, empty when plain
+	Encryption string `json:"encryption,omitempty"`
+}
+
+// NewManifest creates a manifest for the backup run described by the layout
+func NewManifest(layout *Layout, kbakVersion string, startedAt time.Time) *Manifest {
+	return &Manifest{
+		FormatVersion: ManifestFormatVersion,
+		KbakVersion:   kbakVersion,
+		Cluster:       layout.Cluster,
+		Timestamp:     layout.Timestamp,
+		StartedAt:     startedAt.UTC(),
+		Filters:       ManifestFilters{PathTemplate: layout.Template.String()},
+		Namespaces:    make(map[string]NamespaceSummary),
+		Files:         []ManifestFile{},
+	}
+}
+
+// AddNamespace records the results of backing up one namespace.
+// File paths are stored relative to dir, the storage directory the manifest is written to.
+func (m *Manifest) AddNamespace(namespace, dir string, stats *BackupStats) error {
+	m.Namespaces[namespace] = NamespaceSummary{
+		ResourceCount:     stats.ResourceCount,
+		ErrorCount:        stats.ErrorCount,
+		ResourcesBackedUp: stats.ResourcesBackedUp,
+		ResourceErrors:    stats.ResourceErrors,
+	}
+	m.ResourceCount += stats.ResourceCount
+	m.ErrorCount += stats.ErrorCount
+
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	for _, file := range stats.Files {
+		if !strings.HasPrefix(file.Path, prefix) {
+			return fmt.Errorf("file %s is not inside the backup directory %s", file.Path, dir)
+		}
+		m.Files = append(m.Files, ManifestFile{
+			Path:       strings.TrimPrefix(file.Path, prefix),
+			Namespace:  file.Namespace,
+			Kind:       file.Kind,
+			Name:       file.Name,
+			Size:       file.Size,
+			SHA256:     file.SHA256,
+			Encryption: file.Encryption,
+		})
+	}
+
+	return nil
+}
+
+// AddAttachment writes a file that holds no object to the storage directory
+// dir and records its checksum. name is relative to dir.
+func (m *Manifest) AddAttachment(store storage.Storage, dir, name string, data []byte) error {
+	if err := store.Write(path.Join(dir, name), data); err != nil {
+		return err
+	}
+	m.recordAttachment(name, data)
+	return nil
+}
+
+// recordAttachment adds the checksum of an attachment, replacing any entry with the same path
+func (m *Manifest) recordAttachment(name string, data []byte) {
+	checksum := sha256.Sum256(data)
+	attachment := ManifestFile{Path: name, Size: int64(len(data)), SHA256: hex.EncodeToString(checksum[:])}
+	for i, existing := range m.Attachments {
+		if existing.Path == name {
+			m.Attachments[i] = attachment
+			return
+		}
+	}
+	m.Attachments = append(m.Attachments, attachment)
+}
+
+// Marshal completes the manifest, setting the completion time unless already
+// set, and returns it as indented JSON
+func (m *Manifest) Marshal() ([]byte, error) {
+	if m.CompletedAt.IsZero() {
+		m.CompletedAt = time.Now().UTC()
+	}
+	m.sortFiles()
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling manifest: %v", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// Write stores the manifest in the storage directory dir, marking the backup as complete
+func (m *Manifest) Write(store storage.Storage, dir string) error {
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := store.Write(path.Join(dir, ManifestFileName), data); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+
+	return nil
+}
+
+// sortFiles orders the files by path
+func (m *Manifest) sortFiles() {
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Path < m.Files[j].Path
+	})
+}
+
+// ReadManifest reads the manifest of the backup in the storage directory dir.
+// A missing manifest returns an error matching fs.ErrNotExist.
+func ReadManifest(store storage.Storage, dir string) (*Manifest, error) {
+	data, err := store.Read(path.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", ManifestFileName, err)
+	}
+
+	return &m, nil
+}
@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+func TestManifestWriteAndRead(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	dir := "2025-01-02T03-04-05Z"
+	tmpl, err := ParsePathTemplate(DefaultPathTemplate)
+	if err != nil {
+		t.Fatalf("ParsePathTemplate returned error: %v", err)
+	}
+	startedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	layout := &Layout{Storage: store, Template: tmpl, Timestamp: "2025-01-02T03-04-05Z", Cluster: "prod"}
+
+	stats := NewBackupStats()
+	stats.ResourceCount = 2
+	stats.ResourcesBackedUp["ConfigMap"] = 2
+	stats.Files = []FileRecord{
+		{Path: dir + "/default/ConfigMap/b.yaml", Namespace: "default", Kind: "ConfigMap", Name: "b", Size: 10, SHA256: "bb"},
+		{Path: dir + "/default/ConfigMap/a.yaml", Namespace: "default", Kind: "ConfigMap", Name: "a", Size: 12, SHA256: "aa"},
+	}
+
+	manifest := NewManifest(layout, "v1.2.3", startedAt)
+	if err := manifest.AddNamespace("default", dir, stats); err != nil {
+		t.Fatalf("AddNamespace returned error: %v", err)
+	}
+	if err := manifest.Write(store, dir); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	read, err := ReadManifest(store, dir)
+	if err != nil {
+		t.Fatalf("ReadManifest returned error: %v", err)
+	}
+	if read.KbakVersion != "v1.2.3" || read.Cluster != "prod" || read.Timestamp != "2025-01-02T03-04-05Z" {
+		t.Errorf("Unexpected manifest metadata: %+v", read)
+	}
+	if read.CompletedAt.IsZero() {
+		t.Errorf("Expected CompletedAt to be set")
+	}
+	if read.ResourceCount != 2 || read.Namespaces["default"].ResourcesBackedUp["ConfigMap"] != 2 {
+		t.Errorf("Unexpected counts: %+v", read.Namespaces)
+	}
+	if len(read.Files) != 2 {
+		t.Fatalf("Expected 2 files, got %d", len(read.Files))
+	}
+	if read.Files[0].Path != "default/ConfigMap/a.yaml" || read.Files[0].SHA256 != "aa" {
+		t.Errorf("Expected files to be sorted with relative paths, got %+v", read.Files[0])
+	}
+}
+
+func TestManifestAddNamespaceOutsideDirectory(t *testing.T) {
+	stats := NewBackupStats()
+	stats.Files = []FileRecord{{Path: "other/default/ConfigMap/a.yaml"}}
+
+	manifest := &Manifest{Namespaces: make(map[string]NamespaceSummary)}
+	if err := manifest.AddNamespace("default", "run", stats); err == nil {
+		t.Errorf("Expected error for a file outside of the backup directory")
+	}
+}
+
+func TestReadManifestMissing(t *testing.T) {
+	if _, err := ReadManifest(storage.NewLocal(t.TempDir()), ""); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not-exist error for missing manifest, got %v", err)
+	}
+}
@@ -0,0 +1,501 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// RepositoryFileName marks the root of a repository and holds its format version
+const RepositoryFileName = "kbak-repository.json"
+
+// RepositoryFormatVersion is the version of the repository format
+const RepositoryFormatVersion = 1
+
+// Directories of a repository
+const (
+	objectsDir   = "objects"
+	snapshotsDir = "snapshots"
+	locksDir     = "locks"
+)
+
+// gcLockFile is held by GarbageCollect while it removes files. GarbageCollect
+// and BeginSnapshot both write their lock before looking for the other one,
+// so at least one of them sees the other and stops.
+const gcLockFile = "gc.lock"
+
+// Repository is a content-addressable backup store. Every file is stored once
+// under objects/ by its SHA-256, and every run writes a snapshot index, a
+// manifest referencing the files by checksum, to snapshots/CLUSTER/TIMESTAMP.json.
+type Repository struct {
+	Storage storage.Storage
+}
+
+// repositoryConfig is the content of RepositoryFileName
+type repositoryConfig struct {
+	FormatVersion int `json:"formatVersion"`
+}
+
+// InitRepository opens the repository at the root of the storage, creating it
+// when the storage is empty
+func InitRepository(store storage.Storage) (*Repository, error) {
+	r, err := OpenRepository(store)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return r, err
+	}
+
+	files, err := store.List("")
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		return nil, fmt.Errorf("%s is not empty and not a kbak repository", store.Location(""))
+	}
+	data, err := json.Marshal(repositoryConfig{FormatVersion: RepositoryFormatVersion})
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Write(RepositoryFileName, append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("error creating repository: %v", err)
+	}
+	return &Repository{Storage: store}, nil
+}
+
+// OpenRepository opens the repository at the root of the storage. A missing
+// repository returns an error matching fs.ErrNotExist.
+func OpenRepository(store storage.Storage) (*Repository, error) {
+	data, err := store.Read(RepositoryFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s is not a kbak repository: %w", store.Location(""), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config repositoryConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", RepositoryFileName, err)
+	}
+	if config.FormatVersion != RepositoryFormatVersion {
+		return nil, fmt.Errorf("unsupported repository format version %d", config.FormatVersion)
+	}
+	return &Repository{Storage: store}, nil
+}
+
+// ObjectPath returns the storage path of the object with the given SHA-256
+func ObjectPath(checksum string) string {
+	if len(checksum) < 2 {
+		return path.Join(objectsDir, checksum)
+	}
+	return path.Join(objectsDir, checksum[:2], checksum)
+}
+
+// SnapshotPath returns the storage path of the index of a snapshot
+func SnapshotPath(id string) string {
+	return path.Join(snapshotsDir, id+".json")
+}
+
+// Put stores the file of an object of the given kind unless the repository
+// already holds the same content, and tells whether it stored a new object
+func (r *Repository) Put(kind string, data []byte) (bool, error) {
+	checksum := sha256.Sum256(data)
+	objectPath := ObjectPath(hex.EncodeToString(checksum[:]))
+
+	exists, err := r.Storage.Exists(objectPath)
+	if err != nil || exists {
+		return false, err
+	}
+	if err := writeFile(r.Storage, objectPath, kind, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AddAttachment stores a file that holds no object and records it in the manifest
+func (r *Repository) AddAttachment(m *Manifest, name string, data []byte) error {
+	if _, err := r.Put("", data); err != nil {
+		return err
+	}
+	m.recordAttachment(name, data)
+	return nil
+}
+
+// BeginSnapshot reserves the ID of a snapshot of the cluster taken at the
+// timestamp and writes a lock, so GarbageCollect does not remove the objects
+// of the run before its index is written
+func (r *Repository) BeginSnapshot(cluster, timestamp string) (string, error) {
+	base := ensureValidFilename(cluster) + "/" + timestamp
+	id := base
+	for i := 1; ; i++ {
+		snapshotExists, err := r.Storage.Exists(SnapshotPath(id))
+		if err != nil {
+			return "", err
+		}
+		lockExists, err := r.Storage.Exists(path.Join(locksDir, id))
+		if err != nil {
+			return "", err
+		}
+		if !snapshotExists && !lockExists {
+			break
+		}
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	if err := r.Storage.Write(path.Join(locksDir, id), []byte(timestamp+"\n")); err != nil {
+		return "", fmt.Errorf("error writing lock: %v", err)
+	}
+	// Objects found in the repository may be removed by a running garbage collection
+	gcRunning, err := r.Storage.Exists(gcLockFile)
+	if err == nil && gcRunning {
+		err = fmt.Errorf("garbage collection is in progress, remove %s if it is not", r.Storage.Location(gcLockFile))
+	}
+	if err != nil {
+		r.Storage.Delete(path.Join(locksDir, id))
+		return "", err
+	}
+	return id, nil
+}
+
+// AbortSnapshot removes the lock of a snapshot that is never committed, so
+// garbage collection removes the objects only it stored
+func (r *Repository) AbortSnapshot(id string) error {
+	if err := r.Storage.Delete(path.Join(locksDir, id)); err != nil {
+		return fmt.Errorf("error removing lock: %v", err)
+	}
+	return nil
+}
+
+// CommitSnapshot writes the index of the snapshot, completing it, and removes its lock
+func (r *Repository) CommitSnapshot(id string, m *Manifest) error {
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := r.Storage.Write(SnapshotPath(id), data); err != nil {
+		return fmt.Errorf("error writing snapshot index: %v", err)
+	}
+	if err := r.Storage.Delete(path.Join(locksDir, id)); err != nil {
+		return fmt.Errorf("error removing lock: %v", err)
+	}
+	return nil
+}
+
+// Snapshots returns the snapshots of the repository, newest first. Path is the
+// storage path of the index and the series is the cluster.
+func (r *Repository) Snapshots() ([]StoredBackup, error) {
+	files, err := r.Storage.List(snapshotsDir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing snapshots: %v", err)
+	}
+
+	var snapshots []StoredBackup
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".json") {
+			continue
+		}
+		t, sequence, _, ok := parseBackupName(strings.TrimSuffix(path.Base(file), ".json"))
+		if !ok {
+			continue
+		}
+		snapshots = append(snapshots, StoredBackup{Path: file, Time: t, Sequence: sequence, Complete: true})
+	}
+	sortBackups(snapshots)
+
+	return snapshots, nil
+}
+
+// SnapshotID returns the ID of the snapshot whose index is at the storage path
+func SnapshotID(indexPath string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(indexPath, snapshotsDir+"/"), ".json")
+}
+
+// ReadSnapshot reads the index of a snapshot. The ID "latest" selects the newest snapshot.
+func (r *Repository) ReadSnapshot(id string) (string, *Manifest, error) {
+	if id == "latest" {
+		snapshots, err := r.Snapshots()
+		if err != nil {
+			return "", nil, err
+		}
+		if len(snapshots) == 0 {
+			return "", nil, fmt.Errorf("the repository has no snapshots")
+		}
+		id = SnapshotID(snapshots[0].Path)
+	}
+
+	data, err := r.Storage.Read(SnapshotPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil, fmt.Errorf("snapshot %s does not exist", id)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", nil, fmt.Errorf("error parsing snapshot %s: %v", id, err)
+	}
+	return id, &m, nil
+}
+
+// SnapshotState returns the content of a snapshot as a State. Its files refer
+// to their objects, so ReadFile(r.Storage, file.Dir, file.ManifestFile) reads them.
+func (r *Repository) SnapshotState(id string) (*State, error) {
+	id, m, err := r.ReadSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{Manifest: m, Chain: []string{id}, Files: make(map[string]StateFile, len(m.Files))}
+	for _, file := range m.Files {
+		filePath := path.Clean(file.Path)
+		file.Path = ObjectPath(file.SHA256)
+		state.Files[filePath] = StateFile{ManifestFile: file}
+	}
+	return state, nil
+}
+
+// Export writes a snapshot as a backup directory to targetDir of the target
+// storage, checking every file against its checksum. The manifest is written
+// last, so the copy is complete only when every file was copied.
+func (r *Repository) Export(id string, target storage.Storage, targetDir string) (*Manifest, error) {
+	_, m, err := r.ReadSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range append(append([]ManifestFile{}, m.Files...), m.Attachments...) {
+		if err := copyFile(r.Storage, ObjectPath(file.SHA256), target, targetDir, file); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.Write(target, targetDir); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ObjectProblem is a file of a snapshot whose object is missing or corrupt
+type ObjectProblem struct {
+	Snapshot string
+	File     ManifestFile
+}
+
+// RepositoryCheck is the result of checking the integrity of a repository
+type RepositoryCheck struct {
+	Snapshots int
+	// Objects is the number of referenced objects whose content matches their checksum
+	Objects int
+	Missing []ObjectProblem
+	Corrupt []ObjectProblem
+	// Unreadable holds the IDs of snapshots whose index cannot be parsed
+	Unreadable []string
+	// Unreferenced is the number of objects no snapshot references, removed by GarbageCollect
+	Unreferenced int
+}
+
+// OK checks if every snapshot is readable and every object it references is intact
+func (c *RepositoryCheck) OK() bool {
+	return len(c.Missing) == 0 && len(c.Corrupt) == 0 && len(c.Unreadable) == 0
+}
+
+// Check reads every snapshot index and re-hashes every object they reference
+func (r *Repository) Check() (*RepositoryCheck, error) {
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := r.objects()
+	if err != nil {
+		return nil, err
+	}
+
+	check := &RepositoryCheck{Snapshots: len(snapshots)}
+	// intact caches the result of hashing every referenced object once
+	intact := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		id, m, err := r.ReadSnapshot(SnapshotID(snapshot.Path))
+		if err != nil {
+			check.Unreadable = append(check.Unreadable, SnapshotID(snapshot.Path))
+			continue
+		}
+		for _, file := range append(append([]ManifestFile{}, m.Files...), m.Attachments...) {
+			ok, checked := intact[file.SHA256]
+			if !checked {
+				ok = objects[file.SHA256] && r.objectIntact(file.SHA256)
+				intact[file.SHA256] = ok
+				if ok {
+					check.Objects++
+				}
+			}
+			switch {
+			case ok:
+			case !objects[file.SHA256]:
+				check.Missing = append(check.Missing, ObjectProblem{Snapshot: id, File: file})
+			default:
+				check.Corrupt = append(check.Corrupt, ObjectProblem{Snapshot: id, File: file})
+			}
+		}
+	}
+
+	for checksum := range objects {
+		if _, referenced := intact[checksum]; !referenced {
+			check.Unreferenced++
+		}
+	}
+
+	return check, nil
+}
+
+// objectIntact checks if the content of an object matches its checksum
+func (r *Repository) objectIntact(checksum string) bool {
+	data, err := r.Storage.Read(ObjectPath(checksum))
+	if err != nil {
+		return false
+	}
+	actual := sha256.Sum256(data)
+	return hex.EncodeToString(actual[:]) == checksum
+}
+
+// objects returns the checksums of all objects in the repository
+func (r *Repository) objects() (map[string]bool, error) {
+	files, err := r.Storage.List(objectsDir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects: %v", err)
+	}
+	objects := make(map[string]bool, len(files))
+	for _, file := range files {
+		objects[path.Base(file)] = true
+	}
+	return objects, nil
+}
+
+// GCResult describes the snapshots and objects removed by GarbageCollect
+type GCResult struct {
+	// Decisions tells for every snapshot whether it is kept, empty without a policy
+	Decisions []PruneDecision
+	// Removed holds the checksums of the removed objects
+	Removed []string
+	// Kept is the number of objects still referenced
+	Kept int
+	// StaleLocks holds the IDs of runs that never completed and were ignored
+	StaleLocks []string
+}
+
+// GarbageCollect removes the snapshots not kept by the policy, unless it is
+// empty, and the objects no remaining snapshot references. It refuses to
+// remove objects while a backup run holds a lock younger than lockTimeout,
+// as its objects are not referenced yet, and holds a lock that keeps new runs
+// from starting until it is done. With dryRun nothing is removed.
+func (r *Repository) GarbageCollect(policy RetentionPolicy, lockTimeout time.Duration, now time.Time, dryRun bool) (*GCResult, error) {
+	result := &GCResult{}
+	if !dryRun {
+		exists, err := r.Storage.Exists(gcLockFile)
+		if err == nil && exists {
+			err = fmt.Errorf("garbage collection is in progress, remove %s if it is not", r.Storage.Location(gcLockFile))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := r.Storage.Write(gcLockFile, []byte(now.UTC().Format(time.RFC3339)+"\n")); err != nil {
+			return nil, fmt.Errorf("error writing lock: %v", err)
+		}
+		defer r.Storage.Delete(gcLockFile)
+	}
+	staleLocks, err := r.checkLocks(lockTimeout, now)
+	if err != nil {
+		return nil, err
+	}
+	result.StaleLocks = staleLocks
+
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	var kept []StoredBackup
+	if policy.Empty() {
+		kept = snapshots
+	} else {
+		result.Decisions = policy.Apply(snapshots, false)
+		for _, decision := range result.Decisions {
+			if decision.Keep {
+				kept = append(kept, decision.Backup)
+			}
+		}
+	}
+
+	// Read every kept index before removing anything
+	referenced := make(map[string]bool)
+	for _, snapshot := range kept {
+		_, m, err := r.ReadSnapshot(SnapshotID(snapshot.Path))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range append(append([]ManifestFile{}, m.Files...), m.Attachments...) {
+			referenced[file.SHA256] = true
+		}
+	}
+	objects, err := r.objects()
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		for _, decision := range result.Decisions {
+			if decision.Keep {
+				continue
+			}
+			for _, file := range []string{decision.Backup.Path, decision.Backup.Path + SignatureExtension} {
+				if err := r.Storage.Delete(file); err != nil {
+					return result, fmt.Errorf("error removing snapshot %s: %v", SnapshotID(decision.Backup.Path), err)
+				}
+			}
+		}
+	}
+
+	for checksum := range objects {
+		if referenced[checksum] {
+			result.Kept++
+			continue
+		}
+		result.Removed = append(result.Removed, checksum)
+	}
+	sort.Strings(result.Removed)
+	if !dryRun {
+		for _, checksum := range result.Removed {
+			if err := r.Storage.Delete(ObjectPath(checksum)); err != nil {
+				return result, fmt.Errorf("error removing object %s: %v", checksum, err)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// checkLocks returns the IDs of the runs holding locks older than
+// lockTimeout, or an error when a run holds a younger lock
+func (r *Repository) checkLocks(lockTimeout time.Duration, now time.Time) ([]string, error) {
+	locks, err := r.Storage.List(locksDir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing locks: %v", err)
+	}
+	var stale []string
+	for _, lock := range locks {
+		id := strings.TrimPrefix(lock, locksDir+"/")
+		t, _, _, ok := parseBackupName(path.Base(lock))
+		if ok && now.Sub(t) > lockTimeout {
+			stale = append(stale, id)
+			continue
+		}
+		return nil, fmt.Errorf("backup run %s is in progress, remove %s if it is not", id, r.Storage.Location(lock))
+	}
+	return stale, nil
+}
@@ -0,0 +1,251 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// writeSnapshot stores the files in the repository and commits a snapshot referencing them
+func writeSnapshot(t *testing.T, r *Repository, cluster, timestamp string, files map[string]string) string {
+	t.Helper()
+	id, err := r.BeginSnapshot(cluster, timestamp)
+	if err != nil {
+		t.Fatalf("BeginSnapshot returned error: %v", err)
+	}
+	manifest := &Manifest{Cluster: cluster, Timestamp: timestamp, Namespaces: map[string]NamespaceSummary{}, Files: []ManifestFile{}}
+	for name, content := range files {
+		if _, err := r.Put("ConfigMap", []byte(content)); err != nil {
+			t.Fatalf("Put returned error: %v", err)
+		}
+		manifest.Files = append(manifest.Files, manifestFile(name, "ConfigMap", []byte(content)))
+	}
+	if err := r.CommitSnapshot(id, manifest); err != nil {
+		t.Fatalf("CommitSnapshot returned error: %v", err)
+	}
+	return id
+}
+
+func TestRepository(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	r, err := InitRepository(store)
+	if err != nil {
+		t.Fatalf("InitRepository returned error: %v", err)
+	}
+
+	first := writeSnapshot(t, r, "prod", "2025-01-01T00-00-00Z", map[string]string{"a.yaml": "a: 1\n", "b.yaml": "b: 1\n"})
+	second := writeSnapshot(t, r, "prod", "2025-01-01T00-00-00Z", map[string]string{"a.yaml": "a: 1\n", "b.yaml": "b: 2\n"})
+	if first != "prod/2025-01-01T00-00-00Z" || second != "prod/2025-01-01T00-00-00Z-1" {
+		t.Errorf("Expected unique snapshot IDs, got %s and %s", first, second)
+	}
+	if added, err := r.Put("ConfigMap", []byte("b: 2\n")); err != nil || added {
+		t.Errorf("Expected a stored object not to be added again, got %v, %v", added, err)
+	}
+	other, err := InitRepository(storage.NewLocal(t.TempDir()))
+	if err != nil {
+		t.Fatalf("InitRepository returned error: %v", err)
+	}
+	if added, err := other.Put("ConfigMap", []byte("b: 2\n")); err != nil || !added {
+		t.Errorf("Expected a new object to be added, got %v, %v", added, err)
+	}
+
+	r, err = OpenRepository(store)
+	if err != nil {
+		t.Fatalf("OpenRepository returned error: %v", err)
+	}
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		t.Fatalf("Snapshots returned error: %v", err)
+	}
+	if len(snapshots) != 2 || SnapshotID(snapshots[0].Path) != second {
+		t.Errorf("Expected 2 snapshots, newest first, got %v", snapshots)
+	}
+	if id, _, err := r.ReadSnapshot("latest"); err != nil || id != second {
+		t.Errorf("Expected latest to be %s, got %s (%v)", second, id, err)
+	}
+
+	state, err := r.SnapshotState(first)
+	if err != nil {
+		t.Fatalf("SnapshotState returned error: %v", err)
+	}
+	file, ok := state.Files["b.yaml"]
+	if !ok {
+		t.Fatalf("Expected the state to hold b.yaml, got %v", state.Files)
+	}
+	if data, err := ReadFile(store, file.Dir, file.ManifestFile, nil); err != nil || string(data) != "b: 1\n" {
+		t.Errorf("Expected to read b.yaml from its object, got %q (%v)", data, err)
+	}
+
+	target := storage.NewLocal(t.TempDir())
+	if _, err := r.Export(first, target, first); err != nil {
+		t.Fatalf("Export returned error: %v", err)
+	}
+	v, err := VerifyBackup(target, first)
+	if err != nil {
+		t.Fatalf("VerifyBackup returned error: %v", err)
+	}
+	if !v.OK() || v.Verified != 2 {
+		t.Errorf("Expected an intact export with 2 files, got %+v", v)
+	}
+
+	check, err := r.Check()
+	if err != nil {
+		t.Fatalf("Check returned error: %v", err)
+	}
+	if !check.OK() || check.Snapshots != 2 || check.Objects != 3 || check.Unreferenced != 0 {
+		t.Errorf("Expected an intact repository, got %+v", check)
+	}
+}
+
+func TestInitRepositoryNotEmpty(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	store.Write("2025-01-01T00-00-00Z/"+ManifestFileName, []byte("{}\n"))
+
+	if _, err := InitRepository(store); err == nil {
+		t.Errorf("Expected error creating a repository in a directory with backups")
+	}
+	if _, err := OpenRepository(store); err == nil {
+		t.Errorf("Expected error opening a directory that is not a repository")
+	}
+}
+
+func TestRepositoryCheckProblems(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	r, err := InitRepository(store)
+	if err != nil {
+		t.Fatalf("InitRepository returned error: %v", err)
+	}
+	writeSnapshot(t, r, "prod", "2025-01-01T00-00-00Z", map[string]string{"a.yaml": "a: 1\n", "b.yaml": "b: 1\n", "c.yaml": "c: 1\n"})
+	r.Put("ConfigMap", []byte("unreferenced\n"))
+
+	store.Delete(ObjectPath(manifestFile("", "", []byte("a: 1\n")).SHA256))
+	store.Write(ObjectPath(manifestFile("", "", []byte("b: 1\n")).SHA256), []byte("b: 2\n"))
+	store.Write(SnapshotPath("prod/2025-01-02T00-00-00Z"), []byte("not json"))
+
+	check, err := r.Check()
+	if err != nil {
+		t.Fatalf("Check returned error: %v", err)
+	}
+	if check.OK() {
+		t.Errorf("Expected problems to be found")
+	}
+	if len(check.Missing) != 1 || check.Missing[0].File.Path != "a.yaml" {
+		t.Errorf("Expected a.yaml to be missing, got %v", check.Missing)
+	}
+	if len(check.Corrupt) != 1 || check.Corrupt[0].File.Path != "b.yaml" {
+		t.Errorf("Expected b.yaml to be corrupt, got %v", check.Corrupt)
+	}
+	if len(check.Unreadable) != 1 || check.Unreadable[0] != "prod/2025-01-02T00-00-00Z" {
+		t.Errorf("Expected one unreadable snapshot, got %v", check.Unreadable)
+	}
+	if check.Objects != 1 || check.Unreferenced != 1 {
+		t.Errorf("Expected 1 intact and 1 unreferenced object, got %d and %d", check.Objects, check.Unreferenced)
+	}
+}
+
+// listHook calls hook before listing prefix
+type listHook struct {
+	storage.Storage
+	prefix string
+	hook   func()
+}
+
+func (s *listHook) List(prefix string) ([]string, error) {
+	if prefix == s.prefix && s.hook != nil {
+		s.hook()
+		s.hook = nil
+	}
+	return s.Storage.List(prefix)
+}
+
+func TestGarbageCollect(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	r, err := InitRepository(store)
+	if err != nil {
+		t.Fatalf("InitRepository returned error: %v", err)
+	}
+	writeSnapshot(t, r, "prod", "2025-01-01T00-00-00Z", map[string]string{"a.yaml": "a: 1\n", "b.yaml": "b: 1\n"})
+	writeSnapshot(t, r, "prod", "2025-01-02T00-00-00Z", map[string]string{"a.yaml": "a: 1\n", "b.yaml": "b: 2\n"})
+	now := time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	// A running backup blocks the removal of objects
+	running, err := r.BeginSnapshot("prod", "2025-01-02T23-00-00Z")
+	if err != nil {
+		t.Fatalf("BeginSnapshot returned error: %v", err)
+	}
+	if _, err := r.GarbageCollect(RetentionPolicy{KeepLast: 1}, time.Hour, now, false); err == nil {
+		t.Errorf("Expected error while a backup run holds a lock")
+	}
+	// Older than the timeout it is ignored
+	result, err := r.GarbageCollect(RetentionPolicy{KeepLast: 1}, time.Minute, now, true)
+	if err != nil {
+		t.Fatalf("GarbageCollect returned error: %v", err)
+	}
+	if len(result.StaleLocks) != 1 || result.StaleLocks[0] != running {
+		t.Errorf("Expected the lock of %s to be stale, got %v", running, result.StaleLocks)
+	}
+	if len(result.Removed) != 1 || result.Kept != 2 {
+		t.Errorf("Expected a dry run to report 1 removed and 2 kept objects, got %d and %d", len(result.Removed), result.Kept)
+	}
+	if snapshots, _ := r.Snapshots(); len(snapshots) != 2 {
+		t.Errorf("Expected a dry run to keep every snapshot, got %v", snapshots)
+	}
+
+	if err := r.AbortSnapshot(running); err != nil {
+		t.Fatalf("AbortSnapshot returned error: %v", err)
+	}
+	if _, err := r.GarbageCollect(RetentionPolicy{KeepLast: 1}, time.Hour, now, false); err != nil {
+		t.Fatalf("GarbageCollect returned error: %v", err)
+	}
+	snapshots, _ := r.Snapshots()
+	if len(snapshots) != 1 || SnapshotID(snapshots[0].Path) != "prod/2025-01-02T00-00-00Z" {
+		t.Errorf("Expected only the newest snapshot to remain, got %v", snapshots)
+	}
+	check, err := r.Check()
+	if err != nil {
+		t.Fatalf("Check returned error: %v", err)
+	}
+	if !check.OK() || check.Objects != 2 || check.Unreferenced != 0 {
+		t.Errorf("Expected 2 intact objects and no unreferenced ones, got %+v", check)
+	}
+}
+
+func TestGarbageCollectBlocksNewRuns(t *testing.T) {
+	store := &listHook{Storage: storage.NewLocal(t.TempDir()), prefix: objectsDir}
+	r, err := InitRepository(store)
+	if err != nil {
+		t.Fatalf("InitRepository returned error: %v", err)
+	}
+	writeSnapshot(t, r, "prod", "2025-01-01T00-00-00Z", map[string]string{"a.yaml": "a: 1\n"})
+	writeSnapshot(t, r, "prod", "2025-01-02T00-00-00Z", map[string]string{"a.yaml": "a: 2\n"})
+	now := time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	// A run starting during garbage collection could reuse the object of the
+	// snapshot about to be removed
+	var runErr error
+	store.hook = func() { _, runErr = r.BeginSnapshot("prod", "2025-01-02T23-59-00Z") }
+	if _, err := r.GarbageCollect(RetentionPolicy{KeepLast: 1}, time.Hour, now, false); err != nil {
+		t.Fatalf("GarbageCollect returned error: %v", err)
+	}
+	if runErr == nil {
+		t.Errorf("Expected error starting a backup run during garbage collection")
+	}
+	if locks, _ := store.List(locksDir); len(locks) != 0 {
+		t.Errorf("Expected the refused run to leave no lock, got %v", locks)
+	}
+
+	// Once garbage collection is done, runs start again
+	if _, err := r.BeginSnapshot("prod", "2025-01-03T00-00-00Z"); err != nil {
+		t.Errorf("BeginSnapshot returned error: %v", err)
+	}
+
+	// A run that started first blocks garbage collection, which then lets
+	// new runs start
+	if _, err := r.GarbageCollect(RetentionPolicy{KeepLast: 1}, time.Hour, now, false); err == nil {
+		t.Errorf("Expected error while a backup run holds a lock")
+	}
+	if _, err := r.BeginSnapshot("prod", "2025-01-03T00-01-00Z"); err != nil {
+		t.Errorf("BeginSnapshot returned error: %v", err)
+	}
+}
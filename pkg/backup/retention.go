@@ -0,0 +1,249 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// timestampPattern matches backup directory names: a timestamp in
+// TimestampFormat with an optional numeric suffix added by NewLayout
+var timestampPattern = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}Z)(?:-(\d+))?$`)
+
+// archiveExtensions are the file extensions of backup archives
+var archiveExtensions = []string{".tar.gz", ".tgz", ".tar", ".zip"}
+
+// StoredBackup is a backup directory or archive found in a storage
+type StoredBackup struct {
+	// Path is the storage path of the backup directory or archive
+	Path string
+	Time time.Time
+	// Sequence is the numeric suffix of backups started within the same second
+	Sequence int
+	// Complete is set when the backup has a manifest. Archives are always complete.
+	Complete bool
+	Archive  bool
+	// Dir is the directory of the manifest of a complete backup directory:
+	// Path itself, or a directory below it such as all-namespaces
+	Dir string
+}
+
+// Series returns the directory containing the backup. Retention is applied
+// separately to every series, e.g. per cluster with a {{.Cluster}} prefix.
+func (b StoredBackup) Series() string {
+	return path.Dir(b.Path)
+}
+
+// parseBackupName returns the time and sequence of a backup directory or
+// archive name, and whether the name is one
+func parseBackupName(name string) (time.Time, int, bool, bool) {
+	archive := false
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			archive = true
+			break
+		}
+	}
+
+	match := timestampPattern.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, 0, false, false
+	}
+	t, err := time.Parse(TimestampFormat, match[1])
+	if err != nil {
+		return time.Time{}, 0, false, false
+	}
+	sequence := 0
+	if match[2] != "" {
+		sequence, _ = strconv.Atoi(match[2])
+	}
+
+	return t, sequence, archive, true
+}
+
+// FindBackups returns the backups in a storage, newest first. A backup is a
+// directory named after its timestamp, at any depth, or an archive file
+// named after its timestamp. A backup directory is complete when it holds a
+// manifest, at its root or below it; the shallowest one marks its Dir.
+func FindBackups(store storage.Storage) ([]StoredBackup, error) {
+	files, err := store.List("")
+	if err != nil {
+		return nil, fmt.Errorf("error listing backups: %v", err)
+	}
+
+	found := make(map[string]*StoredBackup)
+	for _, file := range files {
+		segments := strings.Split(file, "/")
+		for i, segment := range segments {
+			t, sequence, archive, ok := parseBackupName(segment)
+			if !ok {
+				continue
+			}
+			isFile := i == len(segments)-1
+			if archive != isFile {
+				break
+			}
+
+			backupPath := strings.Join(segments[:i+1], "/")
+			b, exists := found[backupPath]
+			if !exists {
+				b = &StoredBackup{Path: backupPath, Time: t, Sequence: sequence, Archive: archive, Complete: archive}
+				found[backupPath] = b
+			}
+			if !archive && path.Base(file) == ManifestFileName {
+				dir := path.Dir(file)
+				if !b.Complete || strings.Count(dir, "/") < strings.Count(b.Dir, "/") {
+					b.Dir = dir
+				}
+				b.Complete = true
+			}
+			break
+		}
+	}
+
+	backups := make([]StoredBackup, 0, len(found))
+	for _, b := range found {
+		backups = append(backups, *b)
+	}
+	sortBackups(backups)
+
+	return backups, nil
+}
+
+// sortBackups orders backups newest first
+func sortBackups(backups []StoredBackup) {
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].Time.Equal(backups[j].Time) {
+			return backups[i].Time.After(backups[j].Time)
+		}
+		if backups[i].Sequence != backups[j].Sequence {
+			return backups[i].Sequence > backups[j].Sequence
+		}
+		return backups[i].Path < backups[j].Path
+	})
+}
+
+// RetentionPolicy selects the backups to keep in grandfather-father-son style.
+// Only complete backups count towards the policy.
+type RetentionPolicy struct {
+	// KeepLast keeps the newest N backups
+	KeepLast int
+	// KeepDaily keeps the newest backup of each of the last N days with backups
+	KeepDaily int
+	// KeepWeekly keeps the newest backup of each of the last N ISO weeks with backups
+	KeepWeekly int
+	// KeepMonthly keeps the newest backup of each of the last N months with backups
+	KeepMonthly int
+}
+
+// Empty checks if the policy keeps nothing, which would delete every backup
+func (p RetentionPolicy) Empty() bool {
+	return p.KeepLast <= 0 && p.KeepDaily <= 0 && p.KeepWeekly <= 0 && p.KeepMonthly <= 0
+}
+
+// PruneDecision tells whether a backup is kept and why
+type PruneDecision struct {
+	Backup  StoredBackup
+	Keep    bool
+	Reasons []string
+}
+
+// Apply decides which backups to keep. backups must be ordered newest first,
+// as returned by FindBackups. The newest backup of a series is kept when it
+// is incomplete, as it may still be running, unless deleteIncompleteNewest is set.
+func (p RetentionPolicy) Apply(backups []StoredBackup, deleteIncompleteNewest bool) []PruneDecision {
+	type bucketRule struct {
+		reason string
+		limit  int
+		key    func(time.Time) string
+	}
+	rules := []bucketRule{
+		{"last", p.KeepLast, nil},
+		{"daily", p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	decisions := make([]PruneDecision, len(backups))
+	seriesSeen := make(map[string]bool)
+	// buckets[series][rule] holds the bucket keys already kept by a rule
+	buckets := make(map[string][]map[string]bool)
+
+	for i, b := range backups {
+		decisions[i].Backup = b
+		series := b.Series()
+		newest := !seriesSeen[series]
+		seriesSeen[series] = true
+
+		if !b.Complete {
+			if newest && !deleteIncompleteNewest {
+				decisions[i].Keep = true
+				decisions[i].Reasons = []string{"newest, incomplete"}
+			}
+			continue
+		}
+
+		if buckets[series] == nil {
+			buckets[series] = make([]map[string]bool, len(rules))
+			for r := range rules {
+				buckets[series][r] = make(map[string]bool)
+			}
+		}
+		for r, rule := range rules {
+			kept := buckets[series][r]
+			if len(kept) >= rule.limit {
+				continue
+			}
+			key := strconv.Itoa(len(kept))
+			if rule.key != nil {
+				key = rule.key(b.Time)
+			}
+			if kept[key] {
+				continue
+			}
+			kept[key] = true
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, rule.reason)
+		}
+	}
+
+	return decisions
+}
+
+// DeleteBackup removes a backup directory or archive. The manifest of a
+// directory is deleted first, so an interrupted deletion leaves a backup
+// that is recognizably incomplete.
+func DeleteBackup(store storage.Storage, b StoredBackup) error {
+	if b.Archive {
+		return store.Delete(b.Path)
+	}
+
+	dir := b.Dir
+	if dir == "" {
+		dir = b.Path
+	}
+	if err := store.Delete(path.Join(dir, ManifestFileName)); err != nil {
+		return err
+	}
+	files, err := store.List(b.Path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := store.Delete(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+func TestFindBackups(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	files := []string{
+		"2025-01-01T00-00-00Z/kbak-manifest.json",
+		"2025-01-01T00-00-00Z/default/ConfigMap/a.yaml",
+		"2025-01-01T00-00-00Z-1/kbak-manifest.json",
+		"2025-01-02T00-00-00Z/default/ConfigMap/a.yaml",
+		"2024-12-31T00-00-00Z.tar.gz",
+		"prod/2025-01-03T00-00-00Z/all-namespaces/default/ConfigMap/a.yaml",
+		"prod/2025-01-03T00-00-00Z/kbak-manifest.json",
+		"default/ConfigMap/a.yaml",
+		"notes/2025-01-04T00-00-00Z",
+	}
+	for _, file := range files {
+		if err := store.Write(file, []byte("x")); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+	}
+
+	backups, err := FindBackups(store)
+	if err != nil {
+		t.Fatalf("FindBackups returned error: %v", err)
+	}
+
+	want := []StoredBackup{
+		{Path: "prod/2025-01-03T00-00-00Z", Time: time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC), Complete: true, Dir: "prod/2025-01-03T00-00-00Z"},
+		{Path: "2025-01-02T00-00-00Z", Time: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{Path: "2025-01-01T00-00-00Z-1", Time: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), Sequence: 1, Complete: true, Dir: "2025-01-01T00-00-00Z-1"},
+		{Path: "2025-01-01T00-00-00Z", Time: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), Complete: true, Dir: "2025-01-01T00-00-00Z"},
+		{Path: "2024-12-31T00-00-00Z.tar.gz", Time: time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC), Complete: true, Archive: true},
+	}
+	if !reflect.DeepEqual(backups, want) {
+		t.Errorf("FindBackups =\n%+v\nwant\n%+v", backups, want)
+	}
+}
+
+func TestFindBackupsAllNamespaces(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	tmpl, err := ParsePathTemplate(DefaultAllNamespacesPathTemplate)
+	if err != nil {
+		t.Fatalf("ParsePathTemplate returned error: %v", err)
+	}
+
+	// Three complete backups with the manifest in all-namespaces, as written by --all-namespaces
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for day := 0; day < 3; day++ {
+		layout, err := NewLayout(store, tmpl, "", start.AddDate(0, 0, day))
+		if err != nil {
+			t.Fatalf("NewLayout returned error: %v", err)
+		}
+		file, _ := layout.ObjectPath("default", "ConfigMap", "a")
+		store.Write(file, []byte("x"))
+		store.Write(layout.RunDir()+"/"+ManifestFileName, []byte("{}\n"))
+	}
+
+	backups, err := FindBackups(store)
+	if err != nil {
+		t.Fatalf("FindBackups returned error: %v", err)
+	}
+	for _, b := range backups {
+		if !b.Complete || b.Dir != b.Path+"/all-namespaces" {
+			t.Errorf("Expected %s to be complete with its manifest in all-namespaces, got %+v", b.Path, b)
+		}
+	}
+
+	decisions := RetentionPolicy{KeepLast: 3}.Apply(backups, false)
+	if kept := keptPaths(decisions); len(kept) != 3 {
+		t.Errorf("Expected every backup to be kept, got %v", kept)
+	}
+
+	// The manifest is deleted first, so a partly deleted backup is incomplete
+	if err := DeleteBackup(store, backups[2]); err != nil {
+		t.Fatalf("DeleteBackup returned error: %v", err)
+	}
+	if exists, _ := store.Exists(backups[2].Dir + "/" + ManifestFileName); exists {
+		t.Errorf("Expected the manifest of %s to be deleted", backups[2].Path)
+	}
+	if backups, _ = FindBackups(store); len(backups) != 2 {
+		t.Errorf("Expected 2 backups left, got %+v", backups)
+	}
+}
+
+// dailyBackups returns complete backups at noon of the given days of 2025, newest first
+func dailyBackups(dates ...string) []StoredBackup {
+	var backups []StoredBackup
+	for i := len(dates) - 1; i >= 0; i-- {
+		ts, _ := time.Parse("2006-01-02", dates[i])
+		ts = ts.Add(12 * time.Hour)
+		backups = append(backups, StoredBackup{Path: ts.Format(TimestampFormat), Time: ts, Complete: true})
+	}
+	return backups
+}
+
+// keptPaths returns the paths of the kept backups
+func keptPaths(decisions []PruneDecision) []string {
+	var kept []string
+	for _, d := range decisions {
+		if d.Keep {
+			kept = append(kept, d.Backup.Path)
+		}
+	}
+	return kept
+}
+
+func TestRetentionPolicyApply(t *testing.T) {
+	backups := dailyBackups("2025-01-15", "2025-02-01", "2025-02-10", "2025-02-11", "2025-03-01", "2025-03-02", "2025-03-03")
+
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		want   []string
+	}{
+		{
+			name:   "keep last",
+			policy: RetentionPolicy{KeepLast: 2},
+			want:   []string{"2025-03-03T12-00-00Z", "2025-03-02T12-00-00Z"},
+		},
+		{
+			name:   "keep daily",
+			policy: RetentionPolicy{KeepDaily: 3},
+			want:   []string{"2025-03-03T12-00-00Z", "2025-03-02T12-00-00Z", "2025-03-01T12-00-00Z"},
+		},
+		{
+			// 2025-03-03 is a Monday, 2025-03-01 and 02 are in the previous ISO week
+			name:   "keep weekly",
+			policy: RetentionPolicy{KeepWeekly: 3},
+			want:   []string{"2025-03-03T12-00-00Z", "2025-03-02T12-00-00Z", "2025-02-11T12-00-00Z"},
+		},
+		{
+			name:   "keep monthly",
+			policy: RetentionPolicy{KeepMonthly: 12},
+			want:   []string{"2025-03-03T12-00-00Z", "2025-02-11T12-00-00Z", "2025-01-15T12-00-00Z"},
+		},
+		{
+			name:   "combined",
+			policy: RetentionPolicy{KeepLast: 1, KeepMonthly: 2},
+			want:   []string{"2025-03-03T12-00-00Z", "2025-02-11T12-00-00Z"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := keptPaths(test.policy.Apply(backups, false))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Kept %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetentionPolicyIncompleteBackups(t *testing.T) {
+	backups := dailyBackups("2025-03-01", "2025-03-02", "2025-03-03")
+	backups[0].Complete = false
+	backups[1].Complete = false
+
+	decisions := RetentionPolicy{KeepLast: 1}.Apply(backups, false)
+	want := []string{"2025-03-03T12-00-00Z", "2025-03-01T12-00-00Z"}
+	if got := keptPaths(decisions); !reflect.DeepEqual(got, want) {
+		t.Errorf("Kept %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(decisions[0].Reasons, []string{"newest, incomplete"}) {
+		t.Errorf("Unexpected reasons for the newest incomplete backup: %v", decisions[0].Reasons)
+	}
+
+	decisions = RetentionPolicy{KeepLast: 1}.Apply(backups, true)
+	want = []string{"2025-03-01T12-00-00Z"}
+	if got := keptPaths(decisions); !reflect.DeepEqual(got, want) {
+		t.Errorf("Kept %v with deleteIncompleteNewest, want %v", got, want)
+	}
+}
+
+func TestRetentionPolicyPerSeries(t *testing.T) {
+	backups := []StoredBackup{
+		{Path: "prod/2025-03-02T00-00-00Z", Time: time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC), Complete: true},
+		{Path: "staging/2025-03-02T00-00-00Z", Time: time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC), Complete: true},
+		{Path: "prod/2025-03-01T00-00-00Z", Time: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), Complete: true},
+	}
+
+	want := []string{"prod/2025-03-02T00-00-00Z", "staging/2025-03-02T00-00-00Z"}
+	if got := keptPaths(RetentionPolicy{KeepLast: 1}.Apply(backups, false)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Kept %v, want %v", got, want)
+	}
+}
+
+func TestDeleteBackup(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	for _, file := range []string{"run/kbak-manifest.json", "run/default/ConfigMap/a.yaml", "other/a.yaml", "2025-01-01T00-00-00Z.tgz"} {
+		if err := store.Write(file, []byte("x")); err != nil {
+			t.Fatalf("Write returned error: %v", err)
+		}
+	}
+
+	if err := DeleteBackup(store, StoredBackup{Path: "run"}); err != nil {
+		t.Fatalf("DeleteBackup returned error: %v", err)
+	}
+	if err := DeleteBackup(store, StoredBackup{Path: "2025-01-01T00-00-00Z.tgz", Archive: true}); err != nil {
+		t.Fatalf("DeleteBackup returned error: %v", err)
+	}
+
+	paths, err := store.List("")
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	if !reflect.DeepEqual(paths, []string{"other/a.yaml"}) {
+		t.Errorf("Expected only unrelated files to remain, got %v", paths)
+	}
+}
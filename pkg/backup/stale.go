@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// RemoveStaleFiles deletes files that are listed in the previous manifest of the storage directory dir
+// but were not written by the current run, i.e. files of deleted objects.
+// Only namespaces covered by the current run (or, for all-namespaces runs,
+// namespaces that no longer exist) and kinds that were backed up without errors
+// are considered, so a failed listing never deletes files.
+// Returns the files that were removed.
+func RemoveStaleFiles(store storage.Storage, dir string, previous, current *Manifest, kinds []string) ([]ManifestFile, error) {
+	if previous == nil {
+		return nil, nil
+	}
+
+	written := make(map[string]bool, len(current.Files))
+	for _, file := range current.Files {
+		written[file.Path] = true
+	}
+
+	var removed []ManifestFile
+	for _, file := range staleFiles(previous.Files, current, written, kinds) {
+		filename, err := resolveManifestPath(dir, file.Path)
+		if err != nil {
+			return removed, err
+		}
+		if err := store.Delete(filename); err != nil {
+			return removed, fmt.Errorf("error removing stale file %s: %v", store.Location(filename), err)
+		}
+		removed = append(removed, file)
+	}
+
+	return removed, nil
+}
+
+// staleFiles returns the previous files whose path is not in seen, limited to
+// the given kinds and to the namespaces RemoveStaleFiles considers
+func staleFiles(previous []ManifestFile, current *Manifest, seen map[string]bool, kinds []string) []ManifestFile {
+	selectedKinds := make(map[string]bool, len(kinds))
+	for _, kind := range kinds {
+		selectedKinds[kind] = true
+	}
+
+	var stale []ManifestFile
+	for _, file := range previous {
+		if seen[file.Path] || !selectedKinds[file.Kind] {
+			continue
+		}
+		summary, ok := current.Namespaces[file.Namespace]
+		if !ok && !current.Filters.AllNamespaces {
+			continue
+		}
+		if ok && summary.ResourceErrors[file.Kind] > 0 {
+			continue
+		}
+		stale = append(stale, file)
+	}
+
+	return stale
+}
+
+// SameContent checks if two manifests describe the same backup content,
+// ignoring when the runs happened
+func (m *Manifest) SameContent(other *Manifest) bool {
+	if other == nil {
+		return false
+	}
+	m.sortFiles()
+	other.sortFiles()
+	a, b := *m, *other
+	a.Timestamp, b.Timestamp = "", ""
+	a.StartedAt, b.StartedAt = time.Time{}, time.Time{}
+	a.CompletedAt, b.CompletedAt = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+// resolveManifestPath converts a manifest file path to a storage path inside dir,
+// rejecting paths that would escape it
+func resolveManifestPath(dir, manifestPath string) (string, error) {
+	cleaned := path.Clean(manifestPath)
+	if cleaned == "." || path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("manifest path %q is outside of the backup directory", manifestPath)
+	}
+	return path.Join(dir, cleaned), nil
+}
@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+func TestRemoveStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"default/ConfigMap/kept.yaml",
+		"default/ConfigMap/deleted.yaml",
+		"default/Secret/failed.yaml",
+		"default/Pod/unselected.yaml",
+		"other/ConfigMap/other.yaml",
+	}
+	for _, file := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatalf("MkdirAll returned error: %v", err)
+		}
+		if err := os.WriteFile(filename, []byte("data"), 0644); err != nil {
+			t.Fatalf("WriteFile returned error: %v", err)
+		}
+	}
+
+	previous := &Manifest{Files: []ManifestFile{
+		{Path: "default/ConfigMap/kept.yaml", Namespace: "default", Kind: "ConfigMap"},
+		{Path: "default/ConfigMap/deleted.yaml", Namespace: "default", Kind: "ConfigMap"},
+		{Path: "default/Secret/failed.yaml", Namespace: "default", Kind: "Secret"},
+		{Path: "default/Pod/unselected.yaml", Namespace: "default", Kind: "Pod"},
+		{Path: "other/ConfigMap/other.yaml", Namespace: "other", Kind: "ConfigMap"},
+	}}
+	current := &Manifest{
+		Namespaces: map[string]NamespaceSummary{
+			"default": {ResourceErrors: map[string]int{"Secret": 1}},
+		},
+		Files: []ManifestFile{
+			{Path: "default/ConfigMap/kept.yaml", Namespace: "default", Kind: "ConfigMap"},
+		},
+	}
+
+	store := storage.NewLocal(dir)
+	removed, err := RemoveStaleFiles(store, "", previous, current, []string{"ConfigMap", "Secret"})
+	if err != nil {
+		t.Fatalf("RemoveStaleFiles returned error: %v", err)
+	}
+	if len(removed) != 1 || removed[0].Path != "default/ConfigMap/deleted.yaml" {
+		t.Fatalf("Expected only deleted.yaml to be removed, got %v", removed)
+	}
+	for _, file := range files {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(file)))
+		if exists := err == nil; exists != (file != "default/ConfigMap/deleted.yaml") {
+			t.Errorf("Unexpected existence of %s: %v", file, err)
+		}
+	}
+
+	// A namespace that no longer exists is removed in all-namespaces runs
+	current.Filters.AllNamespaces = true
+	if _, err := RemoveStaleFiles(store, "", previous, current, []string{"ConfigMap"}); err != nil {
+		t.Fatalf("RemoveStaleFiles returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other")); !os.IsNotExist(err) {
+		t.Errorf("Expected empty namespace directory to be removed, got %v", err)
+	}
+}
+
+func TestRemoveStaleFilesRejectsEscapingPaths(t *testing.T) {
+	previous := &Manifest{Files: []ManifestFile{{Path: "../outside.yaml", Namespace: "default", Kind: "ConfigMap"}}}
+	current := &Manifest{Namespaces: map[string]NamespaceSummary{"default": {}}}
+
+	if _, err := RemoveStaleFiles(storage.NewLocal(t.TempDir()), "", previous, current, []string{"ConfigMap"}); err == nil {
+		t.Errorf("Expected error for path outside of the backup directory")
+	}
+}
+
+func TestManifestSameContent(t *testing.T) {
+	a := &Manifest{Timestamp: "a", Files: []ManifestFile{{Path: "x", SHA256: "1"}}}
+	b := &Manifest{Timestamp: "b", Files: []ManifestFile{{Path: "x", SHA256: "1"}}}
+	if !a.SameContent(b) {
+		t.Errorf("Expected manifests differing only in run time to have the same content")
+	}
+	b.Files[0].SHA256 = "2"
+	if a.SameContent(b) {
+		t.Errorf("Expected manifests with different checksums to differ")
+	}
+}
@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// SignatureExtension is appended to the name of a signed manifest or snapshot index
+const SignatureExtension = ".sig"
+
+// SignatureFileName is the name of the manifest signature written next to the manifest
+const SignatureFileName = ManifestFileName + SignatureExtension
+
+// Verification is the result of checking the files of a backup against its manifest
+type Verification struct {
+	Manifest *Manifest
+	// Verified is the number of files whose checksum matches
+	Verified int
+	// Modified files exist but their size or checksum differs from the manifest
+	Modified []ManifestFile
+	// Missing files are listed in the manifest but do not exist
+	Missing []ManifestFile
+	// Extra files exist in the backup directory but are not listed in the manifest
+	Extra []string
+}
+
+// OK checks if every file matches the manifest and there are no extra files
+func (v *Verification) OK() bool {
+	return len(v.Modified) == 0 && len(v.Missing) == 0 && len(v.Extra) == 0
+}
+
+// VerifyBackup re-hashes every file and attachment listed in the manifest of
+// the backup in the storage directory dir and looks for files it does not
+// list. The manifest, its signature and git metadata are not extra files.
+func VerifyBackup(store storage.Storage, dir string) (*Verification, error) {
+	manifest, err := ReadManifest(store, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading backup manifest: %v", err)
+	}
+	v := &Verification{Manifest: manifest}
+
+	listed := map[string]bool{ManifestFileName: true, SignatureFileName: true}
+	for _, file := range append(append([]ManifestFile{}, manifest.Files...), manifest.Attachments...) {
+		filename, err := resolveManifestPath(dir, file.Path)
+		if err != nil {
+			return nil, err
+		}
+		listed[path.Clean(file.Path)] = true
+
+		data, err := store.Read(filename)
+		if errors.Is(err, fs.ErrNotExist) {
+			v.Missing = append(v.Missing, file)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		checksum := sha256.Sum256(data)
+		if int64(len(data)) != file.Size || hex.EncodeToString(checksum[:]) != file.SHA256 {
+			v.Modified = append(v.Modified, file)
+			continue
+		}
+		v.Verified++
+	}
+
+	files, err := store.List(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing backup files: %v", err)
+	}
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	for _, file := range files {
+		rel := strings.TrimPrefix(file, prefix)
+		if listed[rel] || rel == ".git" || strings.HasPrefix(rel, ".git/") {
+			continue
+		}
+		v.Extra = append(v.Extra, rel)
+	}
+
+	return v, nil
+}
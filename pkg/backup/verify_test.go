@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/rogosprojects/kbak/pkg/storage"
+)
+
+// manifestFile returns the manifest entry of a file with the given content
+func manifestFile(filePath, kind string, data []byte) ManifestFile {
+	checksum := sha256.Sum256(data)
+	return ManifestFile{Path: filePath, Kind: kind, Size: int64(len(data)), SHA256: hex.EncodeToString(checksum[:])}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	store := storage.NewLocal(t.TempDir())
+	files := map[string]string{
+		"default/ConfigMap/a.yaml": "a: 1\n",
+		"default/ConfigMap/b.yaml": "b: 1\n",
+		"default/Secret/c.yaml":    "c: 1\n",
+	}
+	manifest := &Manifest{Namespaces: map[string]NamespaceSummary{}}
+	for name, content := range files {
+		store.Write("run/"+name, []byte(content))
+		manifest.Files = append(manifest.Files, manifestFile(name, "ConfigMap", []byte(content)))
+	}
+	if err := manifest.AddAttachment(store, "run", "kbak-redactions.json", []byte("{}\n")); err != nil {
+		t.Fatalf("AddAttachment returned error: %v", err)
+	}
+	if err := manifest.Write(store, "run"); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	store.Write("run/"+SignatureFileName, []byte("sig\n"))
+
+	v, err := VerifyBackup(store, "run")
+	if err != nil {
+		t.Fatalf("VerifyBackup returned error: %v", err)
+	}
+	if !v.OK() || v.Verified != 4 {
+		t.Errorf("Expected an intact backup with 4 verified files, got %+v", v)
+	}
+
+	store.Write("run/default/ConfigMap/a.yaml", []byte("a: 2\n"))
+	store.Delete("run/default/Secret/c.yaml")
+	store.Write("run/default/ConfigMap/d.yaml", []byte("d: 1\n"))
+	store.Write("run/kbak-redactions.json", []byte("{\"redactions\":[]}\n"))
+
+	v, err = VerifyBackup(store, "run")
+	if err != nil {
+		t.Fatalf("VerifyBackup returned error: %v", err)
+	}
+	if v.OK() || v.Verified != 1 {
+		t.Errorf("Expected a modified backup with 1 verified file, got %+v", v)
+	}
+	var modified, missing []string
+	for _, file := range v.Modified {
+		modified = append(modified, file.Path)
+	}
+	for _, file := range v.Missing {
+		missing = append(missing, file.Path)
+	}
+	if !reflect.DeepEqual(modified, []string{"default/ConfigMap/a.yaml", "kbak-redactions.json"}) {
+		t.Errorf("Unexpected modified files %v", modified)
+	}
+	if !reflect.DeepEqual(missing, []string{"default/Secret/c.yaml"}) {
+		t.Errorf("Unexpected missing files %v", missing)
+	}
+	if !reflect.DeepEqual(v.Extra, []string{"default/ConfigMap/d.yaml"}) {
+		t.Errorf("Unexpected extra files %v", v.Extra)
+	}
+
+	if _, err := VerifyBackup(store, "missing"); err == nil {
+		t.Errorf("Expected error for a backup without manifest")
+	}
+}
@@ -10,28 +10,49 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// InClusterName is used as context and cluster name when running inside a pod
+const InClusterName = "in-cluster"
+
 // K8sClient contains the Kubernetes clientset and configuration
 type K8sClient struct {
 	Clientset *kubernetes.Clientset
 	Config    *rest.Config
+	// Context is the kubeconfig context in use, or InClusterName
+	Context string
+	// Cluster is the kubeconfig cluster name of the context, or InClusterName
+	Cluster string
 }
 
 // NewClient creates a new Kubernetes client from the provided kubeconfig path
 func NewClient(kubeconfig string, verbose bool) (*K8sClient, error) {
+	return NewClientForContext(kubeconfig, "", verbose)
+}
+
+// NewClientForContext creates a new Kubernetes client for a context of the
+// kubeconfig. Without a context it uses the in-cluster configuration when
+// running in a pod, and the current context otherwise.
+func NewClientForContext(kubeconfig, kubeContext string, verbose bool) (*K8sClient, error) {
 	// Load kubeconfig
 	// First try using in-cluster config if running in a pod
-	config, err := rest.InClusterConfig()
-	if err != nil {
+	contextName, clusterName := InClusterName, InClusterName
+	var config *rest.Config
+	if kubeContext == "" {
+		config, _ = rest.InClusterConfig()
+	}
+	if config == nil {
 		// Fall back to kubeconfig file
 		// Get the current context from the kubeconfig
 		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
 		loadingRules.ExplicitPath = kubeconfig
-		configOverrides := &clientcmd.ConfigOverrides{}
+		configOverrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
 
 		kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
 		clientConfig, err := kubeConfig.ClientConfig()
+		if err != nil && kubeContext != "" {
+			return nil, fmt.Errorf("error building kubeconfig for context %s: %v", kubeContext, err)
+		}
 		if err != nil {
-			fmt.Printf("%s %s%sError building kubeconfig from current context: %v%s\n",
+			fmt.Fprintf(utils.StatusOutput, "%s %s%sError building kubeconfig from current context: %v%s\n",
 				utils.ErrorEmoji, utils.Red, utils.Bold, err, utils.Reset)
 			// Fall back to default config as a last resort
 			config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
@@ -41,10 +62,12 @@ func NewClient(kubeconfig string, verbose bool) (*K8sClient, error) {
 		} else {
 			config = clientConfig
 		}
+
+		contextName, clusterName = currentContext(kubeConfig, kubeContext)
 	}
 
 	if verbose {
-		fmt.Printf("%s %s%sUsing Kubernetes API at: %s%s\n",
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sUsing Kubernetes API at: %s%s\n",
 			utils.K8sEmoji, utils.Blue, utils.Bold, config.Host, utils.Reset)
 	}
 
@@ -57,5 +80,29 @@ func NewClient(kubeconfig string, verbose bool) (*K8sClient, error) {
 	return &K8sClient{
 		Clientset: clientset,
 		Config:    config,
+		Context:   contextName,
+		Cluster:   clusterName,
 	}, nil
 }
+
+// currentContext returns the names of the current kubeconfig context, or of
+// the requested one, and its cluster
+func currentContext(kubeConfig clientcmd.ClientConfig, kubeContext string) (string, string) {
+	rawConfig, err := kubeConfig.RawConfig()
+	if err != nil {
+		return "", ""
+	}
+	if kubeContext == "" {
+		kubeContext = rawConfig.CurrentContext
+	}
+	if kubeContext == "" {
+		return "", ""
+	}
+
+	clusterName := ""
+	if ctx, ok := rawConfig.Contexts[kubeContext]; ok && ctx != nil {
+		clusterName = ctx.Cluster
+	}
+
+	return kubeContext, clusterName
+}
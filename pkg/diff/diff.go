@@ -0,0 +1,346 @@
+package diff
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/rogosprojects/kbak/pkg/backup"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Change types
+const (
+	TypeAdded    = "added"
+	TypeRemoved  = "removed"
+	TypeModified = "modified"
+)
+
+// Placeholders of Secret values unless Options.ShowSecrets is set
+const (
+	HiddenValue    = "<hidden>"
+	HiddenOldValue = "<hidden old value>"
+	HiddenNewValue = "<hidden new value>"
+)
+
+// plainKey matches map keys that can be written as .key in a field path
+var plainKey = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Options controls how objects are compared
+type Options struct {
+	// Context is the number of unchanged lines around each hunk of a diff
+	Context int
+	// ShowSecrets includes the values of Secret data in changes and diffs
+	ShowSecrets bool
+	// Ignore lists the fields left out of the comparison and the diffs
+	Ignore []Rule
+	// Replace rewrites values of the old objects, so that known differences
+	// between environments do not count as changes
+	Replace []Replacement
+}
+
+// FieldChange records one changed field of an object. Old is unset for
+// added fields and New for removed ones.
+type FieldChange struct {
+	// Path is the path of the field, e.g. spec.replicas,
+	// metadata.annotations["example.com/owner"] or
+	// spec.template.spec.containers[app].image
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// Change records an added, removed or modified object
+type Change struct {
+	Namespace string        `json:"namespace,omitempty"`
+	Kind      string        `json:"kind"`
+	Name      string        `json:"name"`
+	Type      string        `json:"type"`
+	Fields    []FieldChange `json:"fields,omitempty"`
+	// Diff is the unified diff of the YAML of a modified object
+	Diff string `json:"diff,omitempty"`
+}
+
+// Report lists the changes between two sets of objects
+type Report struct {
+	Old      string   `json:"old"`
+	New      string   `json:"new"`
+	Added    int      `json:"added"`
+	Removed  int      `json:"removed"`
+	Modified int      `json:"modified"`
+	Changes  []Change `json:"changes"`
+}
+
+// Changed checks if any object was added, removed or modified
+func (r *Report) Changed() bool {
+	return len(r.Changes) > 0
+}
+
+// Compare compares the manifests of two sets of objects. Objects are parsed
+// and compared field by field, so differences in formatting only are ignored.
+func Compare(old, new map[backup.ObjectKey][]byte, opts Options) (*Report, error) {
+	report := &Report{Changes: []Change{}}
+
+	keys := make(map[backup.ObjectKey]bool, len(old)+len(new))
+	for key := range old {
+		keys[key] = true
+	}
+	for key := range new {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		oldData, inOld := old[key]
+		newData, inNew := new[key]
+		change := Change{Namespace: key.Namespace, Kind: key.Kind, Name: key.Name}
+
+		switch {
+		case !inOld:
+			change.Type = TypeAdded
+			report.Added++
+		case !inNew:
+			change.Type = TypeRemoved
+			report.Removed++
+		default:
+			oldObj, err := backup.ParseObject(oldData)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing old %s: %v", key, err)
+			}
+			newObj, err := backup.ParseObject(newData)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing new %s: %v", key, err)
+			}
+			removeIgnored(oldObj, key.Kind, opts.Ignore)
+			removeIgnored(newObj, key.Kind, opts.Ignore)
+			applyReplacements(oldObj, key.Kind, opts.Replace)
+			if key.Kind == "Secret" && !opts.ShowSecrets {
+				oldObj, newObj = hideSecretData(oldObj, newObj)
+			}
+
+			change.Fields = Fields(oldObj, newObj)
+			if len(change.Fields) == 0 {
+				continue
+			}
+			change.Type = TypeModified
+			diff, err := Unified(oldObj, newObj, "a/"+key.String(), "b/"+key.String(), opts.Context)
+			if err != nil {
+				return nil, fmt.Errorf("error comparing %s: %v", key, err)
+			}
+			change.Diff = diff
+			report.Modified++
+		}
+		report.Changes = append(report.Changes, change)
+	}
+
+	sort.Slice(report.Changes, func(i, j int) bool {
+		a, b := report.Changes[i], report.Changes[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+
+	return report, nil
+}
+
+// Fields returns the changed fields between two parsed objects
+func Fields(old, new interface{}) []FieldChange {
+	var changes []FieldChange
+	compareValues("", old, new, &changes)
+	return changes
+}
+
+// compareValues appends the differences between two values at path
+func compareValues(path string, old, new interface{}, changes *[]FieldChange) {
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		keys := make([]string, 0, len(oldMap)+len(newMap))
+		for key := range oldMap {
+			keys = append(keys, key)
+		}
+		for key := range newMap {
+			if _, ok := oldMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			oldValue, inOld := oldMap[key]
+			newValue, inNew := newMap[key]
+			switch {
+			case !inOld:
+				*changes = append(*changes, FieldChange{Path: keyPath(path, key), New: newValue})
+			case !inNew:
+				*changes = append(*changes, FieldChange{Path: keyPath(path, key), Old: oldValue})
+			default:
+				compareValues(keyPath(path, key), oldValue, newValue, changes)
+			}
+		}
+		return
+	}
+
+	oldList, oldIsList := old.([]interface{})
+	newList, newIsList := new.([]interface{})
+	if oldIsList && newIsList {
+		compareLists(path, oldList, newList, changes)
+		return
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		*changes = append(*changes, FieldChange{Path: path, Old: old, New: new})
+	}
+}
+
+// compareLists appends the differences between two lists at path. Lists of
+// named items, like containers or env, are matched by name, other lists by
+// index.
+func compareLists(path string, old, new []interface{}, changes *[]FieldChange) {
+	oldNames, oldNamed := itemNames(old)
+	newNames, newNamed := itemNames(new)
+	if !oldNamed || !newNamed {
+		for i := 0; i < len(old) || i < len(new); i++ {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(old):
+				*changes = append(*changes, FieldChange{Path: itemPath, New: new[i]})
+			case i >= len(new):
+				*changes = append(*changes, FieldChange{Path: itemPath, Old: old[i]})
+			default:
+				compareValues(itemPath, old[i], new[i], changes)
+			}
+		}
+		return
+	}
+
+	newIndex := make(map[string]int, len(newNames))
+	for i, name := range newNames {
+		newIndex[name] = i
+	}
+	oldIndex := make(map[string]bool, len(oldNames))
+	for i, name := range oldNames {
+		oldIndex[name] = true
+		itemPath := path + "[" + name + "]"
+		if j, ok := newIndex[name]; ok {
+			compareValues(itemPath, old[i], new[j], changes)
+		} else {
+			*changes = append(*changes, FieldChange{Path: itemPath, Old: old[i]})
+		}
+	}
+	for j, name := range newNames {
+		if !oldIndex[name] {
+			*changes = append(*changes, FieldChange{Path: path + "[" + name + "]", New: new[j]})
+		}
+	}
+}
+
+// itemNames returns the names of the items of a list if every item is a map
+// with a unique name
+func itemNames(list []interface{}) ([]string, bool) {
+	if len(list) == 0 {
+		return nil, true
+	}
+	names := make([]string, 0, len(list))
+	seen := make(map[string]bool, len(list))
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, ok := m["name"].(string)
+		if !ok || seen[name] {
+			return nil, false
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, true
+}
+
+// keyPath appends a map key to a field path
+func keyPath(path, key string) string {
+	if !plainKey.MatchString(key) {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// hideSecretData returns copies of two Secrets with the values of data and
+// stringData replaced by placeholders, which still show whether a value changed
+func hideSecretData(old, new map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	old, new = shallowCopy(old), shallowCopy(new)
+	for _, field := range []string{"data", "stringData"} {
+		oldData, _ := old[field].(map[string]interface{})
+		newData, _ := new[field].(map[string]interface{})
+		hiddenOld := make(map[string]interface{}, len(oldData))
+		hiddenNew := make(map[string]interface{}, len(newData))
+		for key, oldValue := range oldData {
+			hiddenOld[key] = HiddenValue
+			if newValue, ok := newData[key]; ok && !reflect.DeepEqual(oldValue, newValue) {
+				hiddenOld[key] = HiddenOldValue
+			}
+		}
+		for key, newValue := range newData {
+			hiddenNew[key] = HiddenValue
+			if oldValue, ok := oldData[key]; ok && !reflect.DeepEqual(oldValue, newValue) {
+				hiddenNew[key] = HiddenNewValue
+			}
+		}
+		if oldData != nil {
+			old[field] = hiddenOld
+		}
+		if newData != nil {
+			new[field] = hiddenNew
+		}
+	}
+	return old, new
+}
+
+// shallowCopy copies the top level of an object
+func shallowCopy(obj map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(obj))
+	for key, value := range obj {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Unified returns the unified diff of the YAML of two parsed objects, or an
+// empty string if they are equal
+func Unified(old, new interface{}, oldName, newName string, context int) (string, error) {
+	oldYAML, err := yaml.Marshal(old)
+	if err != nil {
+		return "", err
+	}
+	newYAML, err := yaml.Marshal(new)
+	if err != nil {
+		return "", err
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(string(oldYAML)),
+		B:        splitLines(string(newYAML)),
+		FromFile: oldName,
+		ToFile:   newName,
+		Context:  context,
+	})
+}
+
+// splitLines splits text into lines keeping their line breaks. Unlike
+// difflib.SplitLines it adds no empty line after a final line break.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
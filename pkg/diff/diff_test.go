@@ -0,0 +1,147 @@
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+)
+
+func TestCompare(t *testing.T) {
+	old := map[backup.ObjectKey][]byte{
+		{Namespace: "default", Kind: "ConfigMap", Name: "same"}:    []byte("data:\n  a: \"1\"\n"),
+		{Namespace: "default", Kind: "ConfigMap", Name: "format"}:  []byte("data: {a: \"1\", b: \"2\"}\n"),
+		{Namespace: "default", Kind: "ConfigMap", Name: "changed"}: []byte("data:\n  a: \"1\"\n"),
+		{Namespace: "default", Kind: "ConfigMap", Name: "removed"}: []byte("data: {}\n"),
+	}
+	new := map[backup.ObjectKey][]byte{
+		{Namespace: "default", Kind: "ConfigMap", Name: "same"}:    []byte("data:\n  a: \"1\"\n"),
+		{Namespace: "default", Kind: "ConfigMap", Name: "format"}:  []byte("data:\n  b: \"2\"\n  a: \"1\"\n"),
+		{Namespace: "default", Kind: "ConfigMap", Name: "changed"}: []byte("data:\n  a: \"2\"\n"),
+		{Namespace: "", Kind: "ClusterRole", Name: "added"}:        []byte("rules: []\n"),
+	}
+
+	report, err := Compare(old, new, Options{Context: 3})
+	if err != nil {
+		t.Fatalf("Compare returned error: %v", err)
+	}
+	if report.Added != 1 || report.Removed != 1 || report.Modified != 1 {
+		t.Errorf("Expected 1 added, 1 removed and 1 modified object, got %d, %d and %d", report.Added, report.Removed, report.Modified)
+	}
+
+	var got []string
+	for _, change := range report.Changes {
+		got = append(got, change.Type+" "+change.Kind+"/"+change.Name)
+	}
+	want := []string{"added ClusterRole/added", "modified ConfigMap/changed", "removed ConfigMap/removed"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected changes %v, got %v", want, got)
+	}
+
+	changed := report.Changes[1]
+	if !reflect.DeepEqual(changed.Fields, []FieldChange{{Path: "data.a", Old: "1", New: "2"}}) {
+		t.Errorf("Expected data.a to change, got %v", changed.Fields)
+	}
+	for _, line := range []string{"--- a/default/ConfigMap/changed", "+++ b/default/ConfigMap/changed", "-  a: \"1\"", "+  a: \"2\""} {
+		if !strings.Contains(changed.Diff, line+"\n") {
+			t.Errorf("Expected diff to contain %q, got:\n%s", line, changed.Diff)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want []FieldChange
+	}{
+		{
+			name: "added and removed fields",
+			old:  "spec:\n  replicas: 1\n  paused: true\n",
+			new:  "spec:\n  replicas: 1\n  minReadySeconds: 5\n",
+			want: []FieldChange{
+				{Path: "spec.minReadySeconds", New: float64(5)},
+				{Path: "spec.paused", Old: true},
+			},
+		},
+		{
+			name: "keys with special characters",
+			old:  "metadata:\n  annotations:\n    example.com/owner: a\n",
+			new:  "metadata:\n  annotations:\n    example.com/owner: b\n",
+			want: []FieldChange{{Path: `metadata.annotations["example.com/owner"]`, Old: "a", New: "b"}},
+		},
+		{
+			name: "named items matched by name",
+			old:  "containers:\n- name: app\n  image: app:1\n- name: sidecar\n  image: proxy:1\n",
+			new:  "containers:\n- name: sidecar\n  image: proxy:1\n- name: app\n  image: app:2\n",
+			want: []FieldChange{{Path: "containers[app].image", Old: "app:1", New: "app:2"}},
+		},
+		{
+			name: "other lists by index",
+			old:  "args: [a, b]\n",
+			new:  "args: [a, c, d]\n",
+			want: []FieldChange{
+				{Path: "args[1]", Old: "b", New: "c"},
+				{Path: "args[2]", New: "d"},
+			},
+		},
+		{
+			name: "changed type",
+			old:  "spec:\n  ports: 80\n",
+			new:  "spec:\n  ports: [80]\n",
+			want: []FieldChange{{Path: "spec.ports", Old: float64(80), New: []interface{}{float64(80)}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, err := backup.ParseObject([]byte(tt.old))
+			if err != nil {
+				t.Fatalf("ParseObject returned error: %v", err)
+			}
+			new, err := backup.ParseObject([]byte(tt.new))
+			if err != nil {
+				t.Fatalf("ParseObject returned error: %v", err)
+			}
+			if got := Fields(old, new); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCompareHidesSecrets(t *testing.T) {
+	key := backup.ObjectKey{Namespace: "default", Kind: "Secret", Name: "db"}
+	old := map[backup.ObjectKey][]byte{key: []byte("data:\n  password: b2xk\n  user: dXNlcg==\n")}
+	new := map[backup.ObjectKey][]byte{key: []byte("data:\n  password: bmV3\n  user: dXNlcg==\n  token: dG9rZW4=\n")}
+
+	report, err := Compare(old, new, Options{Context: 3})
+	if err != nil {
+		t.Fatalf("Compare returned error: %v", err)
+	}
+	if len(report.Changes) != 1 {
+		t.Fatalf("Expected 1 change, got %v", report.Changes)
+	}
+	want := []FieldChange{
+		{Path: "data.password", Old: HiddenOldValue, New: HiddenNewValue},
+		{Path: "data.token", New: HiddenValue},
+	}
+	if !reflect.DeepEqual(report.Changes[0].Fields, want) {
+		t.Errorf("Expected %v, got %v", want, report.Changes[0].Fields)
+	}
+	for _, value := range []string{"b2xk", "bmV3", "dXNlcg==", "dG9rZW4="} {
+		if strings.Contains(report.Changes[0].Diff, value) {
+			t.Errorf("Expected diff to hide %s, got:\n%s", value, report.Changes[0].Diff)
+		}
+	}
+
+	report, err = Compare(old, new, Options{Context: 3, ShowSecrets: true})
+	if err != nil {
+		t.Fatalf("Compare returned error: %v", err)
+	}
+	if !strings.Contains(report.Changes[0].Diff, "+  password: bmV3\n") {
+		t.Errorf("Expected diff to show the new password, got:\n%s", report.Changes[0].Diff)
+	}
+}
@@ -0,0 +1,87 @@
+package diff
+
+import (
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+)
+
+// Version is the manifest of an object in one backup
+type Version struct {
+	Backup string
+	Time   time.Time
+	// Data is nil when the backup does not hold the object
+	Data []byte
+}
+
+// Revision is a distinct state of an object, from the first backup holding
+// it to the last one before it changed. Type is TypeAdded when the object
+// appears, TypeModified when it changed and TypeRemoved when it is missing.
+type Revision struct {
+	Number     int       `json:"number"`
+	Type       string    `json:"type"`
+	Backup     string    `json:"backup"`
+	Time       time.Time `json:"time"`
+	LastBackup string    `json:"lastBackup"`
+	// Backups is the number of backups holding this revision
+	Backups int `json:"backups"`
+	// Fields and Diff hold the changes from the previous revision
+	Fields []FieldChange `json:"fields,omitempty"`
+	Diff   string        `json:"diff,omitempty"`
+	// Data is the manifest of the revision, nil when the object is removed
+	Data []byte `json:"-"`
+}
+
+// History returns the distinct revisions of an object from its versions,
+// which are ordered from the oldest backup to the newest. Changes the
+// options ignore do not start a new revision.
+func History(key backup.ObjectKey, versions []Version, opts Options) ([]Revision, error) {
+	var revisions []Revision
+	for _, version := range versions {
+		revision := Revision{
+			Number:     len(revisions) + 1,
+			Backup:     version.Backup,
+			Time:       version.Time,
+			LastBackup: version.Backup,
+			Backups:    1,
+			Data:       version.Data,
+		}
+
+		if len(revisions) == 0 {
+			// Backups from before the object existed are left out
+			if version.Data != nil {
+				revision.Type = TypeAdded
+				revisions = append(revisions, revision)
+			}
+			continue
+		}
+
+		current := &revisions[len(revisions)-1]
+		switch {
+		case version.Data == nil && current.Data == nil:
+			// Still removed
+		case version.Data == nil:
+			revision.Type = TypeRemoved
+		case current.Data == nil:
+			revision.Type = TypeAdded
+		default:
+			report, err := Compare(map[backup.ObjectKey][]byte{key: current.Data}, map[backup.ObjectKey][]byte{key: version.Data}, opts)
+			if err != nil {
+				return nil, err
+			}
+			if report.Changed() {
+				revision.Type = TypeModified
+				revision.Fields, revision.Diff = report.Changes[0].Fields, report.Changes[0].Diff
+			}
+		}
+
+		if revision.Type == "" {
+			current.LastBackup = version.Backup
+			current.Backups++
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
@@ -0,0 +1,65 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+)
+
+func TestHistory(t *testing.T) {
+	key := backup.ObjectKey{Namespace: "shop", Kind: "Deployment", Name: "checkout"}
+	day := func(d int) time.Time { return time.Date(2025, 1, d, 0, 0, 0, 0, time.UTC) }
+	versions := []Version{
+		{Backup: "b1", Time: day(1)},
+		{Backup: "b2", Time: day(2), Data: []byte("spec:\n  replicas: 1\n")},
+		{Backup: "b3", Time: day(3), Data: []byte("spec: {replicas: 1}\n")},
+		{Backup: "b4", Time: day(4), Data: []byte("spec:\n  replicas: 3\n")},
+		{Backup: "b5", Time: day(5)},
+		{Backup: "b6", Time: day(6)},
+		{Backup: "b7", Time: day(7), Data: []byte("spec:\n  replicas: 3\n")},
+	}
+
+	revisions, err := History(key, versions, Options{Context: 3})
+	if err != nil {
+		t.Fatalf("History returned error: %v", err)
+	}
+
+	type summary struct {
+		Number     int
+		Type       string
+		Backup     string
+		LastBackup string
+		Backups    int
+	}
+	var got []summary
+	for _, r := range revisions {
+		got = append(got, summary{r.Number, r.Type, r.Backup, r.LastBackup, r.Backups})
+	}
+	want := []summary{
+		{1, TypeAdded, "b2", "b3", 2},
+		{2, TypeModified, "b4", "b4", 1},
+		{3, TypeRemoved, "b5", "b6", 2},
+		{4, TypeAdded, "b7", "b7", 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected revisions %v, got %v", want, got)
+	}
+	if !reflect.DeepEqual(revisions[1].Fields, []FieldChange{{Path: "spec.replicas", Old: float64(1), New: float64(3)}}) {
+		t.Errorf("Expected spec.replicas to change in revision 2, got %v", revisions[1].Fields)
+	}
+	if revisions[2].Data != nil || string(revisions[3].Data) != "spec:\n  replicas: 3\n" {
+		t.Errorf("Expected revisions to hold the manifest of their first backup")
+	}
+
+	// Ignored changes do not start a revision
+	rule, _ := ParseRule("spec.replicas")
+	revisions, err = History(key, versions[:4], Options{Ignore: []Rule{rule}})
+	if err != nil {
+		t.Fatalf("History returned error: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].Backups != 3 {
+		t.Errorf("Expected one revision in 3 backups, got %v", revisions)
+	}
+}
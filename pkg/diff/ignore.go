@@ -0,0 +1,177 @@
+package diff
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// segment is one step of a field path: a map key or a list item
+type segment struct {
+	value string
+	item  bool
+}
+
+// Rule selects fields to leave out of a comparison. It is written as
+// [KIND:]PATH, where PATH is a field path as reported in FieldChange, e.g.
+// spec.replicas or Deployment:metadata.annotations["example.com/revision"].
+// A * matches any map key or list item, e.g. spec.template.spec.containers[*].image.
+// A rule also covers every field below its path.
+type Rule struct {
+	// Kind limits the rule to objects of this kind, empty for all kinds
+	Kind string
+	path []segment
+	text string
+}
+
+// String returns the rule as it was written
+func (r Rule) String() string {
+	return r.text
+}
+
+// ParseRule parses a rule written as [KIND:]PATH
+func ParseRule(text string) (Rule, error) {
+	rule := Rule{text: text}
+	fieldPath := strings.TrimSpace(text)
+	if i := strings.Index(fieldPath, ":"); i > 0 && !strings.ContainsAny(fieldPath[:i], `.["`) {
+		rule.Kind, fieldPath = fieldPath[:i], fieldPath[i+1:]
+	}
+
+	path, err := parsePath(fieldPath)
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid rule %q: %v", text, err)
+	}
+	if len(path) == 0 {
+		return Rule{}, fmt.Errorf("invalid rule %q: no field path", text)
+	}
+	rule.path = path
+	return rule, nil
+}
+
+// ParseRules parses rules written one per line, skipping empty lines and
+// comments starting with #
+func ParseRules(data []byte) ([]Rule, error) {
+	var rules []Rule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		rule, err := ParseRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// parsePath splits a field path into its segments
+func parsePath(fieldPath string) ([]segment, error) {
+	var path []segment
+	for rest := fieldPath; rest != ""; {
+		switch {
+		case strings.HasPrefix(rest, `["`):
+			quoted, err := strconv.QuotedPrefix(rest[1:])
+			if err != nil || !strings.HasPrefix(rest[1+len(quoted):], "]") {
+				return nil, fmt.Errorf("invalid key in %s", fieldPath)
+			}
+			key, _ := strconv.Unquote(quoted)
+			path = append(path, segment{value: key})
+			rest = rest[len(quoted)+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated list item in %s", fieldPath)
+			}
+			path = append(path, segment{value: rest[1:end], item: true})
+			rest = rest[end+1:]
+		default:
+			if len(path) > 0 {
+				if !strings.HasPrefix(rest, ".") {
+					return nil, fmt.Errorf("unexpected %q in %s", rest, fieldPath)
+				}
+				rest = rest[1:]
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in %s", fieldPath)
+			}
+			path = append(path, segment{value: rest[:end]})
+			rest = rest[end:]
+		}
+	}
+	return path, nil
+}
+
+// removeIgnored removes the fields selected by the rules from a parsed object
+func removeIgnored(obj map[string]interface{}, kind string, rules []Rule) {
+	for _, rule := range rules {
+		if rule.Kind == "" || rule.Kind == kind {
+			updatePath(obj, rule.path, func(interface{}) (interface{}, bool) {
+				return nil, false
+			})
+		}
+	}
+}
+
+// updatePath replaces the values at path below value with the result of
+// update, or removes them when update returns false, and returns the result
+func updatePath(value interface{}, path []segment, update func(interface{}) (interface{}, bool)) interface{} {
+	step, last := path[0], len(path) == 1
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if step.item {
+			return value
+		}
+		for key, child := range typed {
+			if step.value != "*" && step.value != key {
+				continue
+			}
+			if !last {
+				typed[key] = updatePath(child, path[1:], update)
+			} else if updated, keep := update(child); keep {
+				typed[key] = updated
+			} else {
+				delete(typed, key)
+			}
+		}
+	case []interface{}:
+		if !step.item {
+			return value
+		}
+		kept := typed[:0:0]
+		for i, child := range typed {
+			switch {
+			case step.value != "*" && step.value != itemName(child, i):
+				kept = append(kept, child)
+			case !last:
+				kept = append(kept, updatePath(child, path[1:], update))
+			default:
+				if updated, keep := update(child); keep {
+					kept = append(kept, updated)
+				}
+			}
+		}
+		return kept
+	}
+	return value
+}
+
+// itemName returns how an item of a list appears in a field path: its name if
+// it has one, otherwise its index
+func itemName(item interface{}, index int) string {
+	if m, ok := item.(map[string]interface{}); ok {
+		if name, ok := m["name"].(string); ok {
+			return name
+		}
+	}
+	return strconv.Itoa(index)
+}
@@ -0,0 +1,105 @@
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		text    string
+		kind    string
+		path    []segment
+		wantErr bool
+	}{
+		{text: "spec.replicas", path: []segment{{value: "spec"}, {value: "replicas"}}},
+		{text: "Deployment:spec.replicas", kind: "Deployment", path: []segment{{value: "spec"}, {value: "replicas"}}},
+		{
+			text: `metadata.annotations["example.com/revision:x"]`,
+			path: []segment{{value: "metadata"}, {value: "annotations"}, {value: "example.com/revision:x"}},
+		},
+		{
+			text: "spec.template.spec.containers[*].image",
+			path: []segment{{value: "spec"}, {value: "template"}, {value: "spec"}, {value: "containers"}, {value: "*", item: true}, {value: "image"}},
+		},
+		{text: "args[0]", path: []segment{{value: "args"}, {value: "0", item: true}}},
+		{text: "", wantErr: true},
+		{text: "Deployment:", wantErr: true},
+		{text: "spec..replicas", wantErr: true},
+		{text: "spec.containers[app", wantErr: true},
+		{text: `metadata.annotations["unterminated]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			rule, err := ParseRule(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error parsing %q", tt.text)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRule returned error: %v", err)
+			}
+			if rule.Kind != tt.kind || !reflect.DeepEqual(rule.path, tt.path) {
+				t.Errorf("Expected kind %q and path %v, got %q and %v", tt.kind, tt.path, rule.Kind, rule.path)
+			}
+		})
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]byte("# scaled by the HPA\nDeployment:spec.replicas\n\n  metadata.labels[\"example.com/build\"]\n"))
+	if err != nil {
+		t.Fatalf("ParseRules returned error: %v", err)
+	}
+	if len(rules) != 2 || rules[0].Kind != "Deployment" || rules[1].Kind != "" {
+		t.Errorf("Expected 2 rules, got %v", rules)
+	}
+
+	if _, err := ParseRules([]byte("spec.replicas\nspec..x\n")); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("Expected error for line 2, got %v", err)
+	}
+}
+
+func TestCompareIgnore(t *testing.T) {
+	deployment := backup.ObjectKey{Namespace: "default", Kind: "Deployment", Name: "web"}
+	configMap := backup.ObjectKey{Namespace: "default", Kind: "ConfigMap", Name: "settings"}
+	old := map[backup.ObjectKey][]byte{
+		deployment: []byte("metadata:\n  annotations:\n    example.com/build: \"1\"\nspec:\n  replicas: 1\n  template:\n    spec:\n      containers:\n      - name: app\n        image: app:1\n      - name: proxy\n        image: proxy:1\n"),
+		configMap:  []byte("data:\n  replicas: \"1\"\n"),
+	}
+	new := map[backup.ObjectKey][]byte{
+		deployment: []byte("metadata:\n  annotations:\n    example.com/build: \"2\"\nspec:\n  replicas: 3\n  template:\n    spec:\n      containers:\n      - name: app\n        image: app:2\n      - name: proxy\n        image: proxy:2\n"),
+		configMap:  []byte("data:\n  replicas: \"3\"\n"),
+	}
+
+	var rules []Rule
+	for _, text := range []string{"Deployment:spec.replicas", `metadata.annotations["example.com/build"]`, "spec.template.spec.containers[proxy]"} {
+		rule, err := ParseRule(text)
+		if err != nil {
+			t.Fatalf("ParseRule returned error: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	report, err := Compare(old, new, Options{Context: 3, Ignore: rules})
+	if err != nil {
+		t.Fatalf("Compare returned error: %v", err)
+	}
+	if len(report.Changes) != 2 {
+		t.Fatalf("Expected 2 changes, got %v", report.Changes)
+	}
+	// Kind-specific rules leave other kinds alone
+	if !reflect.DeepEqual(report.Changes[0].Fields, []FieldChange{{Path: "data.replicas", Old: "1", New: "3"}}) {
+		t.Errorf("Expected the ConfigMap change to be kept, got %v", report.Changes[0].Fields)
+	}
+	want := []FieldChange{{Path: "spec.template.spec.containers[app].image", Old: "app:1", New: "app:2"}}
+	if !reflect.DeepEqual(report.Changes[1].Fields, want) {
+		t.Errorf("Expected %v, got %v", want, report.Changes[1].Fields)
+	}
+}
@@ -0,0 +1,118 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Replacement rewrites string values of the old objects before they are
+// compared, e.g. the host name of a staging ingress to the production one
+type Replacement struct {
+	// Rule, when set, limits the replacement to the fields at its path
+	Rule *Rule
+	From string
+	To   string
+}
+
+// Apply returns text with the replacement applied
+func (r Replacement) Apply(text string) string {
+	return strings.ReplaceAll(text, r.From, r.To)
+}
+
+// ParseReplacement parses a replacement written as FROM=TO
+func ParseReplacement(text string) (Replacement, error) {
+	from, to, ok := strings.Cut(text, "=")
+	if !ok || from == "" {
+		return Replacement{}, fmt.Errorf("invalid replacement %q, expected FROM=TO", text)
+	}
+	return Replacement{From: from, To: to}, nil
+}
+
+// normalizationFile is the format of a file of normalization rules
+type normalizationFile struct {
+	Ignore  []string `json:"ignore"`
+	Replace []struct {
+		Path string `json:"path"`
+		From string `json:"from"`
+		To   string `json:"to"`
+	} `json:"replace"`
+}
+
+// ParseNormalization parses a YAML file of normalization rules: a list of
+// fields to ignore as written for ParseRule, and a list of replacements with
+// from, to and an optional path:
+//
+//	ignore:
+//	- Deployment:spec.replicas
+//	replace:
+//	- from: staging
+//	  to: production
+//	- path: Ingress:spec.rules[*].host
+//	  from: staging.example.com
+//	  to: example.com
+func ParseNormalization(data []byte) ([]Rule, []Replacement, error) {
+	var file normalizationFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, nil, err
+	}
+
+	var rules []Rule
+	for _, text := range file.Ignore {
+		rule, err := ParseRule(text)
+		if err != nil {
+			return nil, nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	var replacements []Replacement
+	for _, r := range file.Replace {
+		if r.From == "" {
+			return nil, nil, fmt.Errorf("replacement to %q has no from value", r.To)
+		}
+		replacement := Replacement{From: r.From, To: r.To}
+		if r.Path != "" {
+			rule, err := ParseRule(r.Path)
+			if err != nil {
+				return nil, nil, err
+			}
+			replacement.Rule = &rule
+		}
+		replacements = append(replacements, replacement)
+	}
+	return rules, replacements, nil
+}
+
+// applyReplacements rewrites the string values of a parsed object
+func applyReplacements(obj map[string]interface{}, kind string, replacements []Replacement) {
+	for _, r := range replacements {
+		replace := func(value interface{}) (interface{}, bool) {
+			return replaceStrings(value, r), true
+		}
+		switch {
+		case r.Rule == nil:
+			replace(obj)
+		case r.Rule.Kind == "" || r.Rule.Kind == kind:
+			updatePath(obj, r.Rule.path, replace)
+		}
+	}
+}
+
+// replaceStrings applies a replacement to every string below value
+func replaceStrings(value interface{}, r Replacement) interface{} {
+	switch typed := value.(type) {
+	case string:
+		return r.Apply(typed)
+	case map[string]interface{}:
+		for key, child := range typed {
+			typed[key] = replaceStrings(child, r)
+		}
+	case []interface{}:
+		for i, child := range typed {
+			typed[i] = replaceStrings(child, r)
+		}
+	}
+	return value
+}
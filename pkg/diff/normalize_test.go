@@ -0,0 +1,105 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+)
+
+func TestParseReplacement(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    Replacement
+		wantErr bool
+	}{
+		{text: "staging=production", want: Replacement{From: "staging", To: "production"}},
+		{text: "-stg=", want: Replacement{From: "-stg"}},
+		{text: "a=b=c", want: Replacement{From: "a", To: "b=c"}},
+		{text: "staging", wantErr: true},
+		{text: "=production", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			replacement, err := ParseReplacement(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error parsing %q", tt.text)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseReplacement returned error: %v", err)
+			}
+			if !reflect.DeepEqual(replacement, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, replacement)
+			}
+		})
+	}
+}
+
+func TestParseNormalization(t *testing.T) {
+	rules, replacements, err := ParseNormalization([]byte(`
+ignore:
+- Deployment:spec.replicas
+replace:
+- from: staging
+  to: production
+- path: Ingress:spec.rules[*].host
+  from: staging.example.com
+  to: example.com
+`))
+	if err != nil {
+		t.Fatalf("ParseNormalization returned error: %v", err)
+	}
+	if len(rules) != 1 || rules[0].Kind != "Deployment" {
+		t.Errorf("Expected the Deployment rule, got %v", rules)
+	}
+	if len(replacements) != 2 || replacements[0].Rule != nil || replacements[1].Rule == nil || replacements[1].Rule.Kind != "Ingress" {
+		t.Errorf("Expected an unscoped and an Ingress replacement, got %v", replacements)
+	}
+
+	for _, data := range []string{
+		"ignore: [spec..replicas]\n",
+		"replace:\n- to: production\n",
+		"replace:\n- path: spec[\n  from: a\n",
+		"unknown: true\n",
+	} {
+		if _, _, err := ParseNormalization([]byte(data)); err == nil {
+			t.Errorf("Expected error parsing %q", data)
+		}
+	}
+}
+
+func TestCompareReplace(t *testing.T) {
+	ingress := backup.ObjectKey{Kind: "Ingress", Name: "web"}
+	configMap := backup.ObjectKey{Kind: "ConfigMap", Name: "settings"}
+	old := map[backup.ObjectKey][]byte{
+		ingress:   []byte("spec:\n  rules:\n  - host: staging.example.com\n  tls:\n  - hosts: [staging.example.com]\n"),
+		configMap: []byte("data:\n  env: staging\n  url: https://staging.example.com\n"),
+	}
+	new := map[backup.ObjectKey][]byte{
+		ingress:   []byte("spec:\n  rules:\n  - host: example.com\n  tls:\n  - hosts: [example.com]\n"),
+		configMap: []byte("data:\n  env: production\n  url: https://production.example.com\n"),
+	}
+
+	rule, _ := ParseRule("Ingress:spec.rules[*].host")
+	replacements := []Replacement{
+		{Rule: &rule, From: "staging.example.com", To: "example.com"},
+		{From: "staging", To: "production"},
+	}
+	report, err := Compare(old, new, Options{Replace: replacements})
+	if err != nil {
+		t.Fatalf("Compare returned error: %v", err)
+	}
+
+	// Replacements apply in order, so spec.tls only gets the unscoped one
+	if len(report.Changes) != 1 || report.Changes[0].Kind != "Ingress" {
+		t.Fatalf("Expected only the Ingress to differ, got %v", report.Changes)
+	}
+	want := []FieldChange{{Path: "spec.tls[0].hosts[0]", Old: "production.example.com", New: "example.com"}}
+	if !reflect.DeepEqual(report.Changes[0].Fields, want) {
+		t.Errorf("Expected %v, got %v", want, report.Changes[0].Fields)
+	}
+}
@@ -0,0 +1,236 @@
+package encrypt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Encryption formats, recorded in the backup manifest
+const (
+	FormatAge = "age"
+	FormatPGP = "pgp"
+)
+
+// File extensions appended to encrypted files
+const (
+	AgeExtension = ".age"
+	PGPExtension = ".gpg"
+)
+
+// PassphraseEnv is the environment variable holding the passphrase of
+// protected OpenPGP private keys
+const PassphraseEnv = "KBAK_PGP_PASSPHRASE"
+
+// Encryptor encrypts files to a set of age or OpenPGP recipients
+type Encryptor struct {
+	format        string
+	ageRecipients []age.Recipient
+	pgpRecipients openpgp.EntityList
+}
+
+// NewEncryptor creates an encryptor for age recipients and OpenPGP public key
+// files. An age recipient is either a public key (age1...) or a file with one
+// recipient per line. Every file is encrypted in a single format, so age and
+// OpenPGP recipients cannot be combined.
+func NewEncryptor(ageRecipients, pgpKeyFiles []string) (*Encryptor, error) {
+	if len(ageRecipients) > 0 && len(pgpKeyFiles) > 0 {
+		return nil, fmt.Errorf("age and OpenPGP recipients cannot be combined")
+	}
+
+	if len(pgpKeyFiles) > 0 {
+		var entities openpgp.EntityList
+		for _, file := range pgpKeyFiles {
+			keys, err := LoadPGPKeys(file)
+			if err != nil {
+				return nil, err
+			}
+			entities = append(entities, keys...)
+		}
+		return &Encryptor{format: FormatPGP, pgpRecipients: entities}, nil
+	}
+
+	var recipients []age.Recipient
+	for _, spec := range ageRecipients {
+		parsed, err := ParseAgeRecipients(spec)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, parsed...)
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients given")
+	}
+
+	return &Encryptor{format: FormatAge, ageRecipients: recipients}, nil
+}
+
+// ParseAgeRecipients parses an age public key, or reads the recipients of a
+// recipients file
+func ParseAgeRecipients(spec string) ([]age.Recipient, error) {
+	if strings.HasPrefix(spec, "age1") {
+		recipient, err := age.ParseX25519Recipient(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %q: %v", spec, err)
+		}
+		return []age.Recipient{recipient}, nil
+	}
+
+	file, err := os.Open(spec)
+	if err != nil {
+		return nil, fmt.Errorf("error reading age recipients: %v", err)
+	}
+	defer file.Close()
+
+	recipients, err := age.ParseRecipients(file)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing age recipients file %s: %v", spec, err)
+	}
+	return recipients, nil
+}
+
+// LoadPGPKeys reads the OpenPGP keys of an armored or binary key file
+func LoadPGPKeys(filename string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading OpenPGP key file: %v", err)
+	}
+
+	var keys openpgp.EntityList
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing OpenPGP key file %s: %v", filename, err)
+	}
+	return keys, nil
+}
+
+// Format returns the encryption format, FormatAge or FormatPGP
+func (e *Encryptor) Format() string {
+	return e.format
+}
+
+// Extension returns the file extension of encrypted files
+func (e *Encryptor) Extension() string {
+	if e.format == FormatPGP {
+		return PGPExtension
+	}
+	return AgeExtension
+}
+
+// Encrypt encrypts data to all recipients
+func (e *Encryptor) Encrypt(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	if e.format == FormatPGP {
+		w, err = openpgp.Encrypt(&buf, e.pgpRecipients, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	} else {
+		w, err = age.Encrypt(&buf, e.ageRecipients...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting: %v", err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("error encrypting: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("error encrypting: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decryptor decrypts files with age identities and OpenPGP private keys
+type Decryptor struct {
+	ageIdentities []age.Identity
+	pgpKeys       openpgp.EntityList
+}
+
+// NewDecryptor loads age identity files and OpenPGP private key files.
+// Protected OpenPGP keys are unlocked with passphrase.
+func NewDecryptor(ageIdentityFiles, pgpKeyFiles []string, passphrase []byte) (*Decryptor, error) {
+	d := &Decryptor{}
+
+	for _, filename := range ageIdentityFiles {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("error reading age identities: %v", err)
+		}
+		identities, err := age.ParseIdentities(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing age identity file %s: %v", filename, err)
+		}
+		d.ageIdentities = append(d.ageIdentities, identities...)
+	}
+
+	for _, filename := range pgpKeyFiles {
+		keys, err := LoadPGPKeys(filename)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if key.PrivateKey == nil {
+				return nil, fmt.Errorf("OpenPGP key file %s contains no private key", filename)
+			}
+			if key.PrivateKey.Encrypted {
+				if len(passphrase) == 0 {
+					return nil, fmt.Errorf("OpenPGP key in %s is protected, set %s", filename, PassphraseEnv)
+				}
+				if err := key.DecryptPrivateKeys(passphrase); err != nil {
+					return nil, fmt.Errorf("error unlocking OpenPGP key in %s: %v", filename, err)
+				}
+			}
+		}
+		d.pgpKeys = append(d.pgpKeys, keys...)
+	}
+
+	if len(d.ageIdentities) == 0 && len(d.pgpKeys) == 0 {
+		return nil, fmt.Errorf("no identities given")
+	}
+
+	return d, nil
+}
+
+// Decrypt decrypts data encrypted in the given format
+func (d *Decryptor) Decrypt(format string, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch format {
+	case FormatAge:
+		if len(d.ageIdentities) == 0 {
+			return nil, fmt.Errorf("no age identity available")
+		}
+		plaintext, err := age.Decrypt(bytes.NewReader(data), d.ageIdentities...)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting: %v", err)
+		}
+		r = plaintext
+	case FormatPGP:
+		if len(d.pgpKeys) == 0 {
+			return nil, fmt.Errorf("no OpenPGP private key available")
+		}
+		md, err := openpgp.ReadMessage(bytes.NewReader(data), d.pgpKeys, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting: %v", err)
+		}
+		r = md.UnverifiedBody
+	default:
+		return nil, fmt.Errorf("unsupported encryption format %q", format)
+	}
+
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting: %v", err)
+	}
+	return plaintext, nil
+}
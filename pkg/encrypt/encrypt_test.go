@@ -0,0 +1,145 @@
+package encrypt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// writeFile writes data to a file in a temporary directory and returns its path
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	return filename
+}
+
+// newPGPKey creates an OpenPGP key and returns the armored public key file
+// and the binary private key file
+func newPGPKey(t *testing.T, passphrase []byte) (string, string) {
+	t.Helper()
+	entity, err := openpgp.NewEntity("kbak", "test", "kbak@localhost", nil)
+	if err != nil {
+		t.Fatalf("NewEntity returned error: %v", err)
+	}
+
+	var public bytes.Buffer
+	w, err := armor.Encode(&public, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("armor.Encode returned error: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("Serialize returned error: %v", err)
+	}
+	w.Close()
+
+	if passphrase != nil {
+		if err := entity.EncryptPrivateKeys(passphrase, nil); err != nil {
+			t.Fatalf("EncryptPrivateKeys returned error: %v", err)
+		}
+	}
+	var private bytes.Buffer
+	if err := entity.SerializePrivateWithoutSigning(&private, nil); err != nil {
+		t.Fatalf("SerializePrivate returned error: %v", err)
+	}
+
+	return writeFile(t, "public.asc", public.Bytes()), writeFile(t, "private.gpg", private.Bytes())
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity returned error: %v", err)
+	}
+	other, _ := age.GenerateX25519Identity()
+	recipientsFile := writeFile(t, "recipients.txt", []byte("# team key\n"+other.Recipient().String()+"\n"))
+	identityFile := writeFile(t, "key.txt", []byte(identity.String()+"\n"))
+
+	encryptor, err := NewEncryptor([]string{identity.Recipient().String(), recipientsFile}, nil)
+	if err != nil {
+		t.Fatalf("NewEncryptor returned error: %v", err)
+	}
+	if encryptor.Format() != FormatAge || encryptor.Extension() != ".age" {
+		t.Errorf("Unexpected format %q and extension %q", encryptor.Format(), encryptor.Extension())
+	}
+
+	ciphertext, err := encryptor.Encrypt([]byte("data:\n  password: c2VjcmV0\n"))
+	if err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+	if bytes.Contains(ciphertext, []byte("c2VjcmV0")) {
+		t.Errorf("Expected ciphertext not to contain the plaintext")
+	}
+
+	decryptor, err := NewDecryptor([]string{identityFile}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewDecryptor returned error: %v", err)
+	}
+	plaintext, err := decryptor.Decrypt(FormatAge, ciphertext)
+	if err != nil || string(plaintext) != "data:\n  password: c2VjcmV0\n" {
+		t.Errorf("Decrypt = %q, %v", plaintext, err)
+	}
+	if _, err := decryptor.Decrypt(FormatPGP, ciphertext); err == nil {
+		t.Errorf("Expected error decrypting without an OpenPGP key")
+	}
+}
+
+func TestPGPRoundTrip(t *testing.T) {
+	passphrase := []byte("correct horse")
+	publicKey, privateKey := newPGPKey(t, passphrase)
+
+	encryptor, err := NewEncryptor(nil, []string{publicKey})
+	if err != nil {
+		t.Fatalf("NewEncryptor returned error: %v", err)
+	}
+	if encryptor.Format() != FormatPGP || encryptor.Extension() != ".gpg" {
+		t.Errorf("Unexpected format %q and extension %q", encryptor.Format(), encryptor.Extension())
+	}
+	ciphertext, err := encryptor.Encrypt([]byte("kind: Secret\n"))
+	if err != nil {
+		t.Fatalf("Encrypt returned error: %v", err)
+	}
+
+	if _, err := NewDecryptor(nil, []string{privateKey}, nil); err == nil {
+		t.Errorf("Expected error for a protected key without passphrase")
+	}
+	if _, err := NewDecryptor(nil, []string{publicKey}, nil); err == nil {
+		t.Errorf("Expected error for a key file without private key")
+	}
+
+	decryptor, err := NewDecryptor(nil, []string{privateKey}, passphrase)
+	if err != nil {
+		t.Fatalf("NewDecryptor returned error: %v", err)
+	}
+	plaintext, err := decryptor.Decrypt(FormatPGP, ciphertext)
+	if err != nil || string(plaintext) != "kind: Secret\n" {
+		t.Errorf("Decrypt = %q, %v", plaintext, err)
+	}
+}
+
+func TestNewEncryptorValidation(t *testing.T) {
+	publicKey, _ := newPGPKey(t, nil)
+	identity, _ := age.GenerateX25519Identity()
+
+	tests := []struct {
+		age []string
+		pgp []string
+	}{
+		{},
+		{age: []string{"age1invalid"}},
+		{age: []string{"/nonexistent/recipients.txt"}},
+		{age: []string{identity.Recipient().String()}, pgp: []string{publicKey}},
+	}
+	for _, test := range tests {
+		if _, err := NewEncryptor(test.age, test.pgp); err == nil {
+			t.Errorf("Expected error for recipients %v / %v", test.age, test.pgp)
+		}
+	}
+}
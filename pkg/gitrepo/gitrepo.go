@@ -0,0 +1,222 @@
+package gitrepo
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Default author used when neither flags nor git configuration provide one
+const (
+	DefaultAuthorName  = "kbak"
+	DefaultAuthorEmail = "kbak@localhost"
+)
+
+// Change actions
+const (
+	Added    = "added"
+	Modified = "modified"
+	Deleted  = "deleted"
+)
+
+// Change describes one staged file
+type Change struct {
+	// Path is slash-separated and relative to the staged directory
+	Path   string
+	Action string
+	// Namespace and Kind are filled in by the caller to group the commit message
+	Namespace string
+	Kind      string
+}
+
+// Repository is a git repository that backups are committed to
+type Repository struct {
+	repo *git.Repository
+	root string
+}
+
+// Open opens the git repository containing dir, searching parent directories.
+// If there is none, a new repository is initialized in dir.
+// The returned bool is true when the repository was initialized.
+func Open(dir string) (*Repository, bool, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	initialized := false
+	repo, err := git.PlainOpenWithOptions(absDir, &git.PlainOpenOptions{DetectDotGit: true})
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.PlainInit(absDir, false)
+		initialized = true
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error opening git repository at %s: %v", absDir, err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, false, fmt.Errorf("error opening git worktree: %v", err)
+	}
+
+	return &Repository{repo: repo, root: worktree.Filesystem.Root()}, initialized, nil
+}
+
+// Root returns the top-level directory of the repository
+func (r *Repository) Root() string {
+	return r.root
+}
+
+// Stage stages all additions, modifications and deletions below dir and
+// returns the staged changes below it
+func (r *Repository) Stage(dir string) ([]Change, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(r.root, absDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%s is not inside the git repository at %s", dir, r.root)
+	}
+
+	worktree, err := r.repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("error opening git worktree: %v", err)
+	}
+	if err := worktree.AddWithOptions(&git.AddOptions{Path: rel}); err != nil {
+		return nil, fmt.Errorf("error staging %s: %v", rel, err)
+	}
+
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, fmt.Errorf("error reading git status: %v", err)
+	}
+
+	prefix := filepath.ToSlash(rel) + "/"
+	if rel == "." {
+		prefix = ""
+	}
+
+	var changes []Change
+	for file, fileStatus := range status {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+
+		var action string
+		switch fileStatus.Staging {
+		case git.Added:
+			action = Added
+		case git.Modified, git.Renamed, git.Copied:
+			action = Modified
+		case git.Deleted:
+			action = Deleted
+		default:
+			continue
+		}
+		changes = append(changes, Change{Path: strings.TrimPrefix(file, prefix), Action: action})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes, nil
+}
+
+// Commit records the staged changes and returns the hash of the new commit.
+// Empty author fields are taken from the git configuration, then from the defaults.
+func (r *Repository) Commit(message, authorName, authorEmail string) (string, error) {
+	if authorName == "" || authorEmail == "" {
+		if cfg, err := r.repo.ConfigScoped(config.GlobalScope); err == nil {
+			if authorName == "" {
+				authorName = cfg.User.Name
+			}
+			if authorEmail == "" {
+				authorEmail = cfg.User.Email
+			}
+		}
+	}
+	if authorName == "" {
+		authorName = DefaultAuthorName
+	}
+	if authorEmail == "" {
+		authorEmail = DefaultAuthorEmail
+	}
+
+	worktree, err := r.repo.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("error opening git worktree: %v", err)
+	}
+
+	hash, err := worktree.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  authorName,
+			Email: authorEmail,
+			When:  time.Now(),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating commit: %v", err)
+	}
+
+	return hash.String(), nil
+}
+
+// CommitMessage builds a commit message summarizing the changes per namespace and kind
+func CommitMessage(subject string, changes []Change) string {
+	type counts struct {
+		added, modified, deleted int
+	}
+
+	total := counts{}
+	groups := make(map[string]*counts)
+	var groupNames []string
+	for _, change := range changes {
+		group := change.Namespace + "/" + change.Kind
+		if change.Namespace == "" && change.Kind == "" {
+			group = "other files"
+		}
+		c, ok := groups[group]
+		if !ok {
+			c = &counts{}
+			groups[group] = c
+			groupNames = append(groupNames, group)
+		}
+
+		switch change.Action {
+		case Added:
+			c.added++
+			total.added++
+		case Modified:
+			c.modified++
+			total.modified++
+		case Deleted:
+			c.deleted++
+			total.deleted++
+		}
+	}
+	sort.Strings(groupNames)
+
+	format := func(c *counts) string {
+		return fmt.Sprintf("%d added, %d changed, %d deleted", c.added, c.modified, c.deleted)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s\n", subject, format(&total))
+	if len(groupNames) > 0 {
+		b.WriteString("\n")
+	}
+	for _, group := range groupNames {
+		fmt.Fprintf(&b, "%s: %s\n", group, format(groups[group]))
+	}
+
+	return b.String()
+}
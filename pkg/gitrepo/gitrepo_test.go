@@ -0,0 +1,108 @@
+package gitrepo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, filename, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatalf("MkdirAll returned error: %v", err)
+	}
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+}
+
+func TestStageAndCommit(t *testing.T) {
+	root := t.TempDir()
+	backupDir := filepath.Join(root, "cluster")
+
+	repo, initialized, err := Open(root)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if !initialized {
+		t.Errorf("Expected a new repository to be initialized")
+	}
+
+	writeFile(t, filepath.Join(backupDir, "default", "ConfigMap", "a.yaml"), "a: 1\n")
+	writeFile(t, filepath.Join(backupDir, "default", "ConfigMap", "b.yaml"), "b: 1\n")
+	writeFile(t, filepath.Join(root, "README.md"), "not staged\n")
+
+	changes, err := repo.Stage(backupDir)
+	if err != nil {
+		t.Fatalf("Stage returned error: %v", err)
+	}
+	if len(changes) != 2 || changes[0].Path != "default/ConfigMap/a.yaml" || changes[0].Action != Added {
+		t.Fatalf("Unexpected changes: %+v", changes)
+	}
+	if _, err := repo.Commit("first", "", ""); err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+
+	// Reopening from a subdirectory finds the same repository
+	repo, initialized, err = Open(backupDir)
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if initialized || repo.Root() != root {
+		t.Errorf("Expected existing repository at %s, got %s (initialized %v)", root, repo.Root(), initialized)
+	}
+
+	writeFile(t, filepath.Join(backupDir, "default", "ConfigMap", "a.yaml"), "a: 2\n")
+	if err := os.Remove(filepath.Join(backupDir, "default", "ConfigMap", "b.yaml")); err != nil {
+		t.Fatalf("Remove returned error: %v", err)
+	}
+
+	changes, err = repo.Stage(backupDir)
+	if err != nil {
+		t.Fatalf("Stage returned error: %v", err)
+	}
+	want := []Change{
+		{Path: "default/ConfigMap/a.yaml", Action: Modified},
+		{Path: "default/ConfigMap/b.yaml", Action: Deleted},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %d changes, got %+v", len(want), changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("Change %d = %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestStageRejectsDirectoryOutsideRepository(t *testing.T) {
+	repo, _, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if _, err := repo.Stage(t.TempDir()); err == nil {
+		t.Errorf("Expected error when staging a directory outside the repository")
+	}
+}
+
+func TestCommitMessage(t *testing.T) {
+	message := CommitMessage("kbak backup of prod", []Change{
+		{Path: "a", Action: Added, Namespace: "default", Kind: "ConfigMap"},
+		{Path: "b", Action: Modified, Namespace: "default", Kind: "ConfigMap"},
+		{Path: "c", Action: Deleted, Namespace: "apps", Kind: "Deployment"},
+		{Path: "kbak-manifest.json", Action: Modified},
+	})
+
+	lines := strings.Split(strings.TrimSpace(message), "\n")
+	want := []string{
+		"kbak backup of prod: 1 added, 2 changed, 1 deleted",
+		"",
+		"apps/Deployment: 0 added, 0 changed, 1 deleted",
+		"default/ConfigMap: 1 added, 1 changed, 0 deleted",
+		"other files: 0 added, 1 changed, 0 deleted",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected commit message:\n%s", message)
+	}
+}
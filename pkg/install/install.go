@@ -0,0 +1,393 @@
+// Package install generates the manifests for running kbak in a cluster: a
+// ServiceAccount, a ClusterRole with the least privileges a backup needs,
+// its bindings and a CronJob, or a Deployment of the operator.
+package install
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rogosprojects/kbak/pkg/operator"
+	"github.com/rogosprojects/kbak/pkg/resources"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// BackupVolumePath is where the backup volume is mounted in the CronJob pods
+const BackupVolumePath = "/backups"
+
+// MetricsPort is the port the operator serves its metrics on
+const MetricsPort = 9090
+
+// Options are the settings of the generated manifests
+type Options struct {
+	// Name is the name of the ServiceAccount, ClusterRole, bindings and CronJobs
+	Name string
+	// Namespace is the namespace kbak runs in
+	Namespace string
+	Image     string
+	Schedule  string
+	// Namespaces are the namespaces to back up, every namespace when empty
+	Namespaces []string
+	// SelectedTypes are the lowercase kinds to back up, every kind when empty
+	SelectedTypes map[string]bool
+	// ExcludeSecrets leaves Secrets out of the backup and the ClusterRole
+	ExcludeSecrets bool
+	// Output is the --output of the backups, BackupVolumePath by default
+	Output string
+	// PVC is the PersistentVolumeClaim mounted at BackupVolumePath
+	PVC string
+	// Args are additional arguments of the backups, or of the operator
+	Args []string
+	// Operator installs the operator and its CRD in a Deployment instead of
+	// CronJobs; its BackupSchedules declare the backups
+	Operator bool
+}
+
+// Verbs are the verbs a backup needs on every resource type: objects are
+// listed, never read one by one
+var Verbs = []string{"list"}
+
+// ResourceTypes returns the resource types backed up with the options
+func (o *Options) ResourceTypes() []resources.ResourceType {
+	var types []resources.ResourceType
+	for _, resourceType := range resources.GetResourceTypes(o.SelectedTypes) {
+		if o.ExcludeSecrets && resourceType.Kind == "Secret" {
+			continue
+		}
+		types = append(types, resourceType)
+	}
+	return types
+}
+
+// Rules returns the rules of the ClusterRole: the verbs on the backed-up
+// resource types, grouped by API group, and listing namespaces when every
+// namespace is backed up
+func (o *Options) Rules() []rbacv1.PolicyRule {
+	groups := make(map[string][]string)
+	for _, resourceType := range o.ResourceTypes() {
+		groups[resourceType.Group] = append(groups[resourceType.Group], resourceType.Resource)
+	}
+	if len(o.Namespaces) == 0 {
+		groups[""] = append(groups[""], "namespaces")
+	}
+
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+
+	rules := make([]rbacv1.PolicyRule, 0, len(groups))
+	for _, group := range names {
+		sort.Strings(groups[group])
+		rules = append(rules, rbacv1.PolicyRule{
+			APIGroups: []string{group},
+			Resources: groups[group],
+			Verbs:     Verbs,
+		})
+	}
+	return rules
+}
+
+// OperatorRules are the rules the operator needs besides listing the
+// backed-up resource types: watching BackupSchedules and reporting their status
+var OperatorRules = []rbacv1.PolicyRule{
+	{APIGroups: []string{operator.Group}, Resources: []string{operator.Resource}, Verbs: []string{"get", "list", "watch"}},
+	{APIGroups: []string{operator.Group}, Resources: []string{operator.Resource + "/status"}, Verbs: []string{"get", "update"}},
+}
+
+// Objects returns the objects to apply: the ServiceAccount, the ClusterRole,
+// a ClusterRoleBinding or a RoleBinding per backed-up namespace, and a
+// CronJob for all namespaces or one per backed-up namespace. The operator
+// gets its CRD, a Role for leader election and a Deployment instead.
+func Objects(o Options) ([]runtime.Object, error) {
+	if o.Name == "" || o.Namespace == "" || o.Image == "" || (o.Schedule == "" && !o.Operator) {
+		return nil, fmt.Errorf("name, namespace, image and schedule are required")
+	}
+	if o.Output == "" {
+		o.Output = BackupVolumePath
+	}
+	if !strings.Contains(o.Output, "://") && o.PVC == "" && !o.Operator {
+		return nil, fmt.Errorf("a local output needs a PersistentVolumeClaim to keep the backups")
+	}
+	if o.Operator && len(o.Namespaces) > 0 {
+		return nil, fmt.Errorf("the operator backs up the namespaces of its BackupSchedules, not of --backup-namespace")
+	}
+	if len(o.ResourceTypes()) == 0 {
+		return nil, fmt.Errorf("no resource types to back up")
+	}
+
+	labels := map[string]string{"app.kubernetes.io/name": "kbak", "app.kubernetes.io/instance": o.Name}
+	subject := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: o.Name, Namespace: o.Namespace}
+	roleRef := rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: o.Name}
+	if o.Operator {
+		return o.operatorObjects(labels, subject, roleRef)
+	}
+
+	objects := []runtime.Object{
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Name, Namespace: o.Namespace, Labels: labels},
+		},
+		&rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Name, Labels: labels},
+			Rules:      o.Rules(),
+		},
+	}
+
+	if len(o.Namespaces) == 0 {
+		objects = append(objects,
+			&rbacv1.ClusterRoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: o.Name, Labels: labels},
+				Subjects:   []rbacv1.Subject{subject},
+				RoleRef:    roleRef,
+			},
+			o.cronJob(o.Name, "", labels))
+		return objects, nil
+	}
+
+	// The ClusterRole is only granted in the backed-up namespaces
+	for _, namespace := range o.Namespaces {
+		objects = append(objects, &rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Name, Namespace: namespace, Labels: labels},
+			Subjects:   []rbacv1.Subject{subject},
+			RoleRef:    roleRef,
+		})
+	}
+	for _, namespace := range o.Namespaces {
+		name := o.Name
+		if len(o.Namespaces) > 1 {
+			name = o.Name + "-" + namespace
+		}
+		objects = append(objects, o.cronJob(name, namespace, labels))
+	}
+	return objects, nil
+}
+
+// BackupArgs returns the arguments of the backup of one namespace, or of every
+// namespace when namespace is empty. With several namespaces every one has its
+// own directory below the output, so retention and incremental backups never
+// take the runs of another namespace for their own.
+func (o *Options) BackupArgs(namespace string) []string {
+	args := []string{"--all-namespaces"}
+	if namespace != "" {
+		args = []string{"--namespace", namespace}
+	}
+	output := o.Output
+	if namespace != "" && len(o.Namespaces) > 1 {
+		output = strings.TrimSuffix(output, "/") + "/" + namespace
+	}
+	args = append(args, "--output", output)
+
+	// Leaving out Secrets takes every other kind
+	if len(o.SelectedTypes) > 0 || o.ExcludeSecrets {
+		for _, resourceType := range o.ResourceTypes() {
+			args = append(args, "--"+kindFlag(resourceType.Kind))
+		}
+	}
+	return append(args, o.Args...)
+}
+
+// kindFlag returns the kbak flag selecting a kind
+func kindFlag(kind string) string {
+	if kind == "PersistentVolumeClaim" {
+		return "pvc"
+	}
+	return strings.ToLower(kind)
+}
+
+// podSpec returns the pod running kbak with args as a non-root user on a
+// read-only root filesystem, with the backup volume when there is a claim
+func (o *Options) podSpec(args []string, restartPolicy corev1.RestartPolicy) corev1.PodSpec {
+	nonRoot := true
+	noEscalation := false
+	readOnly := true
+	user := int64(65534)
+
+	container := corev1.Container{
+		Name:  "kbak",
+		Image: o.Image,
+		Args:  args,
+		SecurityContext: &corev1.SecurityContext{
+			RunAsNonRoot:             &nonRoot,
+			RunAsUser:                &user,
+			AllowPrivilegeEscalation: &noEscalation,
+			ReadOnlyRootFilesystem:   &readOnly,
+			Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+		},
+	}
+	pod := corev1.PodSpec{
+		ServiceAccountName: o.Name,
+		RestartPolicy:      restartPolicy,
+		SecurityContext:    &corev1.PodSecurityContext{FSGroup: &user},
+		Containers:         []corev1.Container{container},
+	}
+	if o.PVC != "" {
+		pod.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "backups", MountPath: BackupVolumePath}}
+		pod.Volumes = []corev1.Volume{{
+			Name:         "backups",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: o.PVC}},
+		}}
+	}
+	return pod
+}
+
+// cronJob returns the CronJob backing up one namespace, or every namespace
+// when namespace is empty
+func (o *Options) cronJob(name, namespace string, labels map[string]string) *batchv1.CronJob {
+	backoffLimit := int32(2)
+	history := int32(3)
+
+	return &batchv1.CronJob{
+		TypeMeta:   metav1.TypeMeta{APIVersion: batchv1.SchemeGroupVersion.String(), Kind: "CronJob"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: o.Namespace, Labels: labels},
+		Spec: batchv1.CronJobSpec{
+			Schedule:                   o.Schedule,
+			ConcurrencyPolicy:          batchv1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: &history,
+			FailedJobsHistoryLimit:     &history,
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					BackoffLimit: &backoffLimit,
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: labels},
+						Spec:       o.podSpec(o.BackupArgs(namespace), corev1.RestartPolicyOnFailure),
+					},
+				},
+			},
+		},
+	}
+}
+
+// operatorObjects returns the objects of the operator: the BackupSchedule CRD,
+// the ServiceAccount, a ClusterRole listing the backed-up resource types in
+// every namespace and watching BackupSchedules, a Role for the leader
+// election Lease, their bindings and the Deployment
+func (o *Options) operatorObjects(labels map[string]string, subject rbacv1.Subject, roleRef rbacv1.RoleRef) ([]runtime.Object, error) {
+	crd := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal(operator.CRD, &crd.Object); err != nil {
+		return nil, fmt.Errorf("error reading the BackupSchedule CRD: %v", err)
+	}
+
+	// One replica runs at a time; the Lease keeps a rolling update from
+	// running backups twice
+	replicas := int32(1)
+	args := append([]string{"operator", "--leader-elect", fmt.Sprintf("--metrics-address=:%d", MetricsPort)}, o.Args...)
+	pod := o.podSpec(args, corev1.RestartPolicyAlways)
+	pod.Containers[0].Ports = []corev1.ContainerPort{{Name: "metrics", ContainerPort: MetricsPort}}
+
+	return []runtime.Object{
+		crd,
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Name, Namespace: o.Namespace, Labels: labels},
+		},
+		&rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Name, Labels: labels},
+			Rules:      append(o.Rules(), OperatorRules...),
+		},
+		&rbacv1.ClusterRoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Name, Labels: labels},
+			Subjects:   []rbacv1.Subject{subject},
+			RoleRef:    roleRef,
+		},
+		&rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Name, Namespace: o.Namespace, Labels: labels},
+			Rules: []rbacv1.PolicyRule{{
+				APIGroups: []string{coordinationv1.GroupName},
+				Resources: []string{"leases"},
+				Verbs:     []string{"get", "create", "update"},
+			}},
+		},
+		&rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Name, Namespace: o.Namespace, Labels: labels},
+			Subjects:   []rbacv1.Subject{subject},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: o.Name},
+		},
+		&appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{Name: o.Name, Namespace: o.Namespace, Labels: labels},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec:       pod,
+				},
+			},
+		},
+	}, nil
+}
+
+// Manifests returns the objects as multi-document YAML
+func Manifests(o Options) ([]byte, error) {
+	objects, err := Objects(o)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, obj := range objects {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return nil, err
+		}
+		// The CRD is written as it is, with its empty status subresource
+		if _, ok := obj.(*unstructured.Unstructured); !ok {
+			removeEmpty(content)
+		}
+		data, err := yaml.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// emptyFields are the fields the API types marshal to when they are unset
+var emptyFields = map[string]bool{"creationTimestamp": true, "metadata": true, "resources": true, "status": true, "strategy": true}
+
+// removeEmpty removes the null and empty unset fields of the API types
+func removeEmpty(obj map[string]interface{}) {
+	for key, value := range obj {
+		if items, ok := value.([]interface{}); ok {
+			for _, item := range items {
+				if itemObj, ok := item.(map[string]interface{}); ok {
+					removeEmpty(itemObj)
+				}
+			}
+			continue
+		}
+		if typed, ok := value.(map[string]interface{}); ok {
+			removeEmpty(typed)
+			if len(typed) > 0 {
+				continue
+			}
+		} else if value != nil {
+			continue
+		}
+		if emptyFields[key] {
+			delete(obj, key)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package install
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want []rbacv1.PolicyRule
+	}{
+		{
+			name: "selected types in one namespace",
+			opts: Options{Namespaces: []string{"shop"}, SelectedTypes: map[string]bool{"deployment": true, "secret": true, "configmap": true}},
+			want: []rbacv1.PolicyRule{
+				{APIGroups: []string{""}, Resources: []string{"configmaps", "secrets"}, Verbs: []string{"list"}},
+				{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"list"}},
+			},
+		},
+		{
+			name: "all namespaces without secrets",
+			opts: Options{SelectedTypes: map[string]bool{"secret": true, "configmap": true}, ExcludeSecrets: true},
+			want: []rbacv1.PolicyRule{
+				{APIGroups: []string{""}, Resources: []string{"configmaps", "namespaces"}, Verbs: []string{"list"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.Rules(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected rules %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	// Without a selection every type but Secrets is listed
+	opts := Options{ExcludeSecrets: true}
+	for _, rule := range opts.Rules() {
+		for _, resource := range rule.Resources {
+			if resource == "secrets" {
+				t.Errorf("Expected no access to secrets, got %v", rule)
+			}
+		}
+		if !reflect.DeepEqual(rule.Verbs, []string{"list"}) {
+			t.Errorf("Expected only the list verb, got %v", rule.Verbs)
+		}
+	}
+}
+
+func TestObjects(t *testing.T) {
+	opts := Options{
+		Name:       "kbak",
+		Namespace:  "backup",
+		Image:      "kbak:1.0",
+		Schedule:   "0 2 * * *",
+		Namespaces: []string{"shop", "web"},
+		PVC:        "kbak-backups",
+		Args:       []string{"--keep-daily", "7"},
+	}
+	objects, err := Objects(opts)
+	if err != nil {
+		t.Fatalf("Objects returned error: %v", err)
+	}
+
+	var kinds []string
+	for _, obj := range objects {
+		kinds = append(kinds, obj.GetObjectKind().GroupVersionKind().Kind)
+	}
+	want := []string{"ServiceAccount", "ClusterRole", "RoleBinding", "RoleBinding", "CronJob", "CronJob"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("Expected %v, got %v", want, kinds)
+	}
+	if binding := objects[3].(*rbacv1.RoleBinding); binding.Namespace != "web" || binding.Subjects[0].Namespace != "backup" {
+		t.Errorf("Expected a binding in web for the service account in backup, got %v", binding)
+	}
+	cronJob := objects[5].(*batchv1.CronJob)
+	args := cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Args
+	if cronJob.Name != "kbak-web" || strings.Join(args, " ") != "--namespace web --output /backups/web --keep-daily 7" {
+		t.Errorf("Expected CronJob kbak-web backing up web, got %s with %v", cronJob.Name, args)
+	}
+	// The retention of one namespace never removes the backups of another
+	shopArgs := objects[4].(*batchv1.CronJob).Spec.JobTemplate.Spec.Template.Spec.Containers[0].Args
+	if strings.Join(shopArgs, " ") != "--namespace shop --output /backups/shop --keep-daily 7" {
+		t.Errorf("Expected the CronJob of shop to back up to its own output, got %v", shopArgs)
+	}
+
+	// Every namespace is backed up by one CronJob with a ClusterRoleBinding
+	opts.Namespaces = nil
+	if objects, err = Objects(opts); err != nil {
+		t.Fatalf("Objects returned error: %v", err)
+	}
+	if len(objects) != 4 || objects[2].GetObjectKind().GroupVersionKind().Kind != "ClusterRoleBinding" {
+		t.Errorf("Expected a ClusterRoleBinding and one CronJob, got %d objects", len(objects))
+	}
+
+	// Local backups need a volume
+	opts.PVC = ""
+	if _, err := Objects(opts); err == nil {
+		t.Errorf("Expected error for a local output without a claim")
+	}
+	opts.Output = "s3://backups/prod"
+	if _, err := Objects(opts); err != nil {
+		t.Errorf("Expected no claim to be needed for S3, got %v", err)
+	}
+}
+
+func TestBackupArgs(t *testing.T) {
+	opts := Options{Output: "/backups", SelectedTypes: map[string]bool{"persistentvolumeclaim": true, "secret": true}, ExcludeSecrets: true}
+	if got := strings.Join(opts.BackupArgs(""), " "); got != "--all-namespaces --output /backups --pvc" {
+		t.Errorf("Expected the pvc flag only, got %q", got)
+	}
+
+	// A single namespace keeps the output, several get a directory each
+	opts = Options{Output: "s3://backups/prod/", Namespaces: []string{"shop"}}
+	if got := strings.Join(opts.BackupArgs("shop"), " "); got != "--namespace shop --output s3://backups/prod/" {
+		t.Errorf("Expected the output of the only namespace, got %q", got)
+	}
+	opts.Namespaces = []string{"shop", "web"}
+	if got := strings.Join(opts.BackupArgs("shop"), " "); got != "--namespace shop --output s3://backups/prod/shop" {
+		t.Errorf("Expected a directory of shop below the output, got %q", got)
+	}
+}
+
+func TestManifests(t *testing.T) {
+	data, err := Manifests(Options{Name: "kbak", Namespace: "backup", Image: "kbak:1.0", Schedule: "@daily", PVC: "kbak-backups"})
+	if err != nil {
+		t.Fatalf("Manifests returned error: %v", err)
+	}
+	text := string(data)
+	if strings.Count(text, "---\n") != 4 {
+		t.Errorf("Expected 4 documents, got:\n%s", text)
+	}
+	for _, unwanted := range []string{"creationTimestamp", "status", "{}"} {
+		if strings.Contains(text, unwanted) {
+			t.Errorf("Expected no %q in the manifests, got:\n%s", unwanted, text)
+		}
+	}
+}
+
+func TestOperatorObjects(t *testing.T) {
+	opts := Options{Name: "kbak", Namespace: "backup", Image: "kbak:1.0", ExcludeSecrets: true, Operator: true}
+	objects, err := Objects(opts)
+	if err != nil {
+		t.Fatalf("Objects returned error: %v", err)
+	}
+
+	var kinds []string
+	for _, obj := range objects {
+		kinds = append(kinds, obj.GetObjectKind().GroupVersionKind().Kind)
+	}
+	want := []string{"CustomResourceDefinition", "ServiceAccount", "ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding", "Deployment"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("Expected %v, got %v", want, kinds)
+	}
+
+	rules := objects[2].(*rbacv1.ClusterRole).Rules
+	if !reflect.DeepEqual(rules[len(rules)-2:], OperatorRules) {
+		t.Errorf("Expected the operator rules last, got %v", rules)
+	}
+	deployment := objects[6].(*appsv1.Deployment)
+	if args := deployment.Spec.Template.Spec.Containers[0].Args; strings.Join(args, " ") != "operator --leader-elect --metrics-address=:9090" {
+		t.Errorf("Expected the operator with leader election, got %v", args)
+	}
+
+	data, err := Manifests(opts)
+	if err != nil {
+		t.Fatalf("Manifests returned error: %v", err)
+	}
+	if text := string(data); !strings.Contains(text, "status: {}") || strings.Contains(text, "strategy") {
+		t.Errorf("Expected the status subresource of the CRD and no empty strategy, got:\n%s", text)
+	}
+
+	opts.Namespaces = []string{"shop"}
+	if _, err := Objects(opts); err == nil {
+		t.Errorf("Expected error for backed-up namespaces of the operator")
+	}
+}
@@ -0,0 +1,123 @@
+// Package metrics exposes the results of backups as Prometheus metrics, served
+// on /metrics by long-running kbak processes or pushed to a Pushgateway after
+// one-off backups.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+)
+
+// Metrics holds the metrics of the backups of one kbak process. Every metric
+// has a schedule label naming the BackupSchedule of the operator, which is
+// empty for backups configured by flags.
+type Metrics struct {
+	registry     *prometheus.Registry
+	duration     *prometheus.GaugeVec
+	objects      *prometheus.GaugeVec
+	objectErrors *prometheus.GaugeVec
+	errors       *prometheus.GaugeVec
+	written      *prometheus.GaugeVec
+	lastSuccess  *prometheus.GaugeVec
+	runs         *prometheus.CounterVec
+}
+
+// New returns the metrics registered in a new registry
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kbak_backup_duration_seconds",
+			Help: "Duration of the latest backup.",
+		}, []string{"schedule"}),
+		objects: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kbak_backup_objects",
+			Help: "Objects backed up by the latest backup, per namespace and kind.",
+		}, []string{"schedule", "namespace", "kind"}),
+		objectErrors: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kbak_backup_object_errors",
+			Help: "Errors backing up objects in the latest backup, per namespace and kind.",
+		}, []string{"schedule", "namespace", "kind"}),
+		errors: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kbak_backup_errors",
+			Help: "Errors of the latest backup, including errors outside of single kinds.",
+		}, []string{"schedule"}),
+		written: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kbak_backup_written_bytes",
+			Help: "Bytes written to the storage by the latest backup, without files that were unchanged.",
+		}, []string{"schedule"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kbak_backup_last_success_timestamp_seconds",
+			Help: "Completion time of the latest backup without errors, in seconds since the epoch.",
+		}, []string{"schedule"}),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kbak_backup_runs_total",
+			Help: "Backups run by this process, by result (success or failure).",
+		}, []string{"schedule", "result"}),
+	}
+	m.registry.MustRegister(m.duration, m.objects, m.objectErrors, m.errors, m.written, m.lastSuccess, m.runs)
+	return m
+}
+
+// Observe records a finished backup: the stats of every backed-up namespace
+// by name, and errorCount, the errors of the whole backup. The per-namespace
+// metrics of the previous backup of the schedule are replaced.
+func (m *Metrics) Observe(schedule string, startedAt, completedAt time.Time, stats map[string]*backup.BackupStats, errorCount int) {
+	m.objects.DeletePartialMatch(prometheus.Labels{"schedule": schedule})
+	m.objectErrors.DeletePartialMatch(prometheus.Labels{"schedule": schedule})
+
+	var written int64
+	for namespace, nsStats := range stats {
+		for kind, count := range nsStats.ResourcesBackedUp {
+			m.objects.WithLabelValues(schedule, namespace, kind).Set(float64(count))
+		}
+		for kind, count := range nsStats.ResourceErrors {
+			m.objectErrors.WithLabelValues(schedule, namespace, kind).Set(float64(count))
+		}
+		written += nsStats.WrittenBytes
+	}
+
+	m.duration.WithLabelValues(schedule).Set(completedAt.Sub(startedAt).Seconds())
+	m.errors.WithLabelValues(schedule).Set(float64(errorCount))
+	m.written.WithLabelValues(schedule).Set(float64(written))
+	if errorCount == 0 {
+		m.lastSuccess.WithLabelValues(schedule).Set(float64(completedAt.Unix()))
+		m.runs.WithLabelValues(schedule, "success").Inc()
+	} else {
+		m.runs.WithLabelValues(schedule, "failure").Inc()
+	}
+}
+
+// Forget removes the metrics of a schedule, e.g. of a deleted BackupSchedule
+func (m *Metrics) Forget(schedule string) {
+	labels := prometheus.Labels{"schedule": schedule}
+	m.duration.DeletePartialMatch(labels)
+	m.objects.DeletePartialMatch(labels)
+	m.objectErrors.DeletePartialMatch(labels)
+	m.errors.DeletePartialMatch(labels)
+	m.written.DeletePartialMatch(labels)
+	m.lastSuccess.DeletePartialMatch(labels)
+	m.runs.DeletePartialMatch(labels)
+}
+
+// Handler returns the handler serving the metrics in the Prometheus formats
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Push sends the metrics to the Pushgateway at url under job. Metrics missing
+// from the push keep their previous values in the Pushgateway, so the last
+// success time of an earlier backup survives a failed one.
+func (m *Metrics) Push(url, job string) error {
+	if err := push.New(url, job).Gatherer(m.registry).Add(); err != nil {
+		return fmt.Errorf("error pushing metrics to %s: %v", url, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+)
+
+// scrape returns the metrics served by the handler
+func scrape(t *testing.T, m *Metrics) string {
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return recorder.Body.String()
+}
+
+func TestObserve(t *testing.T) {
+	m := New()
+	startedAt := time.Unix(1700000000, 0)
+	stats := map[string]*backup.BackupStats{
+		"shop": {
+			ResourceCount:     3,
+			ErrorCount:        1,
+			ResourcesBackedUp: map[string]int{"Deployment": 2, "Service": 1},
+			ResourceErrors:    map[string]int{"Secret": 1},
+			// One file was unchanged
+			Files:        []backup.FileRecord{{Size: 100}, {Size: 50}},
+			WrittenBytes: 100,
+		},
+		"web": {ResourceCount: 1, ResourcesBackedUp: map[string]int{"ConfigMap": 1}, Files: []backup.FileRecord{{Size: 25}}, WrittenBytes: 25},
+	}
+	m.Observe("", startedAt, startedAt.Add(90*time.Second), stats, 1)
+
+	text := scrape(t, m)
+	for _, want := range []string{
+		`kbak_backup_duration_seconds{schedule=""} 90`,
+		`kbak_backup_objects{kind="Deployment",namespace="shop",schedule=""} 2`,
+		`kbak_backup_objects{kind="ConfigMap",namespace="web",schedule=""} 1`,
+		`kbak_backup_object_errors{kind="Secret",namespace="shop",schedule=""} 1`,
+		`kbak_backup_errors{schedule=""} 1`,
+		`kbak_backup_written_bytes{schedule=""} 125`,
+		`kbak_backup_runs_total{result="failure",schedule=""} 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "kbak_backup_last_success_timestamp_seconds{") {
+		t.Errorf("Expected no last success after a failed backup, got:\n%s", text)
+	}
+
+	// A successful backup replaces the objects of the previous one
+	completedAt := startedAt.Add(time.Hour)
+	m.Observe("", startedAt, completedAt, map[string]*backup.BackupStats{"web": stats["web"]}, 0)
+	text = scrape(t, m)
+	if strings.Contains(text, `namespace="shop"`) {
+		t.Errorf("Expected no metrics of shop after it was left out, got:\n%s", text)
+	}
+	for _, want := range []string{
+		`kbak_backup_last_success_timestamp_seconds{schedule=""} 1.7000036e+09`,
+		`kbak_backup_runs_total{result="success",schedule=""} 1`,
+		`kbak_backup_runs_total{result="failure",schedule=""} 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", want, text)
+		}
+	}
+}
+
+func TestForget(t *testing.T) {
+	m := New()
+	now := time.Now()
+	m.Observe("kbak/nightly", now, now, map[string]*backup.BackupStats{"shop": {ResourcesBackedUp: map[string]int{"Deployment": 1}}}, 0)
+	m.Observe("kbak/hourly", now, now, nil, 0)
+	m.Forget("kbak/nightly")
+
+	text := scrape(t, m)
+	if strings.Contains(text, "kbak/nightly") || !strings.Contains(text, "kbak/hourly") {
+		t.Errorf("Expected only the metrics of kbak/hourly, got:\n%s", text)
+	}
+}
+
+func TestPush(t *testing.T) {
+	var method, path, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	m := New()
+	now := time.Now()
+	m.Observe("", now, now, nil, 0)
+	if err := m.Push(server.URL, "kbak"); err != nil {
+		t.Fatalf("Push returned error: %v", err)
+	}
+	// POST keeps the metrics missing from the push, e.g. the last success
+	if method != http.MethodPost || path != "/metrics/job/kbak" || !strings.Contains(body, "kbak_backup_runs_total") {
+		t.Errorf("Expected a POST of the metrics to /metrics/job/kbak, got %s %s", method, path)
+	}
+
+	server.Close()
+	if err := m.Push(server.URL, "kbak"); err == nil {
+		t.Errorf("Expected error pushing to a closed Pushgateway")
+	}
+}
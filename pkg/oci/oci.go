@@ -0,0 +1,339 @@
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/credentials"
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+// Media types of kbak backup artifacts
+const (
+	ArtifactType    = "application/vnd.kbak.backup.v1"
+	ConfigMediaType = "application/vnd.kbak.manifest.v1+json"
+	LayerMediaType  = "application/vnd.kbak.namespace.v1.tar+gzip"
+	// AttachmentsMediaType is the layer with the attachments of the backup
+	// manifest and its signature
+	AttachmentsMediaType = "application/vnd.kbak.attachments.v1.tar+gzip"
+)
+
+// Annotations set on backup artifacts and their layers
+const (
+	AnnotationCluster           = "io.kbak.cluster"
+	AnnotationContext           = "io.kbak.context"
+	AnnotationTimestamp         = "io.kbak.timestamp"
+	AnnotationKubernetesVersion = "io.kbak.kubernetes-version"
+	AnnotationKbakVersion       = "io.kbak.version"
+	AnnotationNamespace         = "io.kbak.namespace"
+	AnnotationNamespaceCount    = "io.kbak.namespace-count"
+	AnnotationResourceCount     = "io.kbak.resource-count"
+	AnnotationErrorCount        = "io.kbak.error-count"
+)
+
+// NewRepository returns the registry repository of a reference such as
+// registry.example.com/backups/prod:tag. Credentials are taken from the
+// docker config (docker login / oras login).
+func NewRepository(reference string, plainHTTP bool) (*remote.Repository, error) {
+	repo, err := remote.NewRepository(reference)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCI reference %q: %v", reference, err)
+	}
+	repo.PlainHTTP = plainHTTP
+
+	client := &auth.Client{
+		Client: retry.DefaultClient,
+		Cache:  auth.NewCache(),
+	}
+	credStore, err := credentials.NewStoreFromDocker(credentials.StoreOptions{})
+	if err == nil {
+		client.Credential = credentials.Credential(credStore)
+	}
+	repo.Client = client
+
+	return repo, nil
+}
+
+// Push packages the backup in dir as an artifact with one layer per
+// namespace and pushes it to target under tag
+func Push(ctx context.Context, target oras.Target, tag string, store storage.Storage, dir string) (ocispec.Descriptor, error) {
+	staging := memory.New()
+	desc, err := pack(ctx, staging, store, dir)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := staging.Tag(ctx, desc, tag); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	if _, err := oras.Copy(ctx, staging, tag, target, tag, oras.DefaultCopyOptions); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error pushing artifact: %v", err)
+	}
+
+	return desc, nil
+}
+
+// pack stores the config, layers and manifest of the backup artifact in
+// pusher and returns the manifest descriptor
+func pack(ctx context.Context, pusher content.Pusher, store storage.Storage, dir string) (ocispec.Descriptor, error) {
+	config, err := store.Read(path.Join(dir, backup.ManifestFileName))
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error reading backup manifest: %v", err)
+	}
+	var manifest backup.Manifest
+	if err := json.Unmarshal(config, &manifest); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("error parsing backup manifest: %v", err)
+	}
+
+	configDesc, err := oras.PushBytes(ctx, pusher, ConfigMediaType, config)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	namespaces := make([]string, 0, len(manifest.Namespaces))
+	for ns := range manifest.Namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	var layers []ocispec.Descriptor
+	for _, ns := range namespaces {
+		var files []string
+		for _, file := range manifest.Files {
+			if file.Namespace == ns {
+				files = append(files, file.Path)
+			}
+		}
+		data, err := tarLayer(store, dir, files)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		layer, err := oras.PushBytes(ctx, pusher, LayerMediaType, data)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		layer.Annotations = map[string]string{
+			ocispec.AnnotationTitle: ns + ".tar.gz",
+			AnnotationNamespace:     ns,
+			AnnotationResourceCount: strconv.Itoa(manifest.Namespaces[ns].ResourceCount),
+			AnnotationErrorCount:    strconv.Itoa(manifest.Namespaces[ns].ErrorCount),
+		}
+		layers = append(layers, layer)
+	}
+
+	// Attachments and the signature are not part of any namespace
+	var attachments []string
+	for _, file := range manifest.Attachments {
+		attachments = append(attachments, file.Path)
+	}
+	if exists, err := store.Exists(path.Join(dir, backup.SignatureFileName)); err != nil {
+		return ocispec.Descriptor{}, err
+	} else if exists {
+		attachments = append(attachments, backup.SignatureFileName)
+	}
+	if len(attachments) > 0 {
+		data, err := tarLayer(store, dir, attachments)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		layer, err := oras.PushBytes(ctx, pusher, AttachmentsMediaType, data)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		layer.Annotations = map[string]string{ocispec.AnnotationTitle: "attachments.tar.gz"}
+		layers = append(layers, layer)
+	}
+
+	annotations := map[string]string{
+		ocispec.AnnotationCreated:   manifest.CompletedAt.UTC().Format(time.RFC3339),
+		AnnotationCluster:           manifest.Cluster,
+		AnnotationContext:           manifest.Context,
+		AnnotationTimestamp:         manifest.Timestamp,
+		AnnotationKubernetesVersion: manifest.KubernetesVersion,
+		AnnotationKbakVersion:       manifest.KbakVersion,
+		AnnotationNamespaceCount:    strconv.Itoa(len(manifest.Namespaces)),
+		AnnotationResourceCount:     strconv.Itoa(manifest.ResourceCount),
+		AnnotationErrorCount:        strconv.Itoa(manifest.ErrorCount),
+	}
+	for key, value := range annotations {
+		if value == "" {
+			delete(annotations, key)
+		}
+	}
+
+	return oras.PackManifest(ctx, pusher, oras.PackManifestVersion1_1, ArtifactType, oras.PackManifestOptions{
+		Layers:              layers,
+		ConfigDescriptor:    &configDesc,
+		ManifestAnnotations: annotations,
+	})
+}
+
+// tarLayer returns a gzipped tar of files, with paths relative to the
+// backup directory. The archive has no timestamps, so unchanged backups
+// produce identical layers.
+func tarLayer(store storage.Storage, dir string, files []string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, file := range files {
+		data, err := store.Read(path.Join(dir, file))
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", file, err)
+		}
+		header := &tar.Header{
+			Name:     file,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Artifact is a backup artifact fetched from a registry
+type Artifact struct {
+	Descriptor ocispec.Descriptor
+	Manifest   ocispec.Manifest
+	fetcher    content.Fetcher
+}
+
+// Fetch copies the artifact of a tag or digest from src
+func Fetch(ctx context.Context, src oras.ReadOnlyTarget, reference string) (*Artifact, error) {
+	staging := memory.New()
+	desc, err := oras.Copy(ctx, src, reference, staging, "", oras.DefaultCopyOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error pulling artifact: %v", err)
+	}
+
+	data, err := content.FetchAll(ctx, staging, desc)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing artifact manifest: %v", err)
+	}
+	if manifest.ArtifactType != ArtifactType {
+		return nil, fmt.Errorf("%s is not a kbak backup (artifact type %q)", reference, manifest.ArtifactType)
+	}
+
+	return &Artifact{Descriptor: desc, Manifest: manifest, fetcher: staging}, nil
+}
+
+// Timestamp returns the timestamp of the backup run
+func (a *Artifact) Timestamp() string {
+	return a.Manifest.Annotations[AnnotationTimestamp]
+}
+
+// Extract writes the backup files and the backup manifest to dir
+func (a *Artifact) Extract(ctx context.Context, store storage.Storage, dir string) (*backup.Manifest, error) {
+	config, err := content.FetchAll(ctx, a.fetcher, a.Manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	var manifest backup.Manifest
+	if err := json.Unmarshal(config, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing backup manifest: %v", err)
+	}
+
+	// Files of secret-bearing kinds get the secret permissions of the storage
+	secretFiles := make(map[string]bool)
+	for _, file := range manifest.Files {
+		if backup.IsSecretKind(file.Kind) {
+			secretFiles[path.Clean(file.Path)] = true
+		}
+	}
+
+	for _, layer := range a.Manifest.Layers {
+		if layer.MediaType != LayerMediaType && layer.MediaType != AttachmentsMediaType {
+			continue
+		}
+		data, err := content.FetchAll(ctx, a.fetcher, layer)
+		if err != nil {
+			return nil, err
+		}
+		if err := extractLayer(data, store, dir, secretFiles); err != nil {
+			return nil, fmt.Errorf("error extracting %s: %v", layer.Annotations[ocispec.AnnotationTitle], err)
+		}
+	}
+
+	// The manifest is written last and marks the backup as complete
+	if err := store.Write(path.Join(dir, backup.ManifestFileName), config); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// extractLayer writes the regular files of a gzipped tar to dir. Files in
+// secretFiles, by path relative to dir, are written as secrets.
+func extractLayer(data []byte, store storage.Storage, dir string, secretFiles map[string]bool) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid path %q in layer", header.Name)
+		}
+		fileData, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		write := store.Write
+		if secretFiles[name] {
+			write = func(p string, data []byte) error { return storage.WriteSecret(store, p, data) }
+		}
+		if err := write(path.Join(dir, name), fileData); err != nil {
+			return err
+		}
+	}
+}
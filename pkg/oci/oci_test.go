@@ -0,0 +1,222 @@
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/storage"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+// writeTestBackup writes a backup with two namespaces to store
+func writeTestBackup(t *testing.T, store storage.Storage, dir string) {
+	t.Helper()
+
+	files := map[string][]backup.FileRecord{
+		"default": {{Path: dir + "/default/ConfigMap/a.yaml", Namespace: "default", Kind: "ConfigMap", Name: "a"}},
+		"prod": {
+			{Path: dir + "/prod/ConfigMap/b.yaml", Namespace: "prod", Kind: "ConfigMap", Name: "b"},
+			{Path: dir + "/prod/Secret/c.yaml", Namespace: "prod", Kind: "Secret", Name: "c"},
+		},
+	}
+
+	manifest := &backup.Manifest{
+		Cluster:    "prod-cluster",
+		Timestamp:  "2025-01-02T03-04-05Z",
+		StartedAt:  time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		Namespaces: make(map[string]backup.NamespaceSummary),
+	}
+	for ns, records := range files {
+		stats := backup.NewBackupStats()
+		for i, record := range records {
+			data := []byte("name: " + record.Name + "\n")
+			if err := store.Write(record.Path, data); err != nil {
+				t.Fatalf("Write returned error: %v", err)
+			}
+			checksum := sha256.Sum256(data)
+			records[i].Size = int64(len(data))
+			records[i].SHA256 = hex.EncodeToString(checksum[:])
+			stats.ResourceCount++
+		}
+		stats.Files = records
+		if err := manifest.AddNamespace(ns, dir, stats); err != nil {
+			t.Fatalf("AddNamespace returned error: %v", err)
+		}
+	}
+	if err := manifest.Write(store, dir); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+}
+
+// testPushAndPull pushes a backup to target and pulls it back by tag and digest
+func testPushAndPull(t *testing.T, target oras.Target, tag string) {
+	t.Helper()
+	ctx := context.Background()
+
+	source := storage.NewLocal(t.TempDir())
+	writeTestBackup(t, source, "run")
+
+	desc, err := Push(ctx, target, tag, source, "run")
+	if err != nil {
+		t.Fatalf("Push returned error: %v", err)
+	}
+	// Unlike registries, memory stores resolve tags only
+	if store, ok := target.(*memory.Store); ok {
+		if err := store.Tag(ctx, desc, desc.Digest.String()); err != nil {
+			t.Fatalf("Tag returned error: %v", err)
+		}
+	}
+
+	for _, reference := range []string{tag, desc.Digest.String()} {
+		artifact, err := Fetch(ctx, target, reference)
+		if err != nil {
+			t.Fatalf("Fetch(%q) returned error: %v", reference, err)
+		}
+		if artifact.Descriptor.Digest != desc.Digest {
+			t.Errorf("Expected digest %s, got %s", desc.Digest, artifact.Descriptor.Digest)
+		}
+		if len(artifact.Manifest.Layers) != 2 {
+			t.Fatalf("Expected one layer per namespace, got %d", len(artifact.Manifest.Layers))
+		}
+		if got := artifact.Manifest.Layers[1].Annotations[AnnotationNamespace]; got != "prod" {
+			t.Errorf("Expected second layer for namespace prod, got %q", got)
+		}
+		annotations := artifact.Manifest.Annotations
+		if annotations[AnnotationCluster] != "prod-cluster" || annotations[AnnotationResourceCount] != "3" || artifact.Timestamp() != "2025-01-02T03-04-05Z" {
+			t.Errorf("Unexpected annotations: %v", annotations)
+		}
+
+		dest := storage.NewLocal(t.TempDir())
+		manifest, err := artifact.Extract(ctx, dest, "restored")
+		if err != nil {
+			t.Fatalf("Extract returned error: %v", err)
+		}
+		if manifest.ResourceCount != 3 {
+			t.Errorf("Expected 3 resources in the extracted manifest, got %d", manifest.ResourceCount)
+		}
+		paths, err := dest.List("restored")
+		if err != nil {
+			t.Fatalf("List returned error: %v", err)
+		}
+		want := []string{
+			"restored/default/ConfigMap/a.yaml",
+			"restored/kbak-manifest.json",
+			"restored/prod/ConfigMap/b.yaml",
+			"restored/prod/Secret/c.yaml",
+		}
+		if fmt.Sprint(paths) != fmt.Sprint(want) {
+			t.Errorf("Extracted files = %v, want %v", paths, want)
+		}
+		data, err := dest.Read("restored/prod/Secret/c.yaml")
+		if err != nil || string(data) != "name: c\n" {
+			t.Errorf("Unexpected extracted content %q, %v", data, err)
+		}
+	}
+}
+
+func TestPushAndPull(t *testing.T) {
+	testPushAndPull(t, memory.New(), "v1")
+}
+
+func TestPushIsReproducible(t *testing.T) {
+	ctx := context.Background()
+	source := storage.NewLocal(t.TempDir())
+	writeTestBackup(t, source, "run")
+
+	first, err := Push(ctx, memory.New(), "a", source, "run")
+	if err != nil {
+		t.Fatalf("Push returned error: %v", err)
+	}
+	second, err := Push(ctx, memory.New(), "b", source, "run")
+	if err != nil {
+		t.Fatalf("Push returned error: %v", err)
+	}
+	if first.Digest != second.Digest {
+		t.Errorf("Expected identical digests for the same backup, got %s and %s", first.Digest, second.Digest)
+	}
+}
+
+func TestPushAttachments(t *testing.T) {
+	ctx := context.Background()
+	source := storage.NewLocal(t.TempDir())
+	writeTestBackup(t, source, "run")
+
+	manifest, err := backup.ReadManifest(source, "run")
+	if err != nil {
+		t.Fatalf("ReadManifest returned error: %v", err)
+	}
+	if err := manifest.AddAttachment(source, "run", "kbak-redactions.json", []byte("{}\n")); err != nil {
+		t.Fatalf("AddAttachment returned error: %v", err)
+	}
+	if err := manifest.Write(source, "run"); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	source.Write("run/"+backup.SignatureFileName, []byte("c2lnbmF0dXJl\n"))
+
+	target := memory.New()
+	if _, err := Push(ctx, target, "v1", source, "run"); err != nil {
+		t.Fatalf("Push returned error: %v", err)
+	}
+	artifact, err := Fetch(ctx, target, "v1")
+	if err != nil {
+		t.Fatalf("Fetch returned error: %v", err)
+	}
+	if last := artifact.Manifest.Layers[len(artifact.Manifest.Layers)-1]; last.MediaType != AttachmentsMediaType {
+		t.Errorf("Expected an attachments layer last, got %s", last.MediaType)
+	}
+
+	dest := storage.NewLocal(t.TempDir())
+	if _, err := artifact.Extract(ctx, dest, "restored"); err != nil {
+		t.Fatalf("Extract returned error: %v", err)
+	}
+	verification, err := backup.VerifyBackup(dest, "restored")
+	if err != nil {
+		t.Fatalf("VerifyBackup returned error: %v", err)
+	}
+	if !verification.OK() {
+		t.Errorf("Expected the pulled backup to verify, got %+v", verification)
+	}
+	if data, err := dest.Read("restored/" + backup.SignatureFileName); err != nil || string(data) != "c2lnbmF0dXJl\n" {
+		t.Errorf("Expected the signature to be pulled, got %q, %v", data, err)
+	}
+}
+
+func TestFetchRejectsOtherArtifacts(t *testing.T) {
+	ctx := context.Background()
+	target := memory.New()
+	desc, err := oras.PackManifest(ctx, target, oras.PackManifestVersion1_1, "application/vnd.example", oras.PackManifestOptions{})
+	if err != nil {
+		t.Fatalf("PackManifest returned error: %v", err)
+	}
+	if err := target.Tag(ctx, desc, "other"); err != nil {
+		t.Fatalf("Tag returned error: %v", err)
+	}
+
+	if _, err := Fetch(ctx, target, "other"); err == nil {
+		t.Errorf("Expected error for an artifact that is not a kbak backup")
+	}
+}
+
+// TestRegistry runs against a local registry:
+//
+//	docker run -d -p 5000:5000 registry:2
+//	KBAK_TEST_OCI_REGISTRY=localhost:5000 go test ./pkg/oci/
+func TestRegistry(t *testing.T) {
+	registry := os.Getenv("KBAK_TEST_OCI_REGISTRY")
+	if registry == "" {
+		t.Skip("KBAK_TEST_OCI_REGISTRY not set")
+	}
+
+	repo, err := NewRepository(registry+"/kbak-test", true)
+	if err != nil {
+		t.Fatalf("NewRepository returned error: %v", err)
+	}
+	testPushAndPull(t, repo, fmt.Sprintf("test-%d", time.Now().UnixNano()))
+}
@@ -0,0 +1,240 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/rogosprojects/kbak/pkg/utils"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// statusTimeout bounds a status update, which also runs after a backup that
+// finished while the controller is stopping
+const statusTimeout = 30 * time.Second
+
+// Runner makes one backup of a BackupSchedule and returns its results
+type Runner func(schedule *BackupSchedule) RunStatus
+
+// Controller schedules the backups of the BackupSchedules it watches and
+// writes their results to their status
+type Controller struct {
+	client dynamic.Interface
+	// root is the directory holding the local destinations
+	root      string
+	run       Runner
+	scheduler *cron.Cron
+	// OnRemove is called with the name of deleted BackupSchedules
+	OnRemove func(name string)
+
+	mu sync.Mutex
+	// entries are the scheduled BackupSchedules by name
+	entries map[string]*entry
+	// running holds the BackupSchedules with a backup in progress
+	running map[string]bool
+}
+
+// entry is the state of one BackupSchedule in the controller
+type entry struct {
+	uid        types.UID
+	generation int64
+	// id is the cron entry, 0 for invalid or suspended BackupSchedules
+	id cron.EntryID
+}
+
+// NewController returns a controller of the BackupSchedules making backups
+// with run, to local destinations below root
+func NewController(client dynamic.Interface, root string, run Runner) *Controller {
+	return &Controller{
+		client:    client,
+		root:      root,
+		run:       run,
+		scheduler: cron.New(),
+		entries:   make(map[string]*entry),
+		running:   make(map[string]bool),
+	}
+}
+
+// Run watches the BackupSchedules and runs their backups until ctx is done,
+// then waits for running backups to finish
+func (c *Controller) Run(ctx context.Context) error {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.client, 0)
+	informer := factory.ForResource(GroupVersionResource).Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.sync,
+		UpdateFunc: func(_, obj interface{}) { c.sync(obj) },
+		DeleteFunc: c.remove,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.scheduler.Start()
+	defer func() { <-c.scheduler.Stop().Done() }()
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) && ctx.Err() == nil {
+		return fmt.Errorf("error watching %s", GroupVersionResource.GroupResource())
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// sync schedules the backups of a new or changed BackupSchedule
+func (c *Controller) sync(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	var bs BackupSchedule
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &bs); err != nil {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError reading BackupSchedule %s: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, u.GetName(), err, utils.Reset)
+		return
+	}
+	key := bs.Name
+
+	// Status updates leave the generation unchanged
+	c.mu.Lock()
+	existing := c.entries[key]
+	if existing != nil && existing.uid == bs.UID && existing.generation == bs.Generation {
+		c.mu.Unlock()
+		return
+	}
+	if existing != nil && existing.id != 0 {
+		c.scheduler.Remove(existing.id)
+	}
+	e := &entry{uid: bs.UID, generation: bs.Generation}
+	c.entries[key] = e
+
+	schedule, err := bs.Spec.Validate(c.root)
+	var next *metav1.Time
+	if err == nil && !bs.Spec.Suspend {
+		e.id = c.scheduler.Schedule(schedule, cron.FuncJob(func() { c.backup(key, bs, schedule) }))
+		next = &metav1.Time{Time: schedule.Next(time.Now())}
+	}
+	c.mu.Unlock()
+
+	switch {
+	case err != nil:
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError in BackupSchedule %s: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, key, err, utils.Reset)
+	case bs.Spec.Suspend:
+		fmt.Fprintf(utils.StatusOutput, "%s %sBackupSchedule %s is suspended%s\n",
+			utils.InfoEmoji, utils.Cyan, key, utils.Reset)
+	default:
+		fmt.Fprintf(utils.StatusOutput, "%s %sScheduled BackupSchedule %s on %q, next at %s%s\n",
+			utils.InfoEmoji, utils.Cyan, key, bs.Spec.Schedule, next.Format(time.RFC3339), utils.Reset)
+	}
+
+	c.updateStatus(bs.Name, func(status *BackupScheduleStatus) {
+		status.ObservedGeneration = bs.Generation
+		status.Error = ""
+		if err != nil {
+			status.Error = err.Error()
+		}
+		status.NextRunTime = next
+	})
+}
+
+// remove stops the backups of a deleted BackupSchedule
+func (c *Controller) remove(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	key := u.GetName()
+
+	c.mu.Lock()
+	if e := c.entries[key]; e != nil && e.id != 0 {
+		c.scheduler.Remove(e.id)
+	}
+	delete(c.entries, key)
+	c.mu.Unlock()
+
+	if c.OnRemove != nil {
+		c.OnRemove(key)
+	}
+}
+
+// backup runs a scheduled backup and reports it in the status. A backup is
+// skipped while the previous one of the same BackupSchedule is still going.
+func (c *Controller) backup(key string, bs BackupSchedule, schedule cron.Schedule) {
+	c.mu.Lock()
+	if c.running[key] {
+		c.mu.Unlock()
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sWarning: skipping the backup of BackupSchedule %s, the previous one is still running%s\n",
+			utils.WarningEmoji, utils.Yellow, utils.Bold, key, utils.Reset)
+		return
+	}
+	c.running[key] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.running, key)
+		c.mu.Unlock()
+	}()
+
+	fmt.Fprintf(utils.StatusOutput, "\n%s %s%sBackup of BackupSchedule %s%s\n",
+		utils.InfoEmoji, utils.Cyan, utils.Bold, key, utils.Reset)
+	result := c.run(&bs)
+
+	c.mu.Lock()
+	_, scheduled := c.entries[key]
+	c.mu.Unlock()
+	c.updateStatus(bs.Name, func(status *BackupScheduleStatus) {
+		status.LastRun = &result
+		if result.ErrorCount == 0 {
+			status.LastSuccessfulTime = &result.CompletionTime
+		}
+		if scheduled && status.ObservedGeneration == bs.Generation {
+			status.NextRunTime = &metav1.Time{Time: schedule.Next(time.Now())}
+		}
+	})
+}
+
+// updateStatus changes the status of a BackupSchedule, retrying on conflicts
+func (c *Controller) updateStatus(name string, update func(status *BackupScheduleStatus)) {
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+	resource := c.client.Resource(GroupVersionResource)
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		u, err := resource.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		var bs BackupSchedule
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &bs); err != nil {
+			return err
+		}
+		update(&bs.Status)
+		status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&bs.Status)
+		if err != nil {
+			return err
+		}
+		u.Object["status"] = status
+		_, err = resource.UpdateStatus(ctx, u, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		fmt.Fprintf(utils.StatusOutput, "%s %s%sError updating the status of BackupSchedule %s: %v%s\n",
+			utils.ErrorEmoji, utils.Red, utils.Bold, name, err, utils.Reset)
+	}
+}
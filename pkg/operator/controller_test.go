@@ -0,0 +1,88 @@
+package operator
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func backupSchedule(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": Group + "/" + Version,
+		"kind":       Kind,
+		"metadata":   map[string]interface{}{"name": name, "generation": int64(1), "uid": name},
+		"spec":       spec,
+	}}
+}
+
+func TestController(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{GroupVersionResource: Kind + "List"},
+		backupSchedule("nightly", map[string]interface{}{"schedule": "@every 1s", "destination": "/backups", "namespaces": []interface{}{"shop"}}),
+		backupSchedule("broken", map[string]interface{}{"schedule": "sometimes", "destination": "/backups"}),
+		backupSchedule("escaping", map[string]interface{}{"schedule": "@every 1s", "destination": "/etc/kubernetes"}),
+		backupSchedule("paused", map[string]interface{}{"schedule": "@every 1s", "destination": "/backups", "suspend": true}),
+	)
+
+	var runs atomic.Int32
+	controller := NewController(client, "/backups", func(bs *BackupSchedule) RunStatus {
+		runs.Add(1)
+		if bs.Name != "nightly" || bs.Spec.Namespaces[0] != "shop" {
+			t.Errorf("Expected a backup of nightly, got %s with %v", bs.Name, bs.Spec.Namespaces)
+		}
+		now := metav1.Now()
+		return RunStatus{StartTime: now, CompletionTime: now, Location: "/backups/shop", ResourceCount: 4}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- controller.Run(ctx) }()
+
+	status := func(name string) BackupScheduleStatus {
+		u, err := client.Resource(GroupVersionResource).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get returned error: %v", err)
+		}
+		var bs BackupSchedule
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &bs); err != nil {
+			t.Fatalf("FromUnstructured returned error: %v", err)
+		}
+		return bs.Status
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for status("nightly").LastRun == nil && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	nightly := status("nightly")
+	if nightly.LastRun == nil || nightly.LastRun.ResourceCount != 4 || nightly.LastSuccessfulTime == nil {
+		t.Fatalf("Expected a successful run of nightly, got %+v", nightly)
+	}
+	if nightly.ObservedGeneration != 1 || nightly.NextRunTime == nil {
+		t.Errorf("Expected generation 1 with a next run, got %+v", nightly)
+	}
+	if broken := status("broken"); broken.Error == "" || broken.NextRunTime != nil {
+		t.Errorf("Expected an error and no next run for broken, got %+v", broken)
+	}
+	if escaping := status("escaping"); escaping.Error == "" || escaping.LastRun != nil {
+		t.Errorf("Expected an error and no runs for a destination outside of the root, got %+v", escaping)
+	}
+	if paused := status("paused"); paused.Error != "" || paused.NextRunTime != nil || paused.LastRun != nil {
+		t.Errorf("Expected no runs of paused, got %+v", paused)
+	}
+	if runs.Load() == 0 {
+		t.Errorf("Expected backups to run")
+	}
+}
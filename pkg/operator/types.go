@@ -0,0 +1,175 @@
+// Package operator runs kbak as a controller of BackupSchedule custom
+// resources: every BackupSchedule declares what to back up, when and where,
+// and reports the results of its latest run in its status.
+//
+// BackupSchedules are cluster-scoped: the operator can read every namespace,
+// so only those allowed to create cluster-wide objects may declare backups.
+package operator
+
+import (
+	_ "embed"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+	"github.com/rogosprojects/kbak/pkg/resources"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	Group    = "kbak.io"
+	Version  = "v1alpha1"
+	Kind     = "BackupSchedule"
+	Resource = "backupschedules"
+)
+
+// GroupVersionResource identifies BackupSchedules in the API
+var GroupVersionResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: Resource}
+
+// CRD is the CustomResourceDefinition of BackupSchedules
+//
+//go:embed crd.yaml
+var CRD []byte
+
+// BackupSchedule declares scheduled backups of a cluster
+type BackupSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BackupScheduleSpec   `json:"spec"`
+	Status BackupScheduleStatus `json:"status,omitempty"`
+}
+
+// BackupScheduleSpec is what to back up, when and where
+type BackupScheduleSpec struct {
+	// Schedule is a cron expression, e.g. "0 2 * * *" or @daily
+	Schedule string `json:"schedule"`
+	// Suspend stops scheduling backups without deleting the BackupSchedule
+	Suspend bool `json:"suspend,omitempty"`
+	// Namespaces are the namespaces to back up, every namespace when empty
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Kinds are the kinds to back up, e.g. Deployment, every kind when empty
+	Kinds []string `json:"kinds,omitempty"`
+	// Destination is the --output of the backups: a local directory of the
+	// operator below its destination root, or an s3://, azblob:// or gs://
+	// bucket and prefix
+	Destination string `json:"destination"`
+	// Retention prunes older backups in the destination after every run
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+// Retention is a grandfather-father-son retention policy
+type Retention struct {
+	KeepLast    int `json:"keepLast,omitempty"`
+	KeepDaily   int `json:"keepDaily,omitempty"`
+	KeepWeekly  int `json:"keepWeekly,omitempty"`
+	KeepMonthly int `json:"keepMonthly,omitempty"`
+}
+
+// Policy returns the retention policy, empty when r is nil
+func (r *Retention) Policy() backup.RetentionPolicy {
+	if r == nil {
+		return backup.RetentionPolicy{}
+	}
+	return backup.RetentionPolicy{KeepLast: r.KeepLast, KeepDaily: r.KeepDaily, KeepWeekly: r.KeepWeekly, KeepMonthly: r.KeepMonthly}
+}
+
+// BackupScheduleStatus reports the state of a BackupSchedule
+type BackupScheduleStatus struct {
+	// ObservedGeneration is the generation of the spec the status is for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Error explains why an invalid spec is not scheduled
+	Error string `json:"error,omitempty"`
+	// NextRunTime is the time of the next scheduled backup
+	NextRunTime *metav1.Time `json:"nextRunTime,omitempty"`
+	// LastSuccessfulTime is the completion time of the latest backup without errors
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	LastRun            *RunStatus   `json:"lastRun,omitempty"`
+}
+
+// RunStatus reports the results of one backup
+type RunStatus struct {
+	StartTime      metav1.Time `json:"startTime"`
+	CompletionTime metav1.Time `json:"completionTime"`
+	// Location is where the backup was written
+	Location string `json:"location,omitempty"`
+	// ResourceCount and ErrorCount sum up the backed-up namespaces
+	ResourceCount int `json:"resourceCount"`
+	ErrorCount    int `json:"errorCount"`
+	// ResourcesBackedUp and ResourceErrors are the counts per kind
+	ResourcesBackedUp map[string]int `json:"resourcesBackedUp,omitempty"`
+	ResourceErrors    map[string]int `json:"resourceErrors,omitempty"`
+	// Errors describe failures outside of single kinds, e.g. an unreachable destination
+	Errors []string `json:"errors,omitempty"`
+}
+
+// AddStats adds the statistics of one backed-up namespace
+func (r *RunStatus) AddStats(stats *backup.BackupStats) {
+	r.ResourceCount += stats.ResourceCount
+	r.ErrorCount += stats.ErrorCount
+	for kind, count := range stats.ResourcesBackedUp {
+		if r.ResourcesBackedUp == nil {
+			r.ResourcesBackedUp = make(map[string]int)
+		}
+		r.ResourcesBackedUp[kind] += count
+	}
+	for kind, count := range stats.ResourceErrors {
+		if r.ResourceErrors == nil {
+			r.ResourceErrors = make(map[string]int)
+		}
+		r.ResourceErrors[kind] += count
+	}
+}
+
+// AddError records a failure outside of single kinds
+func (r *RunStatus) AddError(err error) {
+	r.ErrorCount++
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// SelectedTypes returns the resource types of the spec, keyed by lowercase
+// kind like the backup flags; an empty map selects every type
+func (s *BackupScheduleSpec) SelectedTypes() map[string]bool {
+	selectedTypes := make(map[string]bool)
+	for _, kind := range s.Kinds {
+		selectedTypes[strings.ToLower(kind)] = true
+	}
+	return selectedTypes
+}
+
+// Validate checks the spec and returns its parsed schedule. A local
+// destination must be an absolute path at or below root.
+func (s *BackupScheduleSpec) Validate(root string) (cron.Schedule, error) {
+	schedule, err := cron.ParseStandard(s.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %v", s.Schedule, err)
+	}
+	if s.Destination == "" {
+		return nil, fmt.Errorf("destination is required")
+	}
+	if !strings.Contains(s.Destination, "://") && !withinRoot(s.Destination, root) {
+		return nil, fmt.Errorf("local destination %s is not below the destination root %s", s.Destination, root)
+	}
+	selectedTypes := s.SelectedTypes()
+	if len(resources.GetResourceTypes(selectedTypes)) != len(selectedTypes) && len(selectedTypes) > 0 {
+		return nil, fmt.Errorf("unknown kind in %s", strings.Join(s.Kinds, ", "))
+	}
+	if r := s.Retention; r != nil && (r.KeepLast < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0) {
+		return nil, fmt.Errorf("retention counts must not be negative")
+	}
+	return schedule, nil
+}
+
+// withinRoot checks if dir is an absolute path at or below root
+func withinRoot(dir, root string) bool {
+	if root == "" || !filepath.IsAbs(dir) {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(dir))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,63 @@
+package operator
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/rogosprojects/kbak/pkg/backup"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    BackupScheduleSpec
+		wantErr bool
+	}{
+		{"valid", BackupScheduleSpec{Schedule: "0 2 * * *", Destination: "/backups", Kinds: []string{"Deployment", "configmap"}}, false},
+		{"descriptor", BackupScheduleSpec{Schedule: "@daily", Destination: "s3://backups/prod"}, false},
+		{"invalid schedule", BackupScheduleSpec{Schedule: "every day", Destination: "/backups"}, true},
+		{"no destination", BackupScheduleSpec{Schedule: "@daily"}, true},
+		{"unknown kind", BackupScheduleSpec{Schedule: "@daily", Destination: "/backups", Kinds: []string{"Deployment", "Widget"}}, true},
+		{"below root", BackupScheduleSpec{Schedule: "@daily", Destination: "/backups/prod/"}, false},
+		{"outside root", BackupScheduleSpec{Schedule: "@daily", Destination: "/var/lib/kubelet"}, true},
+		{"sibling of root", BackupScheduleSpec{Schedule: "@daily", Destination: "/backups-other"}, true},
+		{"escaping root", BackupScheduleSpec{Schedule: "@daily", Destination: "/backups/../etc"}, true},
+		{"relative", BackupScheduleSpec{Schedule: "@daily", Destination: "backups"}, true},
+		{"negative retention", BackupScheduleSpec{Schedule: "@daily", Destination: "/backups", Retention: &Retention{KeepDaily: -1}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := tt.spec.Validate("/backups")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && schedule == nil {
+				t.Errorf("Expected a schedule")
+			}
+		})
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	var status RunStatus
+	status.AddStats(&backup.BackupStats{ResourceCount: 3, ErrorCount: 1,
+		ResourcesBackedUp: map[string]int{"Deployment": 2, "Service": 1}, ResourceErrors: map[string]int{"Secret": 1}})
+	status.AddStats(&backup.BackupStats{ResourceCount: 2, ResourcesBackedUp: map[string]int{"Deployment": 2}})
+	status.AddError(errors.New("storage unavailable"))
+
+	if status.ResourceCount != 5 || status.ErrorCount != 2 {
+		t.Errorf("Expected 5 resources and 2 errors, got %d and %d", status.ResourceCount, status.ErrorCount)
+	}
+	if want := map[string]int{"Deployment": 4, "Service": 1}; !reflect.DeepEqual(status.ResourcesBackedUp, want) {
+		t.Errorf("Expected %v, got %v", want, status.ResourcesBackedUp)
+	}
+	if !reflect.DeepEqual(status.Errors, []string{"storage unavailable"}) {
+		t.Errorf("Expected the storage error, got %v", status.Errors)
+	}
+
+	if policy := (*Retention)(nil).Policy(); !policy.Empty() {
+		t.Errorf("Expected an empty policy without retention, got %v", policy)
+	}
+}
@@ -0,0 +1,260 @@
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Redaction modes
+const (
+	// ModePlaceholder replaces every value with Placeholder
+	ModePlaceholder = "placeholder"
+	// ModeHash replaces every value with a salted hash, so equal values can
+	// still be recognized without revealing them
+	ModeHash = "hash"
+)
+
+// Placeholder replaces redacted values in ModePlaceholder
+const Placeholder = "REDACTED"
+
+// ReportFileName is the name of the redaction report written at the root of a backup
+const ReportFileName = "kbak-redactions.json"
+
+// Reasons recorded in the report
+const (
+	ReasonSecretData = "secret data"
+	ReasonEnvName    = "credential-like variable name"
+	ReasonEnvValue   = "credential-like value"
+)
+
+// credentialName matches environment variable names that usually hold credentials
+var credentialName = regexp.MustCompile(`(?i)(passw(or)?d|passwd|pwd|secret|token|api_?key|access_?key|private_?key|credential|auth|session_?key|signing_?key|client_?key)`)
+
+// credentialValues match values that look like credentials whatever their name
+var credentialValues = []*regexp.Regexp{
+	// URLs with a password, e.g. postgres://user:pass@db
+	regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]*:[^/\s@]+@`),
+	// AWS access key IDs
+	regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),
+	// JSON Web Tokens
+	regexp.MustCompile(`\beyJ[a-zA-Z0-9_-]+\.eyJ[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]+`),
+	// PEM private keys
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`),
+	// GitHub and Slack tokens
+	regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|xox[baprs]-[A-Za-z0-9-]{10,})`),
+}
+
+// Redaction records one redacted value
+type Redaction struct {
+	Namespace string `json:"namespace,omitempty"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	// Field is the path of the redacted value, e.g. data.password or
+	// spec.template.spec.containers[app].env[DB_PASSWORD]
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// Report lists all redactions of a backup
+type Report struct {
+	Mode string `json:"mode"`
+	// RandomSalt is set when hashes were salted with a random salt, so they
+	// can only be compared within the same backup
+	RandomSalt bool        `json:"randomSalt,omitempty"`
+	ScrubEnv   bool        `json:"scrubEnv"`
+	Redactions []Redaction `json:"redactions"`
+}
+
+// Redactor removes credentials from objects before they are written
+type Redactor struct {
+	mode       string
+	salt       []byte
+	randomSalt bool
+	scrubEnv   bool
+
+	mu         sync.Mutex
+	redactions []Redaction
+}
+
+// NewRedactor creates a redactor. In ModeHash, values are hashed with HMAC-SHA256
+// keyed with salt, or with a random salt when salt is empty. With scrubEnv,
+// literal environment variable values of pod templates are redacted when
+// their name or value looks like a credential.
+func NewRedactor(mode string, salt []byte, scrubEnv bool) (*Redactor, error) {
+	r := &Redactor{mode: mode, salt: salt, scrubEnv: scrubEnv}
+
+	switch mode {
+	case ModePlaceholder:
+	case ModeHash:
+		if len(r.salt) == 0 {
+			r.salt = make([]byte, 32)
+			if _, err := rand.Read(r.salt); err != nil {
+				return nil, err
+			}
+			r.randomSalt = true
+		}
+	default:
+		return nil, fmt.Errorf("unknown redaction mode %q, use %q or %q", mode, ModePlaceholder, ModeHash)
+	}
+
+	return r, nil
+}
+
+// Mode returns the redaction mode
+func (r *Redactor) Mode() string {
+	return r.mode
+}
+
+// replacement returns the value that replaces a redacted value
+func (r *Redactor) replacement(value []byte) string {
+	if r.mode == ModePlaceholder {
+		return Placeholder
+	}
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write(value)
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// record adds a redaction to the report
+func (r *Redactor) record(redaction Redaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.redactions = append(r.redactions, redaction)
+}
+
+// Redact replaces the credentials of an object in place. It should be called
+// after CleanObject.
+func (r *Redactor) Redact(obj interface{}) {
+	switch typedObj := obj.(type) {
+	case *v1.Secret:
+		r.redactSecret(typedObj)
+	case *v1.Pod:
+		r.redactPodSpec(typedObj.Namespace, "Pod", typedObj.Name, "spec", &typedObj.Spec)
+	case *appsv1.Deployment:
+		r.redactPodSpec(typedObj.Namespace, "Deployment", typedObj.Name, "spec.template.spec", &typedObj.Spec.Template.Spec)
+	case *appsv1.StatefulSet:
+		r.redactPodSpec(typedObj.Namespace, "StatefulSet", typedObj.Name, "spec.template.spec", &typedObj.Spec.Template.Spec)
+	case *appsv1.DaemonSet:
+		r.redactPodSpec(typedObj.Namespace, "DaemonSet", typedObj.Name, "spec.template.spec", &typedObj.Spec.Template.Spec)
+	case *appsv1.ReplicaSet:
+		r.redactPodSpec(typedObj.Namespace, "ReplicaSet", typedObj.Name, "spec.template.spec", &typedObj.Spec.Template.Spec)
+	case *batchv1.Job:
+		r.redactPodSpec(typedObj.Namespace, "Job", typedObj.Name, "spec.template.spec", &typedObj.Spec.Template.Spec)
+	case *batchv1.CronJob:
+		r.redactPodSpec(typedObj.Namespace, "CronJob", typedObj.Name, "spec.jobTemplate.spec.template.spec", &typedObj.Spec.JobTemplate.Spec.Template.Spec)
+	}
+}
+
+// redactSecret replaces every value of a Secret and keeps its keys
+func (r *Redactor) redactSecret(secret *v1.Secret) {
+	for _, key := range sortedKeys(secret.Data) {
+		secret.Data[key] = []byte(r.replacement(secret.Data[key]))
+		r.record(Redaction{Namespace: secret.Namespace, Kind: "Secret", Name: secret.Name, Field: "data." + key, Reason: ReasonSecretData})
+	}
+	for _, key := range sortedKeys(secret.StringData) {
+		secret.StringData[key] = r.replacement([]byte(secret.StringData[key]))
+		r.record(Redaction{Namespace: secret.Namespace, Kind: "Secret", Name: secret.Name, Field: "stringData." + key, Reason: ReasonSecretData})
+	}
+}
+
+// sortedKeys returns the keys of a map in order, so the report is stable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// redactPodSpec scrubs credential-like environment variables of all containers
+func (r *Redactor) redactPodSpec(namespace, kind, name, field string, spec *v1.PodSpec) {
+	if !r.scrubEnv {
+		return
+	}
+	for i := range spec.InitContainers {
+		r.redactContainer(namespace, kind, name, field+".initContainers", &spec.InitContainers[i])
+	}
+	for i := range spec.Containers {
+		r.redactContainer(namespace, kind, name, field+".containers", &spec.Containers[i])
+	}
+}
+
+// redactContainer scrubs the literal environment variable values of a container
+func (r *Redactor) redactContainer(namespace, kind, name, field string, container *v1.Container) {
+	for i := range container.Env {
+		envVar := &container.Env[i]
+		if envVar.Value == "" {
+			continue
+		}
+		reason := credentialReason(envVar.Name, envVar.Value)
+		if reason == "" {
+			continue
+		}
+		envVar.Value = r.replacement([]byte(envVar.Value))
+		r.record(Redaction{
+			Namespace: namespace,
+			Kind:      kind,
+			Name:      name,
+			Field:     fmt.Sprintf("%s[%s].env[%s]", field, container.Name, envVar.Name),
+			Reason:    reason,
+		})
+	}
+}
+
+// credentialReason returns why an environment variable looks like a
+// credential, or an empty string when it does not
+func credentialReason(name, value string) string {
+	if credentialName.MatchString(name) {
+		return ReasonEnvName
+	}
+	for _, pattern := range credentialValues {
+		if pattern.MatchString(value) {
+			return ReasonEnvValue
+		}
+	}
+	return ""
+}
+
+// Report returns the redactions so far, ordered by object and field
+func (r *Redactor) Report() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	redactions := append([]Redaction{}, r.redactions...)
+	sort.SliceStable(redactions, func(i, j int) bool {
+		a, b := redactions[i], redactions[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Field < b.Field
+	})
+
+	return &Report{Mode: r.mode, RandomSalt: r.randomSalt, ScrubEnv: r.scrubEnv, Redactions: redactions}
+}
+
+// Marshal returns the report as indented JSON
+func (rep *Report) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling redaction report: %v", err)
+	}
+	return append(data, '\n'), nil
+}
@@ -11,93 +11,124 @@ import (
 
 // ResourceType defines a Kubernetes resource type that can be backed up
 type ResourceType struct {
-	Kind    string
-	APIFunc func(client *client.K8sClient, namespace string, opts metav1.ListOptions) (interface{}, error)
+	Kind string
+	// Group and Resource are the API group and plural resource name, e.g. for RBAC rules
+	Group    string
+	Resource string
+	APIFunc  func(client *client.K8sClient, namespace string, opts metav1.ListOptions) (interface{}, error)
 }
 
 // GetAllResourceTypes returns all supported Kubernetes resource types
 func GetAllResourceTypes() []ResourceType {
 	return []ResourceType{
 		{
-			Kind: "Pod",
+			Kind:     "Pod",
+			Group:    "",
+			Resource: "pods",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.CoreV1().Pods(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "Deployment",
+			Kind:     "Deployment",
+			Group:    "apps",
+			Resource: "deployments",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.AppsV1().Deployments(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "Service",
+			Kind:     "Service",
+			Group:    "",
+			Resource: "services",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.CoreV1().Services(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "ConfigMap",
+			Kind:     "ConfigMap",
+			Group:    "",
+			Resource: "configmaps",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.CoreV1().ConfigMaps(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "Secret",
+			Kind:     "Secret",
+			Group:    "",
+			Resource: "secrets",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.CoreV1().Secrets(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "PersistentVolumeClaim",
+			Kind:     "PersistentVolumeClaim",
+			Group:    "",
+			Resource: "persistentvolumeclaims",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.CoreV1().PersistentVolumeClaims(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "ServiceAccount",
+			Kind:     "ServiceAccount",
+			Group:    "",
+			Resource: "serviceaccounts",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.CoreV1().ServiceAccounts(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "StatefulSet",
+			Kind:     "StatefulSet",
+			Group:    "apps",
+			Resource: "statefulsets",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.AppsV1().StatefulSets(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "DaemonSet",
+			Kind:     "DaemonSet",
+			Group:    "apps",
+			Resource: "daemonsets",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.AppsV1().DaemonSets(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "Ingress",
+			Kind:     "Ingress",
+			Group:    "networking.k8s.io",
+			Resource: "ingresses",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.NetworkingV1().Ingresses(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "Role",
+			Kind:     "Role",
+			Group:    "rbac.authorization.k8s.io",
+			Resource: "roles",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.RbacV1().Roles(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "RoleBinding",
+			Kind:     "RoleBinding",
+			Group:    "rbac.authorization.k8s.io",
+			Resource: "rolebindings",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.RbacV1().RoleBindings(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "CronJob",
+			Kind:     "CronJob",
+			Group:    "batch",
+			Resource: "cronjobs",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.BatchV1().CronJobs(ns).List(context.TODO(), opts)
 			},
 		},
 		{
-			Kind: "Job",
+			Kind:     "Job",
+			Group:    "batch",
+			Resource: "jobs",
 			APIFunc: func(client *client.K8sClient, ns string, opts metav1.ListOptions) (interface{}, error) {
 				return client.Clientset.BatchV1().Jobs(ns).List(context.TODO(), opts)
 			},
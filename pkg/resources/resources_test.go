@@ -2,6 +2,7 @@ package resources
 
 import (
 	"errors"
+	"strings"
 	"testing"
 )
 
@@ -32,6 +33,11 @@ func TestGetAllResourceTypes(t *testing.T) {
 		if rt.APIFunc == nil {
 			t.Errorf("Resource type %s has nil APIFunc", rt.Kind)
 		}
+
+		// Check that the resource name is the lowercase plural of the kind
+		if !strings.HasPrefix(rt.Resource, strings.ToLower(rt.Kind)[:len(rt.Kind)-1]) || !strings.HasSuffix(rt.Resource, "s") {
+			t.Errorf("Resource type %s has resource name %q", rt.Kind, rt.Resource)
+		}
 	}
 
 	// Verify all expected types were found
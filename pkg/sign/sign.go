@@ -0,0 +1,127 @@
+package sign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// Signer signs backup manifests with an ed25519 or ECDSA private key
+type Signer struct {
+	key crypto.Signer
+}
+
+// LoadSigner reads an unencrypted PEM private key: PKCS#8 ed25519 or ECDSA,
+// or SEC 1 ECDSA, as written by openssl genpkey and openssl ecparam
+func LoadSigner(keyFile string) (*Signer, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM encoded", keyFile)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %q in %s, expected an unencrypted PRIVATE KEY", block.Type, keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing key %s: %v", keyFile, err)
+	}
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return &Signer{key: k}, nil
+	case *ecdsa.PrivateKey:
+		return &Signer{key: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing key algorithm %T in %s, use ed25519 or ECDSA", key, keyFile)
+	}
+}
+
+// Sign returns the base64 signature of data followed by a newline. ed25519
+// signs data directly; ECDSA signs its SHA-256 digest, like cosign sign-blob.
+func (s *Signer) Sign(data []byte) ([]byte, error) {
+	var signature []byte
+	var err error
+	switch s.key.(type) {
+	case ed25519.PrivateKey:
+		signature, err = s.key.Sign(rand.Reader, data, crypto.Hash(0))
+	default:
+		digest := sha256.Sum256(data)
+		signature, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing: %v", err)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(signature) + "\n"), nil
+}
+
+// Verifier returns the verifier of the public key of the signer
+func (s *Signer) Verifier() *Verifier {
+	return &Verifier{key: s.key.Public()}
+}
+
+// Verifier checks manifest signatures with an ed25519 or ECDSA public key
+type Verifier struct {
+	key crypto.PublicKey
+}
+
+// LoadVerifier reads a PEM PKIX public key
+func LoadVerifier(keyFile string) (*Verifier, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("public key %s is not a PEM PUBLIC KEY", keyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key %s: %v", keyFile, err)
+	}
+
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return &Verifier{key: key}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key algorithm %T in %s, use ed25519 or ECDSA", key, keyFile)
+	}
+}
+
+// Verify checks a base64 signature created by Sign
+func (v *Verifier) Verify(data, signature []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	valid := false
+	switch k := v.key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, data, raw)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		valid = ecdsa.VerifyASN1(k, digest[:], raw)
+	}
+	if !valid {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
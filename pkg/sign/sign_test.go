@@ -0,0 +1,107 @@
+package sign
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeKeys writes a private key in PKCS#8 and its public key in PKIX PEM
+// format and returns the file names
+func writeKeys(t *testing.T, private, public interface{}) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey returned error: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey returned error: %v", err)
+	}
+
+	privateFile := filepath.Join(dir, "key.pem")
+	publicFile := filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	if err := os.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	return privateFile, publicFile
+}
+
+func TestSignVerify(t *testing.T) {
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey returned error: %v", err)
+	}
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey returned error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		private interface{}
+		public  interface{}
+	}{
+		{"ed25519", edPrivate, edPublic},
+		{"ecdsa", ecPrivate, &ecPrivate.PublicKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			privateFile, publicFile := writeKeys(t, test.private, test.public)
+
+			signer, err := LoadSigner(privateFile)
+			if err != nil {
+				t.Fatalf("LoadSigner returned error: %v", err)
+			}
+			verifier, err := LoadVerifier(publicFile)
+			if err != nil {
+				t.Fatalf("LoadVerifier returned error: %v", err)
+			}
+
+			manifest := []byte(`{"files":[]}`)
+			signature, err := signer.Sign(manifest)
+			if err != nil {
+				t.Fatalf("Sign returned error: %v", err)
+			}
+			if err := verifier.Verify(manifest, signature); err != nil {
+				t.Errorf("Verify returned error: %v", err)
+			}
+			if err := signer.Verifier().Verify(manifest, signature); err != nil {
+				t.Errorf("Verify with the signer's public key returned error: %v", err)
+			}
+			if err := verifier.Verify([]byte(`{"files":[1]}`), signature); err == nil {
+				t.Errorf("Expected error for modified data")
+			}
+			if err := verifier.Verify(manifest, []byte("not base64!")); err == nil {
+				t.Errorf("Expected error for an invalid signature")
+			}
+		})
+	}
+}
+
+func TestLoadKeyErrors(t *testing.T) {
+	_, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	privateFile, publicFile := writeKeys(t, edPrivate, edPrivate.Public())
+
+	if _, err := LoadSigner(publicFile); err == nil {
+		t.Errorf("Expected error loading a public key as signing key")
+	}
+	if _, err := LoadVerifier(privateFile); err == nil {
+		t.Errorf("Expected error loading a private key as public key")
+	}
+	if _, err := LoadSigner(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Errorf("Expected error for a missing key file")
+	}
+}
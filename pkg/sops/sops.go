@@ -0,0 +1,556 @@
+package sops
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgparmor "github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is the encryption format of sops files, recorded in the backup manifest
+const Format = "sops"
+
+// Version is the sops version written to the metadata. Files use the
+// format of sops 3.x; the tests decrypt them with the sops library of this
+// version, and decrypt files written by its sops binary.
+const Version = "3.8.1"
+
+// SecretEncryptedRegex selects the keys of a Secret whose values are encrypted
+const SecretEncryptedRegex = "^(data|stringData)$"
+
+// nonceSize is the AES-GCM nonce size used by sops
+const nonceSize = 32
+
+// metadataKey is the top-level key holding the sops metadata
+const metadataKey = "sops"
+
+// encryptedValue matches a value encrypted by sops
+var encryptedValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.*),tag:(.*),type:(.*)\]$`)
+
+// ageKey is the data key encrypted to an age recipient
+type ageKey struct {
+	Recipient string `yaml:"recipient"`
+	Enc       string `yaml:"enc"`
+}
+
+// pgpKey is the data key encrypted to an OpenPGP key
+type pgpKey struct {
+	CreatedAt string `yaml:"created_at"`
+	Enc       string `yaml:"enc"`
+	FP        string `yaml:"fp"`
+}
+
+// metadata is the sops section of an encrypted file
+type metadata struct {
+	Age            []ageKey `yaml:"age,omitempty"`
+	LastModified   string   `yaml:"lastmodified"`
+	MAC            string   `yaml:"mac"`
+	PGP            []pgpKey `yaml:"pgp,omitempty"`
+	EncryptedRegex string   `yaml:"encrypted_regex,omitempty"`
+	Version        string   `yaml:"version"`
+}
+
+// pgpRecipient is an OpenPGP key with the fingerprint recorded in the metadata
+type pgpRecipient struct {
+	fingerprint string
+	entity      *openpgp.Entity
+}
+
+// Encryptor writes YAML documents in the sops format
+type Encryptor struct {
+	ageRecipients []*age.X25519Recipient
+	pgpRecipients []pgpRecipient
+	// EncryptedRegex selects the keys whose values are encrypted
+	EncryptedRegex string
+	// Now returns the modification time written to the metadata
+	Now func() time.Time
+}
+
+// NewEncryptor creates an encryptor for Kubernetes Secrets. Age recipients
+// are public keys (age1...) or recipients files. OpenPGP recipients are all
+// keys of pgpKeyFiles plus the keys of pgpFingerprints, which are looked up
+// in pgpKeyFiles first and in the gpg keyring otherwise.
+func NewEncryptor(ageRecipients, pgpFingerprints, pgpKeyFiles []string) (*Encryptor, error) {
+	e := &Encryptor{EncryptedRegex: SecretEncryptedRegex, Now: time.Now}
+
+	for _, spec := range ageRecipients {
+		recipients, err := encrypt.ParseAgeRecipients(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, recipient := range recipients {
+			x25519, ok := recipient.(*age.X25519Recipient)
+			if !ok {
+				return nil, fmt.Errorf("sops supports X25519 age recipients only")
+			}
+			e.ageRecipients = append(e.ageRecipients, x25519)
+		}
+	}
+
+	var keyring openpgp.EntityList
+	for _, file := range pgpKeyFiles {
+		keys, err := encrypt.LoadPGPKeys(file)
+		if err != nil {
+			return nil, err
+		}
+		keyring = append(keyring, keys...)
+		for _, key := range keys {
+			e.pgpRecipients = append(e.pgpRecipients, pgpRecipient{fingerprint: fingerprint(key), entity: key})
+		}
+	}
+	for _, fp := range pgpFingerprints {
+		fp = strings.ToUpper(strings.ReplaceAll(fp, " ", ""))
+		key, err := findPGPKey(keyring, fp)
+		if err != nil {
+			return nil, err
+		}
+		if !hasFingerprint(e.pgpRecipients, fp) {
+			e.pgpRecipients = append(e.pgpRecipients, pgpRecipient{fingerprint: fp, entity: key})
+		}
+	}
+
+	if len(e.ageRecipients) == 0 && len(e.pgpRecipients) == 0 {
+		return nil, fmt.Errorf("no sops recipients given")
+	}
+
+	return e, nil
+}
+
+// fingerprint returns the fingerprint of an OpenPGP key as used by sops
+func fingerprint(key *openpgp.Entity) string {
+	return fmt.Sprintf("%X", key.PrimaryKey.Fingerprint)
+}
+
+// hasFingerprint checks if a recipient with the fingerprint exists
+func hasFingerprint(recipients []pgpRecipient, fp string) bool {
+	for _, recipient := range recipients {
+		if recipient.fingerprint == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// findPGPKey returns the key with the fingerprint (or its long key ID
+// suffix) from keyring, falling back to the public keyring of gpg
+func findPGPKey(keyring openpgp.EntityList, fp string) (*openpgp.Entity, error) {
+	for _, key := range keyring {
+		if strings.HasSuffix(fingerprint(key), fp) {
+			return key, nil
+		}
+	}
+
+	out, err := exec.Command("gpg", "--export", fp).Output()
+	if err != nil || len(out) == 0 {
+		return nil, fmt.Errorf("OpenPGP key %s not found in the given key files or the gpg keyring", fp)
+	}
+	keys, err := openpgp.ReadKeyRing(bytes.NewReader(out))
+	if err != nil || len(keys) == 0 {
+		return nil, fmt.Errorf("error reading OpenPGP key %s from gpg: %v", fp, err)
+	}
+	return keys[0], nil
+}
+
+// EncryptYAML encrypts the values of the keys matching EncryptedRegex in a
+// YAML document and appends the sops metadata. Other values stay readable.
+func (e *Encryptor) EncryptYAML(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing YAML: %v", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("sops encryption needs a YAML mapping")
+	}
+	root := doc.Content[0]
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	pattern, err := regexp.Compile(e.EncryptedRegex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted regex: %v", err)
+	}
+
+	// The MAC covers all values in document order, encrypted or not
+	hash := sha512.New()
+	err = walk(root, nil, false, func(node *yaml.Node, path []string, encrypted bool) error {
+		plaintext, err := leafBytes(node)
+		if err != nil {
+			return err
+		}
+		hash.Write(plaintext)
+		if !encrypted {
+			return nil
+		}
+		return encryptNode(node, dataKey, path)
+	}, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	lastModified := e.Now().UTC().Format(time.RFC3339)
+	mac, err := encryptValue([]byte(fmt.Sprintf("%X", hash.Sum(nil))), "str", dataKey, lastModified)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := metadata{
+		LastModified:   lastModified,
+		MAC:            mac,
+		EncryptedRegex: e.EncryptedRegex,
+		Version:        Version,
+	}
+	for _, recipient := range e.ageRecipients {
+		enc, err := encryptAgeKey(dataKey, recipient)
+		if err != nil {
+			return nil, err
+		}
+		meta.Age = append(meta.Age, ageKey{Recipient: recipient.String(), Enc: enc})
+	}
+	for _, recipient := range e.pgpRecipients {
+		enc, err := encryptPGPKey(dataKey, recipient.entity)
+		if err != nil {
+			return nil, err
+		}
+		meta.PGP = append(meta.PGP, pgpKey{CreatedAt: lastModified, Enc: enc, FP: recipient.fingerprint})
+	}
+
+	var metaNode yaml.Node
+	if err := metaNode.Encode(meta); err != nil {
+		return nil, err
+	}
+	root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: metadataKey}, &metaNode)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(4)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// walk calls onLeaf for every scalar below node with the path of mapping
+// keys leading to it. Like sops, sequence items share the path of the
+// sequence, and a value is encrypted when any key of its path matches pattern.
+func walk(node *yaml.Node, path []string, encrypted bool, onLeaf func(*yaml.Node, []string, bool) error, pattern *regexp.Regexp) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if len(path) == 0 && key == metadataKey {
+				continue
+			}
+			childPath := append(append([]string{}, path...), key)
+			if err := walk(node.Content[i+1], childPath, encrypted || pattern.MatchString(key), onLeaf, pattern); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if err := walk(item, path, encrypted, onLeaf, pattern); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return nil
+		}
+		return onLeaf(node, path, encrypted)
+	case yaml.AliasNode:
+		return fmt.Errorf("YAML aliases are not supported")
+	}
+	return nil
+}
+
+// leafBytes returns the bytes of a scalar that sops adds to the MAC
+func leafBytes(node *yaml.Node) ([]byte, error) {
+	switch node.Tag {
+	case "!!bool":
+		var value bool
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		if value {
+			return []byte("True"), nil
+		}
+		return []byte("False"), nil
+	case "!!int":
+		var value int
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(value)), nil
+	case "!!float":
+		var value float64
+		if err := node.Decode(&value); err != nil {
+			return nil, err
+		}
+		return []byte(strconv.FormatFloat(value, 'f', -1, 64)), nil
+	default:
+		return []byte(node.Value), nil
+	}
+}
+
+// encryptNode replaces a scalar with its encrypted form. Empty strings stay
+// empty, as in sops.
+func encryptNode(node *yaml.Node, dataKey []byte, path []string) error {
+	valueType := "str"
+	plaintext := []byte(node.Value)
+	switch node.Tag {
+	case "!!bool":
+		valueType = "bool"
+		var value bool
+		if err := node.Decode(&value); err != nil {
+			return err
+		}
+		plaintext = []byte(strconv.FormatBool(value))
+	case "!!int":
+		valueType = "int"
+	case "!!float":
+		valueType = "float"
+	}
+	if valueType == "str" && node.Value == "" {
+		return nil
+	}
+
+	encrypted, err := encryptValue(plaintext, valueType, dataKey, strings.Join(path, ":")+":")
+	if err != nil {
+		return err
+	}
+	node.Tag = "!!str"
+	node.Value = encrypted
+	node.Style = 0
+	return nil
+}
+
+// encryptValue encrypts a value with AES-GCM in the sops value format
+func encryptValue(plaintext []byte, valueType string, dataKey []byte, additionalData string) (string, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, nonceSize)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, nonceSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	out := gcm.Seal(nil, iv, plaintext, []byte(additionalData))
+	tagStart := len(out) - gcm.Overhead()
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(out[:tagStart]),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(out[tagStart:]),
+		valueType), nil
+}
+
+// encryptAgeKey encrypts the data key to an age recipient as an armored age file
+func encryptAgeKey(dataKey []byte, recipient age.Recipient) (string, error) {
+	var buf bytes.Buffer
+	aw := agearmor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, recipient)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(dataKey); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := aw.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// encryptPGPKey encrypts the data key to an OpenPGP key as an armored message
+func encryptPGPKey(dataKey []byte, key *openpgp.Entity) (string, error) {
+	var buf bytes.Buffer
+	aw, err := pgparmor.Encode(&buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", err
+	}
+	w, err := openpgp.Encrypt(aw, []*openpgp.Entity{key}, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(dataKey); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := aw.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// DecryptYAML decrypts a sops encrypted YAML document with the identities
+// of decryptor and verifies its MAC. The sops metadata is removed.
+func DecryptYAML(data []byte, decryptor *encrypt.Decryptor) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing YAML: %v", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("not a sops encrypted YAML document")
+	}
+	root := doc.Content[0]
+
+	var meta metadata
+	metaIndex := -1
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == metadataKey {
+			if err := root.Content[i+1].Decode(&meta); err != nil {
+				return nil, fmt.Errorf("invalid sops metadata: %v", err)
+			}
+			metaIndex = i
+		}
+	}
+	if metaIndex < 0 {
+		return nil, fmt.Errorf("not a sops encrypted YAML document")
+	}
+	root.Content = append(root.Content[:metaIndex], root.Content[metaIndex+2:]...)
+
+	dataKey, err := decryptDataKey(meta, decryptor)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha512.New()
+	err = walk(root, nil, false, func(node *yaml.Node, path []string, _ bool) error {
+		if match := encryptedValue.FindStringSubmatch(node.Value); match != nil && node.Tag == "!!str" {
+			if err := decryptNode(node, match, dataKey, strings.Join(path, ":")+":"); err != nil {
+				return fmt.Errorf("error decrypting %s: %v", strings.Join(path, "."), err)
+			}
+		}
+		plaintext, err := leafBytes(node)
+		if err != nil {
+			return err
+		}
+		hash.Write(plaintext)
+		return nil
+	}, regexp.MustCompile("$^"))
+	if err != nil {
+		return nil, err
+	}
+
+	match := encryptedValue.FindStringSubmatch(meta.MAC)
+	if match == nil {
+		return nil, fmt.Errorf("invalid sops MAC")
+	}
+	macNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str"}
+	if err := decryptNode(macNode, match, dataKey, meta.LastModified); err != nil {
+		return nil, fmt.Errorf("error decrypting sops MAC: %v", err)
+	}
+	if macNode.Value != fmt.Sprintf("%X", hash.Sum(nil)) {
+		return nil, fmt.Errorf("sops MAC mismatch, the file was modified")
+	}
+
+	return yaml.Marshal(&doc)
+}
+
+// decryptDataKey decrypts the data key with the first matching identity
+func decryptDataKey(meta metadata, decryptor *encrypt.Decryptor) ([]byte, error) {
+	if decryptor == nil {
+		return nil, fmt.Errorf("an identity is required to decrypt sops files")
+	}
+
+	var errs []string
+	for _, key := range meta.Age {
+		ciphertext, err := io.ReadAll(agearmor.NewReader(strings.NewReader(key.Enc)))
+		if err == nil {
+			var dataKey []byte
+			if dataKey, err = decryptor.Decrypt(encrypt.FormatAge, ciphertext); err == nil {
+				return dataKey, nil
+			}
+		}
+		errs = append(errs, fmt.Sprintf("age %s: %v", key.Recipient, err))
+	}
+	for _, key := range meta.PGP {
+		block, err := pgparmor.Decode(strings.NewReader(key.Enc))
+		if err == nil {
+			var ciphertext, dataKey []byte
+			if ciphertext, err = io.ReadAll(block.Body); err == nil {
+				if dataKey, err = decryptor.Decrypt(encrypt.FormatPGP, ciphertext); err == nil {
+					return dataKey, nil
+				}
+			}
+		}
+		errs = append(errs, fmt.Sprintf("pgp %s: %v", key.FP, err))
+	}
+
+	return nil, fmt.Errorf("no identity can decrypt the sops data key (%s)", strings.Join(errs, "; "))
+}
+
+// decryptNode replaces an encrypted scalar with its plaintext
+func decryptNode(node *yaml.Node, match []string, dataKey []byte, additionalData string) error {
+	ciphertext, err := base64.StdEncoding.DecodeString(match[1])
+	if err != nil {
+		return err
+	}
+	iv, err := base64.StdEncoding.DecodeString(match[2])
+	if err != nil {
+		return err
+	}
+	tag, err := base64.StdEncoding.DecodeString(match[3])
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(additionalData))
+	if err != nil {
+		return err
+	}
+
+	node.Value = string(plaintext)
+	node.Style = 0
+	switch match[4] {
+	case "str":
+		node.Tag = "!!str"
+	case "int":
+		node.Tag = "!!int"
+	case "float":
+		node.Tag = "!!float"
+	case "bool":
+		node.Tag = "!!bool"
+	default:
+		return fmt.Errorf("unsupported value type %q", match[4])
+	}
+	return nil
+}
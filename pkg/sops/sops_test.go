@@ -0,0 +1,320 @@
+package sops
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	sopsdecrypt "github.com/getsops/sops/v3/decrypt"
+	"github.com/rogosprojects/kbak/pkg/encrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const secret = `apiVersion: v1
+data:
+  password: c2VjcmV0
+  token: ""
+kind: Secret
+metadata:
+  labels:
+    app: web
+  name: credentials
+  namespace: default
+stringData:
+  config.yaml: |
+    user: admin
+type: Opaque
+`
+
+// writeFile writes data to a file in a temporary directory and returns its path
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	return filename
+}
+
+// decodeMap parses a YAML document into a map
+func decodeMap(t *testing.T, data []byte) map[string]interface{} {
+	t.Helper()
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		t.Fatalf("Unmarshal returned error: %v", err)
+	}
+	return m
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity returned error: %v", err)
+	}
+	identityFile := writeFile(t, "key.txt", []byte(identity.String()+"\n"))
+
+	encryptor, err := NewEncryptor([]string{identity.Recipient().String()}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewEncryptor returned error: %v", err)
+	}
+	encryptor.Now = func() time.Time { return time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC) }
+
+	encrypted, err := encryptor.EncryptYAML([]byte(secret))
+	if err != nil {
+		t.Fatalf("EncryptYAML returned error: %v", err)
+	}
+	for _, plaintext := range []string{"c2VjcmV0", "user: admin"} {
+		if bytes.Contains(encrypted, []byte(plaintext)) {
+			t.Errorf("Expected encrypted file not to contain %q", plaintext)
+		}
+	}
+
+	doc := decodeMap(t, encrypted)
+	data := doc["data"].(map[string]interface{})
+	if !strings.HasPrefix(data["password"].(string), "ENC[AES256_GCM,data:") || !strings.HasSuffix(data["password"].(string), ",type:str]") {
+		t.Errorf("Unexpected encrypted value %q", data["password"])
+	}
+	if data["token"] != "" {
+		t.Errorf("Expected empty value to stay empty, got %q", data["token"])
+	}
+	metadata := doc["metadata"].(map[string]interface{})
+	if metadata["name"] != "credentials" || doc["kind"] != "Secret" {
+		t.Errorf("Expected metadata to stay readable, got %v", metadata)
+	}
+	meta := doc["sops"].(map[string]interface{})
+	if meta["encrypted_regex"] != SecretEncryptedRegex || meta["lastmodified"] != "2025-03-01T12:00:00Z" || meta["version"] != Version {
+		t.Errorf("Unexpected sops metadata %v", meta)
+	}
+	ageKeys := meta["age"].([]interface{})
+	if len(ageKeys) != 1 || ageKeys[0].(map[string]interface{})["recipient"] != identity.Recipient().String() {
+		t.Errorf("Unexpected age keys %v", ageKeys)
+	}
+
+	decryptor, err := encrypt.NewDecryptor([]string{identityFile}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewDecryptor returned error: %v", err)
+	}
+	decrypted, err := DecryptYAML(encrypted, decryptor)
+	if err != nil {
+		t.Fatalf("DecryptYAML returned error: %v", err)
+	}
+	got := decodeMap(t, decrypted)
+	want := decodeMap(t, []byte(secret))
+	if !yamlEqual(t, got, want) {
+		t.Errorf("DecryptYAML =\n%s\nwant\n%s", decrypted, secret)
+	}
+
+	// Changing a readable value invalidates the MAC
+	tampered := bytes.Replace(encrypted, []byte("app: web"), []byte("app: api"), 1)
+	if _, err := DecryptYAML(tampered, decryptor); err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+		t.Errorf("Expected MAC mismatch for a modified file, got %v", err)
+	}
+
+	other, _ := age.GenerateX25519Identity()
+	otherFile := writeFile(t, "other.txt", []byte(other.String()+"\n"))
+	otherDecryptor, _ := encrypt.NewDecryptor([]string{otherFile}, nil, nil)
+	if _, err := DecryptYAML(encrypted, otherDecryptor); err == nil {
+		t.Errorf("Expected error decrypting with a foreign identity")
+	}
+}
+
+// yamlEqual compares two decoded documents through their YAML form
+func yamlEqual(t *testing.T, a, b map[string]interface{}) bool {
+	t.Helper()
+	ya, err := yaml.Marshal(a)
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+	yb, err := yaml.Marshal(b)
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+	return bytes.Equal(ya, yb)
+}
+
+func TestPGPRoundTrip(t *testing.T) {
+	entity, err := openpgp.NewEntity("kbak", "test", "kbak@localhost", nil)
+	if err != nil {
+		t.Fatalf("NewEntity returned error: %v", err)
+	}
+	var public bytes.Buffer
+	w, _ := armor.Encode(&public, openpgp.PublicKeyType, nil)
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("Serialize returned error: %v", err)
+	}
+	w.Close()
+	var private bytes.Buffer
+	if err := entity.SerializePrivateWithoutSigning(&private, nil); err != nil {
+		t.Fatalf("SerializePrivate returned error: %v", err)
+	}
+	publicFile := writeFile(t, "public.asc", public.Bytes())
+	privateFile := writeFile(t, "private.gpg", private.Bytes())
+	fp := fingerprint(entity)
+
+	// The fingerprint is found in the key file and not added twice
+	encryptor, err := NewEncryptor(nil, []string{strings.ToLower(fp)}, []string{publicFile})
+	if err != nil {
+		t.Fatalf("NewEncryptor returned error: %v", err)
+	}
+	encrypted, err := encryptor.EncryptYAML([]byte(secret))
+	if err != nil {
+		t.Fatalf("EncryptYAML returned error: %v", err)
+	}
+	pgpKeys := decodeMap(t, encrypted)["sops"].(map[string]interface{})["pgp"].([]interface{})
+	if len(pgpKeys) != 1 || pgpKeys[0].(map[string]interface{})["fp"] != fp {
+		t.Errorf("Unexpected pgp keys %v", pgpKeys)
+	}
+	if !strings.Contains(pgpKeys[0].(map[string]interface{})["enc"].(string), "-----BEGIN PGP MESSAGE-----") {
+		t.Errorf("Expected an armored OpenPGP message")
+	}
+
+	decryptor, err := encrypt.NewDecryptor(nil, []string{privateFile}, nil)
+	if err != nil {
+		t.Fatalf("NewDecryptor returned error: %v", err)
+	}
+	if _, err := DecryptYAML(encrypted, decryptor); err != nil {
+		t.Errorf("DecryptYAML returned error: %v", err)
+	}
+}
+
+func TestEncryptYAMLValueTypes(t *testing.T) {
+	identity, _ := age.GenerateX25519Identity()
+	identityFile := writeFile(t, "key.txt", []byte(identity.String()+"\n"))
+	encryptor, err := NewEncryptor([]string{identity.Recipient().String()}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewEncryptor returned error: %v", err)
+	}
+
+	input := "data:\n  count: 3\n  enabled: true\n  ratio: 0.5\n  list:\n  - a\n  - \"true\"\nimmutable: false\n"
+	encrypted, err := encryptor.EncryptYAML([]byte(input))
+	if err != nil {
+		t.Fatalf("EncryptYAML returned error: %v", err)
+	}
+	for _, valueType := range []string{"type:int]", "type:bool]", "type:float]", "type:str]"} {
+		if !bytes.Contains(encrypted, []byte(valueType)) {
+			t.Errorf("Expected a value of %s in\n%s", valueType, encrypted)
+		}
+	}
+	if !bytes.Contains(encrypted, []byte("immutable: false")) {
+		t.Errorf("Expected values outside data to stay readable")
+	}
+
+	decryptor, _ := encrypt.NewDecryptor([]string{identityFile}, nil, nil)
+	decrypted, err := DecryptYAML(encrypted, decryptor)
+	if err != nil {
+		t.Fatalf("DecryptYAML returned error: %v", err)
+	}
+	if !yamlEqual(t, decodeMap(t, decrypted), decodeMap(t, []byte(input))) {
+		t.Errorf("DecryptYAML =\n%s\nwant\n%s", decrypted, input)
+	}
+}
+
+func TestNewEncryptorValidation(t *testing.T) {
+	if _, err := NewEncryptor(nil, nil, nil); err == nil {
+		t.Errorf("Expected error without recipients")
+	}
+	if _, err := NewEncryptor([]string{"age1invalid"}, nil, nil); err == nil {
+		t.Errorf("Expected error for an invalid age recipient")
+	}
+	t.Setenv("GNUPGHOME", t.TempDir())
+	if _, err := NewEncryptor(nil, []string{"0123456789ABCDEF0123456789ABCDEF01234567"}, nil); err == nil {
+		t.Errorf("Expected error for an unknown OpenPGP fingerprint")
+	}
+}
+
+// The files in testdata were encrypted from secret by sops 3.8.1 with
+// --encrypted-regex '^(data|stringData)$' and the keys in testdata:
+//
+//	sops --encrypt --age <recipient of age-key.txt> ... secret.yaml > secret.age.yaml
+//	sops --encrypt --pgp <fingerprint of pgp-key.asc> ... secret.yaml > secret.pgp.yaml
+func TestDecryptYAMLSOPSFiles(t *testing.T) {
+	decryptor, err := encrypt.NewDecryptor([]string{"testdata/age-key.txt"}, []string{"testdata/pgp-key.asc"}, nil)
+	if err != nil {
+		t.Fatalf("NewDecryptor returned error: %v", err)
+	}
+
+	for _, name := range []string{"secret.age.yaml", "secret.pgp.yaml"} {
+		t.Run(name, func(t *testing.T) {
+			encrypted, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatalf("ReadFile returned error: %v", err)
+			}
+			decrypted, err := DecryptYAML(encrypted, decryptor)
+			if err != nil {
+				t.Fatalf("DecryptYAML returned error: %v", err)
+			}
+			if !yamlEqual(t, decodeMap(t, decrypted), decodeMap(t, []byte(secret))) {
+				t.Errorf("DecryptYAML =\n%s\nwant\n%s", decrypted, secret)
+			}
+
+			// The MAC of sops covers the readable values as well
+			tampered := bytes.Replace(encrypted, []byte("app: web"), []byte("app: api"), 1)
+			if _, err := DecryptYAML(tampered, decryptor); err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+				t.Errorf("Expected MAC mismatch for a modified file, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSOPSDecryptsEncryptYAML(t *testing.T) {
+	ageKey, err := os.ReadFile("testdata/age-key.txt")
+	if err != nil {
+		t.Fatalf("ReadFile returned error: %v", err)
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(ageKey))
+	if err != nil {
+		t.Fatalf("ParseIdentities returned error: %v", err)
+	}
+	recipient := identities[0].(*age.X25519Identity).Recipient().String()
+	pgpKeys, err := encrypt.LoadPGPKeys("testdata/pgp-key.asc")
+	if err != nil {
+		t.Fatalf("LoadPGPKeys returned error: %v", err)
+	}
+
+	// sops reads age identities from SOPS_AGE_KEY_FILE and OpenPGP keys
+	// from the secring.gpg of GNUPGHOME
+	gnupgHome := t.TempDir()
+	var secring bytes.Buffer
+	if err := pgpKeys[0].SerializePrivate(&secring, nil); err != nil {
+		t.Fatalf("SerializePrivate returned error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(gnupgHome, "secring.gpg"), secring.Bytes(), 0600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	t.Setenv("GNUPGHOME", gnupgHome)
+	t.Setenv("SOPS_AGE_KEY_FILE", "testdata/age-key.txt")
+
+	tests := []struct {
+		name       string
+		ageKeys    []string
+		pgpKeyFile []string
+	}{
+		{"age", []string{recipient}, nil},
+		{"pgp", nil, []string{"testdata/pgp-key.asc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encryptor, err := NewEncryptor(tt.ageKeys, nil, tt.pgpKeyFile)
+			if err != nil {
+				t.Fatalf("NewEncryptor returned error: %v", err)
+			}
+			encrypted, err := encryptor.EncryptYAML([]byte(secret))
+			if err != nil {
+				t.Fatalf("EncryptYAML returned error: %v", err)
+			}
+			decrypted, err := sopsdecrypt.Data(encrypted, "yaml")
+			if err != nil {
+				t.Fatalf("sops failed to decrypt:\n%s\nerror: %v", encrypted, err)
+			}
+			if !yamlEqual(t, decodeMap(t, decrypted), decodeMap(t, []byte(secret))) {
+				t.Errorf("sops decrypted\n%s\nwant\n%s", decrypted, secret)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// AzureOptions configures an Azure Blob Storage destination
+type AzureOptions struct {
+	// Account is the storage account name. Defaults to AZURE_STORAGE_ACCOUNT.
+	Account string
+	// Endpoint overrides the blob service URL, e.g.
+	// http://127.0.0.1:10000/devstoreaccount1 for Azurite
+	Endpoint string
+	// AccountKeyFile is a file containing the storage account key. When
+	// empty, AZURE_STORAGE_KEY is used if set, otherwise the default Azure
+	// credential chain (workload identity, managed identity, environment, CLI).
+	AccountKeyFile string
+	Container      string
+	Prefix         string
+}
+
+// Azure stores files as blobs in an Azure Blob Storage container.
+// AZURE_STORAGE_CONNECTION_STRING, when set, takes precedence over all
+// other credentials.
+type Azure struct {
+	client *azblob.Client
+	opts   AzureOptions
+}
+
+// NewAzure creates an Azure Blob Storage destination
+func NewAzure(opts AzureOptions) (*Azure, error) {
+	if opts.Container == "" {
+		return nil, fmt.Errorf("Azure container is required")
+	}
+
+	if connectionString := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); connectionString != "" {
+		client, err := azblob.NewClientFromConnectionString(connectionString, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating Azure client from connection string: %v", err)
+		}
+		return &Azure{client: client, opts: opts}, nil
+	}
+
+	if opts.Account == "" {
+		opts.Account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	if opts.Account == "" {
+		return nil, fmt.Errorf("Azure storage account is required")
+	}
+	serviceURL := opts.Endpoint
+	if serviceURL == "" {
+		serviceURL = fmt.Sprintf("https://%s.blob.core.windows.net/", opts.Account)
+	}
+
+	accountKey := os.Getenv("AZURE_STORAGE_KEY")
+	if opts.AccountKeyFile != "" {
+		data, err := os.ReadFile(opts.AccountKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading Azure account key file: %v", err)
+		}
+		accountKey = strings.TrimSpace(string(data))
+	}
+
+	var client *azblob.Client
+	if accountKey != "" {
+		cred, err := azblob.NewSharedKeyCredential(opts.Account, accountKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure account key: %v", err)
+		}
+		client, err = azblob.NewClientWithSharedKeyCredential(serviceURL, cred, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating Azure client: %v", err)
+		}
+	} else {
+		cred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, fmt.Errorf("error loading Azure credentials: %v", err)
+		}
+		client, err = azblob.NewClient(serviceURL, cred, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating Azure client: %v", err)
+		}
+	}
+
+	return &Azure{client: client, opts: opts}, nil
+}
+
+// name returns the blob name of a storage path
+func (a *Azure) name(p string) (string, error) {
+	cleaned, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(path.Join(a.opts.Prefix, cleaned), "/"), nil
+}
+
+// Write uploads data to the blob at path
+func (a *Azure) Write(p string, data []byte) error {
+	name, err := a.name(p)
+	if err != nil {
+		return err
+	}
+
+	blobContentType := contentType(name)
+	_, err = a.client.UploadBuffer(context.TODO(), a.opts.Container, name, data, &azblob.UploadBufferOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &blobContentType},
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %v", a.Location(p), err)
+	}
+
+	return nil
+}
+
+// Read downloads the blob at path
+func (a *Azure) Read(p string) ([]byte, error) {
+	name, err := a.name(p)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.DownloadStream(context.TODO(), a.opts.Container, name, nil)
+	if err != nil {
+		return nil, a.wrapError(p, err)
+	}
+	defer resp.Body.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, resp.Body); err != nil {
+		return nil, a.wrapError(p, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Delete removes the blob at path
+func (a *Azure) Delete(p string) error {
+	name, err := a.name(p)
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.client.DeleteBlob(context.TODO(), a.opts.Container, name, nil); err != nil {
+		if err := a.wrapError(p, err); !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// list returns the blob names below prefix, stopping after limit names
+// when limit is greater than zero
+func (a *Azure) list(prefix string, limit int) ([]string, error) {
+	name, err := a.name(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		name += "/"
+	}
+
+	opts := &azblob.ListBlobsFlatOptions{Prefix: &name}
+	if limit > 0 {
+		maxResults := int32(limit)
+		opts.MaxResults = &maxResults
+	}
+
+	var names []string
+	pager := a.client.NewListBlobsFlatPager(a.opts.Container, opts)
+	for pager.More() {
+		page, err := pager.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("error listing %s: %v", a.Location(prefix), err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			names = append(names, *item.Name)
+		}
+		if limit > 0 && len(names) >= limit {
+			break
+		}
+	}
+
+	return names, nil
+}
+
+// List returns the paths of all blobs below prefix
+func (a *Azure) List(prefix string) ([]string, error) {
+	names, err := a.list(prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	root := ""
+	if a.opts.Prefix != "" {
+		root = a.opts.Prefix + "/"
+	}
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		paths = append(paths, strings.TrimPrefix(name, root))
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Exists checks if there is a blob at path or below it
+func (a *Azure) Exists(p string) (bool, error) {
+	name, err := a.name(p)
+	if err != nil {
+		return false, err
+	}
+
+	if name != "" {
+		blobClient := a.client.ServiceClient().NewContainerClient(a.opts.Container).NewBlobClient(name)
+		if _, err := blobClient.GetProperties(context.TODO(), nil); err == nil {
+			return true, nil
+		} else if err := a.wrapError(p, err); !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+
+	names, err := a.list(p, 1)
+	if err != nil {
+		return false, err
+	}
+	return len(names) > 0, nil
+}
+
+// Location returns the azblob:// URL of path
+func (a *Azure) Location(p string) string {
+	name, err := a.name(p)
+	if err != nil {
+		name = p
+	}
+	return fmt.Sprintf("azblob://%s/%s", a.opts.Container, name)
+}
+
+// wrapError converts missing blob errors to fs.ErrNotExist
+func (a *Azure) wrapError(p string, err error) error {
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return fmt.Errorf("%s: %w", a.Location(p), fs.ErrNotExist)
+	}
+	return fmt.Errorf("error accessing %s: %v", a.Location(p), err)
+}
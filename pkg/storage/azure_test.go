@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestAzure runs against Azurite:
+//
+//	docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+//	KBAK_TEST_AZURE=1 AZURE_STORAGE_CONNECTION_STRING=UseDevelopmentStorage=true go test ./pkg/storage/
+func TestAzure(t *testing.T) {
+	if os.Getenv("KBAK_TEST_AZURE") == "" {
+		t.Skip("KBAK_TEST_AZURE not set")
+	}
+
+	container := fmt.Sprintf("kbak-test-%d", time.Now().UnixNano())
+	store, err := NewAzure(AzureOptions{Container: container, Prefix: "backups"})
+	if err != nil {
+		t.Fatalf("NewAzure returned error: %v", err)
+	}
+	if _, err := store.client.CreateContainer(context.TODO(), container, nil); err != nil {
+		t.Fatalf("CreateContainer returned error: %v", err)
+	}
+
+	testStorage(t, store)
+}
+
+func TestNewAzureValidation(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_CONNECTION_STRING", "")
+	t.Setenv("AZURE_STORAGE_ACCOUNT", "")
+
+	tests := []AzureOptions{
+		{},
+		{Container: "c"},
+		{Container: "c", Account: "a", AccountKeyFile: "/nonexistent/key"},
+	}
+	for _, opts := range tests {
+		if _, err := NewAzure(opts); err == nil {
+			t.Errorf("Expected error for options %+v", opts)
+		}
+	}
+}
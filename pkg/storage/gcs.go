@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// DefaultGCSEndpoint is the Google Cloud Storage JSON API endpoint
+const DefaultGCSEndpoint = "https://storage.googleapis.com"
+
+// gcsScope is the OAuth2 scope required to read and write objects
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// GCSOptions configures a Google Cloud Storage destination
+type GCSOptions struct {
+	// Endpoint overrides the JSON API endpoint, e.g. for fake-gcs-server.
+	// The STORAGE_EMULATOR_HOST environment variable is honored as well.
+	Endpoint string
+	// CredentialsFile is a service account key file. When empty, Application
+	// Default Credentials are used, which include GOOGLE_APPLICATION_CREDENTIALS
+	// and GKE workload identity.
+	CredentialsFile string
+	Bucket          string
+	Prefix          string
+	// Anonymous sends unauthenticated requests, as expected by emulators
+	Anonymous bool
+}
+
+// GCS stores files as objects in a Google Cloud Storage bucket using the JSON API
+type GCS struct {
+	client   *http.Client
+	endpoint string
+	opts     GCSOptions
+}
+
+// gcsObjectList is the response of the objects list call
+type gcsObjectList struct {
+	Items []struct {
+		Name string `json:"name"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// NewGCS creates a Google Cloud Storage destination
+func NewGCS(opts GCSOptions) (*GCS, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("GCS bucket is required")
+	}
+
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+			endpoint = host
+			if !strings.Contains(endpoint, "://") {
+				endpoint = "http://" + endpoint
+			}
+			opts.Anonymous = true
+		} else {
+			endpoint = DefaultGCSEndpoint
+		}
+	}
+
+	client := http.DefaultClient
+	if !opts.Anonymous {
+		ctx := context.TODO()
+		var creds *google.Credentials
+		var err error
+		if opts.CredentialsFile != "" {
+			data, readErr := os.ReadFile(opts.CredentialsFile)
+			if readErr != nil {
+				return nil, fmt.Errorf("error reading GCS credentials file: %v", readErr)
+			}
+			creds, err = google.CredentialsFromJSON(ctx, data, gcsScope)
+		} else {
+			creds, err = google.FindDefaultCredentials(ctx, gcsScope)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error loading GCS credentials: %v", err)
+		}
+		client = oauth2.NewClient(ctx, creds.TokenSource)
+	}
+
+	return &GCS{client: client, endpoint: strings.TrimSuffix(endpoint, "/"), opts: opts}, nil
+}
+
+// name returns the object name of a storage path
+func (g *GCS) name(p string) (string, error) {
+	cleaned, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(path.Join(g.opts.Prefix, cleaned), "/"), nil
+}
+
+// objectURL returns the JSON API URL of an object
+func (g *GCS) objectURL(name string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", g.endpoint, url.PathEscape(g.opts.Bucket), url.PathEscape(name))
+}
+
+// do sends a request and returns the response body. A 404 response returns
+// an error matching fs.ErrNotExist.
+func (g *GCS) do(method, requestURL, contentType string, body []byte, p string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(context.TODO(), method, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing %s: %v", g.Location(p), err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing %s: %v", g.Location(p), err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s: %w", g.Location(p), fs.ErrNotExist)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("error accessing %s: %s: %s", g.Location(p), resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return data, nil
+}
+
+// Write uploads data to the object at path
+func (g *GCS) Write(p string, data []byte) error {
+	name, err := g.name(p)
+	if err != nil {
+		return err
+	}
+
+	uploadURL := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		g.endpoint, url.PathEscape(g.opts.Bucket), url.QueryEscape(name))
+	_, err = g.do(http.MethodPost, uploadURL, contentType(name), data, p)
+	return err
+}
+
+// Read downloads the object at path
+func (g *GCS) Read(p string) ([]byte, error) {
+	name, err := g.name(p)
+	if err != nil {
+		return nil, err
+	}
+	return g.do(http.MethodGet, g.objectURL(name)+"?alt=media", "", nil, p)
+}
+
+// Delete removes the object at path
+func (g *GCS) Delete(p string) error {
+	name, err := g.name(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.do(http.MethodDelete, g.objectURL(name), "", nil, p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// list returns up to limit object names below prefix; limit 0 means all
+func (g *GCS) list(prefix string, limit int) ([]string, error) {
+	name, err := g.name(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		name += "/"
+	}
+
+	var names []string
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("prefix", name)
+		query.Set("fields", "items(name),nextPageToken")
+		if limit > 0 {
+			query.Set("maxResults", fmt.Sprint(limit))
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		listURL := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", g.endpoint, url.PathEscape(g.opts.Bucket), query.Encode())
+		data, err := g.do(http.MethodGet, listURL, "", nil, prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		var list gcsObjectList
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("error parsing object list of %s: %v", g.Location(prefix), err)
+		}
+		for _, item := range list.Items {
+			names = append(names, item.Name)
+		}
+
+		if list.NextPageToken == "" || (limit > 0 && len(names) >= limit) {
+			return names, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+// List returns the paths of all objects below prefix
+func (g *GCS) List(prefix string) ([]string, error) {
+	names, err := g.list(prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	root := ""
+	if g.opts.Prefix != "" {
+		root = g.opts.Prefix + "/"
+	}
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		paths = append(paths, strings.TrimPrefix(name, root))
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Exists checks if there is an object at path or below it
+func (g *GCS) Exists(p string) (bool, error) {
+	name, err := g.name(p)
+	if err != nil {
+		return false, err
+	}
+
+	if name != "" {
+		_, err = g.do(http.MethodGet, g.objectURL(name), "", nil, p)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+
+	names, err := g.list(p, 1)
+	if err != nil {
+		return false, err
+	}
+	return len(names) > 0, nil
+}
+
+// Location returns the gs:// URL of path
+func (g *GCS) Location(p string) string {
+	name, err := g.name(p)
+	if err != nil {
+		name = p
+	}
+	return fmt.Sprintf("gs://%s/%s", g.opts.Bucket, name)
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCS implements the subset of the GCS JSON API used by the GCS storage
+type fakeGCS struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	const objectsPath = "/storage/v1/b/bucket/o"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload"+objectsPath:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Query().Get("name")] = data
+		fmt.Fprint(w, "{}")
+	case r.Method == http.MethodGet && r.URL.Path == objectsPath:
+		prefix := r.URL.Query().Get("prefix")
+		var list gcsObjectList
+		var names []string
+		for name := range f.objects {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			list.Items = append(list.Items, struct {
+				Name string `json:"name"`
+			}{Name: name})
+		}
+		json.NewEncoder(w).Encode(list)
+	case strings.HasPrefix(r.URL.Path, objectsPath+"/"):
+		name := strings.TrimPrefix(r.URL.Path, objectsPath+"/")
+		data, ok := f.objects[name]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			delete(f.objects, name)
+		case r.URL.Query().Get("alt") == "media":
+			io.Copy(w, bytes.NewReader(data))
+		default:
+			json.NewEncoder(w).Encode(map[string]string{"name": name})
+		}
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func TestGCSFake(t *testing.T) {
+	fake := &fakeGCS{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	store, err := NewGCS(GCSOptions{Endpoint: server.URL, Bucket: "bucket", Prefix: "backups", Anonymous: true})
+	if err != nil {
+		t.Fatalf("NewGCS returned error: %v", err)
+	}
+
+	testStorage(t, store)
+
+	if _, ok := fake.objects["backups/run/default/ConfigMap/a.yaml"]; !ok {
+		t.Errorf("Expected objects to be stored below the prefix, got %v", fake.objects)
+	}
+}
+
+// TestGCS runs against fake-gcs-server:
+//
+//	docker run -p 4443:4443 fsouza/fake-gcs-server -scheme http
+//	KBAK_TEST_GCS_ENDPOINT=http://localhost:4443 go test ./pkg/storage/
+func TestGCS(t *testing.T) {
+	endpoint := os.Getenv("KBAK_TEST_GCS_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("KBAK_TEST_GCS_ENDPOINT not set")
+	}
+
+	bucket := fmt.Sprintf("kbak-test-%d", time.Now().UnixNano())
+	body := strings.NewReader(fmt.Sprintf(`{"name":%q}`, bucket))
+	resp, err := http.Post(endpoint+"/storage/v1/b", "application/json", body)
+	if err != nil {
+		t.Fatalf("Creating bucket returned error: %v", err)
+	}
+	resp.Body.Close()
+
+	store, err := NewGCS(GCSOptions{Endpoint: endpoint, Bucket: bucket, Prefix: "backups", Anonymous: true})
+	if err != nil {
+		t.Fatalf("NewGCS returned error: %v", err)
+	}
+
+	testStorage(t, store)
+}
+
+func TestNewGCSValidation(t *testing.T) {
+	if _, err := NewGCS(GCSOptions{}); err == nil {
+		t.Errorf("Expected error for missing bucket")
+	}
+	if _, err := NewGCS(GCSOptions{Bucket: "b", CredentialsFile: "/nonexistent/key.json"}); err == nil {
+		t.Errorf("Expected error for missing credentials file")
+	}
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+)
+
+// Permissions are the modes of the files and directories Local creates
+type Permissions struct {
+	DirMode  fs.FileMode
+	FileMode fs.FileMode
+}
+
+// DefaultPermissions are the permissions of Local unless configured otherwise
+var DefaultPermissions = Permissions{DirMode: 0755, FileMode: 0644}
+
+// RestrictedPermissions make files accessible to their owner only
+var RestrictedPermissions = Permissions{DirMode: 0700, FileMode: 0600}
+
+// LocalOptions holds the settings of the local backend
+type LocalOptions struct {
+	// Permissions apply to all created files and directories. Zero modes
+	// use DefaultPermissions.
+	Permissions Permissions
+	// SecretPermissions apply to files written with WriteSecret and to the
+	// directories created for them. Zero modes use Permissions.
+	SecretPermissions Permissions
+	// Group is the name or ID of the group given to created files and
+	// directories. Empty keeps the default group.
+	Group string
+	// AllowWorldWritable permits writing into a world-writable root directory
+	AllowWorldWritable bool
+}
+
+// Local stores files in a directory of the local filesystem
+type Local struct {
+	Root              string
+	Permissions       Permissions
+	SecretPermissions Permissions
+	// GID is the group ID of created files and directories, -1 to keep the default
+	GID int
+	// exactModes applies the modes regardless of the umask, set when they are configured
+	exactModes bool
+}
+
+// NewLocal creates a storage rooted at the given directory with DefaultPermissions
+func NewLocal(root string) *Local {
+	return &Local{Root: root, Permissions: DefaultPermissions, SecretPermissions: DefaultPermissions, GID: -1}
+}
+
+// NewLocalWithOptions creates a storage rooted at the given directory. It
+// refuses an existing world-writable root, where other users could tamper
+// with the backups, unless opts.AllowWorldWritable is set.
+func NewLocalWithOptions(root string, opts LocalOptions) (*Local, error) {
+	l := NewLocal(root)
+	l.Permissions = opts.Permissions.withDefaults(DefaultPermissions)
+	l.SecretPermissions = opts.SecretPermissions.withDefaults(l.Permissions)
+	l.exactModes = opts.Permissions != Permissions{} || opts.SecretPermissions != Permissions{}
+
+	if opts.Group != "" {
+		gid, err := lookupGroup(opts.Group)
+		if err != nil {
+			return nil, err
+		}
+		l.GID = gid
+	}
+
+	if !opts.AllowWorldWritable && runtime.GOOS != "windows" {
+		info, err := os.Stat(root)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil && info.Mode().Perm()&0002 != 0 {
+			return nil, fmt.Errorf("output directory %s is world-writable (mode %04o), other users could tamper with the backups", root, info.Mode().Perm())
+		}
+	}
+
+	return l, nil
+}
+
+// withDefaults replaces zero modes with those of defaults
+func (p Permissions) withDefaults(defaults Permissions) Permissions {
+	if p.DirMode == 0 {
+		p.DirMode = defaults.DirMode
+	}
+	if p.FileMode == 0 {
+		p.FileMode = defaults.FileMode
+	}
+	return p
+}
+
+// lookupGroup resolves a group name or numeric group ID
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %q: %v", group, err)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// Path returns the filesystem path of a storage path
+func (l *Local) Path(p string) (string, error) {
+	cleaned, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Root, filepath.FromSlash(cleaned)), nil
+}
+
+// Write stores data at path, creating parent directories as needed.
+// The data is written to a temporary file first and renamed, so readers
+// never see a partially written file.
+func (l *Local) Write(p string, data []byte) error {
+	return l.write(p, data, l.Permissions)
+}
+
+// WriteSecret stores data like Write with the secret permissions. Parent
+// directories created for the file get the secret directory mode.
+func (l *Local) WriteSecret(p string, data []byte) error {
+	return l.write(p, data, l.SecretPermissions)
+}
+
+// write stores data at path with the given permissions
+func (l *Local) write(p string, data []byte, perms Permissions) error {
+	filename, err := l.Path(p)
+	if err != nil {
+		return err
+	}
+	if err := l.mkdirAll(filepath.Dir(filename), perms.DirMode); err != nil {
+		return err
+	}
+
+	// A leftover temporary file would keep its old mode
+	tmpFile := filename + ".tmp"
+	os.Remove(tmpFile)
+	if err := os.WriteFile(tmpFile, data, perms.FileMode); err != nil {
+		return err
+	}
+	if err := l.setPermissions(tmpFile, perms.FileMode); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, filename); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	return nil
+}
+
+// mkdirAll creates dir and its missing parents. The deepest directory gets
+// leafMode, the others the directory mode of Permissions. Existing
+// directories are left untouched.
+func (l *Local) mkdirAll(dir string, leafMode fs.FileMode) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		mode := l.Permissions.DirMode
+		if i == 0 {
+			mode = leafMode
+		}
+		if err := os.Mkdir(missing[i], mode); err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				continue
+			}
+			return err
+		}
+		if err := l.setPermissions(missing[i], mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setPermissions applies configured modes, which the umask may have narrowed,
+// and the group
+func (l *Local) setPermissions(name string, mode fs.FileMode) error {
+	if l.exactModes {
+		if err := os.Chmod(name, mode); err != nil {
+			return err
+		}
+	}
+	if l.GID >= 0 {
+		if err := os.Chown(name, -1, l.GID); err != nil {
+			return fmt.Errorf("error setting group of %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Read returns the content of the file at path
+func (l *Local) Read(p string) ([]byte, error) {
+	filename, err := l.Path(p)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filename)
+}
+
+// Delete removes the file at path and any parent directories left empty
+func (l *Local) Delete(p string) error {
+	filename, err := l.Path(p)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// Remove empty parent directories up to, but not including, the root
+	root := filepath.Clean(l.Root)
+	for dir := filepath.Dir(filename); dir != root && dir != "." && len(dir) > len(root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			// Not empty or not removable, stop here
+			break
+		}
+	}
+
+	return nil
+}
+
+// List returns the paths of all files below prefix
+func (l *Local) List(prefix string) ([]string, error) {
+	dir, err := l.Path(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	err = filepath.WalkDir(dir, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Root, filename)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Exists checks if path is a file or a directory
+func (l *Local) Exists(p string) (bool, error) {
+	filename, err := l.Path(p)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Location returns the filesystem path of path
+func (l *Local) Location(p string) string {
+	filename, err := l.Path(p)
+	if err != nil {
+		return p
+	}
+	return filename
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory keeps files in memory, e.g. the content of an archive that is read
+// but never extracted to disk
+type Memory struct {
+	// Name is used as location in messages
+	Name  string
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemory creates an empty in-memory storage
+func NewMemory(name string) *Memory {
+	return &Memory{Name: name, files: make(map[string][]byte)}
+}
+
+// Write stores a copy of data at path
+func (m *Memory) Write(p string, data []byte) error {
+	cleaned, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+	if cleaned == "" {
+		return fmt.Errorf("invalid storage path %q", p)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[cleaned] = append([]byte(nil), data...)
+	return nil
+}
+
+// Read returns the content of the file at path
+func (m *Memory) Read(p string) ([]byte, error) {
+	cleaned, err := cleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[cleaned]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", m.Location(p), fs.ErrNotExist)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// Delete removes the file at path
+func (m *Memory) Delete(p string) error {
+	cleaned, err := cleanPath(p)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, cleaned)
+	return nil
+}
+
+// List returns the paths of all files below prefix
+func (m *Memory) List(prefix string) ([]string, error) {
+	cleaned, err := cleanPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var paths []string
+	for p := range m.files {
+		if cleaned == "" || p == cleaned || strings.HasPrefix(p, cleaned+"/") {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Exists checks if path is a file or a directory containing files
+func (m *Memory) Exists(p string) (bool, error) {
+	paths, err := m.List(p)
+	return len(paths) > 0, err
+}
+
+// Location returns path prefixed with the name of the storage
+func (m *Memory) Location(p string) string {
+	if p == "" {
+		return m.Name
+	}
+	return m.Name + "/" + p
+}
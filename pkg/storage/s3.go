@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// DefaultS3Endpoint is used when no S3 endpoint is configured
+const DefaultS3Endpoint = "s3.amazonaws.com"
+
+// Server-side encryption modes for S3
+const (
+	SSENone = ""
+	SSES3   = "s3"
+	SSEKMS  = "kms"
+)
+
+// S3Options configures an S3-compatible storage
+type S3Options struct {
+	// Endpoint is the host[:port] of the S3 API, e.g. localhost:9000 for MinIO
+	Endpoint string
+	Region   string
+	Bucket   string
+	Prefix   string
+	// Insecure uses plain HTTP instead of HTTPS
+	Insecure bool
+	// SSE is the server-side encryption mode: SSENone, SSES3 or SSEKMS
+	SSE string
+	// KMSKeyID is the key used with SSEKMS
+	KMSKeyID string
+}
+
+// S3 stores files as objects in an S3-compatible bucket.
+// Credentials are read from the AWS_* or MINIO_* environment variables,
+// the AWS credentials file or the instance/pod IAM role, in that order.
+type S3 struct {
+	client *minio.Client
+	opts   S3Options
+	sse    encrypt.ServerSide
+}
+
+// NewS3 creates an S3-compatible storage
+func NewS3(opts S3Options) (*S3, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = DefaultS3Endpoint
+	}
+
+	var sse encrypt.ServerSide
+	switch opts.SSE {
+	case SSENone:
+	case SSES3:
+		sse = encrypt.NewSSE()
+	case SSEKMS:
+		if opts.KMSKeyID == "" {
+			return nil, fmt.Errorf("a KMS key ID is required for S3 server-side encryption with KMS")
+		}
+		var err error
+		sse, err = encrypt.NewSSEKMS(opts.KMSKeyID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KMS encryption settings: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported S3 server-side encryption %q (use %q or %q)", opts.SSE, SSES3, SSEKMS)
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	})
+
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !opts.Insecure,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating S3 client: %v", err)
+	}
+
+	return &S3{client: client, opts: opts, sse: sse}, nil
+}
+
+// key returns the object key of a storage path
+func (s *S3) key(p string) (string, error) {
+	cleaned, err := cleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(path.Join(s.opts.Prefix, cleaned), "/"), nil
+}
+
+// Write uploads data to the object at path
+func (s *S3) Write(p string, data []byte) error {
+	key, err := s.key(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(context.TODO(), s.opts.Bucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{
+			ContentType:          contentType(key),
+			ServerSideEncryption: s.sse,
+		})
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %v", s.Location(p), err)
+	}
+
+	return nil
+}
+
+// Read downloads the object at path
+func (s *S3) Read(p string) ([]byte, error) {
+	key, err := s.key(p)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := s.client.GetObject(context.TODO(), s.opts.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s.wrapError(p, err)
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return nil, s.wrapError(p, err)
+	}
+
+	return data, nil
+}
+
+// Delete removes the object at path
+func (s *S3) Delete(p string) error {
+	key, err := s.key(p)
+	if err != nil {
+		return err
+	}
+
+	if err := s.client.RemoveObject(context.TODO(), s.opts.Bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return s.wrapError(p, err)
+	}
+
+	return nil
+}
+
+// List returns the paths of all objects below prefix
+func (s *S3) List(prefix string) ([]string, error) {
+	key, err := s.key(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		key += "/"
+	}
+
+	root := ""
+	if s.opts.Prefix != "" {
+		root = s.opts.Prefix + "/"
+	}
+
+	var paths []string
+	for object := range s.client.ListObjects(context.TODO(), s.opts.Bucket, minio.ListObjectsOptions{
+		Prefix:    key,
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("error listing %s: %v", s.Location(prefix), object.Err)
+		}
+		paths = append(paths, strings.TrimPrefix(object.Key, root))
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Exists checks if there is an object at path or below it
+func (s *S3) Exists(p string) (bool, error) {
+	key, err := s.key(p)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := s.client.StatObject(context.TODO(), s.opts.Bucket, key, minio.StatObjectOptions{}); err == nil {
+		return true, nil
+	} else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return false, s.wrapError(p, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	for object := range s.client.ListObjects(ctx, s.opts.Bucket, minio.ListObjectsOptions{
+		Prefix:    key + "/",
+		Recursive: true,
+		MaxKeys:   1,
+	}) {
+		if object.Err != nil {
+			return false, fmt.Errorf("error listing %s: %v", s.Location(p), object.Err)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Location returns the s3:// URL of path
+func (s *S3) Location(p string) string {
+	key, err := s.key(p)
+	if err != nil {
+		key = p
+	}
+	return fmt.Sprintf("s3://%s/%s", s.opts.Bucket, key)
+}
+
+// wrapError converts missing object errors to fs.ErrNotExist
+func (s *S3) wrapError(p string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%s: %w", s.Location(p), fs.ErrNotExist)
+	}
+	return fmt.Errorf("error accessing %s: %v", s.Location(p), err)
+}
+
+// contentType returns the MIME type stored with an object
+func contentType(key string) string {
+	switch path.Ext(key) {
+	case ".yaml", ".yml":
+		return "application/yaml"
+	case ".json":
+		return "application/json"
+	default:
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// TestS3 runs against an S3-compatible server such as a local MinIO:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	KBAK_TEST_S3_ENDPOINT=localhost:9000 AWS_ACCESS_KEY_ID=minioadmin AWS_SECRET_ACCESS_KEY=minioadmin go test ./pkg/storage/
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("KBAK_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("KBAK_TEST_S3_ENDPOINT not set")
+	}
+
+	bucket := fmt.Sprintf("kbak-test-%d", time.Now().UnixNano())
+	store, err := NewS3(S3Options{Endpoint: endpoint, Bucket: bucket, Prefix: "backups", Insecure: true})
+	if err != nil {
+		t.Fatalf("NewS3 returned error: %v", err)
+	}
+	if err := store.client.MakeBucket(context.TODO(), bucket, minio.MakeBucketOptions{}); err != nil {
+		t.Fatalf("MakeBucket returned error: %v", err)
+	}
+
+	testStorage(t, store)
+}
+
+func TestNewS3Validation(t *testing.T) {
+	tests := []S3Options{
+		{},
+		{Bucket: "b", SSE: "aes"},
+		{Bucket: "b", SSE: SSEKMS},
+	}
+	for _, opts := range tests {
+		if _, err := NewS3(opts); err == nil {
+			t.Errorf("Expected error for options %+v", opts)
+		}
+	}
+
+	if _, err := NewS3(S3Options{Bucket: "b", SSE: SSEKMS, KMSKeyID: "key"}); err != nil {
+		t.Errorf("NewS3 with KMS returned error: %v", err)
+	}
+}
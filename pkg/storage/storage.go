@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Storage is the destination that backups, manifests and archives are written to.
+// Paths are slash-separated and relative to the root of the storage.
+type Storage interface {
+	// Write stores data at path, replacing any existing content
+	Write(path string, data []byte) error
+	// Read returns the content at path. Missing paths return an error
+	// matching fs.ErrNotExist.
+	Read(path string) ([]byte, error)
+	// Delete removes path. Deleting a missing path is not an error.
+	Delete(path string) error
+	// List returns the paths of all files below prefix, recursively
+	List(prefix string) ([]string, error)
+	// Exists checks if path is a file or a directory. For object stores a
+	// directory exists when there is at least one object below it.
+	Exists(path string) (bool, error)
+	// Location returns a human readable location of path for messages
+	Location(path string) string
+}
+
+// SecretWriter is implemented by storages that protect files containing
+// secrets more strictly than other files
+type SecretWriter interface {
+	// WriteSecret stores data at path like Write
+	WriteSecret(path string, data []byte) error
+}
+
+// WriteSecret stores data at path with the secret permissions of the
+// storage, or like Write when the storage has none
+func WriteSecret(store Storage, path string, data []byte) error {
+	if w, ok := store.(SecretWriter); ok {
+		return w.WriteSecret(path, data)
+	}
+	return store.Write(path, data)
+}
+
+// Options holds the settings of the remote storage backends
+type Options struct {
+	Local LocalOptions
+	S3    S3Options
+	Azure AzureOptions
+	GCS   GCSOptions
+}
+
+// Open returns the storage for an output location. Locations with a
+// supported URL scheme (s3://, azblob:// or gs://) select a remote backend; anything else is
+// a local directory.
+func Open(location string, opts Options) (Storage, error) {
+	scheme, rest, found := strings.Cut(location, "://")
+	if !found {
+		return NewLocalWithOptions(location, opts.Local)
+	}
+
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("missing bucket in output location %q", location)
+	}
+	prefix = strings.Trim(prefix, "/")
+
+	switch scheme {
+	case "s3":
+		s3Opts := opts.S3
+		s3Opts.Bucket = bucket
+		s3Opts.Prefix = prefix
+		return NewS3(s3Opts)
+	case "azblob":
+		azureOpts := opts.Azure
+		azureOpts.Container = bucket
+		azureOpts.Prefix = prefix
+		return NewAzure(azureOpts)
+	case "gs":
+		gcsOpts := opts.GCS
+		gcsOpts.Bucket = bucket
+		gcsOpts.Prefix = prefix
+		return NewGCS(gcsOpts)
+	default:
+		return nil, fmt.Errorf("unsupported output location scheme %q", scheme)
+	}
+}
+
+// cleanPath validates a storage path and returns it in canonical form.
+// The empty path refers to the storage root.
+func cleanPath(p string) (string, error) {
+	if p == "" {
+		return "", nil
+	}
+	cleaned := path.Clean(p)
+	if cleaned == "." {
+		return "", nil
+	}
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid storage path %q", p)
+	}
+	return cleaned, nil
+}
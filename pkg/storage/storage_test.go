@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// testStorage runs the checks every storage implementation must pass
+func testStorage(t *testing.T, store Storage) {
+	t.Helper()
+
+	if err := store.Write("run/default/ConfigMap/a.yaml", []byte("a: 1\n")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := store.Write("run/default/Secret/b.yaml", []byte("b: 1\n")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := store.Write("run/kbak-manifest.json", []byte("{}")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	data, err := store.Read("run/default/ConfigMap/a.yaml")
+	if err != nil || string(data) != "a: 1\n" {
+		t.Errorf("Read = %q, %v", data, err)
+	}
+	if _, err := store.Read("run/missing.yaml"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not-exist error for missing file, got %v", err)
+	}
+
+	paths, err := store.List("run/default")
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	want := []string{"run/default/ConfigMap/a.yaml", "run/default/Secret/b.yaml"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("List = %v, want %v", paths, want)
+	}
+
+	for path, wantExists := range map[string]bool{"run": true, "run/kbak-manifest.json": true, "ru": false, "other": false} {
+		exists, err := store.Exists(path)
+		if err != nil || exists != wantExists {
+			t.Errorf("Exists(%q) = %v, %v, want %v", path, exists, err, wantExists)
+		}
+	}
+
+	if err := store.Delete("run/default/Secret/b.yaml"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if err := store.Delete("run/default/Secret/b.yaml"); err != nil {
+		t.Errorf("Deleting a missing file returned error: %v", err)
+	}
+	if exists, _ := store.Exists("run/default/Secret"); exists {
+		t.Errorf("Expected empty directory to be gone after deleting its last file")
+	}
+
+	if err := store.Write("../escape.yaml", []byte("x")); err == nil {
+		t.Errorf("Expected error for path outside of the storage")
+	}
+}
+
+func TestLocal(t *testing.T) {
+	testStorage(t, NewLocal(t.TempDir()))
+}
+
+func TestMemory(t *testing.T) {
+	testStorage(t, NewMemory("memory"))
+}
+
+func TestOpen(t *testing.T) {
+	store, err := Open("backups", Options{})
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if local, ok := store.(*Local); !ok || local.Root != "backups" {
+		t.Errorf("Expected local storage for a plain path, got %#v", store)
+	}
+
+	store, err = Open("s3://bucket/some/prefix/", Options{S3: S3Options{Endpoint: "localhost:9000"}})
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if got := store.Location("run/a.yaml"); got != "s3://bucket/some/prefix/run/a.yaml" {
+		t.Errorf("Location = %q", got)
+	}
+
+	store, err = Open("gs://bucket/prefix", Options{GCS: GCSOptions{Endpoint: "http://localhost:4443", Anonymous: true}})
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if got := store.Location("run/a.yaml"); got != "gs://bucket/prefix/run/a.yaml" {
+		t.Errorf("Location = %q", got)
+	}
+
+	t.Setenv("AZURE_STORAGE_CONNECTION_STRING", "")
+	t.Setenv("AZURE_STORAGE_KEY", "a2V5")
+	store, err = Open("azblob://container/prefix", Options{Azure: AzureOptions{Account: "account"}})
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	if got := store.Location("run/a.yaml"); got != "azblob://container/prefix/run/a.yaml" {
+		t.Errorf("Location = %q", got)
+	}
+
+	for _, location := range []string{"s3://", "ftp://host/path"} {
+		if _, err := Open(location, Options{}); err == nil {
+			t.Errorf("Expected error for output location %q", location)
+		}
+	}
+}
+
+// fileMode returns the permission bits of a file
+func fileMode(t *testing.T, name string) fs.FileMode {
+	t.Helper()
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("Stat returned error: %v", err)
+	}
+	return info.Mode().Perm()
+}
+
+func TestLocalPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on Windows")
+	}
+
+	root := filepath.Join(t.TempDir(), "backups")
+	store, err := NewLocalWithOptions(root, LocalOptions{
+		Permissions:       Permissions{DirMode: 0750, FileMode: 0640},
+		SecretPermissions: Permissions{FileMode: 0600, DirMode: 0700},
+		Group:             strconv.Itoa(os.Getgid()),
+	})
+	if err != nil {
+		t.Fatalf("NewLocalWithOptions returned error: %v", err)
+	}
+
+	if err := store.Write("run/default/ConfigMap/a.yaml", []byte("a")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := WriteSecret(store, "run/default/Secret/b.yaml", []byte("b")); err != nil {
+		t.Fatalf("WriteSecret returned error: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		mode fs.FileMode
+	}{
+		{"", 0750},
+		{"run/default", 0750},
+		{"run/default/ConfigMap", 0750},
+		{"run/default/ConfigMap/a.yaml", 0640},
+		{"run/default/Secret", 0700},
+		{"run/default/Secret/b.yaml", 0600},
+	}
+	for _, test := range tests {
+		if mode := fileMode(t, filepath.Join(root, filepath.FromSlash(test.path))); mode != test.mode {
+			t.Errorf("Mode of %q is %04o, want %04o", test.path, mode, test.mode)
+		}
+	}
+
+	// Replacing a file applies the mode again
+	os.Chmod(filepath.Join(root, "run/default/Secret/b.yaml"), 0644)
+	if err := WriteSecret(store, "run/default/Secret/b.yaml", []byte("c")); err != nil {
+		t.Fatalf("WriteSecret returned error: %v", err)
+	}
+	if mode := fileMode(t, filepath.Join(root, "run/default/Secret/b.yaml")); mode != 0600 {
+		t.Errorf("Mode of a replaced secret is %04o, want 0600", mode)
+	}
+
+	if _, err := NewLocalWithOptions(root, LocalOptions{Group: "no-such-group-kbak"}); err == nil {
+		t.Errorf("Expected error for an unknown group")
+	}
+}
+
+func TestLocalWorldWritable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on Windows")
+	}
+
+	root := t.TempDir()
+	if err := os.Chmod(root, 0777); err != nil {
+		t.Fatalf("Chmod returned error: %v", err)
+	}
+	if _, err := NewLocalWithOptions(root, LocalOptions{}); err == nil {
+		t.Errorf("Expected error for a world-writable output directory")
+	}
+	if _, err := Open(root, Options{}); err == nil {
+		t.Errorf("Expected Open to refuse a world-writable output directory")
+	}
+	if _, err := NewLocalWithOptions(root, LocalOptions{AllowWorldWritable: true}); err != nil {
+		t.Errorf("Expected AllowWorldWritable to permit the directory, got %v", err)
+	}
+	if _, err := NewLocalWithOptions(filepath.Join(root, "missing"), LocalOptions{}); err != nil {
+		t.Errorf("Expected a missing output directory to be accepted, got %v", err)
+	}
+}
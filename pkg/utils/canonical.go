@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// CanonicalizeObject sorts well-known lists whose order is not meaningful,
+// so that the same object always serializes to the same YAML.
+// It should be called after CleanObject.
+func CanonicalizeObject(obj interface{}) {
+	switch typedObj := obj.(type) {
+	case *v1.Pod:
+		CanonicalizePodSpec(&typedObj.Spec)
+	case *appsv1.Deployment:
+		CanonicalizePodSpec(&typedObj.Spec.Template.Spec)
+	case *appsv1.StatefulSet:
+		CanonicalizePodSpec(&typedObj.Spec.Template.Spec)
+	case *appsv1.DaemonSet:
+		CanonicalizePodSpec(&typedObj.Spec.Template.Spec)
+	case *appsv1.ReplicaSet:
+		CanonicalizePodSpec(&typedObj.Spec.Template.Spec)
+	case *batchv1.Job:
+		CanonicalizePodSpec(&typedObj.Spec.Template.Spec)
+	case *batchv1.CronJob:
+		CanonicalizePodSpec(&typedObj.Spec.JobTemplate.Spec.Template.Spec)
+	case *v1.Service:
+		sort.SliceStable(typedObj.Spec.Ports, func(i, j int) bool {
+			a, b := typedObj.Spec.Ports[i], typedObj.Spec.Ports[j]
+			if a.Port != b.Port {
+				return a.Port < b.Port
+			}
+			return a.Protocol < b.Protocol
+		})
+	}
+}
+
+// CanonicalizePodSpec sorts volumes by name and, for every container,
+// environment variables by name and ports by port number.
+// The order of containers themselves is meaningful and is kept.
+func CanonicalizePodSpec(spec *v1.PodSpec) {
+	sort.SliceStable(spec.Volumes, func(i, j int) bool {
+		return spec.Volumes[i].Name < spec.Volumes[j].Name
+	})
+
+	for i := range spec.InitContainers {
+		canonicalizeContainer(&spec.InitContainers[i])
+	}
+	for i := range spec.Containers {
+		canonicalizeContainer(&spec.Containers[i])
+	}
+}
+
+// canonicalizeContainer sorts the environment variables and ports of a container
+func canonicalizeContainer(container *v1.Container) {
+	// Variables can reference earlier ones with $(NAME), so their order
+	// matters as soon as one of them does
+	if !hasDependentEnvVars(container.Env) {
+		sort.SliceStable(container.Env, func(i, j int) bool {
+			return container.Env[i].Name < container.Env[j].Name
+		})
+	}
+
+	sort.SliceStable(container.Ports, func(i, j int) bool {
+		a, b := container.Ports[i], container.Ports[j]
+		if a.ContainerPort != b.ContainerPort {
+			return a.ContainerPort < b.ContainerPort
+		}
+		return a.Protocol < b.Protocol
+	})
+}
+
+// hasDependentEnvVars checks if any environment variable references another one
+func hasDependentEnvVars(env []v1.EnvVar) bool {
+	for _, envVar := range env {
+		if strings.Contains(envVar.Value, "$(") {
+			return true
+		}
+	}
+	return false
+}
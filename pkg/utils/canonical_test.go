@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCanonicalizeDeployment(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{{Name: "data"}, {Name: "config"}},
+					Containers: []corev1.Container{
+						{
+							Name: "app",
+							Env:  []corev1.EnvVar{{Name: "B", Value: "2"}, {Name: "A", Value: "1"}},
+							Ports: []corev1.ContainerPort{
+								{ContainerPort: 9090},
+								{ContainerPort: 8080, Protocol: corev1.ProtocolUDP},
+								{ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
+							},
+						},
+						{Name: "sidecar"},
+					},
+				},
+			},
+		},
+	}
+
+	CanonicalizeObject(deployment)
+	spec := deployment.Spec.Template.Spec
+
+	if got := []string{spec.Volumes[0].Name, spec.Volumes[1].Name}; !reflect.DeepEqual(got, []string{"config", "data"}) {
+		t.Errorf("Expected volumes sorted by name, got %v", got)
+	}
+	if spec.Containers[0].Name != "app" || spec.Containers[1].Name != "sidecar" {
+		t.Errorf("Expected container order to be preserved, got %s, %s", spec.Containers[0].Name, spec.Containers[1].Name)
+	}
+	container := spec.Containers[0]
+	if container.Env[0].Name != "A" || container.Env[1].Name != "B" {
+		t.Errorf("Expected env sorted by name, got %v", container.Env)
+	}
+	wantPorts := []corev1.ContainerPort{
+		{ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
+		{ContainerPort: 8080, Protocol: corev1.ProtocolUDP},
+		{ContainerPort: 9090},
+	}
+	if !reflect.DeepEqual(container.Ports, wantPorts) {
+		t.Errorf("Expected ports sorted by port and protocol, got %v", container.Ports)
+	}
+}
+
+func TestCanonicalizeKeepsDependentEnvOrder(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "app",
+				Env: []corev1.EnvVar{
+					{Name: "HOST", Value: "db"},
+					{Name: "URL", Value: "postgres://$(HOST)"},
+					{Name: "A", Value: "1"},
+				},
+			}},
+		},
+	}
+
+	CanonicalizeObject(pod)
+
+	env := pod.Spec.Containers[0].Env
+	if env[0].Name != "HOST" || env[1].Name != "URL" || env[2].Name != "A" {
+		t.Errorf("Expected env order to be preserved when variables reference each other, got %v", env)
+	}
+}
+
+func TestCanonicalizeService(t *testing.T) {
+	service := &corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "https", Port: 443}, {Name: "http", Port: 80}},
+		},
+	}
+
+	CanonicalizeObject(service)
+
+	if service.Spec.Ports[0].Port != 80 || service.Spec.Ports[1].Port != 443 {
+		t.Errorf("Expected service ports sorted by port, got %v", service.Spec.Ports)
+	}
+}
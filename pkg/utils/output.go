@@ -0,0 +1,11 @@
+package utils
+
+import (
+	"io"
+	"os"
+)
+
+// StatusOutput receives status and progress messages.
+// It is switched to os.Stderr when manifests are streamed to stdout,
+// so that stdout only contains YAML.
+var StatusOutput io.Writer = os.Stdout